@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/batcher"
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/deadletter"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/grid-stream-org/go-commons/pkg/logger"
+	"github.com/grid-stream-org/go-commons/pkg/sigctx"
+	"github.com/pkg/errors"
+)
+
+const deadLetterUsage = `usage: batcher deadletter <command> [flags] [ids...]
+
+commands:
+  list              list every dead letter entry
+  inspect <id>      show an entry and its raw payload
+  purge <ids...>    remove entries, or every entry with -all
+  replay [ids...]   run the given entries, or every entry, back through the pipeline
+
+list, inspect and purge read the dead letter dir from the config unless -dir is given.
+replay always uses the config, as it needs the destinations.`
+
+func deadLetterMain(args []string, log *slog.Logger) int {
+	if err := runDeadLetter(args, os.Stdout); err != nil {
+		return handleErrors(err, log)
+	}
+	return 0
+}
+
+func runDeadLetter(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(deadLetterUsage)
+	}
+	cmd, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("deadletter "+cmd, flag.ContinueOnError)
+	dir := fs.String("dir", "", "dead letter directory, read from the config when not set")
+	all := fs.Bool("all", false, "purge every entry")
+	if err := fs.Parse(args); err != nil {
+		return errors.WithStack(err)
+	}
+	ids := fs.Args()
+
+	if cmd == "replay" {
+		if *dir != "" {
+			return errors.New("replay reads the dead letter dir from the config, -dir is not supported")
+		}
+		return replayDeadLetters(ids)
+	}
+
+	store, err := openDeadLetterStore(*dir)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "list":
+		return listDeadLetters(store, out)
+	case "inspect":
+		if len(ids) != 1 {
+			return errors.New("inspect takes exactly one id")
+		}
+		return inspectDeadLetter(store, ids[0], out)
+	case "purge":
+		return purgeDeadLetters(store, ids, *all, out)
+	default:
+		return errors.Errorf("unknown deadletter command %q\n\n%s", cmd, deadLetterUsage)
+	}
+}
+
+func openDeadLetterStore(dir string) (*deadletter.Store, error) {
+	if dir == "" {
+		cfg, err := config.Load()
+		if err != nil {
+			return nil, err
+		}
+		if cfg.DeadLetter == nil {
+			return nil, errors.New("dead_letter is not configured, pass -dir instead")
+		}
+		dir = cfg.DeadLetter.Dir
+	}
+	return deadletter.Open(dir, logger.Default())
+}
+
+func listDeadLetters(store *deadletter.Store, out io.Writer) error {
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCLASS\tREASON\tATTEMPTS\tTOPIC\tLAST FAILED\tERROR")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			e.ID(), e.Class, e.Reason, e.Attempts, e.Record.Metadata.Topic, e.LastFailedAt.Format(time.RFC3339), truncate(e.Error, 60))
+	}
+	return errors.WithStack(w.Flush())
+}
+
+func inspectDeadLetter(store *deadletter.Store, id string, out io.Writer) error {
+	e, err := store.Get(id)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "id:\t%s\n", e.ID())
+	fmt.Fprintf(w, "class:\t%s\n", e.Class)
+	if e.Reason != "" {
+		fmt.Fprintf(w, "reason:\t%s\n", e.Reason)
+	}
+	fmt.Fprintf(w, "error:\t%s\n", e.Error)
+	fmt.Fprintf(w, "attempts:\t%d\n", e.Attempts)
+	fmt.Fprintf(w, "topic:\t%s\n", e.Record.Metadata.Topic)
+	fmt.Fprintf(w, "received_at:\t%s\n", e.Record.ReceivedAt.Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "first_failed_at:\t%s\n", e.FirstFailedAt.Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "last_failed_at:\t%s\n", e.LastFailedAt.Format(time.RFC3339Nano))
+	if err := w.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = fmt.Fprintf(out, "payload:\n%s\n", e.Record.Payload)
+	return errors.WithStack(err)
+}
+
+func purgeDeadLetters(store *deadletter.Store, ids []string, all bool, out io.Writer) error {
+	if all == (len(ids) > 0) {
+		return errors.New("purge takes either ids or -all")
+	}
+	if all {
+		n, err := store.Purge()
+		fmt.Fprintf(out, "purged %d entries\n", n)
+		return err
+	}
+	for _, id := range ids {
+		if err := store.Delete(id); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "purged %d entries\n", len(ids))
+	return nil
+}
+
+// replayDeadLetters runs the batcher with the dead letter entries as its only source. It exits once
+// every entry has been submitted and the pipeline has drained
+func replayDeadLetters(ids []string) error {
+	ctx, cancel := sigctx.New(context.Background())
+	defer cancel()
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	if cfg.DeadLetter == nil {
+		return errors.New("dead_letter is not configured")
+	}
+
+	log, err := logger.New(cfg.Log, nil)
+	if err != nil {
+		return err
+	}
+
+	// Leave the live sources, capture, spill and dedup cache of a running batcher alone
+	cfg.MQTT = nil
+	cfg.Sources = &config.Sources{DeadLetter: &config.DeadLetterSource{IDs: ids}}
+	cfg.Capture = nil
+	cfg.Pool.Overflow, cfg.Pool.SpillDir = "block", ""
+	if cfg.Pool.Dedup != nil {
+		cfg.Pool.Dedup.Path = ""
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	metrics.InitMetricsProvider()
+	b, err := batcher.New(ctx, cfg, log)
+	if err != nil {
+		return err
+	}
+	return b.Run(ctx)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
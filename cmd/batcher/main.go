@@ -19,6 +19,10 @@ import (
 
 func main() {
 	log := logger.Default()
+	if len(os.Args) > 1 && os.Args[1] == "deadletter" {
+		os.Exit(deadLetterMain(os.Args[2:], log))
+	}
+
 	exitCode := 0
 	if err := run(); err != nil {
 		exitCode = handleErrors(err, log)
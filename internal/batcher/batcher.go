@@ -4,9 +4,12 @@ import (
 	"context"
 	"log/slog"
 
+	"github.com/grid-stream-org/batcher/internal/capture"
 	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/deadletter"
 	"github.com/grid-stream-org/batcher/internal/destination"
 	"github.com/grid-stream-org/batcher/internal/mqtt"
+	"github.com/grid-stream-org/batcher/internal/source"
 	"github.com/grid-stream-org/batcher/internal/task"
 	"github.com/grid-stream-org/go-commons/pkg/eventbus"
 	"github.com/pkg/errors"
@@ -14,37 +17,86 @@ import (
 )
 
 type Batcher struct {
-	cfg  *config.Config
-	dest destination.Destination
-	tp   *task.TaskPool
-	mqtt *mqtt.Client
-	eb   eventbus.EventBus
-	log  *slog.Logger
+	cfg     *config.Config
+	router  *destination.Router
+	tp      *task.TaskPool
+	sources []source.Source
+	started []source.Source
+	capture *capture.Writer
+	eb      eventbus.EventBus
+	// listening is closed once the listener has submitted every event left on the closed bus
+	listening chan struct{}
+	log       *slog.Logger
 }
 
 func New(ctx context.Context, cfg *config.Config, log *slog.Logger) (*Batcher, error) {
-	dest, err := destination.NewDestination(ctx, cfg.Destination, log)
+	router, err := destination.NewRouter(ctx, cfg.Destinations, cfg.Routes, log)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	eb := eventbus.New()
-	mqtt, err := mqtt.NewClient(cfg.MQTT, eb, log)
+	// dlq is only set when configured, a nil *Store would not compare equal to a nil interface
+	var store *deadletter.Store
+	var dlq task.DeadLetterer
+	if cfg.DeadLetter != nil {
+		if store, err = deadletter.Open(cfg.DeadLetter.Dir, log); err != nil {
+			router.Close() // best effort cleanup
+			return nil, errors.WithStack(err)
+		}
+		dlq = store
+	}
+
+	eb := newBus()
+	tp, err := task.NewTaskPool(ctx, cfg.Pool, router, dlq, log)
 	if err != nil {
-		dest.Close() // best effort cleanup
+		router.Close() // best effort cleanup
 		return nil, errors.WithStack(err)
 	}
 
-	tp := task.NewTaskPool(ctx, cfg.Pool, dest, log)
+	var cw *capture.Writer
+	if cfg.Capture != nil {
+		if cw, err = capture.NewWriter(cfg.Capture, log); err != nil {
+			router.Close() // best effort cleanup
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	b := &Batcher{
+		cfg:       cfg,
+		router:    router,
+		tp:        tp,
+		capture:   cw,
+		eb:        eb,
+		listening: make(chan struct{}),
+		log:       log.With("component", "batcher"),
+	}
+	if b.sources, err = b.newSources(store, log); err != nil {
+		router.Close() // best effort cleanup
+		return nil, errors.WithStack(err)
+	}
+	return b, nil
+}
 
-	return &Batcher{
-		cfg:  cfg,
-		dest: dest,
-		tp:   tp,
-		mqtt: mqtt,
-		eb:   eb,
-		log:  log.With("component", "batcher"),
-	}, nil
+func (b *Batcher) newSources(store *deadletter.Store, log *slog.Logger) ([]source.Source, error) {
+	cfg, tp := b.cfg, b.tp
+	var sources []source.Source
+	if cfg.MQTT != nil {
+		client, err := mqtt.NewClient(cfg.MQTT, b.eb, log)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		sources = append(sources, client)
+	}
+	if cfg.Sources.HTTP != nil {
+		sources = append(sources, source.NewHTTPSource(cfg.Sources.HTTP, capturingPool{tp, b}, log))
+	}
+	if cfg.Sources.Replay != nil {
+		sources = append(sources, source.NewReplaySource(cfg.Sources.Replay, tp, log))
+	}
+	if cfg.Sources.DeadLetter != nil {
+		sources = append(sources, source.NewDeadLetterSource(cfg.Sources.DeadLetter, store, tp, log))
+	}
+	return sources, nil
 }
 
 func (b *Batcher) Run(ctx context.Context) (err error) {
@@ -55,61 +107,147 @@ func (b *Batcher) Run(ctx context.Context) (err error) {
 		}
 	}()
 
-	// Start event listener
-	go b.listen(ctx)
+	// Start event listener, subscribed before any source can publish
+	go b.listen(b.eb.Subscribe(b.cfg.Pool.Capacity))
 
-	// Start task pool
-	b.tp.Start(ctx)
+	// Start task pool, which keeps running after ctx is cancelled so that Stop can drain it
+	b.tp.Start(context.WithoutCancel(ctx))
 
-	// Connect to MQTT
-	if err := b.mqtt.Connect(); err != nil {
-		return errors.WithStack(err)
+	// Start sources
+	for _, src := range b.sources {
+		if err := src.Start(ctx); err != nil {
+			return errors.Wrapf(err, "failed to start %s source", src.Name())
+		}
+		b.started = append(b.started, src)
 	}
 
-	// Subscribe to topic
-	if err := b.mqtt.Subscribe(); err != nil {
-		return errors.WithStack(err)
+	// Wait for context cancellation, or for every source to run out of input
+	select {
+	case <-ctx.Done():
+	case <-b.exhausted():
+		b.log.Info("all sources exhausted")
 	}
-
-	// Wait for context cancellation
-	<-ctx.Done()
 	if ctx.Err() != nil {
 		err = multierr.Combine(err, ctx.Err())
 	}
 	return err
 }
 
-func (b *Batcher) listen(ctx context.Context) {
-	b.log.Debug("starting event listener")
-	events := b.eb.Subscribe(b.cfg.Pool.Capacity)
-	defer b.eb.Unsubscribe(events)
-
-	for {
-		select {
-		case event := <-events:
-			b.tp.Submit(event)
-		case <-ctx.Done():
-			return
+// exhausted returns a channel that is closed once every started source has run out of input, or
+// nil, which blocks forever, when any of them runs until stopped
+func (b *Batcher) exhausted() <-chan struct{} {
+	finite := make([]source.Finite, 0, len(b.started))
+	for _, src := range b.started {
+		f, ok := src.(source.Finite)
+		if !ok {
+			return nil
 		}
+		finite = append(finite, f)
 	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, f := range finite {
+			<-f.Done()
+		}
+		close(done)
+	}()
+	return done
 }
 
+// listen submits events from the bus until it is closed, including those still buffered on it
+func (b *Batcher) listen(events chan any) {
+	defer close(b.listening)
+	b.log.Debug("starting event listener")
+	for event := range events {
+		b.record(event)
+		b.tp.Submit(event)
+	}
+}
+
+// capturingPool records live tasks that are submitted straight to the pool, as the listener does
+// for those published on the event bus
+type capturingPool struct {
+	*task.TaskPool
+	b *Batcher
+}
+
+func (p capturingPool) Submit(t any) bool {
+	p.b.record(t)
+	return p.TaskPool.Submit(t)
+}
+
+// record archives the payload when capture is enabled. Capture failures are logged rather than
+// allowed to hold up processing
+func (b *Batcher) record(event any) {
+	if b.capture == nil {
+		return
+	}
+	t, ok := event.(task.Task)
+	if !ok {
+		return
+	}
+	if err := b.capture.Write(t.Record()); err != nil {
+		b.log.Error("failed to capture payload", "error", err)
+	}
+}
+
+// Stop shuts down in order, so that nothing accepted is lost: sources stop taking input, the task
+// queue drains within the drain timeout, the destinations flush before they close, and only then
+// are the connections of paused sources closed, as flushing acknowledges what they delivered
 func (b *Batcher) Stop(ctx context.Context) error {
-	b.log.Info("shutting down batcher")
+	b.log.Info("shutting down batcher", "drain_timeout", b.cfg.Batcher.DrainTimeout.String())
 
-	// Stop MQTT client
-	if err := b.mqtt.Stop(); err != nil {
-		b.log.Error("failed to stop MQTT client", "error", err)
+	// Shutdown uses contexts that are not already cancelled
+	stopCtx := context.WithoutCancel(ctx)
+	drainCtx, cancel := context.WithTimeout(stopCtx, b.cfg.Batcher.DrainTimeout)
+	defer cancel()
+
+	// Stop intake in start order, so that MQTT stops receiving first. Sources that acknowledge
+	// what they delivered are only paused
+	var paused []source.Source
+	for _, src := range b.started {
+		if p, ok := src.(source.Pauser); ok {
+			if err := p.Pause(stopCtx); err != nil {
+				b.log.Error("failed to pause source", "source", src.Name(), "error", err)
+			}
+			paused = append(paused, src)
+			continue
+		}
+		if err := src.Stop(stopCtx); err != nil {
+			b.log.Error("failed to stop source", "source", src.Name(), "error", err)
+		}
 	}
 
-	// Close event bus to stop listening
+	// Close event bus, the listener submits what is left on it and stops
 	b.eb.Close()
+	select {
+	case <-b.listening:
+	case <-drainCtx.Done():
+		b.log.Warn("drain deadline passed before the event bus emptied")
+	}
 
-	// Stop task pool and wait for workers to finish
-	b.tp.Wait()
+	// Process the queue, persisting whatever is left at the deadline
+	b.tp.Drain(drainCtx)
+	<-b.listening
 
-	// Close the destination
-	if err := b.dest.Close(); err != nil {
+	// Finish the current capture archive
+	if b.capture != nil {
+		if err := b.capture.Close(); err != nil {
+			b.log.Error("failed to close capture writer", "error", err)
+		}
+	}
+
+	// Close the destinations, buffered destinations flush first
+	err := b.router.Close()
+
+	// Acknowledgements have all been sent, the paused sources can disconnect
+	for _, src := range paused {
+		if err := src.Stop(stopCtx); err != nil {
+			b.log.Error("failed to stop source", "source", src.Name(), "error", err)
+		}
+	}
+	if err != nil {
 		return errors.WithStack(err)
 	}
 
@@ -0,0 +1,73 @@
+package batcher
+
+import (
+	"sync"
+
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/grid-stream-org/go-commons/pkg/eventbus"
+)
+
+// bus is the event bus sources publish to. It behaves like eventbus.New, except that an event a
+// full subscriber cannot take is counted as dropped instead of vanishing without a trace
+type bus struct {
+	mu          sync.Mutex
+	subscribers []chan any
+}
+
+func newBus() eventbus.EventBus {
+	return &bus{}
+}
+
+func (b *bus) Subscribe(capacity int) chan any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan any, capacity)
+	b.subscribers = append(b.subscribers, ch)
+	return ch
+}
+
+func (b *bus) Publish(event any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			topic := ""
+			if t, ok := event.(task.Task); ok {
+				topic = t.Metadata().Topic
+				// Nothing will acknowledge it now, the source is left to redeliver it
+				t.Release()
+			}
+			metrics.Local.Counter(metrics.MessagesDropped).WithLabelValues(topic, metrics.ReasonBusFull).Inc()
+		}
+	}
+}
+
+func (b *bus) Unsubscribe(ch chan any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, sub := range b.subscribers {
+		if sub == ch {
+			b.subscribers = append(b.subscribers[:i], b.subscribers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+func (b *bus) Subscribers() []chan any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscribers
+}
+
+func (b *bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subscribers {
+		close(ch)
+	}
+	b.subscribers = nil
+}
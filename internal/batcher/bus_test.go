@@ -0,0 +1,44 @@
+package batcher
+
+import (
+	"testing"
+
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+type BusTestSuite struct {
+	suite.Suite
+}
+
+func (s *BusTestSuite) SetupSuite() {
+	metrics.InitMetricsProvider()
+}
+
+func (s *BusTestSuite) TestPublishCountsDrops() {
+	dropped := metrics.Local.Counter(metrics.MessagesDropped).WithLabelValues("grid/ders", metrics.ReasonBusFull)
+	before := testutil.ToFloat64(dropped)
+
+	b := newBus()
+	events := b.Subscribe(1)
+	released := 0
+	for i := 0; i < 3; i++ {
+		t := task.NewTaskWithMetadata([]byte("[]"), task.Metadata{Topic: "grid/ders"})
+		b.Publish(t.WithRelease(func() { released++ }))
+	}
+	s.Len(events, 1)
+	s.Equal(before+2, testutil.ToFloat64(dropped))
+	s.Equal(2, released)
+
+	b.Close()
+	_, open := <-events
+	s.True(open)
+	_, open = <-events
+	s.False(open)
+}
+
+func TestBusSuite(t *testing.T) {
+	suite.Run(t, new(BusTestSuite))
+}
@@ -1,78 +1,272 @@
 package buffer
 
 import (
+	"math"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	pb "github.com/grid-stream-org/grid-stream-protos/gen/validator/v1"
+	"google.golang.org/protobuf/encoding/protowire"
 
+	"github.com/grid-stream-org/batcher/internal/config"
 	"github.com/grid-stream-org/batcher/internal/outcome"
 	"github.com/grid-stream-org/batcher/internal/types"
 )
 
+// AvgCache averages outcomes per project in windows of event time, so that a reading counts toward
+// the interval it was taken in rather than the one open when it arrived. Windows are aligned to the
+// origin and any number can be open at once. A window closes once the watermark passes its end.
+// The watermark follows the clock, or in event mode the readings themselves, so that archives
+// replayed long after they were taken are windowed as they were then
+// Closing swaps the windows out, with their outcomes, under the same lock that Add takes, so an
+// outcome is either in what a flush takes or left for the next one
 type AvgCache struct {
-	mu        sync.Mutex
-	items     map[string]*RunningAvg
-	startTime time.Time
-	endTime   time.Time
+	mu       sync.Mutex
+	windows  map[time.Time]*window
+	late     []outcome.Outcome
+	origin   time.Time
+	interval time.Duration
+	lateness time.Duration
+	// averaging is how the samples of every window are weighted
+	averaging *config.Averaging
+	// event moves the watermark with the latest event time seen rather than the clock
+	event bool
+	// closed is the end of the last window closed, outcomes from before it are late
+	closed time.Time
+	// latest is the latest event time seen
+	latest time.Time
 }
 
-func NewAvgCache(startTime time.Time, endTime time.Time) *AvgCache {
-	return &AvgCache{
-		items:     make(map[string]*RunningAvg),
-		startTime: startTime,
-		endTime:   endTime,
+type window struct {
+	start    time.Time
+	end      time.Time
+	items    map[string]*RunningAvg
+	outcomes []outcome.Outcome
+}
+
+// Closed holds what was taken out of the windows that closed, and the outcomes that arrived after
+// their window closed
+type Closed struct {
+	Outcomes []outcome.Outcome
+	Averages []types.AverageOutput
+	Late     []outcome.Outcome
+}
+
+// NewAvgCache creates a cache whose windows are aligned to the origin. With the clock watermark
+// nothing from before the origin is accepted. With the event watermark nothing is late until the
+// first window closes, since the readings may be from any time
+func NewAvgCache(origin time.Time, interval time.Duration, lateness time.Duration, watermark string, averaging *config.Averaging) *AvgCache {
+	ac := &AvgCache{
+		windows:   make(map[time.Time]*window),
+		origin:    origin,
+		interval:  interval,
+		lateness:  lateness,
+		averaging: averaging,
+		event:     watermark == "event",
+	}
+	if !ac.event {
+		ac.closed = origin
 	}
+	return ac
 }
 
-func (ac *AvgCache) Add(o *outcome.Outcome) {
+// Add puts the outcome in the window its event time falls in. It returns false when that window
+// has already closed, and the outcome is kept with the late ones instead
+func (ac *AvgCache) Add(o *outcome.Outcome) bool {
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
 
-	ra, ok := ac.items[o.ProjectID]
+	t := o.EventTime()
+	if t.Before(ac.closed) {
+		ac.late = append(ac.late, *o)
+		return false
+	}
+	if t.After(ac.latest) {
+		ac.latest = t
+	}
+
+	start := ac.align(t)
+	w, ok := ac.windows[start]
+	if !ok {
+		w = &window{start: start, end: start.Add(ac.interval), items: make(map[string]*RunningAvg)}
+		ac.windows[start] = w
+	}
+	w.outcomes = append(w.outcomes, *o)
+
+	ra, ok := w.items[o.ProjectID]
 	if !ok {
-		ra = NewRunningAvg(o, ac.startTime, ac.endTime, o.Baseline)
-		ac.items[o.ProjectID] = ra
+		ra = NewRunningAvg(o, w.start, w.end, o.Baseline, ac.averaging)
+		w.items[o.ProjectID] = ra
+	}
+	if o.Meter != "" {
+		ra.AddMeter(o, t)
+		return true
 	}
-	ra.Add(o.NetOutput)
+	ra.Add(o.NetOutput, t)
+	return true
 }
 
-func (ac *AvgCache) GetOutputs() []types.AverageOutput {
+// Watermark trails the clock by the allowed lateness. Event times only pick the window, so a
+// reading stamped in the future cannot close the current ones early. In event mode it trails the
+// latest event time seen instead
+func (ac *AvgCache) Watermark(now time.Time) time.Time {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.event {
+		return ac.latest.Add(-ac.lateness)
+	}
+	return now.Add(-ac.lateness)
+}
+
+// Close takes out every window that ends at or before the watermark. Outcomes for those windows
+// that arrive afterwards are late
+func (ac *AvgCache) Close(watermark time.Time) *Closed {
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
 
-	outputs := make([]types.AverageOutput, 0, len(ac.items))
-	for _, ra := range ac.items {
-		outputs = append(outputs, *ra.average)
+	if watermark.After(ac.closed) {
+		ac.closed = later(ac.closed, ac.align(watermark))
 	}
-	return outputs
+	return ac.take(func(w *window) bool { return !w.end.After(watermark) })
 }
 
-func (ac *AvgCache) GetProtoOutputs() []*pb.AverageOutput {
+// CloseAll takes out every window, whether or not the watermark has passed it
+func (ac *AvgCache) CloseAll() *Closed {
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
 
-	outputs := make([]*pb.AverageOutput, 0, len(ac.items))
-	for _, ra := range ac.items {
-		avg := &pb.AverageOutput{
-			ProjectId:         ra.average.ProjectID,
-			AverageOutput:     ra.average.AverageOutput,
-			Baseline:          ra.average.Baseline,
-			ContractThreshold: ra.average.ContractThreshold,
-			StartTime:         ra.average.StartTime.Format(time.RFC3339),
-			EndTime:           ra.average.EndTime.Format(time.RFC3339),
+	closed := ac.take(func(*window) bool { return true })
+	for _, avg := range closed.Averages {
+		ac.closed = later(ac.closed, avg.EndTime)
+	}
+	return closed
+}
+
+// take removes the windows that match, oldest first with projects in order
+func (ac *AvgCache) take(match func(w *window) bool) *Closed {
+	var windows []*window
+	for start, w := range ac.windows {
+		if match(w) {
+			windows = append(windows, w)
+			delete(ac.windows, start)
 		}
-		outputs = append(outputs, avg)
 	}
-	return outputs
+	slices.SortFunc(windows, func(a, b *window) int { return a.start.Compare(b.start) })
+
+	closed := &Closed{Late: ac.late}
+	ac.late = nil
+	for _, w := range windows {
+		closed.Outcomes = append(closed.Outcomes, w.outcomes...)
+		averages := make([]types.AverageOutput, 0, len(w.items))
+		for _, ra := range w.items {
+			averages = append(averages, ra.Output())
+		}
+		slices.SortFunc(averages, func(a, b types.AverageOutput) int { return strings.Compare(a.ProjectID, b.ProjectID) })
+		closed.Averages = append(closed.Averages, averages...)
+	}
+	return closed
+}
+
+// align returns the start of the window t falls in, which is before the origin when t is
+func (ac *AvgCache) align(t time.Time) time.Time {
+	offset := t.Sub(ac.origin) % ac.interval
+	if offset < 0 {
+		offset += ac.interval
+	}
+	return t.Add(-offset)
 }
 
-func (ac *AvgCache) Reset(nextStartTime time.Time, nextEndTime time.Time) {
+// Open returns the number of windows still open
+func (ac *AvgCache) Open() int {
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
-	ac.startTime = nextStartTime
-	ac.endTime = nextEndTime
-	for k := range ac.items {
-		delete(ac.items, k)
+	return len(ac.windows)
+}
+
+// Fields of the statistics that validator/v1 does not declare, numbered on from its last field in
+// the order of types.AverageOutput
+const (
+	fieldUnits protowire.Number = iota + 7
+	fieldSampleCount
+	fieldMinOutput
+	fieldMaxOutput
+	fieldStdDevOutput
+	fieldP50Output
+	fieldP95Output
+	fieldFirstReadingAt
+	fieldLastReadingAt
+	fieldAveraging
+	fieldEnergyKWh
+	fieldDroppedSamples
+)
+
+// ProtoOutputs converts averages to the messages sent to the validator. The statistics validator/v1
+// does not declare are carried as unknown fields, which a validator reads once its protos declare them
+func ProtoOutputs(averages []types.AverageOutput) []*pb.AverageOutput {
+	outputs := make([]*pb.AverageOutput, 0, len(averages))
+	for _, avg := range averages {
+		output := &pb.AverageOutput{
+			ProjectId:         avg.ProjectID,
+			AverageOutput:     avg.AverageOutput,
+			Baseline:          avg.Baseline,
+			ContractThreshold: avg.ContractThreshold,
+			StartTime:         avg.StartTime.Format(time.RFC3339),
+			EndTime:           avg.EndTime.Format(time.RFC3339),
+		}
+		output.ProtoReflect().SetUnknown(statistics(avg))
+		outputs = append(outputs, output)
+	}
+	return outputs
+}
+
+// statistics encodes the statistics of an average that validator/v1 does not declare. Like proto3
+// fields, those with zero values are left out
+func statistics(avg types.AverageOutput) []byte {
+	var b []byte
+	str := func(n protowire.Number, v string) {
+		if v != "" {
+			b = protowire.AppendTag(b, n, protowire.BytesType)
+			b = protowire.AppendString(b, v)
+		}
+	}
+	num := func(n protowire.Number, v int64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, n, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(v))
+		}
+	}
+	float := func(n protowire.Number, v float64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, n, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(v))
+		}
+	}
+	at := func(n protowire.Number, v time.Time) {
+		if !v.IsZero() {
+			str(n, v.Format(time.RFC3339Nano))
+		}
+	}
+
+	str(fieldUnits, avg.Units)
+	num(fieldSampleCount, avg.SampleCount)
+	float(fieldMinOutput, avg.MinOutput)
+	float(fieldMaxOutput, avg.MaxOutput)
+	float(fieldStdDevOutput, avg.StdDevOutput)
+	float(fieldP50Output, avg.P50Output)
+	float(fieldP95Output, avg.P95Output)
+	at(fieldFirstReadingAt, avg.FirstReadingAt)
+	at(fieldLastReadingAt, avg.LastReadingAt)
+	str(fieldAveraging, avg.Averaging)
+	float(fieldEnergyKWh, avg.EnergyKWh)
+	num(fieldDroppedSamples, avg.DroppedSamples)
+	return b
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
 	}
+	return b
 }
@@ -1,269 +1,333 @@
 package buffer
 
 import (
+	"math"
 	"testing"
 	"time"
 
+	pb "github.com/grid-stream-org/grid-stream-protos/gen/validator/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
 	"github.com/grid-stream-org/batcher/internal/outcome"
 	"github.com/grid-stream-org/batcher/internal/types"
-	pb "github.com/grid-stream-org/grid-stream-protos/gen/validator/v1"
 	"github.com/stretchr/testify/suite"
 )
 
 type AvgCacheTestSuite struct {
 	suite.Suite
 	startTime time.Time
-	endTime   time.Time
+	interval  time.Duration
 	cache     *AvgCache
 }
 
 func (s *AvgCacheTestSuite) SetupTest() {
 	s.startTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
-	s.endTime = time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
-	s.cache = NewAvgCache(s.startTime, s.endTime)
-}
-
-func (s *AvgCacheTestSuite) TestNewAvgCache() {
-	s.NotNil(s.cache)
-	s.NotNil(s.cache.items)
-	s.Equal(s.startTime, s.cache.startTime)
-	s.Equal(s.endTime, s.cache.endTime)
-	s.Empty(s.cache.items)
+	s.interval = time.Hour
+	s.cache = NewAvgCache(s.startTime, s.interval, 0, "clock", nil)
 }
 
-func (s *AvgCacheTestSuite) TestAdd() {
-	// First addition (new item)
-	data1 := []types.RealTimeDERData{{
+// outcome builds an outcome for a reading taken at offset from the start time
+func (s *AvgCacheTestSuite) outcome(taskID string, projectID string, threshold float64, netOutput float64, offset time.Duration) *outcome.Outcome {
+	data := []types.RealTimeDERData{{
 		ID: "der1",
 		DER: types.DER{
-			ProjectID:         "project1",
+			ProjectID:         projectID,
 			DerID:             "der1",
-			ContractThreshold: 0.5,
+			ContractThreshold: threshold,
 			IsOnline:          true,
-			CurrentOutput:     10.0,
+			CurrentOutput:     netOutput,
+			Timestamp:         s.startTime.Add(offset),
 		},
 	}}
-	o1 := outcome.New(1, "task1", "project1", data1, 10.0, time.Second)
-	s.cache.Add(o1)
-	s.Len(s.cache.items, 1)
+	return outcome.New(1, taskID, projectID, data, netOutput, time.Second)
+}
+
+func (s *AvgCacheTestSuite) TestNewAvgCache() {
+	s.NotNil(s.cache)
+	s.NotNil(s.cache.windows)
+	s.Equal(s.startTime, s.cache.origin)
+	s.Equal(s.startTime, s.cache.closed)
+	s.Empty(s.cache.windows)
+}
+
+func (s *AvgCacheTestSuite) TestAdd() {
+	// First addition (new item)
+	s.True(s.cache.Add(s.outcome("task1", "project1", 0.5, 10.0, time.Minute)))
+	s.Equal(1, s.cache.Open())
 
 	// Second addition (existing item)
-	data2 := []types.RealTimeDERData{{
-		ID: "der1",
-		DER: types.DER{
-			ProjectID:         "project1",
-			DerID:             "der1",
-			ContractThreshold: 0.5,
-			IsOnline:          true,
-			CurrentOutput:     20.0,
-		},
-	}}
-	o2 := outcome.New(1, "task1", "project1", data2, 20.0, time.Second)
-	s.cache.Add(o2)
-	s.Len(s.cache.items, 1)
+	s.True(s.cache.Add(s.outcome("task2", "project1", 0.5, 20.0, 2*time.Minute)))
+	s.Equal(1, s.cache.Open())
 
 	// Different project
-	data3 := []types.RealTimeDERData{{
-		ID: "der2",
-		DER: types.DER{
-			ProjectID:         "project2",
-			DerID:             "der2",
-			ContractThreshold: 0.75,
-			IsOnline:          true,
-			CurrentOutput:     30.0,
-		},
-	}}
-	o3 := outcome.New(1, "task1", "project2", data3, 30.0, time.Second)
-	s.cache.Add(o3)
-	s.Len(s.cache.items, 2)
+	s.True(s.cache.Add(s.outcome("task3", "project2", 0.75, 30.0, 3*time.Minute)))
+	s.Equal(1, s.cache.Open())
 
 	// Verify the averages
-	s.Equal(15.0, s.cache.items["project1"].average.AverageOutput) // (10 + 20) / 2
-	s.Equal(30.0, s.cache.items["project2"].average.AverageOutput)
+	w := s.cache.windows[s.startTime]
+	s.Len(w.items, 2)
+	s.Len(w.outcomes, 3)
+	s.Equal(15.0, w.items["project1"].Output().AverageOutput) // (10 + 20) / 2
+	s.Equal(30.0, w.items["project2"].Output().AverageOutput)
 }
 
-func (s *AvgCacheTestSuite) TestGetOutputs() {
-	// Add some test data
-	data1 := []types.RealTimeDERData{{
-		ID: "der1",
-		DER: types.DER{
-			ProjectID:         "project1",
-			DerID:             "der1",
-			ContractThreshold: 0.5,
-			IsOnline:          true,
-			CurrentOutput:     10.0,
+func (s *AvgCacheTestSuite) TestAddMeters() {
+	testCases := []struct {
+		name     string
+		outcomes []*outcome.Outcome
+		expected float64
+		baseline float64
+	}{
+		{
+			name: "meters of one task make one sample",
+			outcomes: []*outcome.Outcome{
+				{TaskID: "task1", ProjectID: "project1", Meter: "project1/100", NetOutput: 10.0, Baseline: 40.0},
+				{TaskID: "task1", ProjectID: "project1", Meter: "project1/200", NetOutput: 20.0, Baseline: 60.0},
+			},
+			expected: 30.0,
+			baseline: 100.0,
 		},
-	}}
-	o1 := outcome.New(1, "task1", "project1", data1, 10.0, time.Second)
-	s.cache.Add(o1)
-
-	data2 := []types.RealTimeDERData{{
-		ID: "der1",
-		DER: types.DER{
-			ProjectID:         "project1",
-			DerID:             "der1",
-			ContractThreshold: 0.5,
-			IsOnline:          true,
-			CurrentOutput:     20.0,
+		{
+			name: "meters of different tasks make separate samples",
+			outcomes: []*outcome.Outcome{
+				{TaskID: "task1", ProjectID: "project1", Meter: "project1/100", NetOutput: 10.0, Baseline: 40.0},
+				{TaskID: "task1", ProjectID: "project1", Meter: "project1/200", NetOutput: 20.0, Baseline: 60.0},
+				{TaskID: "task2", ProjectID: "project1", Meter: "project1/100", NetOutput: 50.0, Baseline: 40.0},
+			},
+			expected: 40.0, // (10 + 20 + 50) / 2
+			baseline: 100.0,
 		},
-	}}
-	o2 := outcome.New(1, "task1", "project1", data2, 20.0, time.Second)
-	s.cache.Add(o2)
-
-	data3 := []types.RealTimeDERData{{
-		ID: "der2",
-		DER: types.DER{
-			ProjectID:         "project2",
-			DerID:             "der2",
-			ContractThreshold: 0.75,
-			IsOnline:          true,
-			CurrentOutput:     30.0,
+		{
+			name: "a meter seen in a later task adds its baseline",
+			outcomes: []*outcome.Outcome{
+				{TaskID: "task1", ProjectID: "project1", Meter: "project1/100", NetOutput: 10.0, Baseline: 40.0},
+				{TaskID: "task2", ProjectID: "project1", Meter: "project1/200", NetOutput: 20.0, Baseline: 60.0},
+			},
+			expected: 15.0,
+			baseline: 100.0,
 		},
-	}}
-	o3 := outcome.New(1, "task1", "project2", data3, 30.0, time.Second)
-	s.cache.Add(o3)
-
-	outputs := s.cache.GetOutputs()
-	s.Len(outputs, 2)
-
-	// Sort outputs by project ID for consistent testing
-	var proj1, proj2 types.AverageOutput
-	for _, out := range outputs {
-		if out.ProjectID == "project1" {
-			proj1 = out
-		} else {
-			proj2 = out
-		}
 	}
 
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			cache := NewAvgCache(s.startTime, s.interval, 0, "clock", nil)
+			for _, o := range tc.outcomes {
+				o.CreatedAt = s.startTime.Add(time.Minute)
+				s.True(cache.Add(o))
+			}
+			w := cache.windows[s.startTime]
+			s.Len(w.items, 1)
+			out := w.items["project1"].Output()
+			s.Equal(tc.expected, out.AverageOutput)
+			s.Equal(tc.baseline, out.Baseline)
+		})
+	}
+}
+
+func (s *AvgCacheTestSuite) TestEventTime() {
+	// Readings land in the window they were taken in, whenever they arrive
+	s.True(s.cache.Add(s.outcome("task1", "project1", 0.5, 10.0, 59*time.Minute+59*time.Second)))
+	s.True(s.cache.Add(s.outcome("task2", "project1", 0.5, 20.0, time.Hour+time.Second)))
+	s.True(s.cache.Add(s.outcome("task3", "project1", 0.5, 30.0, 30*time.Minute)))
+	s.Equal(2, s.cache.Open())
+
+	closed := s.cache.CloseAll()
+	s.Require().Len(closed.Averages, 2)
+	s.Equal(s.startTime, closed.Averages[0].StartTime)
+	s.Equal(s.startTime.Add(s.interval), closed.Averages[0].EndTime)
+	s.Equal(20.0, closed.Averages[0].AverageOutput) // (10 + 30) / 2
+	s.Equal(s.startTime.Add(s.interval), closed.Averages[1].StartTime)
+	s.Equal(20.0, closed.Averages[1].AverageOutput)
+	s.Len(closed.Outcomes, 3)
+}
+
+func (s *AvgCacheTestSuite) TestWatermark() {
+	testCases := []struct {
+		name      string
+		watermark string
+		lateness  time.Duration
+		latest    time.Duration
+		now       time.Duration
+		expected  time.Duration
+	}{
+		{name: "clock ahead of readings", watermark: "clock", lateness: 0, latest: 10 * time.Minute, now: 20 * time.Minute, expected: 20 * time.Minute},
+		{name: "readings ahead of clock", watermark: "clock", lateness: 0, latest: 30 * time.Hour, now: 20 * time.Minute, expected: 20 * time.Minute},
+		{name: "lateness holds it back", watermark: "clock", lateness: 5 * time.Minute, latest: 10 * time.Minute, now: 20 * time.Minute, expected: 15 * time.Minute},
+		{name: "event follows readings", watermark: "event", lateness: 5 * time.Minute, latest: -48 * time.Hour, now: 20 * time.Minute, expected: -48*time.Hour - 5*time.Minute},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			cache := NewAvgCache(s.startTime, s.interval, tc.lateness, tc.watermark, nil)
+			s.True(cache.Add(s.outcome("task1", "project1", 0.5, 10.0, tc.latest)))
+			s.Equal(s.startTime.Add(tc.expected), cache.Watermark(s.startTime.Add(tc.now)))
+		})
+	}
+}
+
+func (s *AvgCacheTestSuite) TestEventWatermark() {
+	// Readings from well before the origin, as a replayed archive would have
+	cache := NewAvgCache(s.startTime, s.interval, 0, "event", nil)
+	s.True(cache.Add(s.outcome("task1", "project1", 0.5, 10.0, -50*time.Hour+time.Minute)))
+	s.True(cache.Add(s.outcome("task2", "project1", 0.5, 30.0, -50*time.Hour+2*time.Minute)))
+	s.True(cache.Add(s.outcome("task3", "project1", 0.5, 20.0, -49*time.Hour+time.Minute)))
+
+	closed := cache.Close(cache.Watermark(time.Now()))
+	s.Require().Len(closed.Averages, 1)
+	s.Equal(s.startTime.Add(-50*time.Hour), closed.Averages[0].StartTime)
+	s.Equal(20.0, closed.Averages[0].AverageOutput)
+	s.Len(closed.Outcomes, 2)
+	s.Empty(closed.Late)
+	s.Equal(1, cache.Open())
+
+	// Only the window that closed turns readings away
+	s.False(cache.Add(s.outcome("task4", "project1", 0.5, 10.0, -50*time.Hour+3*time.Minute)))
+	s.True(cache.Add(s.outcome("task5", "project1", 0.5, 10.0, -49*time.Hour+3*time.Minute)))
+}
+
+func (s *AvgCacheTestSuite) TestClose() {
+	s.True(s.cache.Add(s.outcome("task1", "project2", 0.75, 30.0, time.Minute)))
+	s.True(s.cache.Add(s.outcome("task2", "project1", 0.5, 10.0, 2*time.Minute)))
+	s.True(s.cache.Add(s.outcome("task3", "project1", 0.5, 20.0, 3*time.Minute)))
+	s.True(s.cache.Add(s.outcome("task4", "project1", 0.5, 40.0, time.Hour+time.Minute)))
+
+	// The watermark has not passed the end of the first window
+	closed := s.cache.Close(s.startTime.Add(59 * time.Minute))
+	s.Empty(closed.Averages)
+	s.Empty(closed.Outcomes)
+	s.Equal(2, s.cache.Open())
+
+	closed = s.cache.Close(s.startTime.Add(time.Hour + 30*time.Minute))
+	s.Len(closed.Outcomes, 3)
+	s.Require().Len(closed.Averages, 2)
+
+	proj1, proj2 := closed.Averages[0], closed.Averages[1]
 	s.Equal("project1", proj1.ProjectID)
 	s.Equal(15.0, proj1.AverageOutput)
 	s.Equal(0.5, proj1.ContractThreshold)
 	s.Equal(s.startTime, proj1.StartTime)
-	s.Equal(s.endTime, proj1.EndTime)
+	s.Equal(s.startTime.Add(s.interval), proj1.EndTime)
 
 	s.Equal("project2", proj2.ProjectID)
 	s.Equal(30.0, proj2.AverageOutput)
 	s.Equal(0.75, proj2.ContractThreshold)
 	s.Equal(s.startTime, proj2.StartTime)
-	s.Equal(s.endTime, proj2.EndTime)
-}
+	s.Equal(s.startTime.Add(s.interval), proj2.EndTime)
 
-func (s *AvgCacheTestSuite) TestGetProtoOutputs() {
-	// Add some test data
-	data1 := []types.RealTimeDERData{{
-		ID: "der1",
-		DER: types.DER{
-			ProjectID:         "project1",
-			DerID:             "der1",
-			ContractThreshold: 0.5,
-			IsOnline:          true,
-			CurrentOutput:     10.0,
-		},
-	}}
-	o1 := outcome.New(1, "task1", "project1", data1, 10.0, time.Second)
-	s.cache.Add(o1)
+	// The second window stays open
+	s.Equal(1, s.cache.Open())
+}
 
-	data2 := []types.RealTimeDERData{{
-		ID: "der1",
-		DER: types.DER{
-			ProjectID:         "project1",
-			DerID:             "der1",
-			ContractThreshold: 0.5,
-			IsOnline:          true,
-			CurrentOutput:     20.0,
-		},
-	}}
-	o2 := outcome.New(1, "task1", "project1", data2, 20.0, time.Second)
-	s.cache.Add(o2)
+func (s *AvgCacheTestSuite) TestLate() {
+	testCases := []struct {
+		name     string
+		offset   time.Duration
+		accepted bool
+	}{
+		{name: "before the start time", offset: -time.Minute, accepted: false},
+		{name: "closed window", offset: 59 * time.Minute, accepted: false},
+		{name: "window closed with nothing in it", offset: time.Hour + time.Minute, accepted: false},
+		{name: "open window", offset: 2*time.Hour + time.Minute, accepted: true},
+	}
 
-	data3 := []types.RealTimeDERData{{
-		ID: "der2",
-		DER: types.DER{
-			ProjectID:         "project2",
-			DerID:             "der2",
-			ContractThreshold: 0.75,
-			IsOnline:          true,
-			CurrentOutput:     30.0,
-		},
-	}}
-	o3 := outcome.New(1, "task1", "project2", data3, 30.0, time.Second)
-	s.cache.Add(o3)
-
-	outputs := s.cache.GetProtoOutputs()
-	s.Len(outputs, 2)
-
-	// Sort outputs by project ID for consistent testing
-	var proj1, proj2 *pb.AverageOutput
-	for _, out := range outputs {
-		if out.ProjectId == "project1" {
-			proj1 = out
-		} else {
-			proj2 = out
-		}
+	cache := NewAvgCache(s.startTime, s.interval, 0, "clock", nil)
+	cache.Close(s.startTime.Add(2*time.Hour + 30*time.Minute))
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			s.Equal(tc.accepted, cache.Add(s.outcome("task1", "project1", 0.5, 10.0, tc.offset)))
+		})
 	}
+}
 
+func (s *AvgCacheTestSuite) TestCloseAll() {
+	s.True(s.cache.Add(s.outcome("task1", "project1", 0.5, 10.0, time.Minute)))
+	s.True(s.cache.Add(s.outcome("task2", "project2", 0.75, 20.0, 3*time.Hour)))
+
+	closed := s.cache.CloseAll()
+	s.Len(closed.Averages, 2)
+	s.Len(closed.Outcomes, 2)
+	s.Zero(s.cache.Open())
+
+	// Nothing can be added to the windows once they have gone
+	s.False(s.cache.Add(s.outcome("task3", "project1", 0.5, 30.0, 3*time.Hour)))
+	s.True(s.cache.Add(s.outcome("task4", "project3", 0.6, 30.0, 4*time.Hour)))
+	s.Equal(1, s.cache.Open())
+}
+
+func (s *AvgCacheTestSuite) TestProtoOutputs() {
+	s.True(s.cache.Add(s.outcome("task1", "project1", 0.5, 10.0, time.Minute)))
+	s.True(s.cache.Add(s.outcome("task2", "project1", 0.5, 20.0, 2*time.Minute)))
+	s.True(s.cache.Add(s.outcome("task3", "project2", 0.75, 30.0, 3*time.Minute)))
+
+	outputs := ProtoOutputs(s.cache.CloseAll().Averages)
+	s.Require().Len(outputs, 2)
+
+	proj1, proj2 := outputs[0], outputs[1]
 	s.Equal("project1", proj1.ProjectId)
 	s.Equal(15.0, proj1.AverageOutput)
 	s.Equal(0.5, proj1.ContractThreshold)
 	s.Equal(s.startTime.Format(time.RFC3339), proj1.StartTime)
-	s.Equal(s.endTime.Format(time.RFC3339), proj1.EndTime)
+	s.Equal(s.startTime.Add(s.interval).Format(time.RFC3339), proj1.EndTime)
 
 	s.Equal("project2", proj2.ProjectId)
 	s.Equal(30.0, proj2.AverageOutput)
 	s.Equal(0.75, proj2.ContractThreshold)
 	s.Equal(s.startTime.Format(time.RFC3339), proj2.StartTime)
-	s.Equal(s.endTime.Format(time.RFC3339), proj2.EndTime)
+	s.Equal(s.startTime.Add(s.interval).Format(time.RFC3339), proj2.EndTime)
 }
 
-func (s *AvgCacheTestSuite) TestReset() {
-	// Add some test data
-	data1 := []types.RealTimeDERData{{
-		ID: "der1",
-		DER: types.DER{
-			ProjectID:         "project1",
-			DerID:             "der1",
-			ContractThreshold: 0.5,
-			IsOnline:          true,
-			CurrentOutput:     10.0,
-		},
-	}}
-	o1 := outcome.New(1, "task1", "project1", data1, 10.0, time.Second)
-	s.cache.Add(o1)
+func (s *AvgCacheTestSuite) TestProtoStatistics() {
+	s.True(s.cache.Add(s.outcome("task1", "project1", 0.5, 10.0, time.Minute)))
+	s.True(s.cache.Add(s.outcome("task2", "project1", 0.5, 20.0, 2*time.Minute)))
+	averages := s.cache.CloseAll().Averages
+	s.Require().Len(averages, 1)
+	avg := averages[0]
+	avg.Units = "kW"
 
-	data2 := []types.RealTimeDERData{{
-		ID: "der2",
-		DER: types.DER{
-			ProjectID:         "project2",
-			DerID:             "der2",
-			ContractThreshold: 0.75,
-			IsOnline:          true,
-			CurrentOutput:     20.0,
-		},
-	}}
-	o2 := outcome.New(1, "task1", "project2", data2, 20.0, time.Second)
-	s.cache.Add(o2)
-	s.Len(s.cache.items, 2)
+	// The statistics survive the trip to the validator
+	b, err := proto.Marshal(ProtoOutputs([]types.AverageOutput{avg})[0])
+	s.Require().NoError(err)
+	var received pb.AverageOutput
+	s.Require().NoError(proto.Unmarshal(b, &received))
+	s.Equal(15.0, received.AverageOutput)
 
-	// Reset the cache
-	s.cache.Reset(s.startTime, s.endTime)
-	s.Empty(s.cache.items)
+	fields := make(map[protowire.Number]any)
+	unknown := received.ProtoReflect().GetUnknown()
+	for len(unknown) > 0 {
+		n, typ, length := protowire.ConsumeTag(unknown)
+		s.Require().Positive(length)
+		unknown = unknown[length:]
+		switch typ {
+		case protowire.BytesType:
+			v, length := protowire.ConsumeString(unknown)
+			fields[n] = v
+			unknown = unknown[length:]
+		case protowire.VarintType:
+			v, length := protowire.ConsumeVarint(unknown)
+			fields[n] = int64(v)
+			unknown = unknown[length:]
+		case protowire.Fixed64Type:
+			v, length := protowire.ConsumeFixed64(unknown)
+			fields[n] = math.Float64frombits(v)
+			unknown = unknown[length:]
+		default:
+			s.FailNow("unexpected wire type", "field %d", n)
+		}
+	}
 
-	// Add new data after reset
-	data3 := []types.RealTimeDERData{{
-		ID: "der3",
-		DER: types.DER{
-			ProjectID:         "project3",
-			DerID:             "der3",
-			ContractThreshold: 0.6,
-			IsOnline:          true,
-			CurrentOutput:     30.0,
-		},
-	}}
-	o3 := outcome.New(1, "task1", "project3", data3, 30.0, time.Second)
-	s.cache.Add(o3)
-	s.Len(s.cache.items, 1)
-	s.Contains(s.cache.items, "project3")
+	s.Equal(map[protowire.Number]any{
+		fieldUnits:          "kW",
+		fieldSampleCount:    int64(2),
+		fieldMinOutput:      10.0,
+		fieldMaxOutput:      20.0,
+		fieldStdDevOutput:   avg.StdDevOutput,
+		fieldP50Output:      avg.P50Output,
+		fieldP95Output:      avg.P95Output,
+		fieldFirstReadingAt: s.startTime.Add(time.Minute).Format(time.RFC3339Nano),
+		fieldLastReadingAt:  s.startTime.Add(2 * time.Minute).Format(time.RFC3339Nano),
+		fieldAveraging:      "sample",
+	}, fields)
 }
 
 func TestAvgCacheSuite(t *testing.T) {
@@ -9,6 +9,7 @@ import (
 	"github.com/grid-stream-org/batcher/internal/config"
 	"github.com/grid-stream-org/batcher/internal/outcome"
 	"github.com/grid-stream-org/batcher/internal/types"
+	"github.com/grid-stream-org/batcher/metrics"
 	"github.com/grid-stream-org/go-commons/pkg/validator"
 	"github.com/pkg/errors"
 	"go.uber.org/multierr"
@@ -17,18 +18,20 @@ import (
 type FlushOutcome struct {
 	Outcomes   []outcome.Outcome     `json:"outcomes"`
 	AvgOutputs []types.AverageOutput `json:"average_outputs"`
+	// Late outcomes arrived after their window closed, and are not in any average
+	Late []outcome.Outcome `json:"late"`
 }
 
 type FlushFunc func(ctx context.Context, data *FlushOutcome) error
 
 type Buffer struct {
 	cfg       *config.Buffer
-	mu        sync.Mutex
-	data      []outcome.Outcome
 	vc        validator.ValidatorClient
 	avgCache  *AvgCache
 	flushFunc FlushFunc
 	log       *slog.Logger
+	stop      chan struct{}
+	stopOnce  sync.Once
 	done      chan struct{}
 }
 
@@ -39,23 +42,35 @@ func New(ctx context.Context, cfg *config.Buffer, flushFunc FlushFunc, log *slog
 	}
 	buf := &Buffer{
 		cfg:       cfg,
-		data:      make([]outcome.Outcome, 0),
 		vc:        vc,
 		flushFunc: flushFunc,
 		log:       log.With("component", "buffer"),
-		avgCache:  NewAvgCache(cfg.StartTime, cfg.StartTime.Add(cfg.Interval)),
+		avgCache:  NewAvgCache(cfg.StartTime, cfg.Interval, cfg.AllowedLateness, cfg.Watermark, cfg.Averaging),
+		stop:      make(chan struct{}),
 		done:      make(chan struct{}),
 	}
-	log.Info("buffer initialized", "start_time", cfg.StartTime.Format(time.RFC3339), "interval", cfg.Interval, "offset", cfg.Offset)
+	log.Info("buffer initialized",
+		"start_time", cfg.StartTime.Format(time.RFC3339),
+		"interval", cfg.Interval,
+		"offset", cfg.Offset,
+		"allowed_lateness", cfg.AllowedLateness,
+		"watermark", cfg.Watermark,
+		"averaging", cfg.Averaging.Mode,
+	)
 	return buf, nil
 }
 
 func (b *Buffer) Add(ctx context.Context, data *outcome.Outcome) {
-	b.mu.Lock()
-	b.data = append(b.data, *data)
-	b.mu.Unlock()
-	b.avgCache.Add(data)
-	b.log.Debug("record added to buffer", "buffer_size", len(b.data))
+	if b.avgCache.Add(data) {
+		b.log.Debug("record added to buffer", "open_windows", b.avgCache.Open())
+		return
+	}
+	metrics.Local.Counter(metrics.LateOutcomes).WithLabelValues().Inc()
+	b.log.Warn("outcome arrived after its window closed",
+		"project_id", data.ProjectID,
+		"task_id", data.TaskID,
+		"event_time", data.EventTime().Format(time.RFC3339),
+	)
 }
 
 func (b *Buffer) Start(ctx context.Context) {
@@ -72,10 +87,12 @@ func (b *Buffer) autoFlush(ctx context.Context) {
 		case <-ctx.Done():
 			timer.Stop()
 			b.log.Debug("context canceled, performing final flush")
-			if err := b.Flush(context.Background()); err != nil {
-				b.log.Error("failed to flush buffer during shutdown", "error", err)
-			}
-			close(b.done)
+			b.finalFlush()
+			return
+		case <-b.stop:
+			timer.Stop()
+			b.log.Debug("buffer stopped, performing final flush")
+			b.finalFlush()
 			return
 		case <-timer.C:
 			if err := b.Flush(ctx); err != nil {
@@ -86,7 +103,18 @@ func (b *Buffer) autoFlush(ctx context.Context) {
 	}
 }
 
+// finalFlush closes every window, including those the watermark has not passed yet
+func (b *Buffer) finalFlush() {
+	if err := b.flush(context.Background(), b.avgCache.CloseAll()); err != nil {
+		b.log.Error("failed to flush buffer during shutdown", "error", err)
+	}
+	close(b.done)
+}
+
+// Stop performs the final flush, unless cancelling the context passed to Start already has, and
+// closes the validator connection
 func (b *Buffer) Stop() error {
+	b.stopOnce.Do(func() { close(b.stop) })
 	<-b.done
 	// Close validator connection
 	if err := b.vc.Close(); err != nil {
@@ -95,39 +123,40 @@ func (b *Buffer) Stop() error {
 	return nil
 }
 
+// Flush writes out the windows the watermark has passed, and the outcomes that arrived too late
+// for theirs. They are swapped out before anything is written, so outcomes added during a slow
+// flush land in windows that are still open and are left for the next one
 func (b *Buffer) Flush(parentCtx context.Context) error {
+	watermark := b.avgCache.Watermark(time.Now())
+	return b.flush(parentCtx, b.avgCache.Close(watermark))
+}
+
+func (b *Buffer) flush(parentCtx context.Context, closed *Closed) error {
 	timeoutCtx, timeoutCancel := context.WithTimeout(parentCtx, b.cfg.Offset)
 	defer timeoutCancel()
 
-	currentEndTime := b.avgCache.endTime
-	nextStartTime := currentEndTime
-	nextEndTime := nextStartTime.Add(b.cfg.Interval)
-
-	b.mu.Lock()
-	if len(b.data) == 0 {
-		b.avgCache.Reset(nextStartTime, nextEndTime)
-		b.mu.Unlock()
+	late := closed.Late
+	if len(closed.Outcomes) == 0 && len(late) == 0 {
 		b.log.Info("nothing to flush")
 		return nil
 	}
 
 	totalStart := time.Now()
-	b.log.Debug("starting flush", "data_length", len(b.data))
-	outcomes := b.data
-	b.data = make([]outcome.Outcome, 0, len(b.data))
-	b.mu.Unlock()
+	b.log.Debug("starting flush", "data_length", len(closed.Outcomes), "late", len(late))
 
 	var validatorTime time.Duration
 	var flushTime time.Duration
-	var avgOutputs []types.AverageOutput
 	var validatorErr, flushErr error
 	var wg sync.WaitGroup
 
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
+		if len(closed.Averages) == 0 {
+			return
+		}
 		validatorStart := time.Now()
-		if err := b.vc.SendAverages(timeoutCtx, b.avgCache.GetProtoOutputs()); err != nil {
+		if err := b.vc.SendAverages(timeoutCtx, ProtoOutputs(closed.Averages)); err != nil {
 			validatorErr = errors.WithStack(err)
 		}
 		validatorTime = time.Since(validatorStart)
@@ -135,10 +164,10 @@ func (b *Buffer) Flush(parentCtx context.Context) error {
 
 	go func() {
 		defer wg.Done()
-		avgOutputs = b.avgCache.GetOutputs()
 		data := &FlushOutcome{
-			Outcomes:   outcomes,
-			AvgOutputs: avgOutputs,
+			Outcomes:   closed.Outcomes,
+			AvgOutputs: closed.Averages,
+			Late:       late,
 		}
 		flushStart := time.Now()
 		if err := b.flushFunc(timeoutCtx, data); err != nil {
@@ -149,7 +178,18 @@ func (b *Buffer) Flush(parentCtx context.Context) error {
 
 	wg.Wait()
 
-	b.avgCache.Reset(nextStartTime, nextEndTime)
+	// Outcomes that were not written are released, so that their source delivers them again rather
+	// than holding back everything after them
+	settle := (*outcome.Outcome).Ack
+	if flushErr != nil {
+		settle = (*outcome.Outcome).Release
+	}
+	for i := range closed.Outcomes {
+		settle(&closed.Outcomes[i])
+	}
+	for i := range late {
+		settle(&late[i])
+	}
 
 	if validatorErr != nil || flushErr != nil {
 		return errors.WithStack(multierr.Combine(validatorErr, flushErr))
@@ -157,8 +197,9 @@ func (b *Buffer) Flush(parentCtx context.Context) error {
 
 	totalTime := time.Since(totalStart)
 	b.log.Info("buffer flushed",
-		"outcomes", len(outcomes),
-		"average_outputs", len(avgOutputs),
+		"outcomes", len(closed.Outcomes),
+		"average_outputs", len(closed.Averages),
+		"late_outcomes", len(late),
 		"validator_ms", validatorTime.Milliseconds(),
 		"flush_ms", flushTime.Milliseconds(),
 		"total_ms", totalTime.Milliseconds())
@@ -0,0 +1,207 @@
+package buffer
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/outcome"
+	"github.com/grid-stream-org/batcher/internal/types"
+	"github.com/grid-stream-org/batcher/metrics"
+	pb "github.com/grid-stream-org/grid-stream-protos/gen/validator/v1"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+type validatorFunc func(ctx context.Context, averages []*pb.AverageOutput) error
+
+func (f validatorFunc) SendAverages(ctx context.Context, averages []*pb.AverageOutput) error {
+	return f(ctx, averages)
+}
+
+func (f validatorFunc) Close() error {
+	return nil
+}
+
+type BufferTestSuite struct {
+	suite.Suite
+	startTime time.Time
+}
+
+func (s *BufferTestSuite) SetupSuite() {
+	metrics.InitMetricsProvider()
+}
+
+func (s *BufferTestSuite) SetupTest() {
+	s.startTime = time.Now().Add(-3 * time.Hour).Truncate(time.Hour)
+}
+
+// buffer builds a buffer whose flushes are recorded, with hourly windows
+func (s *BufferTestSuite) buffer(lateness time.Duration, flushed *[]*FlushOutcome, sent *[]*pb.AverageOutput) *Buffer {
+	cfg := &config.Buffer{StartTime: s.startTime, Interval: time.Hour, Offset: time.Second, AllowedLateness: lateness}
+	return &Buffer{
+		cfg: cfg,
+		vc: validatorFunc(func(_ context.Context, averages []*pb.AverageOutput) error {
+			*sent = append(*sent, averages...)
+			return nil
+		}),
+		avgCache: NewAvgCache(cfg.StartTime, cfg.Interval, cfg.AllowedLateness, cfg.Watermark, cfg.Averaging),
+		flushFunc: func(_ context.Context, data *FlushOutcome) error {
+			*flushed = append(*flushed, data)
+			return nil
+		},
+		log:  slog.Default(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+func (s *BufferTestSuite) outcome(offset time.Duration, acks *int) *outcome.Outcome {
+	data := []types.RealTimeDERData{{
+		ID:  "der1",
+		DER: types.DER{ProjectID: "project1", DerID: "der1", Timestamp: s.startTime.Add(offset)},
+	}}
+	o := outcome.New(1, "task1", "project1", data, 10, time.Second)
+	o.SetAck(func() { *acks++ })
+	return o
+}
+
+func (s *BufferTestSuite) late() float64 {
+	return testutil.ToFloat64(metrics.Local.Counter(metrics.LateOutcomes).WithLabelValues())
+}
+
+func (s *BufferTestSuite) TestFlushWindows() {
+	testCases := []struct {
+		name     string
+		lateness time.Duration
+		closed   int
+		open     int
+	}{
+		{name: "no lateness", lateness: 0, closed: 3, open: 1},
+		{name: "lateness keeps the last window open", lateness: 2 * time.Hour, closed: 1, open: 3},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			var flushed []*FlushOutcome
+			var sent []*pb.AverageOutput
+			acks := 0
+			buf := s.buffer(tc.lateness, &flushed, &sent)
+			for i := range 4 {
+				buf.Add(context.Background(), s.outcome(time.Duration(i)*time.Hour+time.Minute, &acks))
+			}
+
+			s.Require().NoError(buf.Flush(context.Background()))
+			s.Require().Len(flushed, 1)
+			s.Len(flushed[0].AvgOutputs, tc.closed)
+			s.Len(sent, tc.closed)
+			s.Equal(tc.closed, acks)
+			s.Equal(tc.open, buf.avgCache.Open())
+		})
+	}
+}
+
+func (s *BufferTestSuite) TestFlushLate() {
+	var flushed []*FlushOutcome
+	var sent []*pb.AverageOutput
+	acks := 0
+	buf := s.buffer(0, &flushed, &sent)
+	buf.Add(context.Background(), s.outcome(time.Minute, &acks))
+	s.Require().NoError(buf.Flush(context.Background()))
+	before := s.late()
+
+	// The first window has closed, so a reading taken in it is late
+	buf.Add(context.Background(), s.outcome(2*time.Minute, &acks))
+	s.Equal(before+1, s.late())
+	s.Require().NoError(buf.Flush(context.Background()))
+
+	s.Require().Len(flushed, 2)
+	s.Empty(flushed[1].AvgOutputs)
+	s.Empty(flushed[1].Outcomes)
+	s.Len(flushed[1].Late, 1)
+	s.Len(sent, 1)
+	s.Equal(2, acks)
+}
+
+func (s *BufferTestSuite) TestFlushDuringArrivals() {
+	var flushed []*FlushOutcome
+	var sent []*pb.AverageOutput
+	acks := 0
+	buf := s.buffer(0, &flushed, &sent)
+	writing := make(chan struct{})
+	release := make(chan struct{})
+	record := buf.flushFunc
+	buf.flushFunc = func(ctx context.Context, data *FlushOutcome) error {
+		if len(flushed) == 0 {
+			close(writing)
+			<-release
+		}
+		return record(ctx, data)
+	}
+
+	// The window of the last hour is still open when the first flush starts
+	current := 3*time.Hour + time.Minute
+	buf.Add(context.Background(), s.outcome(time.Minute, &acks))
+	buf.Add(context.Background(), s.outcome(current, &acks))
+	done := make(chan error)
+	go func() { done <- buf.Flush(context.Background()) }()
+
+	// Arrivals while the sink is slow go to the open window, not the one being written
+	<-writing
+	buf.Add(context.Background(), s.outcome(current+time.Minute, &acks))
+	close(release)
+	s.Require().NoError(<-done)
+	s.Require().Len(flushed, 1)
+	s.Len(flushed[0].Outcomes, 1)
+	s.Require().Len(flushed[0].AvgOutputs, 1)
+	s.Equal(s.startTime, flushed[0].AvgOutputs[0].StartTime)
+	s.Equal(1, acks)
+
+	// Nothing that arrived during the flush was lost
+	s.Equal(1, buf.avgCache.Open())
+	buf.finalFlush()
+	s.Require().Len(flushed, 2)
+	s.Len(flushed[1].Outcomes, 2)
+	s.Require().Len(flushed[1].AvgOutputs, 1)
+	s.Equal(s.startTime.Add(3*time.Hour), flushed[1].AvgOutputs[0].StartTime)
+	s.Equal(3, acks)
+}
+
+func (s *BufferTestSuite) TestFlushFailureReleases() {
+	var flushed []*FlushOutcome
+	var sent []*pb.AverageOutput
+	acks, releases := 0, 0
+	buf := s.buffer(0, &flushed, &sent)
+	record := buf.flushFunc
+	buf.flushFunc = func(ctx context.Context, data *FlushOutcome) error {
+		if releases == 0 {
+			return errors.New("bigquery unavailable")
+		}
+		return record(ctx, data)
+	}
+	deliver := func() {
+		o := s.outcome(time.Minute, &acks)
+		o.SetRelease(func() { releases++ })
+		buf.Add(context.Background(), o)
+	}
+
+	deliver()
+	s.Error(buf.Flush(context.Background()))
+	s.Zero(acks)
+	s.Equal(1, releases)
+
+	// The source delivers the released outcome again, and it is written with the late ones
+	deliver()
+	s.Require().NoError(buf.Flush(context.Background()))
+	s.Require().Len(flushed, 1)
+	s.Len(flushed[0].Late, 1)
+	s.Equal(1, acks)
+	s.Equal(1, releases)
+}
+
+func TestBufferSuite(t *testing.T) {
+	suite.Run(t, new(BufferTestSuite))
+}
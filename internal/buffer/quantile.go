@@ -0,0 +1,101 @@
+package buffer
+
+import (
+	"math"
+	"slices"
+)
+
+// quantile estimates one quantile of a stream in constant memory with the P² algorithm (Jain and
+// Chlamtac, 1985). It keeps five markers whose heights approximate the minimum, the quantile, the
+// maximum and the points halfway to them, and moves them with each sample
+type quantile struct {
+	p    float64
+	n    int
+	q    [5]float64 // marker heights
+	pos  [5]float64 // marker positions
+	want [5]float64 // desired marker positions
+	inc  [5]float64 // how far the desired positions move with each sample
+}
+
+func newQuantile(p float64) *quantile {
+	return &quantile{
+		p:    p,
+		want: [5]float64{1, 1 + 2*p, 1 + 4*p, 3 + 2*p, 5},
+		inc:  [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+func (e *quantile) add(x float64) {
+	// The first five samples are kept as they are, and become the markers
+	if e.n < 5 {
+		e.q[e.n] = x
+		e.n++
+		if e.n == 5 {
+			slices.Sort(e.q[:])
+			e.pos = [5]float64{1, 2, 3, 4, 5}
+		}
+		return
+	}
+	e.n++
+
+	// Find the cell the sample falls in, extending the extremes if it is outside them
+	var k int
+	switch {
+	case x < e.q[0]:
+		e.q[0] = x
+	case x >= e.q[4]:
+		e.q[4] = x
+		k = 3
+	default:
+		for k < 3 && x >= e.q[k+1] {
+			k++
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.pos[i]++
+	}
+	for i := range e.want {
+		e.want[i] += e.inc[i]
+	}
+
+	// Move the middle markers that are a whole position or more from where they should be
+	for i := 1; i <= 3; i++ {
+		d := e.want[i] - e.pos[i]
+		if (d >= 1 && e.pos[i+1]-e.pos[i] > 1) || (d <= -1 && e.pos[i-1]-e.pos[i] < -1) {
+			s := math.Copysign(1, d)
+			if h := e.parabolic(i, s); e.q[i-1] < h && h < e.q[i+1] {
+				e.q[i] = h
+			} else {
+				e.q[i] = e.linear(i, s)
+			}
+			e.pos[i] += s
+		}
+	}
+}
+
+func (e *quantile) parabolic(i int, d float64) float64 {
+	return e.q[i] + d/(e.pos[i+1]-e.pos[i-1])*
+		((e.pos[i]-e.pos[i-1]+d)*(e.q[i+1]-e.q[i])/(e.pos[i+1]-e.pos[i])+
+			(e.pos[i+1]-e.pos[i]-d)*(e.q[i]-e.q[i-1])/(e.pos[i]-e.pos[i-1]))
+}
+
+func (e *quantile) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return e.q[i] + d*(e.q[j]-e.q[i])/(e.pos[j]-e.pos[i])
+}
+
+// value is the estimate, which is exact until there are more than five samples
+func (e *quantile) value() float64 {
+	if e.n == 0 {
+		return 0
+	}
+	if e.n <= 5 {
+		seen := slices.Clone(e.q[:e.n])
+		slices.Sort(seen)
+		rank := e.p * float64(e.n-1)
+		lo := int(math.Floor(rank))
+		hi := int(math.Ceil(rank))
+		return seen[lo] + (rank-float64(lo))*(seen[hi]-seen[lo])
+	}
+	return e.q[2]
+}
@@ -1,34 +1,226 @@
 package buffer
 
 import (
+	"cmp"
+	"math"
+	"slices"
+	"sort"
 	"time"
 
+	"github.com/grid-stream-org/batcher/internal/config"
 	"github.com/grid-stream-org/batcher/internal/outcome"
 	"github.com/grid-stream-org/batcher/internal/types"
+	"github.com/grid-stream-org/batcher/internal/units"
 )
 
+// RunningAvg summarises the net outputs of a project over a window in bounded memory: the mean,
+// count, extremes, standard deviation (Welford's method), the span of reading times and estimates
+// of the median and 95th percentile. Time weighted averaging integrates the samples as they come,
+// holding back up to maxPendingSamples to put them in order. A sample that arrives behind those
+// already integrated still counts toward the other statistics, but is dropped from the weighting.
+// Meter outcomes hold up to maxOpenTasks samples open, and one baseline per meter of the project
 type RunningAvg struct {
-	sum     float64
-	count   int64
-	average *types.AverageOutput
+	sum   float64
+	count int64
+	mean  float64
+	m2    float64
+	min   float64
+	max   float64
+	first time.Time
+	last  time.Time
+	p50   *quantile
+	p95   *quantile
+	// meters holds the samples of tasks split into per meter outcomes, opened in the order of tasks.
+	// The net outputs of a task's meters add up to one sample, which is complete once the window
+	// closes or too many later tasks have been opened
+	meters map[string]*sample
+	tasks  []string
+	// baselines holds the baseline of each meter seen, the project's baseline is their sum
+	baselines map[string]float64
+	averaging *config.Averaging
+	// pending holds the latest samples in time order until they are integrated
+	pending []sample
+	// prev is the last sample integrated, its weight is only known once the next one has been seen
+	prev     *sample
+	weighted float64
+	total    time.Duration
+	dropped  int64
+	average  *types.AverageOutput
 }
 
-func NewRunningAvg(o *outcome.Outcome, startTime time.Time, endTime time.Time, baseline float64) *RunningAvg {
+type sample struct {
+	v  float64
+	at time.Time
+}
+
+// maxPendingSamples bounds how far out of order samples can arrive and still be time weighted
+const maxPendingSamples = 256
+
+// maxOpenTasks bounds the tasks whose meter samples are held open. The outcomes of a task are added
+// together, so once there are more the oldest is taken to be complete
+const maxOpenTasks = 64
+
+// NewRunningAvg starts the statistics for a window. A nil averaging weights every sample the same
+func NewRunningAvg(o *outcome.Outcome, startTime time.Time, endTime time.Time, baseline float64, averaging *config.Averaging) *RunningAvg {
+	if averaging == nil {
+		averaging = &config.Averaging{Mode: "sample"}
+	}
 	return &RunningAvg{
-		sum:   0,
-		count: 0,
+		sum:       0,
+		count:     0,
+		p50:       newQuantile(0.5),
+		p95:       newQuantile(0.95),
+		averaging: averaging,
 		average: &types.AverageOutput{
 			ProjectID:         o.ProjectID,
 			StartTime:         startTime,
 			Baseline:          baseline,
 			ContractThreshold: o.ContractThreshold,
 			EndTime:           endTime,
+			Units:             o.Units,
+			Averaging:         averaging.Mode,
 		},
 	}
 }
 
-func (ra *RunningAvg) Add(v float64) {
+// Add adds one sample, read at the given time
+func (ra *RunningAvg) Add(v float64, at time.Time) {
 	ra.sum += v
 	ra.count++
-	ra.average.AverageOutput = ra.sum / float64(ra.count)
+	delta := v - ra.mean
+	ra.mean += delta / float64(ra.count)
+	ra.m2 += delta * (v - ra.mean)
+	if ra.count == 1 || v < ra.min {
+		ra.min = v
+	}
+	if ra.count == 1 || v > ra.max {
+		ra.max = v
+	}
+	if ra.first.IsZero() || at.Before(ra.first) {
+		ra.first = at
+	}
+	if at.After(ra.last) {
+		ra.last = at
+	}
+	ra.p50.add(v)
+	ra.p95.add(v)
+	if ra.averaging.Mode == "time" {
+		ra.hold(sample{v: v, at: at})
+	}
+}
+
+// hold puts the sample in order with the pending ones, integrating the oldest once there are too many
+func (ra *RunningAvg) hold(s sample) {
+	if ra.prev != nil && s.at.Before(ra.prev.at) {
+		ra.dropped++
+		return
+	}
+	i := sort.Search(len(ra.pending), func(i int) bool { return ra.pending[i].at.After(s.at) })
+	ra.pending = slices.Insert(ra.pending, i, s)
+	if len(ra.pending) > maxPendingSamples {
+		ra.integrate(ra.pending[0])
+		ra.pending = slices.Delete(ra.pending, 0, 1)
+	}
+}
+
+// integrate weights the previous sample by the time until this one
+func (ra *RunningAvg) integrate(s sample) {
+	var valid time.Duration
+	if ra.prev != nil {
+		valid = s.at.Sub(ra.prev.at)
+		ra.weighted += ra.prev.v * valid.Hours()
+	} else if ra.averaging.Edges == "extend" {
+		valid = max(s.at.Sub(ra.average.StartTime), 0)
+		ra.weighted += s.v * valid.Hours()
+	}
+	ra.total += valid
+	ra.prev = &s
+}
+
+// AddMeter adds the net output of the meter outcome o, read at the given time. The meters of a task
+// are summed into one sample, and the baselines of the meters into the project's baseline
+func (ra *RunningAvg) AddMeter(o *outcome.Outcome, at time.Time) {
+	if ra.meters == nil {
+		ra.meters = make(map[string]*sample)
+		ra.baselines = make(map[string]float64)
+	}
+	ra.baselines[o.Meter] = o.Baseline
+	if m, ok := ra.meters[o.TaskID]; ok {
+		m.v += o.NetOutput
+		return
+	}
+	ra.meters[o.TaskID] = &sample{v: o.NetOutput, at: at}
+	ra.tasks = append(ra.tasks, o.TaskID)
+	if len(ra.tasks) > maxOpenTasks {
+		ra.complete(1)
+	}
+}
+
+// complete adds the samples of the n oldest open tasks
+func (ra *RunningAvg) complete(n int) {
+	for _, taskID := range ra.tasks[:n] {
+		m := ra.meters[taskID]
+		delete(ra.meters, taskID)
+		ra.Add(m.v, m.at)
+	}
+	ra.tasks = slices.Delete(ra.tasks, 0, n)
+}
+
+// Output completes the meter samples and returns the statistics
+func (ra *RunningAvg) Output() types.AverageOutput {
+	ra.complete(len(ra.tasks))
+
+	avg := ra.average
+	if len(ra.baselines) > 0 {
+		avg.Baseline = 0
+		for _, b := range ra.baselines {
+			avg.Baseline += b
+		}
+	}
+	avg.SampleCount = ra.count
+	if ra.count == 0 {
+		return *avg
+	}
+	avg.AverageOutput = ra.sum / float64(ra.count)
+	avg.MinOutput = ra.min
+	avg.MaxOutput = ra.max
+	avg.StdDevOutput = 0
+	if ra.count > 1 {
+		avg.StdDevOutput = math.Sqrt(ra.m2 / float64(ra.count-1))
+	}
+	avg.P50Output = ra.p50.value()
+	avg.P95Output = ra.p95.value()
+	avg.FirstReadingAt = ra.first
+	avg.LastReadingAt = ra.last
+	if ra.averaging.Mode == "time" {
+		ra.timeWeighted(avg)
+	}
+	return *avg
+}
+
+// timeWeighted integrates the pending samples and weights the last one up to the window end, unless
+// edges are clipped. When no sample was valid for any time, such as a single sample with clipped
+// edges, the mean of the samples is kept
+func (ra *RunningAvg) timeWeighted(avg *types.AverageOutput) {
+	for _, s := range ra.pending {
+		ra.integrate(s)
+	}
+	ra.pending = nil
+
+	weighted, total := ra.weighted, ra.total
+	if ra.prev != nil && ra.averaging.Edges != "clip" {
+		valid := max(avg.EndTime.Sub(ra.prev.at), 0)
+		weighted += ra.prev.v * valid.Hours()
+		total += valid
+	}
+	avg.DroppedSamples = ra.dropped
+	if total > 0 {
+		avg.AverageOutput = weighted / total.Hours()
+	}
+
+	// Power without units is taken to be in kW, as DERs report it. Energy is left at zero when the
+	// units cannot be converted
+	if energy, err := units.Convert(weighted, cmp.Or(avg.Units, "kW"), "kW"); err == nil {
+		avg.EnergyKWh = energy
+	}
 }
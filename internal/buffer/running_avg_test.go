@@ -1,9 +1,13 @@
 package buffer
 
 import (
+	"fmt"
+	"math"
+	"math/rand/v2"
 	"testing"
 	"time"
 
+	"github.com/grid-stream-org/batcher/internal/config"
 	"github.com/grid-stream-org/batcher/internal/outcome"
 	"github.com/grid-stream-org/batcher/internal/types"
 	"github.com/stretchr/testify/suite"
@@ -34,7 +38,7 @@ func (s *RunningAvgTestSuite) TestNewRunningAvg() {
 		},
 	}}
 	o := outcome.New(1, "task1", "test-project", data, 0, time.Second)
-	ra := NewRunningAvg(o, s.startTime, s.endTime, s.baseline)
+	ra := NewRunningAvg(o, s.startTime, s.endTime, s.baseline, nil)
 
 	s.NotNil(ra)
 	s.Equal(float64(0), ra.sum)
@@ -97,18 +101,211 @@ func (s *RunningAvgTestSuite) TestAdd() {
 				},
 			}}
 			o := outcome.New(1, "task1", "test-project", data, 0, time.Second)
-			ra := NewRunningAvg(o, s.startTime, s.endTime, s.baseline)
+			ra := NewRunningAvg(o, s.startTime, s.endTime, s.baseline, nil)
 
-			for _, v := range tc.values {
-				ra.Add(v)
+			for i, v := range tc.values {
+				ra.Add(v, s.startTime.Add(time.Duration(i)*time.Minute))
 			}
 			s.Equal(tc.expCount, ra.count)
 			s.Equal(tc.expSum, ra.sum)
-			s.Equal(tc.expected, ra.average.AverageOutput)
+			s.Equal(tc.expected, ra.Output().AverageOutput)
 		})
 	}
 }
 
+func (s *RunningAvgTestSuite) TestOutput() {
+	testCases := []struct {
+		name     string
+		values   []float64
+		expected types.AverageOutput
+	}{
+		{
+			name:     "no samples",
+			values:   nil,
+			expected: types.AverageOutput{},
+		},
+		{
+			name:   "single sample",
+			values: []float64{10.0},
+			expected: types.AverageOutput{
+				SampleCount: 1, AverageOutput: 10, MinOutput: 10, MaxOutput: 10, StdDevOutput: 0, P50Output: 10, P95Output: 10,
+			},
+		},
+		{
+			name:   "several samples",
+			values: []float64{2, 4, 4, 4, 5, 5, 7, 9},
+			expected: types.AverageOutput{
+				SampleCount: 8, AverageOutput: 5, MinOutput: 2, MaxOutput: 9, StdDevOutput: math.Sqrt(32.0 / 7),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			ra := NewRunningAvg(&outcome.Outcome{ProjectID: "test-project"}, s.startTime, s.endTime, s.baseline, nil)
+			// Readings arrive out of order
+			for i, v := range tc.values {
+				ra.Add(v, s.startTime.Add(time.Duration(len(tc.values)-i)*time.Minute))
+			}
+
+			out := ra.Output()
+			s.Equal(tc.expected.SampleCount, out.SampleCount)
+			s.Equal(tc.expected.AverageOutput, out.AverageOutput)
+			s.Equal(tc.expected.MinOutput, out.MinOutput)
+			s.Equal(tc.expected.MaxOutput, out.MaxOutput)
+			s.InDelta(tc.expected.StdDevOutput, out.StdDevOutput, 1e-9)
+			if len(tc.values) == 0 {
+				s.True(out.FirstReadingAt.IsZero())
+				return
+			}
+			s.Equal(s.startTime.Add(time.Minute), out.FirstReadingAt)
+			s.Equal(s.startTime.Add(time.Duration(len(tc.values))*time.Minute), out.LastReadingAt)
+			if tc.expected.P50Output != 0 {
+				s.Equal(tc.expected.P50Output, out.P50Output)
+				s.Equal(tc.expected.P95Output, out.P95Output)
+			}
+		})
+	}
+}
+
+func (s *RunningAvgTestSuite) TestQuantiles() {
+	// Shuffled so that the estimate does not depend on the samples arriving in order
+	values := make([]float64, 10_000)
+	for i := range values {
+		values[i] = float64(i + 1)
+	}
+	rand.New(rand.NewPCG(1, 2)).Shuffle(len(values), func(i, j int) { values[i], values[j] = values[j], values[i] })
+
+	ra := NewRunningAvg(&outcome.Outcome{ProjectID: "test-project"}, s.startTime, s.endTime, s.baseline, nil)
+	for _, v := range values {
+		ra.Add(v, s.startTime)
+	}
+	out := ra.Output()
+	s.InEpsilon(5000.0, out.P50Output, 0.02)
+	s.InEpsilon(9500.0, out.P95Output, 0.02)
+
+	small := newQuantile(0.5)
+	for _, v := range []float64{3, 1, 2, 4} {
+		small.add(v)
+	}
+	s.Equal(2.5, small.value()) // exact while there are few samples
+}
+
+func (s *RunningAvgTestSuite) TestAddMeter() {
+	ra := NewRunningAvg(&outcome.Outcome{ProjectID: "test-project"}, s.startTime, s.endTime, s.baseline, nil)
+	ra.AddMeter(&outcome.Outcome{TaskID: "task1", Meter: "test-project/100", NetOutput: 10, Baseline: 40}, s.startTime.Add(time.Minute))
+	ra.AddMeter(&outcome.Outcome{TaskID: "task2", Meter: "test-project/100", NetOutput: 5, Baseline: 40}, s.startTime.Add(2*time.Minute))
+	ra.AddMeter(&outcome.Outcome{TaskID: "task1", Meter: "test-project/200", NetOutput: 20, Baseline: 60}, s.startTime.Add(time.Minute))
+
+	out := ra.Output()
+	s.Equal(int64(2), out.SampleCount)
+	s.Equal(17.5, out.AverageOutput) // (10 + 20 + 5) / 2
+	s.Equal(5.0, out.MinOutput)
+	s.Equal(30.0, out.MaxOutput)
+	s.Equal(100.0, out.Baseline) // 40 + 60
+}
+
+func (s *RunningAvgTestSuite) TestOpenTasksBounded() {
+	ra := NewRunningAvg(&outcome.Outcome{ProjectID: "test-project"}, s.startTime, s.endTime, s.baseline, nil)
+	for i := range maxOpenTasks + 10 {
+		at := s.startTime.Add(time.Duration(i) * time.Second)
+		ra.AddMeter(&outcome.Outcome{TaskID: fmt.Sprintf("task%d", i), Meter: "test-project/100", NetOutput: 1}, at)
+		ra.AddMeter(&outcome.Outcome{TaskID: fmt.Sprintf("task%d", i), Meter: "test-project/200", NetOutput: 2}, at)
+	}
+	s.Len(ra.meters, maxOpenTasks)
+	s.Len(ra.tasks, maxOpenTasks)
+	s.Equal(int64(10), ra.count)
+
+	out := ra.Output()
+	s.Empty(ra.meters)
+	s.Equal(int64(maxOpenTasks+10), out.SampleCount)
+	s.Equal(3.0, out.AverageOutput)
+	s.Equal(3.0, out.MinOutput)
+}
+
+func (s *RunningAvgTestSuite) TestTimeWeighted() {
+	// A gateway bursts ten readings at the start of the period, then reports zero half way through
+	burst := func(from time.Duration) []sample {
+		var samples []sample
+		for i := range 10 {
+			samples = append(samples, sample{v: 100, at: s.startTime.Add(from + time.Duration(i)*time.Second)})
+		}
+		return append(samples, sample{v: 0, at: s.startTime.Add(30 * time.Minute)})
+	}
+
+	testCases := []struct {
+		name     string
+		mode     string
+		edges    string
+		units    string
+		samples  []sample
+		expected float64
+		energy   float64
+	}{
+		{name: "sample mode", mode: "sample", samples: burst(0), expected: 1000.0 / 11, energy: 0},
+		{name: "hold", mode: "time", edges: "hold", samples: burst(0), expected: 50, energy: 50},
+		{name: "hold after a gap", mode: "time", edges: "hold", samples: burst(10 * time.Minute), expected: 40, energy: 100.0 / 3},
+		{name: "clip", mode: "time", edges: "clip", samples: burst(10 * time.Minute), expected: 100, energy: 100.0 / 3},
+		{name: "extend", mode: "time", edges: "extend", samples: burst(10 * time.Minute), expected: 50, energy: 50},
+		{name: "energy in watts", mode: "time", edges: "hold", units: "W", samples: burst(0), expected: 50, energy: 0.05},
+		{
+			name:     "single sample clipped",
+			mode:     "time",
+			edges:    "clip",
+			samples:  []sample{{v: 80, at: s.startTime.Add(time.Minute)}},
+			expected: 80,
+			energy:   0,
+		},
+		{
+			name:  "out of order",
+			mode:  "time",
+			edges: "hold",
+			samples: []sample{
+				{v: 0, at: s.startTime.Add(45 * time.Minute)},
+				{v: 60, at: s.startTime},
+			},
+			expected: 45,
+			energy:   45,
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			averaging := &config.Averaging{Mode: tc.mode, Edges: tc.edges}
+			ra := NewRunningAvg(&outcome.Outcome{ProjectID: "test-project", Units: tc.units}, s.startTime, s.endTime, s.baseline, averaging)
+			for _, smp := range tc.samples {
+				ra.Add(smp.v, smp.at)
+			}
+
+			out := ra.Output()
+			s.Equal(tc.mode, out.Averaging)
+			s.InDelta(tc.expected, out.AverageOutput, 1e-9)
+			s.InDelta(tc.energy, out.EnergyKWh, 1e-9)
+			s.Equal(int64(len(tc.samples)), out.SampleCount)
+		})
+	}
+}
+
+func (s *RunningAvgTestSuite) TestTimeWeightedBounded() {
+	averaging := &config.Averaging{Mode: "time", Edges: "clip"}
+	ra := NewRunningAvg(&outcome.Outcome{ProjectID: "test-project"}, s.startTime, s.endTime, s.baseline, averaging)
+	for i := range maxPendingSamples + 10 {
+		ra.Add(10, s.startTime.Add(time.Duration(i+1)*time.Second))
+	}
+	s.Len(ra.pending, maxPendingSamples)
+
+	// Behind the samples already integrated, so it is left out of the weighting
+	ra.Add(1000, s.startTime)
+	// Still within the pending samples, so it is put in order
+	ra.Add(10, s.startTime.Add(100*time.Second+time.Millisecond))
+
+	out := ra.Output()
+	s.Equal(int64(maxPendingSamples+12), out.SampleCount)
+	s.Equal(int64(1), out.DroppedSamples)
+	s.InDelta(10.0, out.AverageOutput, 1e-9)
+	s.Equal(1000.0, out.MaxOutput)
+}
+
 func TestRunningAvgSuite(t *testing.T) {
 	suite.Run(t, new(RunningAvgTestSuite))
 }
@@ -0,0 +1,138 @@
+package capture
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/stretchr/testify/suite"
+)
+
+type CaptureTestSuite struct {
+	suite.Suite
+	dir string
+	now time.Time
+}
+
+func (s *CaptureTestSuite) SetupTest() {
+	s.dir = s.T().TempDir()
+	s.now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func (s *CaptureTestSuite) newWriter(cfg *config.Capture) *Writer {
+	cfg.Dir = s.dir
+	w, err := NewWriter(cfg, slog.Default())
+	s.Require().NoError(err)
+	w.now = func() time.Time { return s.now }
+	return w
+}
+
+func (s *CaptureTestSuite) readAll(path string) []task.Record {
+	r, err := Open(path)
+	s.Require().NoError(err)
+	defer r.Close()
+
+	var records []task.Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records
+		}
+		s.Require().NoError(err)
+		records = append(records, rec)
+	}
+}
+
+func (s *CaptureTestSuite) record(payload string) task.Record {
+	t := task.NewTaskWithMetadata([]byte(payload), task.Metadata{Topic: "grid/project1/ders"})
+	return t.Record()
+}
+
+func (s *CaptureTestSuite) TestRoundTrip() {
+	w := s.newWriter(&config.Capture{RotateInterval: time.Hour, MaxFileBytes: 1 << 20})
+	written := []task.Record{s.record(`[{"der_id":"der1"}]`), s.record(`not json`)}
+	for _, rec := range written {
+		s.NoError(w.Write(rec))
+	}
+
+	// Nothing is listed until the archive is complete
+	archives, err := List(s.dir)
+	s.NoError(err)
+	s.Empty(archives)
+
+	s.NoError(w.Close())
+	s.Error(w.Write(written[0]))
+
+	archives, err = Archives(s.dir)
+	s.NoError(err)
+	s.Require().Len(archives, 1)
+
+	read := s.readAll(archives[0])
+	s.Require().Len(read, len(written))
+	for i := range written {
+		s.Equal(written[i].ID, read[i].ID)
+		s.Equal(written[i].Payload, read[i].Payload)
+		s.Equal(written[i].Metadata, read[i].Metadata)
+		s.True(written[i].ReceivedAt.Equal(read[i].ReceivedAt))
+	}
+}
+
+func (s *CaptureTestSuite) TestRotation() {
+	testCases := []struct {
+		name     string
+		cfg      *config.Capture
+		step     time.Duration
+		archives int
+	}{
+		{name: "by interval", cfg: &config.Capture{RotateInterval: time.Minute, MaxFileBytes: 1 << 20}, step: 30 * time.Second, archives: 2},
+		{name: "by size", cfg: &config.Capture{RotateInterval: time.Hour, MaxFileBytes: 1}, step: time.Millisecond, archives: 4},
+		{name: "pruned", cfg: &config.Capture{RotateInterval: time.Hour, MaxFileBytes: 1, MaxFiles: 2}, step: time.Millisecond, archives: 2},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+			w := s.newWriter(tc.cfg)
+			for i := 0; i < 4; i++ {
+				s.NoError(w.Write(s.record(`[]`)))
+				s.now = s.now.Add(tc.step)
+			}
+			s.NoError(w.Close())
+
+			archives, err := List(s.dir)
+			s.NoError(err)
+			s.Len(archives, tc.archives)
+
+			partial, err := filepath.Glob(filepath.Join(s.dir, "*"+partialExt))
+			s.NoError(err)
+			s.Empty(partial)
+		})
+	}
+}
+
+func (s *CaptureTestSuite) TestArchives() {
+	_, err := Archives(filepath.Join(s.dir, "missing"))
+	s.Error(err)
+
+	_, err = Archives(s.dir)
+	s.ErrorContains(err, "no capture archives found")
+
+	path := filepath.Join(s.dir, "single.jsonl")
+	s.Require().NoError(os.WriteFile(path, []byte(`{"id":"a","payload":"W10="}`+"\n"), 0o644))
+	archives, err := Archives(path)
+	s.NoError(err)
+	s.Equal([]string{path}, archives)
+
+	read := s.readAll(path)
+	s.Require().Len(read, 1)
+	s.Equal([]byte("[]"), read[0].Payload)
+}
+
+func TestCaptureSuite(t *testing.T) {
+	suite.Run(t, new(CaptureTestSuite))
+}
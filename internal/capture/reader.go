@@ -0,0 +1,97 @@
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/pkg/errors"
+)
+
+// maxRecordBytes bounds a single archived line, payloads are base64 encoded so this leaves room for
+// roughly 12MB of raw payload
+const maxRecordBytes = 16 << 20
+
+// Reader reads task records back from a single archive, in the order they were written
+type Reader struct {
+	file    *os.File
+	gz      *gzip.Reader
+	scanner *bufio.Scanner
+	line    int
+}
+
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open capture archive")
+	}
+
+	r := &Reader{file: f}
+	var src io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close() // best effort cleanup
+			return nil, errors.Wrapf(err, "failed to read capture archive %s", path)
+		}
+		r.gz = gz
+		src = gz
+	}
+	r.scanner = bufio.NewScanner(src)
+	r.scanner.Buffer(make([]byte, 0, 64*1024), maxRecordBytes)
+	return r, nil
+}
+
+// Next returns the next record, or io.EOF once the archive is exhausted
+func (r *Reader) Next() (task.Record, error) {
+	var rec task.Record
+	for r.scanner.Scan() {
+		r.line++
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return rec, errors.Wrapf(err, "invalid capture record on line %d", r.line)
+		}
+		return rec, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return rec, errors.Wrapf(err, "failed to read capture record after line %d", r.line)
+	}
+	return rec, io.EOF
+}
+
+func (r *Reader) Close() error {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	if err := r.file.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Archives resolves path to the archives it names, either a single file or every completed
+// archive in a directory, oldest first
+func Archives(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	archives, err := List(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(archives) == 0 {
+		return nil, errors.Errorf("no capture archives found in %s", path)
+	}
+	return archives, nil
+}
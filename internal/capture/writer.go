@@ -0,0 +1,179 @@
+package capture
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Archives are written under a temporary name and renamed once closed, so a replay of the
+	// capture directory never reads a file that is still being written
+	archiveExt = ".jsonl.gz"
+	partialExt = ".partial"
+)
+
+// Writer appends task records to gzip compressed JSONL archives, rotating to a new archive once the
+// current one is too old or too large
+type Writer struct {
+	cfg      *config.Capture
+	mu       sync.Mutex
+	file     *os.File
+	gz       *gzip.Writer
+	enc      *json.Encoder
+	path     string
+	written  int64
+	openedAt time.Time
+	closed   bool
+	now      func() time.Time
+	log      *slog.Logger
+}
+
+func NewWriter(cfg *config.Capture, log *slog.Logger) (*Writer, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "failed to create capture directory")
+	}
+	w := &Writer{
+		cfg: cfg,
+		now: time.Now,
+		log: log.With("component", "capture", "dir", cfg.Dir),
+	}
+	w.log.Info("capture writer created",
+		"rotate_interval", cfg.RotateInterval.String(),
+		"max_file_bytes", cfg.MaxFileBytes,
+		"max_files", cfg.MaxFiles,
+	)
+	return w, nil
+}
+
+func (w *Writer) Write(r task.Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return errors.New("capture writer is closed")
+	}
+	if w.file != nil && w.due() {
+		if err := w.rotate(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err := w.enc.Encode(r); err != nil {
+		return errors.Wrap(err, "failed to write capture record")
+	}
+	return nil
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return w.rotate()
+}
+
+func (w *Writer) due() bool {
+	return w.written >= w.cfg.MaxFileBytes || w.now().Sub(w.openedAt) >= w.cfg.RotateInterval
+}
+
+func (w *Writer) open() error {
+	w.openedAt = w.now()
+	w.path = filepath.Join(w.cfg.Dir, fmt.Sprintf("capture-%s%s", w.openedAt.UTC().Format("20060102T150405.000000000Z"), archiveExt))
+
+	f, err := os.OpenFile(w.path+partialExt, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "failed to create capture archive")
+	}
+	w.file = f
+	w.gz = gzip.NewWriter(f)
+	w.enc = json.NewEncoder(countingWriter{w: w.gz, n: &w.written})
+	w.written = 0
+	w.log.Debug("opened capture archive", "path", w.path)
+	return nil
+}
+
+func (w *Writer) rotate() error {
+	if err := w.finish(); err != nil {
+		return errors.WithStack(err)
+	}
+	w.prune()
+	return nil
+}
+
+// finish flushes and closes the current archive and moves it to its final name
+func (w *Writer) finish() error {
+	if w.file == nil {
+		return nil
+	}
+	f, gz := w.file, w.gz
+	w.file, w.gz, w.enc = nil, nil, nil
+
+	if err := gz.Close(); err != nil {
+		f.Close() // best effort cleanup
+		return errors.Wrap(err, "failed to flush capture archive")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close capture archive")
+	}
+	if err := os.Rename(w.path+partialExt, w.path); err != nil {
+		return errors.Wrap(err, "failed to finalize capture archive")
+	}
+	w.log.Info("capture archive complete", "path", w.path, "bytes", w.written)
+	return nil
+}
+
+// prune removes the oldest archives beyond the configured limit
+func (w *Writer) prune() {
+	if w.cfg.MaxFiles == 0 {
+		return
+	}
+	archives, err := List(w.cfg.Dir)
+	if err != nil {
+		w.log.Warn("failed to list capture archives", "error", err)
+		return
+	}
+	for len(archives) > w.cfg.MaxFiles {
+		if err := os.Remove(archives[0]); err != nil {
+			w.log.Warn("failed to remove capture archive", "path", archives[0], "error", err)
+		}
+		archives = archives[1:]
+	}
+}
+
+// List returns the completed archives in dir, oldest first
+func List(dir string) ([]string, error) {
+	archives, err := filepath.Glob(filepath.Join(dir, "*"+archiveExt))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Archive names embed the time they were opened, so lexical order is chronological
+	slices.Sort(archives)
+	return archives, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
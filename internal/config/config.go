@@ -4,8 +4,10 @@ import (
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"time"
 
+	"github.com/grid-stream-org/batcher/internal/topic"
 	"github.com/grid-stream-org/go-commons/pkg/bqclient"
 	"github.com/grid-stream-org/go-commons/pkg/logger"
 	"github.com/grid-stream-org/go-commons/pkg/validator"
@@ -16,42 +18,242 @@ import (
 )
 
 type Config struct {
-	Batcher     *Batcher       `koanf:"batcher"`
-	Pool        *Pool          `koanf:"pool"`
-	Destination *Destination   `koanf:"destination"`
-	MQTT        *MQTT          `koanf:"mqtt"`
-	Log         *logger.Config `koanf:"log"`
+	Batcher      *Batcher                `koanf:"batcher"`
+	Pool         *Pool                   `koanf:"pool"`
+	Destination  *Destination            `koanf:"destination"`
+	Destinations map[string]*Destination `koanf:"destinations"`
+	Routes       []*Route                `koanf:"routes"`
+	MQTT         *MQTT                   `koanf:"mqtt"`
+	Sources      *Sources                `koanf:"sources"`
+	Capture      *Capture                `koanf:"capture"`
+	DeadLetter   *DeadLetter             `koanf:"dead_letter"`
+	Log          *logger.Config          `koanf:"log"`
 }
 
+// DefaultDestination is the name given to the top level destination, which receives any task
+// that no route claims
+const DefaultDestination = "default"
+
 type Batcher struct {
 	Timeout time.Duration `koanf:"timeout"`
+	// DrainTimeout bounds how long shutdown waits for queued tasks, those left are persisted
+	DrainTimeout time.Duration `koanf:"drain_timeout"`
 }
 
 type Pool struct {
-	NumWorkers int `koanf:"num_workers"`
-	Capacity   int `koanf:"capacity"`
+	NumWorkers int         `koanf:"num_workers"`
+	Capacity   int         `koanf:"capacity"`
+	Overflow   string      `koanf:"overflow"`
+	SpillDir   string      `koanf:"spill_dir"`
+	Ordering   *Ordering   `koanf:"ordering"`
+	Autoscale  *Autoscale  `koanf:"autoscale"`
+	Dedup      *Dedup      `koanf:"dedup"`
+	Validation *Validation `koanf:"validation"`
+	// TaskTimeout bounds how long a worker spends on one task, including destination retries
+	TaskTimeout time.Duration `koanf:"task_timeout"`
+	// MaxAbandonedWrites bounds the destination writes left running after their task timed out,
+	// further writes are refused until some of them return
+	MaxAbandonedWrites int `koanf:"max_abandoned_writes"`
+	// GroupBy splits a payload into one outcome per project, or per site meter within a project as
+	// named by the meter_id of each DER
+	GroupBy string `koanf:"group_by"`
+	// Units is the canonical power unit DERs are converted to before their outcomes are built. When
+	// it is not set DERs are taken as they are
+	Units     string     `koanf:"units"`
+	NetOutput *NetOutput `koanf:"net_output"`
+}
+
+// Ordering keeps tasks that share a key in arrival order, by processing them all on one worker.
+// The key is the project ID of the payload, or a segment of the topic template
+type Ordering struct {
+	Key     string `koanf:"key"`
+	Segment string `koanf:"segment"`
+}
+
+// Autoscale grows the pool while tasks queue up, aiming for target_depth queued tasks per worker,
+// and shrinks it again once the queue drains. Scaling up is held back while the average destination
+// write takes longer than max_latency, as more workers would only add to the load on it
+type Autoscale struct {
+	MinWorkers        int           `koanf:"min_workers"`
+	MaxWorkers        int           `koanf:"max_workers"`
+	Interval          time.Duration `koanf:"interval"`
+	TargetDepth       int           `koanf:"target_depth"`
+	MaxLatency        time.Duration `koanf:"max_latency"`
+	ScaleUpCooldown   time.Duration `koanf:"scale_up_cooldown"`
+	ScaleDownCooldown time.Duration `koanf:"scale_down_cooldown"`
+}
+
+// Dedup drops DERs already seen within the window, keyed on DER ID and timestamp. At most
+// max_entries keys are remembered, and they are kept at path across restarts when it is set. The
+// keys are saved every save_interval, so a crash only forgets those seen since the last save
+type Dedup struct {
+	Window       time.Duration `koanf:"window"`
+	MaxEntries   int           `koanf:"max_entries"`
+	Path         string        `koanf:"path"`
+	SaveInterval time.Duration `koanf:"save_interval"`
+}
+
+// Validation checks every DER of a payload against the rules before its outcome is built
+type Validation struct {
+	Rules []*Rule `koanf:"rules"`
+}
+
+// Rule checks one DER field, named as in the payload. A range check takes min and/or max, an enum
+// check takes values, a required check needs a non-empty value and a skew check bounds how far a
+// timestamp may be ahead of or behind the time it is processed. A rule that fails either rejects
+// the payload, flags it in logs and metrics, or clamps the value into bounds (range and skew only).
+// The name is the reason reported for it, and defaults to the field and check
+type Rule struct {
+	Name      string        `koanf:"name"`
+	Field     string        `koanf:"field"`
+	Check     string        `koanf:"check"`
+	Min       *float64      `koanf:"min"`
+	Max       *float64      `koanf:"max"`
+	Values    []string      `koanf:"values"`
+	MaxAhead  time.Duration `koanf:"max_ahead"`
+	MaxBehind time.Duration `koanf:"max_behind"`
+	Action    string        `koanf:"action"`
+}
+
+// NetOutput picks how each DER counts against the site meter reading when net output is computed.
+// A DER uses the strategy for its type, or the default strategy. A project can set its own default
+// and types, which are tried before the top level ones
+type NetOutput struct {
+	Default  string                `koanf:"default"`
+	Types    map[string]string     `koanf:"types"`
+	Projects map[string]*NetOutput `koanf:"projects"`
 }
 
 type Destination struct {
 	Type     string           `koanf:"type"`
 	Buffer   *Buffer          `koanf:"buffer"`
 	Database *bqclient.Config `koanf:"database"`
+	Retry    *Retry           `koanf:"retry"`
+	Breaker  *Breaker         `koanf:"breaker"`
+}
+
+// Retry controls how often a failed destination write is retried, with exponential backoff
+type Retry struct {
+	MaxAttempts    int           `koanf:"max_attempts"`
+	InitialBackoff time.Duration `koanf:"initial_backoff"`
+	MaxBackoff     time.Duration `koanf:"max_backoff"`
+	Multiplier     float64       `koanf:"multiplier"`
+	Jitter         float64       `koanf:"jitter"`
+}
+
+// Breaker stops writing to a destination after repeated failures and sends outcomes to the
+// fallback until the open timeout has passed
+type Breaker struct {
+	FailureThreshold int           `koanf:"failure_threshold"`
+	OpenTimeout      time.Duration `koanf:"open_timeout"`
+	Fallback         string        `koanf:"fallback"`
+	FallbackPath     string        `koanf:"fallback_path"`
+}
+
+type Route struct {
+	Topic       string `koanf:"topic"`
+	Destination string `koanf:"destination"`
 }
 
 type Buffer struct {
 	StartTime time.Time
-	Interval  time.Duration     `koanf:"interval"`
-	Offset    time.Duration     `koanf:"offset"`
+	Interval  time.Duration `koanf:"interval"`
+	Offset    time.Duration `koanf:"offset"`
+	// AllowedLateness keeps a window open for readings that arrive after it has ended. Readings that
+	// arrive later still are written to the late table instead
+	AllowedLateness time.Duration `koanf:"allowed_lateness"`
+	// Watermark decides when windows close. The clock closes them as time passes, event closes them
+	// as readings from later windows arrive, which suits replaying archives of old readings
+	Watermark string            `koanf:"watermark"`
+	LateTable string            `koanf:"late_table"`
+	Averaging *Averaging        `koanf:"averaging"`
 	Validator *validator.Config `koanf:"validator"`
 }
 
+// Averaging picks how samples are weighted in a window. In sample mode every sample counts the
+// same. In time mode each sample counts for the time it was valid, until the next one, and power is
+// integrated into energy. Edges decide what happens at the window boundaries: hold keeps the last
+// sample valid until the window ends, clip counts only the time between the first and last sample,
+// and extend also takes the first sample back to the window start
+type Averaging struct {
+	Mode  string `koanf:"mode"`
+	Edges string `koanf:"edges"`
+}
+
 type MQTT struct {
-	Host     string `koanf:"host"`
-	Port     int    `koanf:"port"`
-	Username string `koanf:"username"`
-	Password string `koanf:"password"`
-	QoS      int    `koanf:"qos"`
-	Topic    string `koanf:"topic"`
+	Host            string          `koanf:"host"`
+	Port            int             `koanf:"port"`
+	Username        string          `koanf:"username"`
+	Password        string          `koanf:"password"`
+	QoS             int             `koanf:"qos"`
+	Topic           string          `koanf:"topic"`
+	Subscriptions   []*Subscription `koanf:"subscriptions"`
+	Transport       string          `koanf:"transport"`
+	TLS             *TLS            `koanf:"tls"`
+	ProtocolVersion int             `koanf:"protocol_version"`
+	ShareGroup      string          `koanf:"share_group"`
+	Delivery        string          `koanf:"delivery"`
+	Session         *Session        `koanf:"session"`
+}
+
+type Sources struct {
+	HTTP       *HTTPSource       `koanf:"http"`
+	Replay     *ReplaySource     `koanf:"replay"`
+	DeadLetter *DeadLetterSource `koanf:"dead_letter"`
+}
+
+type HTTPSource struct {
+	Addr         string   `koanf:"addr"`
+	Path         string   `koanf:"path"`
+	Topic        string   `koanf:"topic"`
+	Tokens       []string `koanf:"tokens"`
+	CertFile     string   `koanf:"cert_file"`
+	KeyFile      string   `koanf:"key_file"`
+	MaxBodyBytes int64    `koanf:"max_body_bytes"`
+}
+
+type ReplaySource struct {
+	Path   string  `koanf:"path"`
+	Pace   string  `koanf:"pace"`
+	Factor float64 `koanf:"factor"`
+}
+
+// DeadLetterSource replays dead letter entries, every entry when IDs is empty
+type DeadLetterSource struct {
+	IDs []string `koanf:"ids"`
+}
+
+// DeadLetter keeps tasks that could not be processed so that they can be inspected and replayed
+type DeadLetter struct {
+	Dir string `koanf:"dir"`
+}
+
+// Capture archives every received payload so that traffic can be replayed later
+type Capture struct {
+	Dir            string        `koanf:"dir"`
+	RotateInterval time.Duration `koanf:"rotate_interval"`
+	MaxFileBytes   int64         `koanf:"max_file_bytes"`
+	MaxFiles       int           `koanf:"max_files"`
+}
+
+type Subscription struct {
+	Topic string `koanf:"topic"`
+	QoS   int    `koanf:"qos"`
+}
+
+type Session struct {
+	ClientID string        `koanf:"client_id"`
+	StoreDir string        `koanf:"store_dir"`
+	Expiry   time.Duration `koanf:"expiry"`
+}
+
+type TLS struct {
+	CAFile             string `koanf:"ca_file"`
+	CertFile           string `koanf:"cert_file"`
+	KeyFile            string `koanf:"key_file"`
+	ServerName         string `koanf:"server_name"`
+	MinVersion         string `koanf:"min_version"`
+	InsecureSkipVerify bool   `koanf:"insecure_skip_verify"`
 }
 
 func Load() (*Config, error) {
@@ -85,17 +287,34 @@ func (c *Config) Validate() error {
 	if c.Pool.Capacity < 0 {
 		c.Pool.Capacity = 0
 	}
+	if err := c.Pool.validate(); err != nil {
+		return errors.WithStack(err)
+	}
 
 	if c.Batcher == nil {
 		c.Batcher = &Batcher{Timeout: 0}
 	}
+	if c.Batcher.DrainTimeout < 0 {
+		return errors.New("batcher drain_timeout cannot be negative")
+	}
+	if c.Batcher.DrainTimeout == 0 {
+		c.Batcher.DrainTimeout = 30 * time.Second
+	}
 
-	if err := c.Destination.validate(); err != nil {
+	if err := c.validateDestinations(); err != nil {
 		return errors.WithStack(err)
 	}
-	if err := c.MQTT.validate(); err != nil {
+	if err := c.validateSources(); err != nil {
 		return errors.WithStack(err)
 	}
+	if c.Capture != nil {
+		if err := c.Capture.validate(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if c.DeadLetter != nil && c.DeadLetter.Dir == "" {
+		return errors.New("dead letter dir is required")
+	}
 	if err := c.Log.Validate(); err != nil {
 		return errors.WithStack(err)
 	}
@@ -103,6 +322,371 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+func (p *Pool) validate() error {
+	if p.TaskTimeout < 0 {
+		return errors.New("pool task_timeout cannot be negative")
+	}
+	if p.TaskTimeout == 0 {
+		p.TaskTimeout = 30 * time.Second
+	}
+	if p.MaxAbandonedWrites < 0 {
+		return errors.New("pool max_abandoned_writes cannot be negative")
+	}
+	if p.MaxAbandonedWrites == 0 {
+		p.MaxAbandonedWrites = 100
+	}
+	if p.GroupBy == "" {
+		p.GroupBy = "project"
+	}
+	if !slices.Contains([]string{"project", "meter"}, p.GroupBy) {
+		return errors.Errorf("invalid pool group_by: %s", p.GroupBy)
+	}
+	if p.Units != "" && !slices.Contains([]string{"W", "kW", "MW"}, p.Units) {
+		return errors.Errorf("invalid pool units: %s", p.Units)
+	}
+	if p.NetOutput == nil {
+		p.NetOutput = &NetOutput{}
+	}
+	if err := p.NetOutput.validate(true); err != nil {
+		return errors.WithStack(err)
+	}
+	if p.Dedup == nil {
+		p.Dedup = &Dedup{}
+	}
+	if err := p.Dedup.validate(); err != nil {
+		return errors.WithStack(err)
+	}
+	if p.Overflow == "" {
+		p.Overflow = "block"
+	}
+	if !slices.Contains([]string{"block", "drop_newest", "drop_oldest", "spill"}, p.Overflow) {
+		return errors.Errorf("invalid pool overflow policy: %s", p.Overflow)
+	}
+	if p.Overflow != "block" && p.Capacity == 0 {
+		return errors.Errorf("pool overflow policy %s requires a capacity", p.Overflow)
+	}
+	if p.Overflow == "spill" && p.SpillDir == "" {
+		return errors.New("spill overflow policy requires a spill_dir")
+	}
+	if p.Overflow != "spill" && p.SpillDir != "" {
+		return errors.New("spill_dir requires the spill overflow policy")
+	}
+	if p.Ordering != nil {
+		if err := p.Ordering.validate(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if p.Validation != nil {
+		if err := p.Validation.validate(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if p.Autoscale != nil {
+		// Lanes are fixed to the number of workers, resizing would move keys between lanes
+		if p.Ordering != nil {
+			return errors.New("pool autoscale cannot be combined with ordering")
+		}
+		if p.Capacity == 0 {
+			return errors.New("pool autoscale requires a capacity")
+		}
+		if err := p.Autoscale.validate(); err != nil {
+			return errors.WithStack(err)
+		}
+		p.NumWorkers = min(max(p.NumWorkers, p.Autoscale.MinWorkers), p.Autoscale.MaxWorkers)
+	}
+	return nil
+}
+
+func (n *NetOutput) validate(top bool) error {
+	if n.Default == "" && top {
+		n.Default = "output"
+	}
+	strategies := []string{"output", "generation", "storage", "load"}
+	if n.Default != "" && !slices.Contains(strategies, n.Default) {
+		return errors.Errorf("invalid net output strategy: %s", n.Default)
+	}
+	for t, s := range n.Types {
+		if !slices.Contains(strategies, s) {
+			return errors.Errorf("invalid net output strategy for type %s: %s", t, s)
+		}
+	}
+	if len(n.Projects) > 0 && !top {
+		return errors.New("net output projects cannot be nested")
+	}
+	for id, p := range n.Projects {
+		if p == nil {
+			return errors.Errorf("net output project %s is empty", id)
+		}
+		if err := p.validate(false); err != nil {
+			return errors.Wrapf(err, "net output project %s", id)
+		}
+	}
+	return nil
+}
+
+func (v *Validation) validate() error {
+	names := make(map[string]bool, len(v.Rules))
+	for i, r := range v.Rules {
+		if err := r.validate(); err != nil {
+			return errors.Wrapf(err, "validation rule %d", i)
+		}
+		if names[r.Name] {
+			return errors.Errorf("duplicate validation rule name: %s", r.Name)
+		}
+		names[r.Name] = true
+	}
+	return nil
+}
+
+func (r *Rule) validate() error {
+	if r.Field == "" {
+		return errors.New("field is required")
+	}
+	if r.Name == "" {
+		r.Name = r.Field + "_" + r.Check
+	}
+	if r.Action == "" {
+		r.Action = "reject"
+	}
+	if !slices.Contains([]string{"reject", "flag", "clamp"}, r.Action) {
+		return errors.Errorf("invalid action: %s", r.Action)
+	}
+
+	switch r.Check {
+	case "range":
+		if r.Min == nil && r.Max == nil {
+			return errors.New("range check requires min or max")
+		}
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			return errors.New("range min must not be greater than max")
+		}
+	case "required":
+	case "enum":
+		if len(r.Values) == 0 {
+			return errors.New("enum check requires values")
+		}
+	case "skew":
+		if r.MaxAhead < 0 || r.MaxBehind < 0 {
+			return errors.New("skew bounds cannot be negative")
+		}
+		if r.MaxAhead == 0 && r.MaxBehind == 0 {
+			return errors.New("skew check requires max_ahead or max_behind")
+		}
+	default:
+		return errors.Errorf("invalid check: %s", r.Check)
+	}
+	if r.Action == "clamp" && r.Check != "range" && r.Check != "skew" {
+		return errors.Errorf("%s check cannot clamp", r.Check)
+	}
+	return nil
+}
+
+func (d *Dedup) validate() error {
+	if d.Window < 0 || d.MaxEntries < 0 || d.SaveInterval < 0 {
+		return errors.New("dedup window, max_entries and save_interval cannot be negative")
+	}
+	if d.Window == 0 {
+		d.Window = 5 * time.Minute
+	}
+	if d.MaxEntries == 0 {
+		d.MaxEntries = 100_000
+	}
+	if d.SaveInterval == 0 {
+		d.SaveInterval = 30 * time.Second
+	}
+	return nil
+}
+
+func (a *Autoscale) validate() error {
+	if a.MinWorkers < 1 {
+		a.MinWorkers = 1
+	}
+	if a.MaxWorkers < a.MinWorkers {
+		return errors.New("autoscale max_workers must not be less than min_workers")
+	}
+	if a.Interval < 0 || a.MaxLatency < 0 || a.ScaleUpCooldown < 0 || a.ScaleDownCooldown < 0 {
+		return errors.New("autoscale durations cannot be negative")
+	}
+	if a.Interval == 0 {
+		a.Interval = 5 * time.Second
+	}
+	if a.TargetDepth < 0 {
+		return errors.New("autoscale target_depth cannot be negative")
+	}
+	if a.TargetDepth == 0 {
+		a.TargetDepth = 10
+	}
+	if a.ScaleUpCooldown == 0 {
+		a.ScaleUpCooldown = 15 * time.Second
+	}
+	if a.ScaleDownCooldown == 0 {
+		a.ScaleDownCooldown = time.Minute
+	}
+	return nil
+}
+
+func (o *Ordering) validate() error {
+	if o.Key == "" {
+		o.Key = "project"
+	}
+	switch o.Key {
+	case "project":
+		if o.Segment != "" {
+			return errors.New("ordering segment requires the segment key")
+		}
+	case "segment":
+		if o.Segment == "" {
+			return errors.New("ordering by segment requires a segment name")
+		}
+	default:
+		return errors.Errorf("invalid ordering key: %s", o.Key)
+	}
+	return nil
+}
+
+func (c *Config) validateDestinations() error {
+	if c.Destinations == nil {
+		c.Destinations = make(map[string]*Destination)
+	}
+	if c.Destination != nil {
+		if d, ok := c.Destinations[DefaultDestination]; ok && d != c.Destination {
+			return errors.Errorf("destination name %q is reserved for the top level destination", DefaultDestination)
+		}
+		c.Destinations[DefaultDestination] = c.Destination
+	}
+	if len(c.Destinations) == 0 {
+		return errors.New("at least one destination is required")
+	}
+
+	for name, d := range c.Destinations {
+		if d == nil {
+			return errors.Errorf("destination %s has no configuration", name)
+		}
+		if err := d.validate(); err != nil {
+			return errors.Wrapf(err, "destination %s", name)
+		}
+	}
+
+	for _, r := range c.Routes {
+		if err := topic.ValidateFilter(r.Topic); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, ok := c.Destinations[r.Destination]; !ok {
+			return errors.Errorf("route for %s references unknown destination %q", r.Topic, r.Destination)
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validateSources() error {
+	if c.Sources == nil {
+		c.Sources = &Sources{}
+	}
+	if c.MQTT == nil && c.Sources.HTTP == nil && c.Sources.Replay == nil && c.Sources.DeadLetter == nil {
+		return errors.New("at least one source is required")
+	}
+
+	if c.MQTT != nil {
+		if err := c.MQTT.validate(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if c.Sources.HTTP != nil {
+		if err := c.Sources.HTTP.validate(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if c.Sources.Replay != nil {
+		if err := c.Sources.Replay.validate(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if c.Sources.DeadLetter != nil && c.DeadLetter == nil {
+		return errors.New("dead letter source requires dead_letter to be configured")
+	}
+	return nil
+}
+
+func (h *HTTPSource) validate() error {
+	if h.Addr == "" {
+		h.Addr = ":8080"
+	}
+	if h.Path == "" {
+		h.Path = "/ingest"
+	}
+	if !strings.HasPrefix(h.Path, "/") {
+		return errors.Errorf("http source path must start with /: %s", h.Path)
+	}
+	if h.Topic == "" {
+		h.Topic = "http/ingest"
+	}
+	if len(h.Tokens) == 0 {
+		return errors.New("http source requires at least one bearer token")
+	}
+	if slices.Contains(h.Tokens, "") {
+		return errors.New("http source bearer tokens cannot be empty")
+	}
+	if (h.CertFile == "") != (h.KeyFile == "") {
+		return errors.New("http source cert_file and key_file must be set together")
+	}
+	if h.MaxBodyBytes < 0 {
+		return errors.New("http source max_body_bytes cannot be negative")
+	}
+	if h.MaxBodyBytes == 0 {
+		h.MaxBodyBytes = 1 << 20
+	}
+	return nil
+}
+
+func (r *ReplaySource) validate() error {
+	if r.Path == "" {
+		return errors.New("replay source path is required")
+	}
+
+	if r.Pace == "" {
+		r.Pace = "original"
+	}
+	switch r.Pace {
+	case "original":
+		r.Factor = 1
+	case "accelerated":
+		if r.Factor == 0 {
+			r.Factor = 10
+		}
+		if r.Factor <= 1 {
+			return errors.Errorf("accelerated replay factor must be greater than 1, got %g", r.Factor)
+		}
+	case "unthrottled":
+		r.Factor = 0
+	default:
+		return errors.Errorf("invalid replay pace: %s", r.Pace)
+	}
+	return nil
+}
+
+func (c *Capture) validate() error {
+	if c.Dir == "" {
+		return errors.New("capture dir is required")
+	}
+	if c.RotateInterval < 0 {
+		return errors.New("capture rotate_interval cannot be negative")
+	}
+	if c.RotateInterval == 0 {
+		c.RotateInterval = time.Hour
+	}
+	if c.MaxFileBytes < 0 {
+		return errors.New("capture max_file_bytes cannot be negative")
+	}
+	if c.MaxFileBytes == 0 {
+		c.MaxFileBytes = 64 << 20
+	}
+	if c.MaxFiles < 0 {
+		return errors.New("capture max_files cannot be negative")
+	}
+	return nil
+}
+
 func (d *Destination) validate() error {
 	if d.Type == "" {
 		return errors.New("destination type is required")
@@ -133,6 +717,73 @@ func (d *Destination) validate() error {
 		}
 	}
 
+	if d.Retry != nil {
+		if err := d.Retry.validate(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if d.Breaker != nil {
+		if err := d.Breaker.validate(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+func (r *Retry) validate() error {
+	if r.MaxAttempts < 0 {
+		return errors.New("retry max_attempts cannot be negative")
+	}
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = 3
+	}
+	if r.InitialBackoff < 0 || r.MaxBackoff < 0 {
+		return errors.New("retry backoff cannot be negative")
+	}
+	if r.InitialBackoff == 0 {
+		r.InitialBackoff = 100 * time.Millisecond
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = 10 * time.Second
+	}
+	if r.MaxBackoff < r.InitialBackoff {
+		return errors.New("retry max_backoff must not be less than initial_backoff")
+	}
+	if r.Multiplier == 0 {
+		r.Multiplier = 2
+	}
+	if r.Multiplier < 1 {
+		return errors.New("retry multiplier must be at least 1")
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return errors.New("retry jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+func (b *Breaker) validate() error {
+	if b.FailureThreshold < 0 {
+		return errors.New("breaker failure_threshold cannot be negative")
+	}
+	if b.FailureThreshold == 0 {
+		b.FailureThreshold = 5
+	}
+	if b.OpenTimeout < 0 {
+		return errors.New("breaker open_timeout cannot be negative")
+	}
+	if b.OpenTimeout == 0 {
+		b.OpenTimeout = 30 * time.Second
+	}
+	if b.Fallback == "" {
+		b.Fallback = "dead_letter"
+	}
+	if !slices.Contains([]string{"dead_letter", "file"}, b.Fallback) {
+		return errors.Errorf("invalid breaker fallback: %s", b.Fallback)
+	}
+	if b.Fallback == "file" && b.FallbackPath == "" {
+		return errors.New("file fallback requires a fallback_path")
+	}
 	return nil
 }
 
@@ -162,6 +813,24 @@ func (b *Buffer) validate() error {
 	if b.Offset >= b.Interval {
 		return errors.New("buffer offset must be less than interval")
 	}
+	if b.AllowedLateness < 0 {
+		return errors.New("buffer allowed lateness cannot be negative")
+	}
+	if b.Watermark == "" {
+		b.Watermark = "clock"
+	}
+	if !slices.Contains([]string{"clock", "event"}, b.Watermark) {
+		return errors.Errorf("invalid buffer watermark: %s", b.Watermark)
+	}
+	if b.LateTable == "" {
+		b.LateTable = "late_der_data"
+	}
+	if b.Averaging == nil {
+		b.Averaging = &Averaging{}
+	}
+	if err := b.Averaging.validate(); err != nil {
+		return errors.WithStack(err)
+	}
 	if b.StartTime.IsZero() {
 		return errors.New("buffer start time required")
 	}
@@ -172,6 +841,22 @@ func (b *Buffer) validate() error {
 	return nil
 }
 
+func (a *Averaging) validate() error {
+	if a.Mode == "" {
+		a.Mode = "sample"
+	}
+	if !slices.Contains([]string{"sample", "time"}, a.Mode) {
+		return errors.Errorf("invalid averaging mode: %s", a.Mode)
+	}
+	if a.Edges == "" {
+		a.Edges = "hold"
+	}
+	if !slices.Contains([]string{"hold", "clip", "extend"}, a.Edges) {
+		return errors.Errorf("invalid averaging edges: %s", a.Edges)
+	}
+	return nil
+}
+
 func (m *MQTT) validate() error {
 	if m.Port < 1 || m.Port > 65535 {
 		return errors.New("port must be between 1 and 65535")
@@ -180,9 +865,108 @@ func (m *MQTT) validate() error {
 		return errors.New("qos must be between 0 and 2")
 	}
 
-	if m.Topic == "" {
+	legacy := func(sub *Subscription) bool { return sub.Topic == m.Topic }
+	if m.Topic != "" && !slices.ContainsFunc(m.Subscriptions, legacy) {
+		m.Subscriptions = append([]*Subscription{{Topic: m.Topic, QoS: m.QoS}}, m.Subscriptions...)
+	}
+	if len(m.Subscriptions) == 0 {
 		return errors.New("topic is required")
 	}
+	for _, sub := range m.Subscriptions {
+		if _, err := topic.ParseTemplate(sub.Topic); err != nil {
+			return errors.WithStack(err)
+		}
+		if sub.QoS < 0 || sub.QoS > 2 {
+			return errors.Errorf("qos for topic %s must be between 0 and 2", sub.Topic)
+		}
+	}
+
+	if m.ProtocolVersion == 0 {
+		m.ProtocolVersion = 4
+	}
+	if m.ProtocolVersion != 4 && m.ProtocolVersion != 5 {
+		return errors.Errorf("unsupported mqtt protocol version: %d", m.ProtocolVersion)
+	}
+
+	if m.ShareGroup != "" {
+		if m.ProtocolVersion != 5 {
+			return errors.New("shared subscriptions require mqtt protocol version 5")
+		}
+		if strings.ContainsAny(m.ShareGroup, "/+#") {
+			return errors.Errorf("invalid share group: %s", m.ShareGroup)
+		}
+	}
+
+	if m.Delivery == "" {
+		m.Delivery = "at_most_once"
+	}
+	if !slices.Contains([]string{"at_most_once", "at_least_once"}, m.Delivery) {
+		return errors.Errorf("invalid mqtt delivery mode: %s", m.Delivery)
+	}
+	if m.Delivery == "at_least_once" {
+		for _, sub := range m.Subscriptions {
+			if sub.QoS < 1 {
+				return errors.Errorf("at_least_once delivery requires qos 1 or 2, topic %s has qos %d", sub.Topic, sub.QoS)
+			}
+		}
+		if m.Session == nil {
+			return errors.New("at_least_once delivery requires a persistent session")
+		}
+	}
+	if m.Session != nil {
+		if err := m.Session.validate(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if m.Transport == "" {
+		m.Transport = "tls"
+	}
+	if !slices.Contains([]string{"tcp", "tls"}, m.Transport) {
+		return errors.Errorf("invalid mqtt transport: %s", m.Transport)
+	}
+
+	if m.Transport == "tls" {
+		if m.TLS == nil {
+			m.TLS = &TLS{}
+		}
+		if err := m.TLS.validate(); err != nil {
+			return errors.WithStack(err)
+		}
+	} else if m.TLS != nil {
+		return errors.New("tls settings require the tls transport")
+	}
+
+	return nil
+}
+
+func (s *Session) validate() error {
+	if s.ClientID == "" {
+		return errors.New("persistent session requires a client_id")
+	}
+	if s.StoreDir == "" {
+		return errors.New("persistent session requires a store_dir")
+	}
+	if s.Expiry < 0 {
+		return errors.New("session expiry cannot be negative")
+	}
+	if s.Expiry == 0 {
+		s.Expiry = 24 * time.Hour
+	}
+	return nil
+}
+
+func (t *TLS) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("tls cert_file and key_file must be set together")
+	}
+
+	if t.MinVersion == "" {
+		t.MinVersion = "1.2"
+	}
+	if !slices.Contains([]string{"1.2", "1.3"}, t.MinVersion) {
+		return errors.Errorf("invalid tls min_version: %s", t.MinVersion)
+	}
 
 	return nil
 }
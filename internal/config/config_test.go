@@ -1,354 +1,1564 @@
 package config
 
-// import (
-// 	"os"
-// 	"testing"
-// 	"time"
-
-// 	"github.com/grid-stream-org/go-commons/pkg/bqclient"
-// 	"github.com/grid-stream-org/go-commons/pkg/logger"
-// 	"github.com/grid-stream-org/go-commons/pkg/validator"
-// 	"github.com/stretchr/testify/suite"
-// )
-
-// type ConfigTestSuite struct {
-// 	suite.Suite
-// }
-
-// func (s *ConfigTestSuite) SetupTest() {
-// 	startTime := time.Now().Format(time.RFC3339)
-// 	os.Setenv("BUFFER_START_TIME", startTime)
-// }
-
-// func (s *ConfigTestSuite) TearDownTest() {
-// 	os.Unsetenv("BUFFER_START_TIME")
-// }
-
-// func (s *ConfigTestSuite) newValidConfig() *Config {
-// 	return &Config{
-// 		Batcher: &Batcher{
-// 			Timeout: time.Minute * 5,
-// 		},
-// 		Pool: &Pool{
-// 			NumWorkers: 4,
-// 			Capacity:   100,
-// 		},
-// 		Destination: &Destination{
-// 			Type: "event",
-// 			Database: &bqclient.Config{
-// 				ProjectID: "test-project",
-// 				DatasetID: "test-dataset",
-// 				CredsPath: "test-creds.json",
-// 			},
-// 			Buffer: &Buffer{
-// 				Interval: time.Minute,
-// 				Offset:   time.Second * 30,
-// 				Validator: &validator.Config{
-// 					Host: "localhost",
-// 					Port: 8080,
-// 				},
-// 			},
-// 		},
-// 		MQTT: &MQTT{
-// 			Host:     "localhost",
-// 			Port:     1883,
-// 			Username: "user",
-// 			Password: "pass",
-// 			QoS:      1,
-// 		},
-// 		Log: &logger.Config{
-// 			Level:  "INFO",
-// 			Format: "json",
-// 		},
-// 	}
-// }
-
-// func (s *ConfigTestSuite) TestConfigValidation() {
-// 	testCases := []struct {
-// 		name        string
-// 		modify      func(*Config)
-// 		expectError bool
-// 		errorMsg    string
-// 	}{
-// 		{
-// 			name:        "valid config",
-// 			modify:      func(c *Config) {},
-// 			expectError: false,
-// 		},
-// 		{
-// 			name: "zero workers gets set to 1",
-// 			modify: func(c *Config) {
-// 				c.Pool.NumWorkers = 0
-// 			},
-// 			expectError: false,
-// 		},
-// 		{
-// 			name: "negative capacity gets set to 0",
-// 			modify: func(c *Config) {
-// 				c.Pool.Capacity = -1
-// 			},
-// 			expectError: false,
-// 		},
-// 		{
-// 			name: "invalid destination",
-// 			modify: func(c *Config) {
-// 				c.Destination.Type = ""
-// 			},
-// 			expectError: true,
-// 			errorMsg:    "destination type is required",
-// 		},
-// 		{
-// 			name: "invalid mqtt",
-// 			modify: func(c *Config) {
-// 				c.MQTT.Port = 0
-// 			},
-// 			expectError: true,
-// 			errorMsg:    "port must be between 1 and 65535",
-// 		},
-// 	}
-
-// 	for _, tc := range testCases {
-// 		s.Run(tc.name, func() {
-// 			cfg := s.newValidConfig()
-// 			tc.modify(cfg)
-// 			err := cfg.Validate()
-// 			if tc.expectError {
-// 				s.Error(err)
-// 				if tc.errorMsg != "" {
-// 					s.Contains(err.Error(), tc.errorMsg)
-// 				}
-// 			} else {
-// 				s.NoError(err)
-// 			}
-// 		})
-// 	}
-// }
-
-// func (s *ConfigTestSuite) TestDestinationValidation() {
-// 	testCases := []struct {
-// 		name        string
-// 		modify      func(*Destination)
-// 		setupEnv    func()
-// 		expectError bool
-// 		errorMsg    string
-// 	}{
-// 		{
-// 			name:        "valid database config",
-// 			modify:      func(d *Destination) {},
-// 			setupEnv:    func() {},
-// 			expectError: false,
-// 		},
-// 		{
-// 			name:   "missing start time env var",
-// 			modify: func(d *Destination) {},
-// 			setupEnv: func() {
-// 				os.Unsetenv("BUFFER_START_TIME")
-// 			},
-// 			expectError: true,
-// 			errorMsg:    "buffer start time not set in environment and is required",
-// 		},
-// 		{
-// 			name:   "invalid start time format",
-// 			modify: func(d *Destination) {},
-// 			setupEnv: func() {
-// 				os.Setenv("BUFFER_START_TIME", "invalid-time")
-// 			},
-// 			expectError: true,
-// 			errorMsg:    "parsing time",
-// 		},
-// 		{
-// 			name: "empty type",
-// 			modify: func(d *Destination) {
-// 				d.Type = ""
-// 			},
-// 			setupEnv:    func() {},
-// 			expectError: true,
-// 			errorMsg:    "destination type is required",
-// 		},
-// 		{
-// 			name: "invalid type",
-// 			modify: func(d *Destination) {
-// 				d.Type = "invalid"
-// 			},
-// 			setupEnv:    func() {},
-// 			expectError: true,
-// 			errorMsg:    "invalid destination type: invalid",
-// 		},
-// 		{
-// 			name: "stream type without database",
-// 			modify: func(d *Destination) {
-// 				d.Type = "stream"
-// 				d.Database = nil
-// 			},
-// 			setupEnv:    func() {},
-// 			expectError: true,
-// 			errorMsg:    "database configuration required",
-// 		},
-// 		{
-// 			name: "event type without buffer",
-// 			modify: func(d *Destination) {
-// 				d.Type = "event"
-// 				d.Buffer = nil
-// 			},
-// 			setupEnv:    func() {},
-// 			expectError: true,
-// 			errorMsg:    "buffer configuration required",
-// 		},
-// 		{
-// 			name: "buffer zero interval",
-// 			modify: func(d *Destination) {
-// 				d.Type = "event"
-// 				d.Buffer.Interval = 0
-// 			},
-// 			setupEnv:    func() {},
-// 			expectError: true,
-// 			errorMsg:    "buffer interval must be positive",
-// 		},
-// 		{
-// 			name: "buffer negative offset",
-// 			modify: func(d *Destination) {
-// 				d.Type = "event"
-// 				d.Buffer.Offset = -1 * time.Second
-// 			},
-// 			setupEnv:    func() {},
-// 			expectError: true,
-// 			errorMsg:    "buffer offset cannot be negative",
-// 		},
-// 		{
-// 			name: "buffer offset equals interval",
-// 			modify: func(d *Destination) {
-// 				d.Type = "event"
-// 				d.Buffer.Interval = time.Second
-// 				d.Buffer.Offset = time.Second
-// 			},
-// 			setupEnv:    func() {},
-// 			expectError: true,
-// 			errorMsg:    "buffer offset must be less than interval",
-// 		},
-// 		{
-// 			name: "stdout type is valid",
-// 			modify: func(d *Destination) {
-// 				d.Type = "stdout"
-// 				d.Buffer = nil
-// 				d.Database = nil
-// 			},
-// 			setupEnv:    func() {},
-// 			expectError: false,
-// 		},
-// 		{
-// 			name: "stream type is valid",
-// 			modify: func(d *Destination) {
-// 				d.Type = "stream"
-// 				d.Buffer = nil
-// 			},
-// 			setupEnv:    func() {},
-// 			expectError: false,
-// 		},
-// 	}
-
-// 	for _, tc := range testCases {
-// 		s.Run(tc.name, func() {
-// 			tc.setupEnv()
-
-// 			dest := &Destination{
-// 				Type: "event",
-// 				Database: &bqclient.Config{
-// 					ProjectID: "test-project",
-// 					DatasetID: "test-dataset",
-// 					CredsPath: "test-creds.json",
-// 				},
-// 				Buffer: &Buffer{
-// 					Interval: time.Minute,
-// 					Offset:   time.Second * 30,
-// 					Validator: &validator.Config{
-// 						Host: "localhost",
-// 						Port: 8080,
-// 					},
-// 				},
-// 			}
-// 			tc.modify(dest)
-// 			err := dest.validate()
-// 			if tc.expectError {
-// 				s.Error(err)
-// 				if tc.errorMsg != "" {
-// 					s.Contains(err.Error(), tc.errorMsg)
-// 				}
-// 			} else {
-// 				s.NoError(err)
-// 			}
-// 		})
-// 	}
-// }
-
-// func (s *ConfigTestSuite) TestMQTTValidation() {
-// 	testCases := []struct {
-// 		name        string
-// 		modify      func(*MQTT)
-// 		expectError bool
-// 		errorMsg    string
-// 	}{
-// 		{
-// 			name:        "valid mqtt config",
-// 			modify:      func(m *MQTT) {},
-// 			expectError: false,
-// 		},
-// 		{
-// 			name: "port too low",
-// 			modify: func(m *MQTT) {
-// 				m.Port = 0
-// 			},
-// 			expectError: true,
-// 			errorMsg:    "port must be between 1 and 65535",
-// 		},
-// 		{
-// 			name: "port too high",
-// 			modify: func(m *MQTT) {
-// 				m.Port = 65536
-// 			},
-// 			expectError: true,
-// 			errorMsg:    "port must be between 1 and 65535",
-// 		},
-// 		{
-// 			name: "QoS too low",
-// 			modify: func(m *MQTT) {
-// 				m.QoS = -1
-// 			},
-// 			expectError: true,
-// 			errorMsg:    "qos must be between 0 and 2",
-// 		},
-// 		{
-// 			name: "QoS too high",
-// 			modify: func(m *MQTT) {
-// 				m.QoS = 3
-// 			},
-// 			expectError: true,
-// 			errorMsg:    "qos must be between 0 and 2",
-// 		},
-// 	}
-
-// 	for _, tc := range testCases {
-// 		s.Run(tc.name, func() {
-// 			mqtt := &MQTT{
-// 				Host:     "localhost",
-// 				Port:     1883,
-// 				Username: "user",
-// 				Password: "pass",
-// 				QoS:      1,
-// 			}
-// 			tc.modify(mqtt)
-// 			err := mqtt.validate()
-// 			if tc.expectError {
-// 				s.Error(err)
-// 				if tc.errorMsg != "" {
-// 					s.Contains(err.Error(), tc.errorMsg)
-// 				}
-// 			} else {
-// 				s.NoError(err)
-// 			}
-// 		})
-// 	}
-// }
-
-// func TestConfigSuite(t *testing.T) {
-// 	suite.Run(t, new(ConfigTestSuite))
-// }
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/go-commons/pkg/bqclient"
+	"github.com/grid-stream-org/go-commons/pkg/logger"
+	"github.com/grid-stream-org/go-commons/pkg/validator"
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfigTestSuite struct {
+	suite.Suite
+}
+
+func (s *ConfigTestSuite) SetupTest() {
+	startTime := time.Now().Format(time.RFC3339)
+	os.Setenv("BUFFER_START_TIME", startTime)
+}
+
+// SetupSubTest resets the environment a test case may have changed
+func (s *ConfigTestSuite) SetupSubTest() {
+	s.SetupTest()
+}
+
+func (s *ConfigTestSuite) TearDownTest() {
+	os.Unsetenv("BUFFER_START_TIME")
+}
+
+func (s *ConfigTestSuite) newValidConfig() *Config {
+	return &Config{
+		Batcher: &Batcher{
+			Timeout: time.Minute * 5,
+		},
+		Pool: &Pool{
+			NumWorkers: 4,
+			Capacity:   100,
+		},
+		Destination: &Destination{
+			Type: "event",
+			Database: &bqclient.Config{
+				ProjectID: "test-project",
+				DatasetID: "test-dataset",
+				CredsPath: "test-creds.json",
+			},
+			Buffer: &Buffer{
+				Interval: time.Minute,
+				Offset:   time.Second * 30,
+				Validator: &validator.Config{
+					Host: "localhost",
+					Port: 8080,
+				},
+			},
+		},
+		MQTT: &MQTT{
+			Host:     "localhost",
+			Port:     1883,
+			Username: "user",
+			Password: "pass",
+			QoS:      1,
+			Topic:    "projects/+/ders",
+		},
+		Log: &logger.Config{
+			Level:  "INFO",
+			Format: "json",
+		},
+	}
+}
+
+func (s *ConfigTestSuite) TestConfigValidation() {
+	testCases := []struct {
+		name        string
+		modify      func(*Config)
+		expectError bool
+		errorMsg    string
+	}{
+		{
+			name:        "valid config",
+			modify:      func(c *Config) {},
+			expectError: false,
+		},
+		{
+			name: "zero workers gets set to 1",
+			modify: func(c *Config) {
+				c.Pool.NumWorkers = 0
+			},
+			expectError: false,
+		},
+		{
+			name: "negative capacity gets set to 0",
+			modify: func(c *Config) {
+				c.Pool.Capacity = -1
+			},
+			expectError: false,
+		},
+		{
+			name: "invalid destination",
+			modify: func(c *Config) {
+				c.Destination.Type = ""
+			},
+			expectError: true,
+			errorMsg:    "destination type is required",
+		},
+		{
+			name: "invalid mqtt",
+			modify: func(c *Config) {
+				c.MQTT.Port = 0
+			},
+			expectError: true,
+			errorMsg:    "port must be between 1 and 65535",
+		},
+		{
+			name: "no batcher settings",
+			modify: func(c *Config) {
+				c.Batcher = nil
+			},
+			expectError: false,
+		},
+		{
+			name: "negative drain timeout",
+			modify: func(c *Config) {
+				c.Batcher.DrainTimeout = -time.Second
+			},
+			expectError: true,
+			errorMsg:    "batcher drain_timeout cannot be negative",
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			cfg := s.newValidConfig()
+			tc.modify(cfg)
+			err := cfg.Validate()
+			if tc.expectError {
+				s.Error(err)
+				if tc.errorMsg != "" {
+					s.Contains(err.Error(), tc.errorMsg)
+				}
+			} else {
+				s.NoError(err)
+			}
+		})
+	}
+}
+
+func (s *ConfigTestSuite) TestDrainTimeoutDefault() {
+	cfg := s.newValidConfig()
+	s.Require().NoError(cfg.Validate())
+	s.Equal(30*time.Second, cfg.Batcher.DrainTimeout)
+}
+
+func (s *ConfigTestSuite) TestDestinationValidation() {
+	testCases := []struct {
+		name        string
+		modify      func(*Destination)
+		setupEnv    func()
+		expectError bool
+		errorMsg    string
+	}{
+		{
+			name:        "valid database config",
+			modify:      func(d *Destination) {},
+			setupEnv:    func() {},
+			expectError: false,
+		},
+		{
+			name:   "missing start time env var",
+			modify: func(d *Destination) {},
+			setupEnv: func() {
+				os.Unsetenv("BUFFER_START_TIME")
+			},
+			expectError: true,
+			errorMsg:    "buffer start time not set in environment and is required",
+		},
+		{
+			name:   "invalid start time format",
+			modify: func(d *Destination) {},
+			setupEnv: func() {
+				os.Setenv("BUFFER_START_TIME", "invalid-time")
+			},
+			expectError: true,
+			errorMsg:    "parsing time",
+		},
+		{
+			name: "empty type",
+			modify: func(d *Destination) {
+				d.Type = ""
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "destination type is required",
+		},
+		{
+			name: "invalid type",
+			modify: func(d *Destination) {
+				d.Type = "invalid"
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "invalid destination type: invalid",
+		},
+		{
+			name: "stream type without database",
+			modify: func(d *Destination) {
+				d.Type = "stream"
+				d.Database = nil
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "database configuration required",
+		},
+		{
+			name: "event type without buffer",
+			modify: func(d *Destination) {
+				d.Type = "event"
+				d.Buffer = nil
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "buffer configuration required",
+		},
+		{
+			name: "buffer zero interval",
+			modify: func(d *Destination) {
+				d.Type = "event"
+				d.Buffer.Interval = 0
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "buffer interval must be positive",
+		},
+		{
+			name: "buffer negative offset",
+			modify: func(d *Destination) {
+				d.Type = "event"
+				d.Buffer.Offset = -1 * time.Second
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "buffer offset cannot be negative",
+		},
+		{
+			name: "buffer offset equals interval",
+			modify: func(d *Destination) {
+				d.Type = "event"
+				d.Buffer.Interval = time.Second
+				d.Buffer.Offset = time.Second
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "buffer offset must be less than interval",
+		},
+		{
+			name: "stdout type is valid",
+			modify: func(d *Destination) {
+				d.Type = "stdout"
+				d.Buffer = nil
+				d.Database = nil
+			},
+			setupEnv:    func() {},
+			expectError: false,
+		},
+		{
+			name: "stream type is valid",
+			modify: func(d *Destination) {
+				d.Type = "stream"
+				d.Buffer = nil
+			},
+			setupEnv:    func() {},
+			expectError: false,
+		},
+		{
+			name: "retry and breaker",
+			modify: func(d *Destination) {
+				d.Retry = &Retry{MaxAttempts: 5, Jitter: 0.2}
+				d.Breaker = &Breaker{Fallback: "file", FallbackPath: "fallback.jsonl"}
+			},
+			setupEnv:    func() {},
+			expectError: false,
+		},
+		{
+			name: "negative retry attempts",
+			modify: func(d *Destination) {
+				d.Retry = &Retry{MaxAttempts: -1}
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "retry max_attempts cannot be negative",
+		},
+		{
+			name: "retry max backoff below initial",
+			modify: func(d *Destination) {
+				d.Retry = &Retry{InitialBackoff: time.Second, MaxBackoff: time.Millisecond}
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "retry max_backoff must not be less than initial_backoff",
+		},
+		{
+			name: "retry multiplier below one",
+			modify: func(d *Destination) {
+				d.Retry = &Retry{Multiplier: 0.5}
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "retry multiplier must be at least 1",
+		},
+		{
+			name: "retry jitter above one",
+			modify: func(d *Destination) {
+				d.Retry = &Retry{Jitter: 1.5}
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "retry jitter must be between 0 and 1",
+		},
+		{
+			name: "negative breaker threshold",
+			modify: func(d *Destination) {
+				d.Breaker = &Breaker{FailureThreshold: -1}
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "breaker failure_threshold cannot be negative",
+		},
+		{
+			name: "invalid breaker fallback",
+			modify: func(d *Destination) {
+				d.Breaker = &Breaker{Fallback: "drop"}
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "invalid breaker fallback: drop",
+		},
+		{
+			name: "file fallback without path",
+			modify: func(d *Destination) {
+				d.Breaker = &Breaker{Fallback: "file"}
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "file fallback requires a fallback_path",
+		},
+		{
+			name: "buffer event watermark with lateness",
+			modify: func(d *Destination) {
+				d.Buffer.Watermark = "event"
+				d.Buffer.AllowedLateness = 5 * time.Minute
+				d.Buffer.LateTable = "late_readings"
+			},
+			setupEnv:    func() {},
+			expectError: false,
+		},
+		{
+			name: "buffer negative allowed lateness",
+			modify: func(d *Destination) {
+				d.Buffer.AllowedLateness = -time.Second
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "buffer allowed lateness cannot be negative",
+		},
+		{
+			name: "buffer invalid watermark",
+			modify: func(d *Destination) {
+				d.Buffer.Watermark = "processing"
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "invalid buffer watermark: processing",
+		},
+		{
+			name: "buffer time weighted averaging",
+			modify: func(d *Destination) {
+				d.Buffer.Averaging = &Averaging{Mode: "time", Edges: "clip"}
+			},
+			setupEnv:    func() {},
+			expectError: false,
+		},
+		{
+			name: "buffer invalid averaging mode",
+			modify: func(d *Destination) {
+				d.Buffer.Averaging = &Averaging{Mode: "median"}
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "invalid averaging mode: median",
+		},
+		{
+			name: "buffer invalid averaging edges",
+			modify: func(d *Destination) {
+				d.Buffer.Averaging = &Averaging{Mode: "time", Edges: "wrap"}
+			},
+			setupEnv:    func() {},
+			expectError: true,
+			errorMsg:    "invalid averaging edges: wrap",
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			tc.setupEnv()
+
+			dest := &Destination{
+				Type: "event",
+				Database: &bqclient.Config{
+					ProjectID: "test-project",
+					DatasetID: "test-dataset",
+					CredsPath: "test-creds.json",
+				},
+				Buffer: &Buffer{
+					Interval: time.Minute,
+					Offset:   time.Second * 30,
+					Validator: &validator.Config{
+						Host: "localhost",
+						Port: 8080,
+					},
+				},
+			}
+			tc.modify(dest)
+			err := dest.validate()
+			if tc.expectError {
+				s.Error(err)
+				if tc.errorMsg != "" {
+					s.Contains(err.Error(), tc.errorMsg)
+				}
+			} else {
+				s.NoError(err)
+			}
+		})
+	}
+}
+
+func (s *ConfigTestSuite) TestBufferDefaults() {
+	b := &Buffer{Interval: time.Minute, Validator: &validator.Config{Host: "localhost", Port: 8080}}
+	s.Require().NoError(b.validate())
+	s.False(b.StartTime.IsZero())
+	s.Equal("clock", b.Watermark)
+	s.Equal("late_der_data", b.LateTable)
+	s.Zero(b.AllowedLateness)
+	s.Equal(&Averaging{Mode: "sample", Edges: "hold"}, b.Averaging)
+}
+
+func (s *ConfigTestSuite) TestMQTTValidation() {
+	testCases := []struct {
+		name        string
+		modify      func(*MQTT)
+		expectError bool
+		errorMsg    string
+	}{
+		{
+			name:        "valid mqtt config",
+			modify:      func(m *MQTT) {},
+			expectError: false,
+		},
+		{
+			name: "port too low",
+			modify: func(m *MQTT) {
+				m.Port = 0
+			},
+			expectError: true,
+			errorMsg:    "port must be between 1 and 65535",
+		},
+		{
+			name: "port too high",
+			modify: func(m *MQTT) {
+				m.Port = 65536
+			},
+			expectError: true,
+			errorMsg:    "port must be between 1 and 65535",
+		},
+		{
+			name: "QoS too low",
+			modify: func(m *MQTT) {
+				m.QoS = -1
+			},
+			expectError: true,
+			errorMsg:    "qos must be between 0 and 2",
+		},
+		{
+			name: "QoS too high",
+			modify: func(m *MQTT) {
+				m.QoS = 3
+			},
+			expectError: true,
+			errorMsg:    "qos must be between 0 and 2",
+		},
+		{
+			name: "tcp transport",
+			modify: func(m *MQTT) {
+				m.Transport = "tcp"
+			},
+			expectError: false,
+		},
+		{
+			name: "invalid transport",
+			modify: func(m *MQTT) {
+				m.Transport = "ws"
+			},
+			expectError: true,
+			errorMsg:    "invalid mqtt transport: ws",
+		},
+		{
+			name: "tls settings without tls transport",
+			modify: func(m *MQTT) {
+				m.Transport = "tcp"
+				m.TLS = &TLS{CAFile: "ca.pem"}
+			},
+			expectError: true,
+			errorMsg:    "tls settings require the tls transport",
+		},
+		{
+			name: "mutual tls",
+			modify: func(m *MQTT) {
+				m.TLS = &TLS{CAFile: "ca.pem", CertFile: "cert.pem", KeyFile: "key.pem", MinVersion: "1.3"}
+			},
+			expectError: false,
+		},
+		{
+			name: "client cert without key",
+			modify: func(m *MQTT) {
+				m.TLS = &TLS{CertFile: "cert.pem"}
+			},
+			expectError: true,
+			errorMsg:    "tls cert_file and key_file must be set together",
+		},
+		{
+			name: "invalid tls min version",
+			modify: func(m *MQTT) {
+				m.TLS = &TLS{MinVersion: "1.1"}
+			},
+			expectError: true,
+			errorMsg:    "invalid tls min_version: 1.1",
+		},
+		{
+			name: "mqtt v5",
+			modify: func(m *MQTT) {
+				m.ProtocolVersion = 5
+			},
+			expectError: false,
+		},
+		{
+			name: "unsupported protocol version",
+			modify: func(m *MQTT) {
+				m.ProtocolVersion = 3
+			},
+			expectError: true,
+			errorMsg:    "unsupported mqtt protocol version: 3",
+		},
+		{
+			name: "shared subscription",
+			modify: func(m *MQTT) {
+				m.ProtocolVersion = 5
+				m.ShareGroup = "batchers"
+			},
+			expectError: false,
+		},
+		{
+			name: "shared subscription on v3",
+			modify: func(m *MQTT) {
+				m.ShareGroup = "batchers"
+			},
+			expectError: true,
+			errorMsg:    "shared subscriptions require mqtt protocol version 5",
+		},
+		{
+			name: "invalid share group",
+			modify: func(m *MQTT) {
+				m.ProtocolVersion = 5
+				m.ShareGroup = "batchers/a"
+			},
+			expectError: true,
+			errorMsg:    "invalid share group: batchers/a",
+		},
+		{
+			name: "at least once delivery",
+			modify: func(m *MQTT) {
+				m.Delivery = "at_least_once"
+				m.Session = &Session{ClientID: "batcher", StoreDir: "/var/lib/batcher/session"}
+			},
+			expectError: false,
+		},
+		{
+			name: "invalid delivery",
+			modify: func(m *MQTT) {
+				m.Delivery = "exactly_once"
+			},
+			expectError: true,
+			errorMsg:    "invalid mqtt delivery mode: exactly_once",
+		},
+		{
+			name: "at least once delivery with qos 0",
+			modify: func(m *MQTT) {
+				m.QoS = 0
+				m.Delivery = "at_least_once"
+				m.Session = &Session{ClientID: "batcher", StoreDir: "/var/lib/batcher/session"}
+			},
+			expectError: true,
+			errorMsg:    "at_least_once delivery requires qos 1 or 2",
+		},
+		{
+			name: "at least once delivery without session",
+			modify: func(m *MQTT) {
+				m.Delivery = "at_least_once"
+			},
+			expectError: true,
+			errorMsg:    "at_least_once delivery requires a persistent session",
+		},
+		{
+			name: "session without client id",
+			modify: func(m *MQTT) {
+				m.Session = &Session{StoreDir: "/var/lib/batcher/session"}
+			},
+			expectError: true,
+			errorMsg:    "persistent session requires a client_id",
+		},
+		{
+			name: "session without store dir",
+			modify: func(m *MQTT) {
+				m.Session = &Session{ClientID: "batcher"}
+			},
+			expectError: true,
+			errorMsg:    "persistent session requires a store_dir",
+		},
+		{
+			name: "negative session expiry",
+			modify: func(m *MQTT) {
+				m.Session = &Session{ClientID: "batcher", StoreDir: "/var/lib/batcher/session", Expiry: -time.Second}
+			},
+			expectError: true,
+			errorMsg:    "session expiry cannot be negative",
+		},
+		{
+			name: "subscriptions",
+			modify: func(m *MQTT) {
+				m.Topic = ""
+				m.Subscriptions = []*Subscription{{Topic: "projects/+/ders", QoS: 1}, {Topic: "sites/#", QoS: 0}}
+			},
+			expectError: false,
+		},
+		{
+			name: "no topic or subscriptions",
+			modify: func(m *MQTT) {
+				m.Topic = ""
+			},
+			expectError: true,
+			errorMsg:    "topic is required",
+		},
+		{
+			name: "subscription qos too high",
+			modify: func(m *MQTT) {
+				m.Subscriptions = []*Subscription{{Topic: "sites/#", QoS: 3}}
+			},
+			expectError: true,
+			errorMsg:    "qos for topic sites/# must be between 0 and 2",
+		},
+		{
+			name: "invalid subscription filter",
+			modify: func(m *MQTT) {
+				m.Subscriptions = []*Subscription{{Topic: "sites/#/ders", QoS: 1}}
+			},
+			expectError: true,
+			errorMsg:    "# must occupy the whole last level",
+		},
+		{
+			name: "topic template",
+			modify: func(m *MQTT) {
+				m.Topic = "projects/{project}/sites/{site}"
+			},
+			expectError: false,
+		},
+		{
+			name: "placeholder within a level",
+			modify: func(m *MQTT) {
+				m.Topic = "projects/p-{project}"
+			},
+			expectError: true,
+			errorMsg:    "placeholders must occupy a whole level",
+		},
+		{
+			name: "duplicate placeholder",
+			modify: func(m *MQTT) {
+				m.Topic = "projects/{project}/{project}"
+			},
+			expectError: true,
+			errorMsg:    "duplicate placeholder {project}",
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			mqtt := &MQTT{
+				Host:     "localhost",
+				Port:     1883,
+				Username: "user",
+				Password: "pass",
+				QoS:      1,
+				Topic:    "projects/+/ders",
+			}
+			tc.modify(mqtt)
+			err := mqtt.validate()
+			if tc.expectError {
+				s.Error(err)
+				if tc.errorMsg != "" {
+					s.Contains(err.Error(), tc.errorMsg)
+				}
+			} else {
+				s.NoError(err)
+			}
+		})
+	}
+}
+
+func (s *ConfigTestSuite) TestMQTTDefaults() {
+	mqtt := &MQTT{Port: 8883, QoS: 1, Topic: "projects/+/ders"}
+	s.Require().NoError(mqtt.validate())
+	s.Equal("tls", mqtt.Transport)
+	s.Equal("1.2", mqtt.TLS.MinVersion)
+	s.Equal(4, mqtt.ProtocolVersion)
+	s.Equal("at_most_once", mqtt.Delivery)
+}
+
+func (s *ConfigTestSuite) TestLegacyTopic() {
+	mqtt := &MQTT{Port: 8883, QoS: 1, Topic: "projects/+/ders", Subscriptions: []*Subscription{{Topic: "sites/#", QoS: 2}}}
+	s.Require().NoError(mqtt.validate())
+	s.Equal([]*Subscription{{Topic: "projects/+/ders", QoS: 1}, {Topic: "sites/#", QoS: 2}}, mqtt.Subscriptions)
+
+	// Validating again does not subscribe to the topic twice
+	s.Require().NoError(mqtt.validate())
+	s.Len(mqtt.Subscriptions, 2)
+}
+
+func (s *ConfigTestSuite) TestRoutesValidation() {
+	testCases := []struct {
+		name        string
+		modify      func(*Config)
+		expectError bool
+		errorMsg    string
+	}{
+		{
+			name: "route to named destination",
+			modify: func(c *Config) {
+				c.Destinations = map[string]*Destination{"raw": {Type: "stdout"}}
+				c.Routes = []*Route{{Topic: "projects/+/raw", Destination: "raw"}}
+			},
+			expectError: false,
+		},
+		{
+			name: "route to top level destination",
+			modify: func(c *Config) {
+				c.Routes = []*Route{{Topic: "projects/#", Destination: DefaultDestination}}
+			},
+			expectError: false,
+		},
+		{
+			name: "named destinations only",
+			modify: func(c *Config) {
+				c.Destination = nil
+				c.Destinations = map[string]*Destination{"raw": {Type: "stdout"}}
+			},
+			expectError: false,
+		},
+		{
+			name: "route to unknown destination",
+			modify: func(c *Config) {
+				c.Routes = []*Route{{Topic: "projects/+/raw", Destination: "raw"}}
+			},
+			expectError: true,
+			errorMsg:    `route for projects/+/raw references unknown destination "raw"`,
+		},
+		{
+			name: "invalid route filter",
+			modify: func(c *Config) {
+				c.Routes = []*Route{{Topic: "projects/#/raw", Destination: DefaultDestination}}
+			},
+			expectError: true,
+			errorMsg:    "# must occupy the whole last level",
+		},
+		{
+			name: "reserved destination name",
+			modify: func(c *Config) {
+				c.Destinations = map[string]*Destination{DefaultDestination: {Type: "stdout"}}
+			},
+			expectError: true,
+			errorMsg:    `destination name "default" is reserved`,
+		},
+		{
+			name: "no destination",
+			modify: func(c *Config) {
+				c.Destination = nil
+			},
+			expectError: true,
+			errorMsg:    "at least one destination is required",
+		},
+		{
+			name: "empty named destination",
+			modify: func(c *Config) {
+				c.Destinations = map[string]*Destination{"raw": nil}
+			},
+			expectError: true,
+			errorMsg:    "destination raw has no configuration",
+		},
+		{
+			name: "invalid named destination",
+			modify: func(c *Config) {
+				c.Destinations = map[string]*Destination{"raw": {Type: "invalid"}}
+			},
+			expectError: true,
+			errorMsg:    "destination raw: invalid destination type: invalid",
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			cfg := s.newValidConfig()
+			tc.modify(cfg)
+			err := cfg.Validate()
+			if tc.expectError {
+				s.Error(err)
+				if tc.errorMsg != "" {
+					s.Contains(err.Error(), tc.errorMsg)
+				}
+			} else {
+				s.NoError(err)
+			}
+		})
+	}
+}
+
+func (s *ConfigTestSuite) TestSourcesValidation() {
+	testCases := []struct {
+		name        string
+		modify      func(*Config)
+		expectError bool
+		errorMsg    string
+	}{
+		{
+			name: "http source only",
+			modify: func(c *Config) {
+				c.MQTT = nil
+				c.Sources = &Sources{HTTP: &HTTPSource{Tokens: []string{"secret"}}}
+			},
+			expectError: false,
+		},
+		{
+			name: "no source",
+			modify: func(c *Config) {
+				c.MQTT = nil
+			},
+			expectError: true,
+			errorMsg:    "at least one source is required",
+		},
+		{
+			name: "http path without slash",
+			modify: func(c *Config) {
+				c.Sources = &Sources{HTTP: &HTTPSource{Path: "ingest", Tokens: []string{"secret"}}}
+			},
+			expectError: true,
+			errorMsg:    "http source path must start with /: ingest",
+		},
+		{
+			name: "http source without tokens",
+			modify: func(c *Config) {
+				c.Sources = &Sources{HTTP: &HTTPSource{}}
+			},
+			expectError: true,
+			errorMsg:    "http source requires at least one bearer token",
+		},
+		{
+			name: "http source with empty token",
+			modify: func(c *Config) {
+				c.Sources = &Sources{HTTP: &HTTPSource{Tokens: []string{"secret", ""}}}
+			},
+			expectError: true,
+			errorMsg:    "http source bearer tokens cannot be empty",
+		},
+		{
+			name: "http cert without key",
+			modify: func(c *Config) {
+				c.Sources = &Sources{HTTP: &HTTPSource{Tokens: []string{"secret"}, CertFile: "cert.pem"}}
+			},
+			expectError: true,
+			errorMsg:    "http source cert_file and key_file must be set together",
+		},
+		{
+			name: "negative http body limit",
+			modify: func(c *Config) {
+				c.Sources = &Sources{HTTP: &HTTPSource{Tokens: []string{"secret"}, MaxBodyBytes: -1}}
+			},
+			expectError: true,
+			errorMsg:    "http source max_body_bytes cannot be negative",
+		},
+		{
+			name: "replay source only",
+			modify: func(c *Config) {
+				c.MQTT = nil
+				c.Sources = &Sources{Replay: &ReplaySource{Path: "capture", Pace: "accelerated", Factor: 5}}
+			},
+			expectError: false,
+		},
+		{
+			name: "replay source without path",
+			modify: func(c *Config) {
+				c.Sources = &Sources{Replay: &ReplaySource{}}
+			},
+			expectError: true,
+			errorMsg:    "replay source path is required",
+		},
+		{
+			name: "invalid replay pace",
+			modify: func(c *Config) {
+				c.Sources = &Sources{Replay: &ReplaySource{Path: "capture", Pace: "fast"}}
+			},
+			expectError: true,
+			errorMsg:    "invalid replay pace: fast",
+		},
+		{
+			name: "accelerated replay not faster",
+			modify: func(c *Config) {
+				c.Sources = &Sources{Replay: &ReplaySource{Path: "capture", Pace: "accelerated", Factor: 0.5}}
+			},
+			expectError: true,
+			errorMsg:    "accelerated replay factor must be greater than 1, got 0.5",
+		},
+		{
+			name: "capture",
+			modify: func(c *Config) {
+				c.Capture = &Capture{Dir: "capture", MaxFiles: 10}
+			},
+			expectError: false,
+		},
+		{
+			name: "capture without dir",
+			modify: func(c *Config) {
+				c.Capture = &Capture{}
+			},
+			expectError: true,
+			errorMsg:    "capture dir is required",
+		},
+		{
+			name: "negative capture rotate interval",
+			modify: func(c *Config) {
+				c.Capture = &Capture{Dir: "capture", RotateInterval: -time.Minute}
+			},
+			expectError: true,
+			errorMsg:    "capture rotate_interval cannot be negative",
+		},
+		{
+			name: "negative capture max files",
+			modify: func(c *Config) {
+				c.Capture = &Capture{Dir: "capture", MaxFiles: -1}
+			},
+			expectError: true,
+			errorMsg:    "capture max_files cannot be negative",
+		},
+		{
+			name: "dead letter source",
+			modify: func(c *Config) {
+				c.MQTT = nil
+				c.DeadLetter = &DeadLetter{Dir: "dead_letter"}
+				c.Sources = &Sources{DeadLetter: &DeadLetterSource{IDs: []string{"task1"}}}
+			},
+			expectError: false,
+		},
+		{
+			name: "dead letter source without dead letter",
+			modify: func(c *Config) {
+				c.Sources = &Sources{DeadLetter: &DeadLetterSource{}}
+			},
+			expectError: true,
+			errorMsg:    "dead letter source requires dead_letter to be configured",
+		},
+		{
+			name: "dead letter without dir",
+			modify: func(c *Config) {
+				c.DeadLetter = &DeadLetter{}
+			},
+			expectError: true,
+			errorMsg:    "dead letter dir is required",
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			cfg := s.newValidConfig()
+			tc.modify(cfg)
+			err := cfg.Validate()
+			if tc.expectError {
+				s.Error(err)
+				if tc.errorMsg != "" {
+					s.Contains(err.Error(), tc.errorMsg)
+				}
+			} else {
+				s.NoError(err)
+			}
+		})
+	}
+}
+
+func (s *ConfigTestSuite) TestHTTPSourceDefaults() {
+	h := &HTTPSource{Tokens: []string{"secret"}}
+	s.Require().NoError(h.validate())
+	s.Equal(":8080", h.Addr)
+	s.Equal("/ingest", h.Path)
+	s.Equal("http/ingest", h.Topic)
+	s.Equal(int64(1<<20), h.MaxBodyBytes)
+}
+
+func (s *ConfigTestSuite) TestReplayPace() {
+	testCases := []struct {
+		name     string
+		pace     string
+		factor   float64
+		expected float64
+	}{
+		{name: "original by default", pace: "", factor: 5, expected: 1},
+		{name: "accelerated by default", pace: "accelerated", factor: 0, expected: 10},
+		{name: "accelerated", pace: "accelerated", factor: 4, expected: 4},
+		{name: "unthrottled", pace: "unthrottled", factor: 4, expected: 0},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			r := &ReplaySource{Path: "capture", Pace: tc.pace, Factor: tc.factor}
+			s.Require().NoError(r.validate())
+			s.Equal(tc.expected, r.Factor)
+		})
+	}
+}
+
+func (s *ConfigTestSuite) TestOverflowValidation() {
+	testCases := []struct {
+		name        string
+		modify      func(*Pool)
+		expected    string
+		expectError bool
+		errorMsg    string
+	}{
+		{
+			name:        "blocks by default",
+			modify:      func(p *Pool) {},
+			expected:    "block",
+			expectError: false,
+		},
+		{
+			name: "block without capacity",
+			modify: func(p *Pool) {
+				p.Capacity = 0
+			},
+			expected:    "block",
+			expectError: false,
+		},
+		{
+			name: "drop oldest",
+			modify: func(p *Pool) {
+				p.Overflow = "drop_oldest"
+			},
+			expected:    "drop_oldest",
+			expectError: false,
+		},
+		{
+			name: "spill",
+			modify: func(p *Pool) {
+				p.Overflow = "spill"
+				p.SpillDir = "spill"
+			},
+			expected:    "spill",
+			expectError: false,
+		},
+		{
+			name: "invalid policy",
+			modify: func(p *Pool) {
+				p.Overflow = "drop_all"
+			},
+			expectError: true,
+			errorMsg:    "invalid pool overflow policy: drop_all",
+		},
+		{
+			name: "drop without capacity",
+			modify: func(p *Pool) {
+				p.Capacity = 0
+				p.Overflow = "drop_newest"
+			},
+			expectError: true,
+			errorMsg:    "pool overflow policy drop_newest requires a capacity",
+		},
+		{
+			name: "spill without dir",
+			modify: func(p *Pool) {
+				p.Overflow = "spill"
+			},
+			expectError: true,
+			errorMsg:    "spill overflow policy requires a spill_dir",
+		},
+		{
+			name: "spill dir without spill",
+			modify: func(p *Pool) {
+				p.Overflow = "drop_newest"
+				p.SpillDir = "spill"
+			},
+			expectError: true,
+			errorMsg:    "spill_dir requires the spill overflow policy",
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			pool := &Pool{NumWorkers: 4, Capacity: 100}
+			tc.modify(pool)
+			err := pool.validate()
+			if tc.expectError {
+				s.Error(err)
+				if tc.errorMsg != "" {
+					s.Contains(err.Error(), tc.errorMsg)
+				}
+			} else {
+				s.NoError(err)
+				s.Equal(tc.expected, pool.Overflow)
+			}
+		})
+	}
+}
+
+func (s *ConfigTestSuite) TestRetryDefaults() {
+	r := &Retry{}
+	s.Require().NoError(r.validate())
+	s.Equal(&Retry{MaxAttempts: 3, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 10 * time.Second, Multiplier: 2}, r)
+
+	b := &Breaker{}
+	s.Require().NoError(b.validate())
+	s.Equal(&Breaker{FailureThreshold: 5, OpenTimeout: 30 * time.Second, Fallback: "dead_letter"}, b)
+}
+
+func (s *ConfigTestSuite) TestPoolValidation() {
+	testCases := []struct {
+		name        string
+		modify      func(*Pool)
+		check       func(*Pool)
+		expectError bool
+		errorMsg    string
+	}{
+		{
+			name: "ordering by project",
+			modify: func(p *Pool) {
+				p.Ordering = &Ordering{}
+			},
+			check: func(p *Pool) {
+				s.Equal("project", p.Ordering.Key)
+			},
+			expectError: false,
+		},
+		{
+			name: "ordering by segment",
+			modify: func(p *Pool) {
+				p.Ordering = &Ordering{Key: "segment", Segment: "site"}
+			},
+			expectError: false,
+		},
+		{
+			name: "invalid ordering key",
+			modify: func(p *Pool) {
+				p.Ordering = &Ordering{Key: "meter"}
+			},
+			expectError: true,
+			errorMsg:    "invalid ordering key: meter",
+		},
+		{
+			name: "ordering by segment without name",
+			modify: func(p *Pool) {
+				p.Ordering = &Ordering{Key: "segment"}
+			},
+			expectError: true,
+			errorMsg:    "ordering by segment requires a segment name",
+		},
+		{
+			name: "ordering by project with segment",
+			modify: func(p *Pool) {
+				p.Ordering = &Ordering{Segment: "site"}
+			},
+			expectError: true,
+			errorMsg:    "ordering segment requires the segment key",
+		},
+		{
+			name: "autoscale",
+			modify: func(p *Pool) {
+				p.Autoscale = &Autoscale{MinWorkers: 2, MaxWorkers: 8}
+			},
+			check: func(p *Pool) {
+				s.Equal(5*time.Second, p.Autoscale.Interval)
+				s.Equal(10, p.Autoscale.TargetDepth)
+				s.Equal(15*time.Second, p.Autoscale.ScaleUpCooldown)
+				s.Equal(time.Minute, p.Autoscale.ScaleDownCooldown)
+			},
+			expectError: false,
+		},
+		{
+			name: "autoscale raises workers to the minimum",
+			modify: func(p *Pool) {
+				p.NumWorkers = 1
+				p.Autoscale = &Autoscale{MinWorkers: 2, MaxWorkers: 8}
+			},
+			check: func(p *Pool) {
+				s.Equal(2, p.NumWorkers)
+			},
+			expectError: false,
+		},
+		{
+			name: "autoscale lowers workers to the maximum",
+			modify: func(p *Pool) {
+				p.NumWorkers = 16
+				p.Autoscale = &Autoscale{MinWorkers: 2, MaxWorkers: 8}
+			},
+			check: func(p *Pool) {
+				s.Equal(8, p.NumWorkers)
+			},
+			expectError: false,
+		},
+		{
+			name: "autoscale with ordering",
+			modify: func(p *Pool) {
+				p.Ordering = &Ordering{}
+				p.Autoscale = &Autoscale{MinWorkers: 2, MaxWorkers: 8}
+			},
+			expectError: true,
+			errorMsg:    "pool autoscale cannot be combined with ordering",
+		},
+		{
+			name: "autoscale without capacity",
+			modify: func(p *Pool) {
+				p.Capacity = 0
+				p.Autoscale = &Autoscale{MinWorkers: 2, MaxWorkers: 8}
+			},
+			expectError: true,
+			errorMsg:    "pool autoscale requires a capacity",
+		},
+		{
+			name: "autoscale maximum below minimum",
+			modify: func(p *Pool) {
+				p.Autoscale = &Autoscale{MinWorkers: 8, MaxWorkers: 2}
+			},
+			expectError: true,
+			errorMsg:    "autoscale max_workers must not be less than min_workers",
+		},
+		{
+			name: "negative autoscale interval",
+			modify: func(p *Pool) {
+				p.Autoscale = &Autoscale{MaxWorkers: 8, Interval: -time.Second}
+			},
+			expectError: true,
+			errorMsg:    "autoscale durations cannot be negative",
+		},
+		{
+			name: "negative autoscale target depth",
+			modify: func(p *Pool) {
+				p.Autoscale = &Autoscale{MaxWorkers: 8, TargetDepth: -1}
+			},
+			expectError: true,
+			errorMsg:    "autoscale target_depth cannot be negative",
+		},
+		{
+			name:   "task timeout and abandoned writes by default",
+			modify: func(p *Pool) {},
+			check: func(p *Pool) {
+				s.Equal(30*time.Second, p.TaskTimeout)
+				s.Equal(100, p.MaxAbandonedWrites)
+			},
+			expectError: false,
+		},
+		{
+			name: "negative task timeout",
+			modify: func(p *Pool) {
+				p.TaskTimeout = -time.Second
+			},
+			expectError: true,
+			errorMsg:    "pool task_timeout cannot be negative",
+		},
+		{
+			name: "negative max abandoned writes",
+			modify: func(p *Pool) {
+				p.MaxAbandonedWrites = -1
+			},
+			expectError: true,
+			errorMsg:    "pool max_abandoned_writes cannot be negative",
+		},
+		{
+			name:   "dedup by default",
+			modify: func(p *Pool) {},
+			check: func(p *Pool) {
+				s.Equal(&Dedup{Window: 5 * time.Minute, MaxEntries: 100_000, SaveInterval: 30 * time.Second}, p.Dedup)
+			},
+			expectError: false,
+		},
+		{
+			name: "persistent dedup",
+			modify: func(p *Pool) {
+				p.Dedup = &Dedup{Window: time.Hour, MaxEntries: 1000, Path: "dedup.json", SaveInterval: time.Minute}
+			},
+			check: func(p *Pool) {
+				s.Equal(&Dedup{Window: time.Hour, MaxEntries: 1000, Path: "dedup.json", SaveInterval: time.Minute}, p.Dedup)
+			},
+			expectError: false,
+		},
+		{
+			name: "negative dedup window",
+			modify: func(p *Pool) {
+				p.Dedup = &Dedup{Window: -time.Minute}
+			},
+			expectError: true,
+			errorMsg:    "dedup window, max_entries and save_interval cannot be negative",
+		},
+		{
+			name: "negative dedup max entries",
+			modify: func(p *Pool) {
+				p.Dedup = &Dedup{MaxEntries: -1}
+			},
+			expectError: true,
+			errorMsg:    "dedup window, max_entries and save_interval cannot be negative",
+		},
+		{
+			name: "negative dedup save interval",
+			modify: func(p *Pool) {
+				p.Dedup = &Dedup{SaveInterval: -time.Second}
+			},
+			expectError: true,
+			errorMsg:    "dedup window, max_entries and save_interval cannot be negative",
+		},
+		{
+			name: "validation rules",
+			modify: func(p *Pool) {
+				p.Validation = &Validation{Rules: []*Rule{
+					{Field: "current_output", Check: "range", Min: floatPtr(-1000), Max: floatPtr(1000), Action: "clamp"},
+					{Field: "type", Check: "enum", Values: []string{"solar", "battery"}, Action: "flag"},
+					{Field: "timestamp", Check: "skew", MaxAhead: time.Minute},
+				}}
+			},
+			check: func(p *Pool) {
+				s.Equal("current_output_range", p.Validation.Rules[0].Name)
+				s.Equal("reject", p.Validation.Rules[2].Action)
+			},
+			expectError: false,
+		},
+		{
+			name: "rule without field",
+			modify: func(p *Pool) {
+				p.Validation = &Validation{Rules: []*Rule{{Check: "required"}}}
+			},
+			expectError: true,
+			errorMsg:    "validation rule 0: field is required",
+		},
+		{
+			name: "invalid rule check",
+			modify: func(p *Pool) {
+				p.Validation = &Validation{Rules: []*Rule{{Field: "der_id", Check: "regex"}}}
+			},
+			expectError: true,
+			errorMsg:    "invalid check: regex",
+		},
+		{
+			name: "invalid rule action",
+			modify: func(p *Pool) {
+				p.Validation = &Validation{Rules: []*Rule{{Field: "der_id", Check: "required", Action: "drop"}}}
+			},
+			expectError: true,
+			errorMsg:    "invalid action: drop",
+		},
+		{
+			name: "range without bounds",
+			modify: func(p *Pool) {
+				p.Validation = &Validation{Rules: []*Rule{{Field: "current_soc", Check: "range"}}}
+			},
+			expectError: true,
+			errorMsg:    "range check requires min or max",
+		},
+		{
+			name: "range min above max",
+			modify: func(p *Pool) {
+				p.Validation = &Validation{Rules: []*Rule{{Field: "current_soc", Check: "range", Min: floatPtr(100), Max: floatPtr(0)}}}
+			},
+			expectError: true,
+			errorMsg:    "range min must not be greater than max",
+		},
+		{
+			name: "enum without values",
+			modify: func(p *Pool) {
+				p.Validation = &Validation{Rules: []*Rule{{Field: "type", Check: "enum"}}}
+			},
+			expectError: true,
+			errorMsg:    "enum check requires values",
+		},
+		{
+			name: "skew without bounds",
+			modify: func(p *Pool) {
+				p.Validation = &Validation{Rules: []*Rule{{Field: "timestamp", Check: "skew"}}}
+			},
+			expectError: true,
+			errorMsg:    "skew check requires max_ahead or max_behind",
+		},
+		{
+			name: "negative skew bound",
+			modify: func(p *Pool) {
+				p.Validation = &Validation{Rules: []*Rule{{Field: "timestamp", Check: "skew", MaxBehind: -time.Minute}}}
+			},
+			expectError: true,
+			errorMsg:    "skew bounds cannot be negative",
+		},
+		{
+			name: "clamp an enum",
+			modify: func(p *Pool) {
+				p.Validation = &Validation{Rules: []*Rule{{Field: "type", Check: "enum", Values: []string{"solar"}, Action: "clamp"}}}
+			},
+			expectError: true,
+			errorMsg:    "enum check cannot clamp",
+		},
+		{
+			name: "duplicate rule names",
+			modify: func(p *Pool) {
+				p.Validation = &Validation{Rules: []*Rule{
+					{Field: "der_id", Check: "required"},
+					{Field: "der_id", Check: "required", Action: "flag"},
+				}}
+			},
+			expectError: true,
+			errorMsg:    "duplicate validation rule name: der_id_required",
+		},
+		{
+			name:   "grouped by project by default",
+			modify: func(p *Pool) {},
+			check: func(p *Pool) {
+				s.Equal("project", p.GroupBy)
+			},
+			expectError: false,
+		},
+		{
+			name: "grouped by meter",
+			modify: func(p *Pool) {
+				p.GroupBy = "meter"
+			},
+			expectError: false,
+		},
+		{
+			name: "invalid group by",
+			modify: func(p *Pool) {
+				p.GroupBy = "der"
+			},
+			expectError: true,
+			errorMsg:    "invalid pool group_by: der",
+		},
+		{
+			name: "units",
+			modify: func(p *Pool) {
+				p.Units = "kW"
+			},
+			expectError: false,
+		},
+		{
+			name:   "units are optional",
+			modify: func(p *Pool) {},
+			check: func(p *Pool) {
+				s.Empty(p.Units)
+			},
+			expectError: false,
+		},
+		{
+			name: "invalid units",
+			modify: func(p *Pool) {
+				p.Units = "kWh"
+			},
+			expectError: true,
+			errorMsg:    "invalid pool units: kWh",
+		},
+		{
+			name:   "net output by default",
+			modify: func(p *Pool) {},
+			check: func(p *Pool) {
+				s.Equal("output", p.NetOutput.Default)
+			},
+			expectError: false,
+		},
+		{
+			name: "net output per type and project",
+			modify: func(p *Pool) {
+				p.NetOutput = &NetOutput{
+					Types:    map[string]string{"solar": "generation", "battery": "storage", "ev_charger": "load"},
+					Projects: map[string]*NetOutput{"project1": {Types: map[string]string{"solar": "output"}}},
+				}
+			},
+			check: func(p *Pool) {
+				// A project without a default falls back to the top level one
+				s.Empty(p.NetOutput.Projects["project1"].Default)
+			},
+			expectError: false,
+		},
+		{
+			name: "invalid net output default",
+			modify: func(p *Pool) {
+				p.NetOutput = &NetOutput{Default: "meter"}
+			},
+			expectError: true,
+			errorMsg:    "invalid net output strategy: meter",
+		},
+		{
+			name: "invalid net output type strategy",
+			modify: func(p *Pool) {
+				p.NetOutput = &NetOutput{Types: map[string]string{"solar": "meter"}}
+			},
+			expectError: true,
+			errorMsg:    "invalid net output strategy for type solar: meter",
+		},
+		{
+			name: "invalid net output project strategy",
+			modify: func(p *Pool) {
+				p.NetOutput = &NetOutput{Projects: map[string]*NetOutput{"project1": {Default: "meter"}}}
+			},
+			expectError: true,
+			errorMsg:    "net output project project1: invalid net output strategy: meter",
+		},
+		{
+			name: "empty net output project",
+			modify: func(p *Pool) {
+				p.NetOutput = &NetOutput{Projects: map[string]*NetOutput{"project1": nil}}
+			},
+			expectError: true,
+			errorMsg:    "net output project project1 is empty",
+		},
+		{
+			name: "nested net output projects",
+			modify: func(p *Pool) {
+				nested := map[string]*NetOutput{"project2": {}}
+				p.NetOutput = &NetOutput{Projects: map[string]*NetOutput{"project1": {Projects: nested}}}
+			},
+			expectError: true,
+			errorMsg:    "net output projects cannot be nested",
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			pool := &Pool{NumWorkers: 4, Capacity: 100}
+			tc.modify(pool)
+			err := pool.validate()
+			if tc.expectError {
+				s.Error(err)
+				if tc.errorMsg != "" {
+					s.Contains(err.Error(), tc.errorMsg)
+				}
+			} else {
+				s.NoError(err)
+				if tc.check != nil {
+					tc.check(pool)
+				}
+			}
+		})
+	}
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+func TestConfigSuite(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
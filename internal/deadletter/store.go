@@ -0,0 +1,214 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotFound = errors.New("dead letter entry not found")
+)
+
+const entryExt = ".json"
+
+// Entry is a task that could not be processed, along with why and how many times it has failed
+type Entry struct {
+	Record        task.Record `json:"record"`
+	Class         string      `json:"class"`
+	Reason        string      `json:"reason,omitempty"`
+	Error         string      `json:"error"`
+	Attempts      int         `json:"attempts"`
+	FirstFailedAt time.Time   `json:"first_failed_at"`
+	LastFailedAt  time.Time   `json:"last_failed_at"`
+}
+
+func (e *Entry) ID() string {
+	return e.Record.ID
+}
+
+// Store keeps dead letter entries on disk, one file per task, so that they survive restarts and can
+// be managed while the batcher is not running
+type Store struct {
+	dir string
+	mu  sync.Mutex
+	now func() time.Time
+	log *slog.Logger
+}
+
+func Open(dir string, log *slog.Logger) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "failed to create dead letter directory")
+	}
+	return &Store{
+		dir: dir,
+		now: time.Now,
+		log: log.With("component", "dead_letter", "dir", dir),
+	}, nil
+}
+
+// Put records a failed task. A task that has failed before keeps its first failure time and has
+// its attempt count incremented
+func (s *Store) Put(r task.Record, class string, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	e, err := s.get(r.ID)
+	if errors.Is(err, ErrNotFound) {
+		e = &Entry{Record: r, FirstFailedAt: now}
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	e.Class = class
+	e.Reason = ""
+	var rejection *task.RejectionError
+	if errors.As(cause, &rejection) {
+		e.Reason = rejection.Reason
+	}
+	e.Error = cause.Error()
+	e.Attempts++
+	e.LastFailedAt = now
+
+	if err := s.write(e); err != nil {
+		return errors.WithStack(err)
+	}
+	s.log.Debug("task dead lettered", "id", r.ID, "class", class, "attempts", e.Attempts)
+	return nil
+}
+
+func (s *Store) Get(id string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(id)
+}
+
+// List returns every entry, oldest failure first
+func (s *Store) List() ([]*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+entryExt))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	entries := make([]*Entry, 0, len(paths))
+	for _, path := range paths {
+		e, err := s.get(strings.TrimSuffix(filepath.Base(path), entryExt))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *Entry) int {
+		return a.FirstFailedAt.Compare(b.FirstFailedAt)
+	})
+	return entries, nil
+}
+
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.path(id)); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Wrapf(ErrNotFound, "id %s", id)
+		}
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Resolve removes an entry after a replay of it succeeded, unless it has failed again since the
+// replay started, which shows as a different attempt count
+func (s *Store) Resolve(id string, attempts int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.get(id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if e.Attempts != attempts {
+		return nil
+	}
+	if err := os.Remove(s.path(id)); err != nil {
+		return errors.WithStack(err)
+	}
+	s.log.Info("dead letter entry resolved", "id", id, "attempts", attempts)
+	return nil
+}
+
+// Purge removes every entry and returns how many were removed
+func (s *Store) Purge() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+entryExt))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	for i, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return i, errors.WithStack(err)
+		}
+	}
+	return len(paths), nil
+}
+
+func (s *Store) get(id string) (*Entry, error) {
+	data, err := os.ReadFile(s.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrapf(ErrNotFound, "id %s", id)
+		}
+		return nil, errors.WithStack(err)
+	}
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, errors.Wrapf(err, "invalid dead letter entry %s", id)
+	}
+	return &e, nil
+}
+
+// write replaces the entry atomically, so that a crash never leaves a partly written entry behind
+func (s *Store) write(e *Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode dead letter entry")
+	}
+	tmp, err := os.CreateTemp(s.dir, ".entry-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write dead letter entry")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to sync dead letter entry")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(e.ID())); err != nil {
+		return errors.Wrap(err, "failed to store dead letter entry")
+	}
+	return nil
+}
+
+func (s *Store) path(id string) string {
+	// Task IDs are URL safe base64, but IDs typed on the command line are not trusted
+	return filepath.Join(s.dir, filepath.Base(id)+entryExt)
+}
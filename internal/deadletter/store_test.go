@@ -0,0 +1,120 @@
+package deadletter
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+)
+
+type StoreTestSuite struct {
+	suite.Suite
+	store *Store
+	now   time.Time
+}
+
+func (s *StoreTestSuite) SetupTest() {
+	store, err := Open(s.T().TempDir(), slog.Default())
+	s.Require().NoError(err)
+	s.now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return s.now }
+	s.store = store
+}
+
+func (s *StoreTestSuite) record(payload string) task.Record {
+	t := task.NewTaskWithMetadata([]byte(payload), task.Metadata{Topic: "grid/project1/ders"})
+	return t.Record()
+}
+
+func (s *StoreTestSuite) TestPut() {
+	rec := s.record(`[{"der_id":`)
+	s.NoError(s.store.Put(rec, task.FailureParse, errors.New("unexpected end of JSON input")))
+
+	first := s.now
+	s.now = s.now.Add(time.Minute)
+	s.NoError(s.store.Put(rec, task.FailureUndeliverable, errors.New("stream closed")))
+
+	e, err := s.store.Get(rec.ID)
+	s.Require().NoError(err)
+	s.Equal(rec.ID, e.ID())
+	s.Equal(rec.Payload, e.Record.Payload)
+	s.Equal("grid/project1/ders", e.Record.Metadata.Topic)
+	s.Equal(task.FailureUndeliverable, e.Class)
+	s.Equal("stream closed", e.Error)
+	s.Equal(2, e.Attempts)
+	s.Equal(first, e.FirstFailedAt.UTC())
+	s.Equal(s.now, e.LastFailedAt.UTC())
+
+	// No temporary files are left behind
+	files, err := os.ReadDir(s.store.dir)
+	s.NoError(err)
+	s.Len(files, 1)
+}
+
+func (s *StoreTestSuite) TestPutRejectionReason() {
+	rec := s.record(`[{"der_id":"der1","current_soc":140}]`)
+	cause := errors.Wrap(&task.RejectionError{Reason: "current_soc_range", Detail: "current_soc 140 is above 100"}, "task failed")
+	s.NoError(s.store.Put(rec, task.FailureRejected, cause))
+
+	e, err := s.store.Get(rec.ID)
+	s.Require().NoError(err)
+	s.Equal(task.FailureRejected, e.Class)
+	s.Equal("current_soc_range", e.Reason)
+}
+
+func (s *StoreTestSuite) TestListDeletePurge() {
+	records := []task.Record{s.record(`[1]`), s.record(`[2]`), s.record(`[3]`)}
+	for _, rec := range records {
+		s.NoError(s.store.Put(rec, task.FailureEmpty, errors.New("received empty DER array")))
+		s.now = s.now.Add(time.Second)
+	}
+
+	entries, err := s.store.List()
+	s.NoError(err)
+	s.Require().Len(entries, 3)
+	for i, e := range entries {
+		s.Equal(records[i].ID, e.ID())
+	}
+
+	s.NoError(s.store.Delete(records[0].ID))
+	s.ErrorIs(s.store.Delete(records[0].ID), ErrNotFound)
+	_, err = s.store.Get(records[0].ID)
+	s.ErrorIs(err, ErrNotFound)
+
+	n, err := s.store.Purge()
+	s.NoError(err)
+	s.Equal(2, n)
+	entries, err = s.store.List()
+	s.NoError(err)
+	s.Empty(entries)
+}
+
+func (s *StoreTestSuite) TestResolve() {
+	rec := s.record(`[]`)
+	s.NoError(s.store.Put(rec, task.FailureEmpty, errors.New("received empty DER array")))
+
+	// The entry failed again after the replay started, so it is kept
+	s.NoError(s.store.Put(rec, task.FailureEmpty, errors.New("received empty DER array")))
+	s.NoError(s.store.Resolve(rec.ID, 1))
+	_, err := s.store.Get(rec.ID)
+	s.NoError(err)
+
+	s.NoError(s.store.Resolve(rec.ID, 2))
+	_, err = s.store.Get(rec.ID)
+	s.ErrorIs(err, ErrNotFound)
+}
+
+func (s *StoreTestSuite) TestPathTraversal() {
+	outside := filepath.Join(filepath.Dir(s.store.dir), "outside"+entryExt)
+	s.Equal(filepath.Join(s.store.dir, "outside"+entryExt), s.store.path("../outside"))
+	s.NotEqual(outside, s.store.path("../outside"))
+}
+
+func TestStoreSuite(t *testing.T) {
+	suite.Run(t, new(StoreTestSuite))
+}
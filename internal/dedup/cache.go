@@ -0,0 +1,153 @@
+package dedup
+
+import (
+	"container/list"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/pkg/errors"
+)
+
+// Cache remembers keys for a window after they are first seen. It holds at most MaxEntries keys,
+// evicting the least recently seen once full, and can be saved to disk so that a restart does not
+// forget them
+type Cache struct {
+	cfg     *config.Dedup
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	log     *slog.Logger
+}
+
+type entry struct {
+	Key    string    `json:"key"`
+	SeenAt time.Time `json:"seen_at"`
+}
+
+// New creates a cache, loading the keys saved at cfg.Path when there are any
+func New(cfg *config.Dedup, log *slog.Logger) (*Cache, error) {
+	c := &Cache{
+		cfg:     cfg,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		log:     log.With("component", "dedup"),
+	}
+	if cfg.Path == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(cfg.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read dedup cache")
+	}
+	var saved []entry
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, errors.Wrap(err, "failed to decode dedup cache")
+	}
+
+	// Entries are saved least recently seen first, so pushing each to the front restores the order
+	now := time.Now()
+	for _, e := range saved {
+		if now.Sub(e.SeenAt) < cfg.Window {
+			c.add(e)
+		}
+	}
+	c.log.Info("dedup cache loaded", "path", cfg.Path, "entries", c.order.Len(), "expired", len(saved)-c.order.Len())
+	return c, nil
+}
+
+// Seen reports whether key was seen within the window, and records it as seen now if not
+func (c *Cache) Seen(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(entry)
+		if now.Sub(e.SeenAt) < c.cfg.Window {
+			c.order.MoveToFront(el)
+			return true
+		}
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	c.add(entry{Key: key, SeenAt: now})
+	return false
+}
+
+// Forget removes key, so that it is let through the next time it is seen
+func (c *Cache) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c *Cache) add(e entry) {
+	c.entries[e.Key] = c.order.PushFront(e)
+	for c.order.Len() > c.cfg.MaxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(entry).Key)
+	}
+}
+
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Save writes the keys to cfg.Path, replacing the previous save atomically. It does nothing when
+// the cache is not persisted
+func (c *Cache) Save() error {
+	if c.cfg.Path == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	saved := make([]entry, 0, c.order.Len())
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		saved = append(saved, el.Value.(entry))
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode dedup cache")
+	}
+	dir := filepath.Dir(c.cfg.Path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return errors.Wrap(err, "failed to create dedup cache directory")
+	}
+	tmp, err := os.CreateTemp(dir, ".dedup-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write dedup cache")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to sync dedup cache")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmp.Name(), c.cfg.Path); err != nil {
+		return errors.Wrap(err, "failed to save dedup cache")
+	}
+	c.log.Debug("dedup cache saved", "path", c.cfg.Path, "entries", len(saved))
+	return nil
+}
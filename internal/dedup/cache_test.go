@@ -0,0 +1,79 @@
+package dedup
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/stretchr/testify/suite"
+)
+
+type CacheTestSuite struct {
+	suite.Suite
+}
+
+func (s *CacheTestSuite) TestSeen() {
+	c, err := New(&config.Dedup{Window: time.Minute, MaxEntries: 10}, slog.Default())
+	s.Require().NoError(err)
+	now := time.Now()
+
+	s.False(c.Seen("der1", now))
+	s.True(c.Seen("der1", now.Add(30*time.Second)))
+	// The window runs from when the key was first seen
+	s.False(c.Seen("der1", now.Add(time.Minute)))
+	s.Equal(1, c.Len())
+}
+
+func (s *CacheTestSuite) TestForget() {
+	c, err := New(&config.Dedup{Window: time.Minute, MaxEntries: 10}, slog.Default())
+	s.Require().NoError(err)
+	now := time.Now()
+
+	s.False(c.Seen("der1", now))
+	c.Forget("der1")
+	c.Forget("der2")
+	s.Zero(c.Len())
+	s.False(c.Seen("der1", now))
+}
+
+func (s *CacheTestSuite) TestBounded() {
+	c, err := New(&config.Dedup{Window: time.Hour, MaxEntries: 3}, slog.Default())
+	s.Require().NoError(err)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		s.False(c.Seen(fmt.Sprintf("der%d", i), now))
+	}
+	// Seeing der0 again makes der1 the least recently seen, so it is evicted for der3
+	s.True(c.Seen("der0", now))
+	s.False(c.Seen("der3", now))
+	s.Equal(3, c.Len())
+
+	s.True(c.Seen("der0", now))
+	s.True(c.Seen("der2", now))
+	s.True(c.Seen("der3", now))
+	s.False(c.Seen("der1", now))
+}
+
+func (s *CacheTestSuite) TestPersisted() {
+	cfg := &config.Dedup{Window: time.Minute, MaxEntries: 2, Path: filepath.Join(s.T().TempDir(), "dedup", "cache.json")}
+	c, err := New(cfg, slog.Default())
+	s.Require().NoError(err)
+	now := time.Now()
+	c.Seen("expired", now.Add(-2*time.Minute))
+	c.Seen("der1", now)
+	s.Require().NoError(c.Save())
+
+	restored, err := New(cfg, slog.Default())
+	s.Require().NoError(err)
+	s.Equal(1, restored.Len())
+	s.True(restored.Seen("der1", now))
+	s.False(restored.Seen("expired", now))
+}
+
+func TestCacheSuite(t *testing.T) {
+	suite.Run(t, new(CacheTestSuite))
+}
@@ -0,0 +1,118 @@
+package destination
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "open"
+	}
+}
+
+// breaker opens after threshold consecutive failures. Once the open timeout has passed a single
+// trial call is let through, closing the breaker on success and opening it again on failure
+type breaker struct {
+	threshold int
+	timeout   time.Duration
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	now       func() time.Time
+	onChange  func(from, to breakerState)
+}
+
+func newBreaker(threshold int, timeout time.Duration, onChange func(from, to breakerState)) *breaker {
+	return &breaker{
+		threshold: threshold,
+		timeout:   timeout,
+		now:       time.Now,
+		onChange:  onChange,
+	}
+}
+
+// Allow reports whether a call may go ahead. Every allowed call must be followed by Done
+func (b *breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.timeout {
+			return false
+		}
+		b.set(breakerHalfOpen)
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		// Only the trial call goes through until it has finished
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Done records the result of an allowed call
+func (b *breaker) Done(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.trial = false
+		if ok {
+			b.failures = 0
+			b.set(breakerClosed)
+		} else {
+			b.open()
+		}
+		return
+	}
+
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerClosed && b.failures >= b.threshold {
+		b.open()
+	}
+}
+
+func (b *breaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *breaker) open() {
+	b.openedAt = b.now()
+	b.set(breakerOpen)
+}
+
+func (b *breaker) set(to breakerState) {
+	from := b.state
+	b.state = to
+	if from != to && b.onChange != nil {
+		b.onChange(from, to)
+	}
+}
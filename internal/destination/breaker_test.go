@@ -0,0 +1,78 @@
+package destination
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type BreakerTestSuite struct {
+	suite.Suite
+	now         time.Time
+	transitions []breakerState
+	b           *breaker
+}
+
+func (s *BreakerTestSuite) SetupTest() {
+	s.now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.transitions = nil
+	s.b = newBreaker(2, time.Minute, func(_, to breakerState) {
+		s.transitions = append(s.transitions, to)
+	})
+	s.b.now = func() time.Time { return s.now }
+}
+
+func (s *BreakerTestSuite) fail() {
+	s.Require().True(s.b.Allow())
+	s.b.Done(false)
+}
+
+func (s *BreakerTestSuite) TestOpensAfterThreshold() {
+	s.fail()
+	s.Equal(breakerClosed, s.b.State())
+
+	// A success resets the count of consecutive failures
+	s.True(s.b.Allow())
+	s.b.Done(true)
+	s.fail()
+	s.Equal(breakerClosed, s.b.State())
+
+	s.fail()
+	s.Equal(breakerOpen, s.b.State())
+	s.False(s.b.Allow())
+	s.Equal([]breakerState{breakerOpen}, s.transitions)
+}
+
+func (s *BreakerTestSuite) TestHalfOpen() {
+	testCases := []struct {
+		name     string
+		trialOK  bool
+		expected breakerState
+	}{
+		{name: "trial succeeds", trialOK: true, expected: breakerClosed},
+		{name: "trial fails", trialOK: false, expected: breakerOpen},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+			s.fail()
+			s.fail()
+
+			s.now = s.now.Add(time.Minute)
+			s.True(s.b.Allow())
+			s.Equal(breakerHalfOpen, s.b.State())
+			// Only one trial call is let through
+			s.False(s.b.Allow())
+
+			s.b.Done(tc.trialOK)
+			s.Equal(tc.expected, s.b.State())
+			s.Equal([]breakerState{breakerOpen, breakerHalfOpen, tc.expected}, s.transitions)
+		})
+	}
+}
+
+func TestBreakerSuite(t *testing.T) {
+	suite.Run(t, new(BreakerTestSuite))
+}
@@ -6,3 +6,14 @@ type Destination interface {
 	Add(ctx context.Context, data any) error
 	Close() error
 }
+
+// AckDeferrer is implemented by destinations that acknowledge outcomes themselves once they are
+// committed, rather than as soon as Add returns
+type AckDeferrer interface {
+	DefersAck() bool
+}
+
+func DefersAck(d Destination) bool {
+	ad, ok := d.(AckDeferrer)
+	return ok && ad.DefersAck()
+}
@@ -7,14 +7,16 @@ import (
 	"github.com/grid-stream-org/batcher/internal/buffer"
 	"github.com/grid-stream-org/batcher/internal/config"
 	"github.com/grid-stream-org/batcher/internal/outcome"
+	"github.com/grid-stream-org/batcher/internal/types"
 	"github.com/grid-stream-org/go-commons/pkg/bqclient"
 	"github.com/pkg/errors"
 )
 
 type eventDestination struct {
-	client bqclient.BQClient
-	buf    *buffer.Buffer
-	log    *slog.Logger
+	client    bqclient.BQClient
+	buf       *buffer.Buffer
+	lateTable string
+	log       *slog.Logger
 }
 
 func newEventDestination(ctx context.Context, cfg *config.Destination, log *slog.Logger) (Destination, error) {
@@ -24,8 +26,9 @@ func newEventDestination(ctx context.Context, cfg *config.Destination, log *slog
 	}
 
 	d := &eventDestination{
-		client: client,
-		log:    log.With("component", "event_destination"),
+		client:    client,
+		lateTable: cfg.Buffer.LateTable,
+		log:       log.With("component", "event_destination"),
 	}
 
 	buf, err := buffer.New(ctx, cfg.Buffer, d.flushFunc, log)
@@ -34,7 +37,8 @@ func newEventDestination(ctx context.Context, cfg *config.Destination, log *slog
 	}
 
 	d.buf = buf
-	d.buf.Start(ctx)
+	// The final flush waits for Close, so that it includes everything the task pool drains on shutdown
+	d.buf.Start(context.WithoutCancel(ctx))
 	return d, nil
 }
 
@@ -47,6 +51,11 @@ func (d *eventDestination) Add(ctx context.Context, data any) error {
 	return nil
 }
 
+// DefersAck is true because outcomes are only committed when the buffer flushes
+func (d *eventDestination) DefersAck() bool {
+	return true
+}
+
 func (d *eventDestination) Close() error {
 	if err := d.buf.Stop(); err != nil {
 		return errors.WithStack(err)
@@ -61,15 +70,32 @@ func (d *eventDestination) Close() error {
 }
 
 func (d *eventDestination) flushFunc(ctx context.Context, data *buffer.FlushOutcome) error {
-	if len(data.Outcomes) == 0 {
+	if len(data.Outcomes) == 0 && len(data.Late) == 0 {
 		d.log.Debug("no outcomes to flush")
 		return nil
 	}
 
-	if err := d.client.StreamPut(ctx, "project_averages", data.AvgOutputs); err != nil {
-		return errors.WithStack(err)
+	if len(data.AvgOutputs) > 0 {
+		if err := d.client.StreamPut(ctx, "project_averages", data.AvgOutputs); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	// Late readings are kept apart, so that the averages already sent stay the ones on record
+	var late []types.RealTimeDERData
+	for _, o := range data.Late {
+		late = append(late, o.Data...)
+	}
+	if len(late) > 0 {
+		rows, err := derRows(late)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := d.client.StreamPut(ctx, d.lateTable, rows); err != nil {
+			return errors.WithStack(err)
+		}
 	}
 
-	d.log.Debug("successfully flushed data to bigquery", "avg_records", len(data.AvgOutputs))
+	d.log.Debug("successfully flushed data to bigquery", "avg_records", len(data.AvgOutputs), "late_records", len(late))
 	return nil
 }
@@ -47,3 +47,17 @@ func (m *MockBuffer) Flush(ctx context.Context) error {
 	args := m.Called(ctx)
 	return args.Error(0)
 }
+
+type MockDestination struct {
+	mock.Mock
+}
+
+func (m *MockDestination) Add(ctx context.Context, data any) error {
+	args := m.Called(ctx, data)
+	return args.Error(0)
+}
+
+func (m *MockDestination) Close() error {
+	args := m.Called()
+	return args.Error(0)
+}
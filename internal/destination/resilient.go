@@ -0,0 +1,237 @@
+package destination
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/outcome"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+// Retryable reports whether a failed write may succeed if it is tried again
+func Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	// Rows BigQuery rejected will be rejected again
+	var putErr bigquery.PutMultiError
+	if errors.As(err, &putErr) {
+		return false
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		default:
+			return false
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// Anything unrecognised is assumed to be transient, max attempts bounds the cost of being wrong
+	return true
+}
+
+// resilientDestination retries failed writes to the destination it wraps and, through a circuit
+// breaker, stops writing to it while it keeps failing
+type resilientDestination struct {
+	name     string
+	dest     Destination
+	retry    *config.Retry
+	breaker  *breaker
+	fallback func(o *outcome.Outcome) error
+	closer   func() error
+	sleep    func(ctx context.Context, d time.Duration) error
+	log      *slog.Logger
+}
+
+// withResilience wraps dest when the config asks for retries or a circuit breaker
+func withResilience(name string, dest Destination, cfg *config.Destination, log *slog.Logger) (Destination, error) {
+	if cfg.Retry == nil && cfg.Breaker == nil {
+		return dest, nil
+	}
+
+	d := &resilientDestination{
+		name:  name,
+		dest:  dest,
+		retry: cfg.Retry,
+		sleep: sleepCtx,
+		log:   log.With("component", "resilient_destination"),
+	}
+	if d.retry == nil {
+		d.retry = &config.Retry{MaxAttempts: 1}
+	}
+
+	if cfg.Breaker != nil {
+		state := metrics.Local.Gauge(metrics.BreakerState).WithLabelValues(name)
+		state.Set(float64(breakerClosed))
+		d.breaker = newBreaker(cfg.Breaker.FailureThreshold, cfg.Breaker.OpenTimeout, func(from, to breakerState) {
+			state.Set(float64(to))
+			d.log.Warn("circuit breaker state changed", "from", from.String(), "to", to.String())
+		})
+
+		if cfg.Breaker.Fallback == "file" {
+			fb, err := newFileFallback(cfg.Breaker.FallbackPath)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			d.fallback = fb.Write
+			d.closer = fb.Close
+		}
+	}
+
+	d.log.Info("destination wrapped with retries",
+		"max_attempts", d.retry.MaxAttempts,
+		"breaker", cfg.Breaker != nil,
+		"file_fallback", d.fallback != nil,
+	)
+	return d, nil
+}
+
+func (d *resilientDestination) Add(ctx context.Context, data any) error {
+	o, ok := data.(*outcome.Outcome)
+	if !ok {
+		return errors.Errorf("expected *outcome.Outcome, got %T", data)
+	}
+
+	if d.breaker != nil && !d.breaker.Allow() {
+		return d.useFallback(o, errors.Wrapf(ErrCircuitOpen, "destination %s", d.name))
+	}
+
+	err := d.addWithRetry(ctx, o)
+	if d.breaker != nil {
+		// A cancelled write says nothing about the health of the destination
+		d.breaker.Done(err == nil || errors.Is(err, context.Canceled))
+	}
+	if err != nil {
+		return d.useFallback(o, err)
+	}
+	return nil
+}
+
+func (d *resilientDestination) addWithRetry(ctx context.Context, o *outcome.Outcome) error {
+	backoff := d.retry.InitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = d.dest.Add(ctx, o); err == nil {
+			return nil
+		}
+		if attempt >= d.retry.MaxAttempts || !Retryable(err) {
+			return errors.Wrapf(err, "write failed after %d attempts", attempt)
+		}
+
+		wait := jitter(backoff, d.retry.Jitter)
+		d.log.Warn("destination write failed, retrying", "attempt", attempt, "backoff", wait.String(), "error", err)
+		metrics.Local.Counter(metrics.WriteRetries).WithLabelValues(d.name).Inc()
+		if sleepErr := d.sleep(ctx, wait); sleepErr != nil {
+			return multierr.Combine(err, sleepErr)
+		}
+		backoff = min(time.Duration(float64(backoff)*d.retry.Multiplier), d.retry.MaxBackoff)
+	}
+}
+
+// useFallback writes the outcome to the fallback file when there is one. Otherwise the error is
+// returned so that the task pool dead letters the task
+func (d *resilientDestination) useFallback(o *outcome.Outcome, cause error) error {
+	if d.fallback == nil {
+		return cause
+	}
+	if err := d.fallback(o); err != nil {
+		return multierr.Combine(cause, errors.Wrap(err, "fallback write failed"))
+	}
+	metrics.Local.Counter(metrics.FallbackWrites).WithLabelValues(d.name).Inc()
+	// The fallback has committed the outcome, even if the destination would have acknowledged it later
+	o.Ack()
+	return nil
+}
+
+func (d *resilientDestination) DefersAck() bool {
+	return DefersAck(d.dest)
+}
+
+func (d *resilientDestination) Close() error {
+	err := d.dest.Close()
+	if d.closer != nil {
+		err = multierr.Append(err, d.closer())
+	}
+	return errors.WithStack(err)
+}
+
+// jitter spreads d by up to the given fraction either side
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction == 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + fraction*(2*rand.Float64()-1)))
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+// fileFallback appends outcomes to a local JSONL file so that they can be loaded once the
+// destination recovers
+type fileFallback struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newFileFallback(path string) (*fileFallback, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, errors.Wrap(err, "failed to create fallback directory")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open fallback file")
+	}
+	return &fileFallback{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (f *fileFallback) Write(o *outcome.Outcome) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.enc.Encode(o); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.file.Sync())
+}
+
+func (f *fileFallback) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return errors.WithStack(f.file.Close())
+}
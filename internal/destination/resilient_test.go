@@ -0,0 +1,169 @@
+package destination
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/outcome"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/api/googleapi"
+)
+
+type ResilientTestSuite struct {
+	suite.Suite
+	ctx    context.Context
+	sleeps []time.Duration
+}
+
+func (s *ResilientTestSuite) SetupSuite() {
+	metrics.InitMetricsProvider()
+}
+
+func (s *ResilientTestSuite) SetupTest() {
+	s.ctx = context.Background()
+	s.sleeps = nil
+}
+
+func (s *ResilientTestSuite) wrap(name string, inner Destination, cfg *config.Destination) *resilientDestination {
+	dest, err := withResilience(name, inner, cfg, slog.Default())
+	s.Require().NoError(err)
+	d := dest.(*resilientDestination)
+	d.sleep = func(_ context.Context, d time.Duration) error {
+		s.sleeps = append(s.sleeps, d)
+		return nil
+	}
+	return d
+}
+
+func (s *ResilientTestSuite) TestRetryable() {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "unknown", err: errors.New("connection reset"), expected: true},
+		{name: "cancelled", err: errors.WithStack(context.Canceled), expected: false},
+		{name: "unavailable", err: errors.WithStack(&googleapi.Error{Code: http.StatusServiceUnavailable}), expected: true},
+		{name: "rate limited", err: &googleapi.Error{Code: http.StatusTooManyRequests}, expected: true},
+		{name: "bad request", err: &googleapi.Error{Code: http.StatusBadRequest}, expected: false},
+		{name: "rejected rows", err: errors.WithStack(bigquery.PutMultiError{}), expected: false},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			s.Equal(tc.expected, Retryable(tc.err))
+		})
+	}
+}
+
+func (s *ResilientTestSuite) TestUnwrapped() {
+	inner := &MockDestination{}
+	dest, err := withResilience("plain", inner, &config.Destination{Type: "stdout"}, slog.Default())
+	s.NoError(err)
+	s.Same(inner, dest)
+}
+
+func (s *ResilientTestSuite) TestRetry() {
+	transient := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	testCases := []struct {
+		name     string
+		errs     []error
+		calls    int
+		sleeps   []time.Duration
+		expected bool
+	}{
+		{name: "first attempt", errs: []error{nil}, calls: 1, expected: true},
+		{name: "recovers", errs: []error{transient, transient, nil}, calls: 3, sleeps: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}, expected: true},
+		{name: "exhausted", errs: []error{transient, transient, transient, transient}, calls: 4, sleeps: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond}},
+		{name: "permanent", errs: []error{&googleapi.Error{Code: http.StatusForbidden}}, calls: 1},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			s.SetupTest()
+			inner := &MockDestination{}
+			for _, err := range tc.errs {
+				inner.On("Add", mock.Anything, mock.Anything).Return(err).Once()
+			}
+			d := s.wrap("retry", inner, &config.Destination{Retry: &config.Retry{
+				MaxAttempts:    4,
+				InitialBackoff: 100 * time.Millisecond,
+				MaxBackoff:     250 * time.Millisecond,
+				Multiplier:     2,
+			}})
+
+			err := d.Add(s.ctx, &outcome.Outcome{})
+			s.Equal(tc.expected, err == nil)
+			inner.AssertNumberOfCalls(s.T(), "Add", tc.calls)
+			s.Equal(tc.sleeps, s.sleeps)
+		})
+	}
+}
+
+func (s *ResilientTestSuite) TestBreakerDeadLetterFallback() {
+	inner := &MockDestination{}
+	inner.On("Add", mock.Anything, mock.Anything).Return(errors.New("stream closed"))
+	d := s.wrap("breaker", inner, &config.Destination{Breaker: &config.Breaker{FailureThreshold: 2, OpenTimeout: time.Minute, Fallback: "dead_letter"}})
+	state := metrics.Local.Gauge(metrics.BreakerState).WithLabelValues("breaker")
+
+	s.Error(d.Add(s.ctx, &outcome.Outcome{}))
+	s.Error(d.Add(s.ctx, &outcome.Outcome{}))
+	s.Equal(float64(breakerOpen), testutil.ToFloat64(state))
+
+	// While open the destination is not called and the error is left for the task pool to dead letter
+	err := d.Add(s.ctx, &outcome.Outcome{})
+	s.ErrorIs(err, ErrCircuitOpen)
+	inner.AssertNumberOfCalls(s.T(), "Add", 2)
+}
+
+func (s *ResilientTestSuite) TestBreakerFileFallback() {
+	path := filepath.Join(s.T().TempDir(), "fallback", "outcomes.jsonl")
+	inner := &MockDestination{}
+	inner.On("Add", mock.Anything, mock.Anything).Return(errors.New("stream closed"))
+	inner.On("Close").Return(nil)
+	d := s.wrap("file", inner, &config.Destination{Breaker: &config.Breaker{
+		FailureThreshold: 1,
+		OpenTimeout:      time.Minute,
+		Fallback:         "file",
+		FallbackPath:     path,
+	}})
+
+	acks := 0
+	for _, id := range []string{"task1", "task2"} {
+		o := &outcome.Outcome{TaskID: id}
+		o.SetAck(func() { acks++ })
+		s.NoError(d.Add(s.ctx, o))
+	}
+	s.Equal(2, acks)
+	inner.AssertNumberOfCalls(s.T(), "Add", 1)
+	s.NoError(d.Close())
+
+	f, err := os.Open(path)
+	s.Require().NoError(err)
+	defer f.Close()
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var o outcome.Outcome
+		s.NoError(json.Unmarshal(scanner.Bytes(), &o))
+		ids = append(ids, o.TaskID)
+	}
+	s.Equal([]string{"task1", "task2"}, ids)
+}
+
+func TestResilientSuite(t *testing.T) {
+	suite.Run(t, new(ResilientTestSuite))
+}
@@ -0,0 +1,81 @@
+package destination
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/topic"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+var (
+	ErrNoRoute = errors.New("no destination routes topic")
+)
+
+// Router owns every named destination and picks the one a topic is routed to
+type Router struct {
+	dests  map[string]Destination
+	routes []*config.Route
+	log    *slog.Logger
+}
+
+func NewRouter(ctx context.Context, cfgs map[string]*config.Destination, routes []*config.Route, log *slog.Logger) (*Router, error) {
+	r := &Router{
+		dests:  make(map[string]Destination, len(cfgs)),
+		routes: routes,
+		log:    log.With("component", "router"),
+	}
+
+	for name, cfg := range cfgs {
+		dest, err := NewDestination(ctx, cfg, log.With("destination", name))
+		if err != nil {
+			r.Close() // best effort cleanup
+			return nil, errors.Wrapf(err, "failed to create destination %s", name)
+		}
+		r.dests[name] = dest
+
+		if dest, err = withResilience(name, dest, cfg, log.With("destination", name)); err != nil {
+			r.Close() // best effort cleanup
+			return nil, errors.Wrapf(err, "failed to create destination %s", name)
+		}
+		r.dests[name] = dest
+	}
+
+	r.log.Info("router created", "destinations", len(r.dests), "routes", len(r.routes))
+	return r, nil
+}
+
+// NewStaticRouter builds a router over destinations that have already been created
+func NewStaticRouter(dests map[string]Destination, routes []*config.Route, log *slog.Logger) *Router {
+	return &Router{
+		dests:  dests,
+		routes: routes,
+		log:    log.With("component", "router"),
+	}
+}
+
+// Route returns the name of the destination for topic and the destination itself. Routes are
+// tried in order, and topics no route claims go to the default destination when there is one
+func (r *Router) Route(t string) (string, Destination, error) {
+	for _, route := range r.routes {
+		if topic.Match(route.Topic, t) {
+			return route.Destination, r.dests[route.Destination], nil
+		}
+	}
+	if dest, ok := r.dests[config.DefaultDestination]; ok {
+		return config.DefaultDestination, dest, nil
+	}
+	return "", nil, errors.Wrapf(ErrNoRoute, "topic %q", t)
+}
+
+func (r *Router) Close() error {
+	var err error
+	for name, dest := range r.dests {
+		if closeErr := dest.Close(); closeErr != nil {
+			err = multierr.Append(err, errors.Wrapf(closeErr, "failed to close destination %s", name))
+		}
+	}
+	return err
+}
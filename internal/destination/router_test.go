@@ -0,0 +1,87 @@
+package destination
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/stretchr/testify/suite"
+)
+
+type RouterTestSuite struct {
+	suite.Suite
+	ctx context.Context
+	log *slog.Logger
+}
+
+func (s *RouterTestSuite) SetupTest() {
+	s.ctx = context.Background()
+	s.log = slog.Default()
+}
+
+func (s *RouterTestSuite) TestRoute() {
+	cfgs := map[string]*config.Destination{
+		config.DefaultDestination: {Type: "stdout"},
+		"test":                    {Type: "stdout"},
+		"utility":                 {Type: "stdout"},
+	}
+	routes := []*config.Route{
+		{Topic: "grid/test/#", Destination: "test"},
+		{Topic: "grid/+/utility", Destination: "utility"},
+	}
+	router, err := NewRouter(s.ctx, cfgs, routes, s.log)
+	s.Require().NoError(err)
+	defer router.Close()
+
+	testCases := []struct {
+		topic    string
+		expected string
+	}{
+		{"grid/test/ders", "test"},
+		{"grid/test/utility", "test"}, // first matching route wins
+		{"grid/project1/utility", "utility"},
+		{"grid/project1/ders", config.DefaultDestination},
+		{"", config.DefaultDestination},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.topic, func() {
+			name, dest, err := router.Route(tc.topic)
+			s.NoError(err)
+			s.Equal(tc.expected, name)
+			s.Same(router.dests[tc.expected], dest)
+		})
+	}
+}
+
+func (s *RouterTestSuite) TestRouteWithoutDefault() {
+	dest, err := newStdoutDestination(s.log)
+	s.Require().NoError(err)
+	router := NewStaticRouter(
+		map[string]Destination{"test": dest},
+		[]*config.Route{{Topic: "grid/test/#", Destination: "test"}},
+		s.log,
+	)
+
+	name, _, err := router.Route("grid/test/ders")
+	s.NoError(err)
+	s.Equal("test", name)
+
+	_, _, err = router.Route("grid/project1/ders")
+	s.ErrorIs(err, ErrNoRoute)
+}
+
+func (s *RouterTestSuite) TestNewRouterInvalidDestination() {
+	cfgs := map[string]*config.Destination{
+		"broken": {Type: "invalid"},
+	}
+	router, err := NewRouter(s.ctx, cfgs, nil, s.log)
+	s.Error(err)
+	s.Nil(router)
+	s.Contains(err.Error(), "failed to create destination broken")
+}
+
+func TestRouterSuite(t *testing.T) {
+	suite.Run(t, new(RouterTestSuite))
+}
@@ -3,9 +3,12 @@ package destination
 import (
 	"context"
 	"log/slog"
+	"sync"
 
+	"cloud.google.com/go/bigquery"
 	"github.com/grid-stream-org/batcher/internal/config"
 	"github.com/grid-stream-org/batcher/internal/outcome"
+	"github.com/grid-stream-org/batcher/internal/types"
 	"github.com/grid-stream-org/go-commons/pkg/bqclient"
 	"github.com/pkg/errors"
 )
@@ -35,13 +38,36 @@ func (d *streamDestination) Add(ctx context.Context, data any) error {
 		return errors.Errorf("expected *outcome.Outcome, got %T", data)
 	}
 
-	if err := d.client.StreamPut(ctx, "der_data", outcome.Data); err != nil {
+	rows, err := derRows(outcome.Data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := d.client.StreamPut(ctx, "der_data", rows); err != nil {
 		return errors.WithStack(err)
 	}
 
 	return nil
 }
 
+var derSchema = sync.OnceValues(func() (bigquery.Schema, error) {
+	return bigquery.InferSchema(types.RealTimeDERData{})
+})
+
+// derRows uses the row IDs as insert IDs, so that BigQuery drops rows that a retry, redelivery or
+// replay sends again. Its deduplication is best effort, the deterministic id column lets queries
+// remove anything that gets through
+func derRows(data []types.RealTimeDERData) ([]*bigquery.StructSaver, error) {
+	schema, err := derSchema()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to infer der_data schema")
+	}
+	rows := make([]*bigquery.StructSaver, len(data))
+	for i, d := range data {
+		rows[i] = &bigquery.StructSaver{Schema: schema, InsertID: d.ID, Struct: d}
+	}
+	return rows, nil
+}
+
 func (d *streamDestination) Close() error {
 	if err := d.client.Close(); err != nil {
 		return errors.WithStack(err)
@@ -0,0 +1,33 @@
+package destination
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/types"
+	"github.com/stretchr/testify/suite"
+)
+
+type StreamTestSuite struct {
+	suite.Suite
+}
+
+func (s *StreamTestSuite) TestDERRows() {
+	der := types.DER{DerID: "der1", ProjectID: "project1", Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), CurrentOutput: 1.5}
+	data := []types.RealTimeDERData{{ID: der.RowID(), DER: der}}
+
+	rows, err := derRows(data)
+	s.Require().NoError(err)
+	s.Require().Len(rows, 1)
+
+	row, insertID, err := rows[0].Save()
+	s.Require().NoError(err)
+	s.Equal(der.RowID(), insertID)
+	s.Equal(der.RowID(), row["id"])
+	s.Equal("der1", row["der_id"])
+	s.Equal(1.5, row["current_output"])
+}
+
+func TestStreamSuite(t *testing.T) {
+	suite.Run(t, new(StreamTestSuite))
+}
@@ -1,111 +1,409 @@
 package mqtt
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/google/uuid"
 	"github.com/grid-stream-org/batcher/internal/config"
 	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/grid-stream-org/batcher/internal/topic"
+	"github.com/grid-stream-org/batcher/metrics"
 	"github.com/grid-stream-org/go-commons/pkg/eventbus"
 	"github.com/pkg/errors"
 )
 
+// Message is a received publish, independent of the protocol version it arrived over
+type Message struct {
+	Topic          string
+	Payload        []byte
+	QoS            byte
+	ContentType    string
+	MessageExpiry  *uint32
+	UserProperties map[string]string
+	// Ack is set when acknowledgements are manual and must be called once the message is handled
+	Ack func()
+}
+
+// conn is implemented by each supported protocol version
+type conn interface {
+	Connect(ctx context.Context) error
+	Subscribe(ctx context.Context, subs []subscription) error
+	Unsubscribe(ctx context.Context, topics []string) error
+	IsConnected() bool
+	Disconnect(ctx context.Context) error
+}
+
+type subscription struct {
+	topic string
+	qos   byte
+	tmpl  *topic.Template
+}
+
+type connOptions struct {
+	broker           *url.URL
+	clientID         string
+	tls              *tls.Config
+	session          *config.Session
+	manualAck        bool
+	handler          func(Message)
+	onConnect        func()
+	onConnectionLost func()
+}
+
+const (
+	stopTimeout           = 5 * time.Second
+	subscribeTimeout      = 10 * time.Second
+	maxResubscribeBackoff = 30 * time.Second
+	// releaseDelay gathers the tasks released by one failure into a single reconnect, and keeps a
+	// payload that keeps failing from reconnecting in a tight loop
+	releaseDelay = 5 * time.Second
+)
+
 type Client struct {
-	client     mqtt.Client
-	eventBus   eventbus.EventBus
-	topic      string
-	cfg        *config.MQTT
-	subscribed bool
-	log        *slog.Logger
+	conn      conn
+	eventBus  eventbus.EventBus
+	subs      []subscription
+	cfg       *config.MQTT
+	log       *slog.Logger
+	connected atomic.Bool
+	// subscribed tracks whether the broker currently holds our subscription, while wantSubscribed
+	// records that one was asked for and so must be restored whenever the connection comes back
+	subscribed     atomic.Bool
+	wantSubscribed atomic.Bool
+	releasing      atomic.Bool
+	paused         atomic.Bool
+	releaseDelay   time.Duration
+	// outstanding counts the deliveries neither acknowledged nor released yet, and released
+	// records that one was released and is waiting for a reconnect to be redelivered
+	outstanding atomic.Int64
+	released    atomic.Bool
 }
 
 func NewClient(cfg *config.MQTT, eb eventbus.EventBus, log *slog.Logger) (*Client, error) {
 	c := &Client{
-		eventBus:   eb,
-		topic:      cfg.Topic,
-		cfg:        cfg,
-		subscribed: false,
-		log:        log.With("component", "mqtt_client"),
-	}
-
-	clientID := fmt.Sprintf("batcher-%s", uuid.NewString())
-	opts := mqtt.NewClientOptions().
-		AddBroker(fmt.Sprintf("tls://%s:%d", cfg.Host, cfg.Port)).
-		SetClientID(clientID).
-		SetUsername(cfg.Username).
-		SetPassword(cfg.Password).
-		SetProtocolVersion(4).
-		SetOnConnectHandler(func(c mqtt.Client) {
-			log.Info("connected to mqtt broker", "client_id", clientID)
-		}).
-		SetConnectionLostHandler(func(c mqtt.Client, err error) {
-			log.Error("lost connection to mqtt broker", "error", err)
-		}).
-		SetReconnectingHandler(func(c mqtt.Client, options *mqtt.ClientOptions) {
-			log.Warn("attempting to reconnect to mqtt broker")
-		}).
-		SetTLSConfig(&tls.Config{
-			InsecureSkipVerify: true,
+		eventBus:     eb,
+		subs:         make([]subscription, 0, len(cfg.Subscriptions)),
+		cfg:          cfg,
+		log:          log.With("component", "mqtt_client"),
+		releaseDelay: releaseDelay,
+	}
+
+	for _, sub := range cfg.Subscriptions {
+		tmpl, err := topic.ParseTemplate(sub.Topic)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		c.subs = append(c.subs, subscription{
+			topic: subscriptionTopic(tmpl.Filter(), cfg.ShareGroup),
+			qos:   byte(sub.QoS),
+			tmpl:  tmpl,
 		})
+	}
 
-	c.client = mqtt.NewClient(opts)
-	log.Info("mqtt client created with options",
-		"broker", opts.Servers[0].String(),
-		"client_id", opts.ClientID,
-		"clean_session", opts.CleanSession,
-		"keep_alive", opts.KeepAlive,
-		"username", opts.Username,
-		"tls_enabled", opts.TLSConfig != nil,
-		"auto_reconnect", opts.AutoReconnect,
-		"protocol_version", opts.ProtocolVersion,
-		"connect_timeout", opts.ConnectTimeout.String(),
-		"keep_alive", opts.KeepAlive,
-		"write_timeout", opts.WriteTimeout.String(),
-	)
+	opts := connOptions{
+		broker:           &url.URL{Scheme: cfg.Transport, Host: net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))},
+		clientID:         fmt.Sprintf("batcher-%s", uuid.NewString()),
+		session:          cfg.Session,
+		manualAck:        cfg.Delivery == "at_least_once",
+		handler:          c.handleMessage,
+		onConnect:        c.onConnect,
+		onConnectionLost: c.onConnectionLost,
+	}
+
+	if cfg.Session != nil {
+		// A persistent session is only resumed if the broker sees the same client ID
+		opts.clientID = cfg.Session.ClientID
+		if err := os.MkdirAll(cfg.Session.StoreDir, 0o750); err != nil {
+			return nil, errors.Wrap(err, "failed to create mqtt session store")
+		}
+	}
+
+	if cfg.Transport == "tls" {
+		tc, err := newTLSConfig(cfg.TLS, time.Now())
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if tc.InsecureSkipVerify {
+			log.Warn("mqtt tls certificate verification is disabled")
+		}
+		opts.tls = tc
+	}
+
+	var err error
+	switch cfg.ProtocolVersion {
+	case 5:
+		c.conn, err = newV5Conn(cfg, opts, c.log)
+	default:
+		c.conn, err = newV3Conn(cfg, opts, c.log)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 	return c, nil
 }
 
-func (c *Client) Connect() error {
+// subscriptionTopic turns topic into a shared subscription for group when one is configured
+func subscriptionTopic(topic string, group string) string {
+	if group == "" {
+		return topic
+	}
+	return fmt.Sprintf("$share/%s/%s", group, topic)
+}
+
+func (c *Client) Connect(ctx context.Context) error {
 	c.log.Debug("attempting to connect to mqtt broker")
-	if token := c.client.Connect(); token.Wait() && token.Error() != nil {
-		return errors.WithStack(token.Error())
+	if err := c.conn.Connect(ctx); err != nil {
+		return errors.WithStack(err)
 	}
 	return nil
 }
 
-func (c *Client) Subscribe() error {
-	c.log.Debug("attempting to subscribe to topic", "topic", c.topic)
-	token := c.client.Subscribe(c.topic, byte(c.cfg.QoS), c.handleMessage)
-	if token.Wait() && token.Error() != nil {
-		return errors.WithStack(token.Error())
+func (c *Client) Subscribe(ctx context.Context) error {
+	c.paused.Store(false)
+	c.wantSubscribed.Store(true)
+	return c.subscribe(ctx)
+}
+
+func (c *Client) subscribe(ctx context.Context) error {
+	c.log.Debug("attempting to subscribe to topics", "topics", c.topics())
+	if err := c.conn.Subscribe(ctx, c.subs); err != nil {
+		return errors.WithStack(err)
+	}
+	c.subscribed.Store(true)
+	c.reportStatus()
+	for _, sub := range c.subs {
+		c.log.Debug("successfully subscribed to topic", "topic", sub.topic, "qos_level", sub.qos)
+	}
+	return nil
+}
+
+func (c *Client) topics() []string {
+	topics := make([]string, len(c.subs))
+	for i, sub := range c.subs {
+		topics[i] = sub.topic
+	}
+	return topics
+}
+
+// onConnect runs on every successful (re)connect. A broker that did not keep our session, or a
+// failover to one that never had it, will not deliver anything until we subscribe again
+func (c *Client) onConnect() {
+	c.connected.Store(true)
+	c.reportStatus()
+
+	backoff := time.Second
+	for c.wantSubscribed.Load() && c.connected.Load() {
+		ctx, cancel := context.WithTimeout(context.Background(), subscribeTimeout)
+		err := c.subscribe(ctx)
+		cancel()
+		if err == nil {
+			c.log.Info("subscriptions restored after connect", "topics", c.topics())
+			return
+		}
+
+		c.log.Error("failed to restore subscriptions, retrying", "topics", c.topics(), "error", err, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxResubscribeBackoff)
+	}
+}
+
+func (c *Client) onConnectionLost() {
+	c.connected.Store(false)
+	c.subscribed.Store(false)
+	c.reportStatus()
+}
+
+func (c *Client) reportStatus() {
+	status := metrics.Local.Gauge(metrics.ConnectionStatus)
+	status.WithLabelValues(metrics.StateConnected).Set(boolToFloat(c.connected.Load()))
+	status.WithLabelValues(metrics.StateSubscribed).Set(boolToFloat(c.subscribed.Load()))
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (c *Client) handleMessage(msg Message) {
+	if c.paused.Load() {
+		// Without manual acknowledgements the message is acknowledged as soon as this returns
+		if msg.Ack == nil {
+			metrics.Local.Counter(metrics.MessagesDropped).WithLabelValues(msg.Topic, metrics.ReasonPaused).Inc()
+			c.log.Warn("dropping message received while paused", "topic", msg.Topic)
+			return
+		}
+		c.log.Debug("leaving message received while paused to be redelivered", "topic", msg.Topic)
+		return
+	}
+	meta := task.Metadata{
+		Topic:          msg.Topic,
+		Segments:       c.segments(msg.Topic),
+		ContentType:    msg.ContentType,
+		UserProperties: msg.UserProperties,
+	}
+	if msg.MessageExpiry != nil {
+		meta.ExpiresAt = time.Now().Add(time.Duration(*msg.MessageExpiry) * time.Second)
+	}
+
+	t := task.NewTaskWithMetadata(msg.Payload, meta)
+	if msg.Ack != nil {
+		ack, release := c.track(msg.Ack)
+		t = t.WithAck(ack).WithRelease(release)
+	}
+
+	c.eventBus.Publish(t)
+	c.log.Debug("message received",
+		"topic", msg.Topic,
+		"payload_size", len(msg.Payload),
+		"content_type", msg.ContentType,
+		"user_properties", len(msg.UserProperties),
+	)
+}
+
+// track counts a delivery as outstanding until it is acknowledged or released
+func (c *Client) track(ack func()) (func(), func()) {
+	c.outstanding.Add(1)
+	var once sync.Once
+	acked := func() {
+		once.Do(func() {
+			ack()
+			c.settle()
+		})
+	}
+	released := func() {
+		once.Do(func() {
+			c.released.Store(true)
+			c.settle()
+		})
+	}
+	return acked, released
+}
+
+// settle is called for a message once it is acknowledged or will never be. The broker only takes
+// acknowledgements in the order it sent the messages, so one that is never acknowledged holds back
+// every one after it until the in-flight window fills and delivery stops. Reconnecting has the
+// broker resume the session and redeliver what was not acknowledged, but it would also strand the
+// acknowledgements still to come, so it waits until nothing else is outstanding
+func (c *Client) settle() {
+	if c.outstanding.Add(-1) > 0 || !c.released.Load() {
+		return
+	}
+	if !c.wantSubscribed.Load() || !c.releasing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.releasing.Store(false)
+		time.Sleep(c.releaseDelay)
+		// The last of any messages delivered in the meantime settles again
+		if c.outstanding.Load() > 0 {
+			return
+		}
+		c.released.Store(false)
+		if err := c.reconnect(); err != nil {
+			c.log.Error("failed to reconnect to release unacknowledged messages", "error", err)
+		}
+	}()
+}
+
+func (c *Client) reconnect() error {
+	if !c.wantSubscribed.Load() {
+		return nil
+	}
+	c.log.Warn("reconnecting to have unacknowledged messages redelivered")
+	metrics.Local.Counter(metrics.Reconnects).WithLabelValues().Inc()
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	if err := c.conn.Disconnect(ctx); err != nil {
+		return errors.WithStack(err)
+	}
+	c.onConnectionLost()
+	return c.Connect(context.Background())
+}
+
+// segments extracts the named topic segments using the first subscription matching topic that
+// names any. Subscriptions may overlap, and a broader filter without placeholders listed first
+// must not hide the project a more specific template fixes
+func (c *Client) segments(t string) map[string]string {
+	for _, sub := range c.subs {
+		if sub.tmpl == nil {
+			continue
+		}
+		if segments, ok := sub.tmpl.Extract(t); ok && len(segments) > 0 {
+			return segments
+		}
 	}
-	c.subscribed = true
-	c.log.Debug("successfully subscribed to topic", "topic", c.topic, "qos_level", c.cfg.QoS)
 	return nil
 }
 
-func (c *Client) handleMessage(_ mqtt.Client, msg mqtt.Message) {
-	pl := msg.Payload()
-	c.eventBus.Publish(task.NewTask(pl))
-	c.log.Debug("message received", "topic", msg.Topic(), "payload_size", len(pl))
+func (c *Client) Name() string {
+	return "mqtt"
 }
 
-func (c *Client) Stop() error {
-	c.log.Debug("stopping mqtt client", "topic", c.topic)
+// Start connects to the broker and subscribes to every configured topic
+func (c *Client) Start(ctx context.Context) error {
+	if err := c.Connect(ctx); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := c.Subscribe(ctx); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Pause stops taking messages while keeping the connection, so that those already received can
+// still be acknowledged. Messages that arrive while paused are not handled. With manual
+// acknowledgements they are left unacknowledged for a persistent session to redeliver on the next
+// run, otherwise the broker would count them as delivered, so the subscription is dropped to stop
+// them arriving and any that were already on their way are counted as dropped
+func (c *Client) Pause(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, stopTimeout)
+	defer cancel()
+
+	c.paused.Store(true)
+	// Stop any reconnect from restoring the subscription while we tear it down
+	wasSubscribed := c.wantSubscribed.Swap(false)
 
-	if c.subscribed {
-		if token := c.client.Unsubscribe(c.topic); token.Wait() && token.Error() != nil {
-			return errors.WithStack(token.Error())
+	// Unsubscribing would discard a persistent session's subscription, and with it any
+	// messages the broker would otherwise queue for us while we are down
+	keep := c.cfg.Session != nil && c.cfg.Delivery == "at_least_once"
+	if wasSubscribed && c.subscribed.Load() && !keep {
+		if err := c.conn.Unsubscribe(ctx, c.topics()); err != nil {
+			return errors.WithStack(err)
 		}
+		c.subscribed.Store(false)
 	}
+	c.log.Debug("mqtt client paused", "topics", c.topics())
+	return nil
+}
 
-	if c.client.IsConnected() {
-		c.client.Disconnect(250)
+func (c *Client) Stop(ctx context.Context) error {
+	c.log.Debug("stopping mqtt client", "topics", c.topics())
+	if err := c.Pause(ctx); err != nil {
+		return errors.WithStack(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, stopTimeout)
+	defer cancel()
+	if c.conn.IsConnected() {
+		if err := c.conn.Disconnect(ctx); err != nil {
+			return errors.WithStack(err)
+		}
 	}
+	c.onConnectionLost()
 
-	c.log.Debug("mqtt client disconnected", "topic", c.topic)
+	c.log.Debug("mqtt client disconnected", "topics", c.topics())
 	return nil
 }
@@ -0,0 +1,431 @@
+package mqtt
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/grid-stream-org/batcher/internal/topic"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/grid-stream-org/go-commons/pkg/eventbus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+type fakeConn struct {
+	mu            sync.Mutex
+	connected     bool
+	connects      int
+	subscriptions []subscription
+	unsubscribed  []string
+	// onConnect stands in for the connection callback the real connections run
+	onConnect func()
+}
+
+func (f *fakeConn) Connect(_ context.Context) error {
+	f.mu.Lock()
+	f.connected = true
+	f.connects++
+	f.mu.Unlock()
+	if f.onConnect != nil {
+		f.onConnect()
+	}
+	return nil
+}
+
+func (f *fakeConn) connectCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connects
+}
+
+func (f *fakeConn) Subscribe(_ context.Context, subs []subscription) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscriptions = append(f.subscriptions, subs...)
+	return nil
+}
+
+func (f *fakeConn) Unsubscribe(_ context.Context, topics []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unsubscribed = append(f.unsubscribed, topics...)
+	return nil
+}
+
+func (f *fakeConn) IsConnected() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connected
+}
+
+func (f *fakeConn) Disconnect(_ context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = false
+	return nil
+}
+
+// orderedAcks acknowledges messages the way the paho clients do, strictly in the order they were
+// received, and forgets what was pending when the connection is dropped
+type orderedAcks struct {
+	mu      sync.Mutex
+	pending []int
+	acked   map[int]bool
+	sent    []int
+}
+
+func (o *orderedAcks) receive(id int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending = append(o.pending, id)
+}
+
+func (o *orderedAcks) ack(id int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.acked[id] = true
+	for len(o.pending) > 0 && o.acked[o.pending[0]] {
+		o.sent = append(o.sent, o.pending[0])
+		o.pending = o.pending[1:]
+	}
+}
+
+func (o *orderedAcks) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending = nil
+	o.acked = map[int]bool{}
+}
+
+func (o *orderedAcks) sentAcks() []int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]int(nil), o.sent...)
+}
+
+// fakeV3Message stands in for a paho v3 message, acking it runs ack
+type fakeV3Message struct {
+	mqtt.Message
+	ack func()
+}
+
+func (m *fakeV3Message) Topic() string     { return "grid/ders" }
+func (m *fakeV3Message) MessageID() uint16 { return 1 }
+func (m *fakeV3Message) Ack()              { m.ack() }
+
+type ClientTestSuite struct {
+	suite.Suite
+}
+
+func (s *ClientTestSuite) SetupSuite() {
+	metrics.InitMetricsProvider()
+}
+
+func (s *ClientTestSuite) newClient(fc *fakeConn, cfg *config.MQTT) *Client {
+	c := &Client{
+		conn: fc,
+		cfg:  cfg,
+		log:  slog.Default(),
+	}
+	for _, sub := range cfg.Subscriptions {
+		c.subs = append(c.subs, subscription{topic: sub.Topic, qos: byte(sub.QoS)})
+	}
+	return c
+}
+
+func (s *ClientTestSuite) TestResubscribeOnReconnect() {
+	fc := &fakeConn{}
+	c := s.newClient(fc, &config.MQTT{Subscriptions: []*config.Subscription{
+		{Topic: "grid/+/telemetry", QoS: 1},
+		{Topic: "grid/test/#", QoS: 0},
+	}})
+	ctx := context.Background()
+
+	// Connecting before a subscription is requested does not subscribe
+	s.NoError(c.Connect(ctx))
+	c.onConnect()
+	s.Empty(fc.subscriptions)
+	s.True(c.connected.Load())
+
+	s.NoError(c.Subscribe(ctx))
+	s.True(c.subscribed.Load())
+
+	// Losing the connection drops the subscription until it is restored on reconnect
+	c.onConnectionLost()
+	s.False(c.connected.Load())
+	s.False(c.subscribed.Load())
+
+	c.onConnect()
+	s.True(c.subscribed.Load())
+	s.Equal([]subscription{
+		{topic: "grid/+/telemetry", qos: 1},
+		{topic: "grid/test/#", qos: 0},
+		{topic: "grid/+/telemetry", qos: 1},
+		{topic: "grid/test/#", qos: 0},
+	}, fc.subscriptions)
+
+	s.NoError(c.Stop(ctx))
+	s.Equal([]string{"grid/+/telemetry", "grid/test/#"}, fc.unsubscribed)
+	s.False(c.subscribed.Load())
+	s.False(c.connected.Load())
+
+	// A reconnect after stopping must not subscribe again
+	c.onConnect()
+	s.Len(fc.subscriptions, 4)
+}
+
+func (s *ClientTestSuite) TestReleaseReconnects() {
+	fc := &fakeConn{}
+	c := s.newClient(fc, &config.MQTT{
+		Subscriptions: []*config.Subscription{{Topic: "grid/ders", QoS: 1}},
+		Session:       &config.Session{ClientID: "batcher-1"},
+		Delivery:      "at_least_once",
+	})
+	c.releaseDelay = 10 * time.Millisecond
+	eb := eventbus.New()
+	defer eb.Close()
+	received := eb.Subscribe(4)
+	c.eventBus = eb
+	broker := &orderedAcks{acked: map[int]bool{}}
+	fc.onConnect = func() {
+		broker.reset()
+		c.onConnect()
+	}
+	ctx := context.Background()
+	s.Require().NoError(c.Connect(ctx))
+	s.Require().NoError(c.Subscribe(ctx))
+
+	deliver := func(id int) task.Task {
+		broker.receive(id)
+		c.handleMessage(Message{Topic: "grid/ders", Payload: []byte("[]"), QoS: 1, Ack: func() { broker.ack(id) }})
+		return (<-received).(task.Task)
+	}
+
+	// The first message fails and the ones after it succeed, their acknowledgements queue behind it
+	failed := deliver(0)
+	for id := 1; id < 3; id++ {
+		t := deliver(id)
+		t.Ack()
+	}
+	s.Empty(broker.sentAcks())
+
+	failed.Release()
+	s.Eventually(func() bool { return fc.connectCount() == 2 && c.subscribed.Load() }, time.Second, 5*time.Millisecond)
+	s.Len(fc.subscriptions, 2)
+
+	// The broker redelivers everything that was not acknowledged, and acknowledgements flow again
+	for id := 0; id < 3; id++ {
+		t := deliver(id)
+		t.Ack()
+	}
+	s.Equal([]int{0, 1, 2}, broker.sentAcks())
+
+	// Nothing is reconnected once the client is paused for shutdown, and nothing more is taken in
+	last := deliver(3)
+	s.NoError(c.Pause(ctx))
+	last.Release()
+	time.Sleep(5 * c.releaseDelay)
+	s.Equal(2, fc.connectCount())
+
+	c.handleMessage(Message{Topic: "grid/ders", Payload: []byte("[]"), QoS: 1, Ack: func() {}})
+	s.Empty(received)
+	s.NoError(c.Stop(ctx))
+}
+
+func (s *ClientTestSuite) TestReleaseWaitsForOutstanding() {
+	fc := &fakeConn{}
+	c := s.newClient(fc, &config.MQTT{
+		Subscriptions: []*config.Subscription{{Topic: "grid/ders", QoS: 1}},
+		Session:       &config.Session{ClientID: "batcher-1"},
+		Delivery:      "at_least_once",
+	})
+	c.releaseDelay = 10 * time.Millisecond
+	eb := eventbus.New()
+	defer eb.Close()
+	received := eb.Subscribe(4)
+	c.eventBus = eb
+	ctx := context.Background()
+	s.Require().NoError(c.Connect(ctx))
+	s.Require().NoError(c.Subscribe(ctx))
+
+	deliver := func() task.Task {
+		c.handleMessage(Message{Topic: "grid/ders", Payload: []byte("[]"), QoS: 1, Ack: func() {}})
+		return (<-received).(task.Task)
+	}
+
+	// A reconnect would strand the acknowledgement the second message is still waiting to send
+	failed, pending := deliver(), deliver()
+	failed.Release()
+	time.Sleep(5 * c.releaseDelay)
+	s.Equal(1, fc.connectCount())
+
+	pending.Ack()
+	s.Eventually(func() bool { return fc.connectCount() == 2 }, time.Second, 5*time.Millisecond)
+	s.NoError(c.Stop(ctx))
+}
+
+func (s *ClientTestSuite) TestV3StaleAck() {
+	c := &v3Conn{log: slog.Default()}
+	acks := 0
+	msg := &fakeV3Message{ack: func() { acks++ }}
+
+	c.ack(c.generation.Load(), msg)
+	s.Equal(1, acks)
+
+	// Acknowledging after the connection that delivered the message is gone sends nothing
+	stale := c.generation.Load()
+	c.generation.Add(1)
+	c.ack(stale, msg)
+	s.Equal(1, acks)
+
+	// Paho panics when the connection closes while the acknowledgement is being sent
+	msg.ack = func() { panic("send on closed channel") }
+	s.NotPanics(func() { c.ack(c.generation.Load(), msg) })
+}
+
+func (s *ClientTestSuite) TestPauseKeepsConnection() {
+	fc := &fakeConn{}
+	c := s.newClient(fc, &config.MQTT{Subscriptions: []*config.Subscription{{Topic: "grid/ders", QoS: 1}}})
+	ctx := context.Background()
+
+	s.NoError(c.Connect(ctx))
+	s.NoError(c.Subscribe(ctx))
+	s.NoError(c.Pause(ctx))
+	s.Equal([]string{"grid/ders"}, fc.unsubscribed)
+	s.True(fc.IsConnected())
+
+	// Stopping a paused client only disconnects it
+	s.NoError(c.Stop(ctx))
+	s.Len(fc.unsubscribed, 1)
+	s.False(fc.IsConnected())
+}
+
+func (s *ClientTestSuite) TestStopKeepsPersistentSubscription() {
+	fc := &fakeConn{}
+	c := s.newClient(fc, &config.MQTT{
+		Subscriptions: []*config.Subscription{{Topic: "grid/ders", QoS: 1}},
+		Session:       &config.Session{ClientID: "batcher-1"},
+		Delivery:      "at_least_once",
+	})
+	ctx := context.Background()
+
+	s.NoError(c.Connect(ctx))
+	s.NoError(c.Subscribe(ctx))
+	s.NoError(c.Stop(ctx))
+	s.Empty(fc.unsubscribed)
+}
+
+func (s *ClientTestSuite) TestPauseWithAutoAck() {
+	fc := &fakeConn{}
+	c := s.newClient(fc, &config.MQTT{
+		Subscriptions: []*config.Subscription{{Topic: "grid/ders", QoS: 1}},
+		Session:       &config.Session{ClientID: "batcher-1"},
+		Delivery:      "at_most_once",
+	})
+	eb := eventbus.New()
+	defer eb.Close()
+	received := eb.Subscribe(1)
+	c.eventBus = eb
+	ctx := context.Background()
+	dropped := func() float64 {
+		return testutil.ToFloat64(metrics.Local.Counter(metrics.MessagesDropped).WithLabelValues("grid/ders", metrics.ReasonPaused))
+	}
+
+	// The broker counts anything it sends as delivered, so it has to stop sending
+	s.NoError(c.Connect(ctx))
+	s.NoError(c.Subscribe(ctx))
+	s.NoError(c.Pause(ctx))
+	s.Equal([]string{"grid/ders"}, fc.unsubscribed)
+
+	// A message already on its way is counted as dropped
+	before := dropped()
+	c.handleMessage(Message{Topic: "grid/ders", Payload: []byte("[]"), QoS: 1})
+	s.Equal(before+1, dropped())
+	s.Empty(received)
+
+	// Left unacknowledged, a message is redelivered rather than dropped
+	c.handleMessage(Message{Topic: "grid/ders", Payload: []byte("[]"), QoS: 1, Ack: func() {}})
+	s.Equal(before+1, dropped())
+	s.NoError(c.Stop(ctx))
+}
+
+func (s *ClientTestSuite) TestSubscriptionTopic() {
+	s.Equal("grid/ders", subscriptionTopic("grid/ders", ""))
+	s.Equal("$share/batchers/grid/ders", subscriptionTopic("grid/ders", "batchers"))
+}
+
+func (s *ClientTestSuite) TestV5HandlePublish() {
+	var received Message
+	c := &v5Conn{handler: func(m Message) { received = m }}
+
+	expiry := uint32(30)
+	handled, err := c.handlePublish(paho.PublishReceived{
+		Packet: &paho.Publish{
+			Topic:   "grid/ders",
+			QoS:     1,
+			Payload: []byte("[]"),
+			Properties: &paho.PublishProperties{
+				ContentType:   "application/json",
+				MessageExpiry: &expiry,
+				User:          paho.UserProperties{{Key: "gateway", Value: "gw1"}},
+			},
+		},
+	})
+
+	s.NoError(err)
+	s.True(handled)
+	s.Equal("grid/ders", received.Topic)
+	s.Equal(byte(1), received.QoS)
+	s.Equal([]byte("[]"), received.Payload)
+	s.Equal("application/json", received.ContentType)
+	s.Equal(uint32(30), *received.MessageExpiry)
+	s.Equal(map[string]string{"gateway": "gw1"}, received.UserProperties)
+}
+
+func (s *ClientTestSuite) TestV3SubackError() {
+	subs := []subscription{{topic: "grid/ders", qos: 1}, {topic: "grid/test/#", qos: 1}}
+	testCases := []struct {
+		name    string
+		granted map[string]byte
+		err     string
+	}{
+		{name: "all granted", granted: map[string]byte{"grid/ders": 1, "grid/test/#": 0}},
+		{name: "one rejected", granted: map[string]byte{"grid/ders": 1, "grid/test/#": 0x80}, err: "subscription to grid/test/# rejected with return code 128"},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			err := subackError(subs, tc.granted)
+			if tc.err == "" {
+				s.NoError(err)
+				return
+			}
+			s.EqualError(err, tc.err)
+		})
+	}
+}
+
+func (s *ClientTestSuite) TestSegments() {
+	c := &Client{}
+	// The broad filter comes first and overlaps the template
+	for _, raw := range []string{"grid/#", "grid/{project_id}/{gateway_id}/ders", "grid/test/#"} {
+		tmpl, err := topic.ParseTemplate(raw)
+		s.Require().NoError(err)
+		c.subs = append(c.subs, subscription{topic: tmpl.Filter(), tmpl: tmpl})
+	}
+
+	s.Equal(map[string]string{"project_id": "project1", "gateway_id": "gw1"}, c.segments("grid/project1/gw1/ders"))
+	s.Nil(c.segments("grid/test/ders"))
+	s.Nil(c.segments("other/topic"))
+}
+
+func TestClientSuite(t *testing.T) {
+	suite.Run(t, new(ClientTestSuite))
+}
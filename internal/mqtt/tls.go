@@ -0,0 +1,107 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/pkg/errors"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the client TLS configuration, loading and checking every certificate up front
+// so that a bad or expired certificate fails at startup rather than on the first handshake
+func newTLSConfig(cfg *config.TLS, now time.Time) (*tls.Config, error) {
+	version, ok := tlsVersions[cfg.MinVersion]
+	if !ok {
+		return nil, errors.Errorf("invalid tls min_version: %s", cfg.MinVersion)
+	}
+
+	tc := &tls.Config{
+		MinVersion:         version,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := loadCAPool(cfg.CAFile, now)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		tc.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := loadClientCert(cfg.CertFile, cfg.KeyFile, now)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+func loadCAPool(path string, now time.Time) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tls ca_file")
+	}
+
+	pool := x509.NewCertPool()
+	count := 0
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse certificate in ca_file %s", path)
+		}
+		if err := checkValidity(cert, now); err != nil {
+			return nil, errors.Wrapf(err, "ca certificate %q in %s", cert.Subject.CommonName, path)
+		}
+		pool.AddCert(cert)
+		count++
+	}
+
+	if count == 0 {
+		return nil, errors.Errorf("no certificates found in ca_file %s", path)
+	}
+	return pool, nil
+}
+
+func loadClientCert(certPath string, keyPath string, now time.Time) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to load tls client certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, errors.Wrapf(err, "failed to parse client certificate %s", certPath)
+	}
+	if err := checkValidity(leaf, now); err != nil {
+		return tls.Certificate{}, errors.Wrapf(err, "client certificate %s", certPath)
+	}
+
+	cert.Leaf = leaf
+	return cert, nil
+}
+
+func checkValidity(cert *x509.Certificate, now time.Time) error {
+	if now.Before(cert.NotBefore) {
+		return errors.Errorf("not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return errors.Errorf("expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/stretchr/testify/suite"
+)
+
+type TLSTestSuite struct {
+	suite.Suite
+	dir string
+	now time.Time
+}
+
+func (s *TLSTestSuite) SetupTest() {
+	s.dir = s.T().TempDir()
+	s.now = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// writeCert generates a self-signed certificate valid between notBefore and notAfter and writes
+// the certificate and key as PEM files, returning their paths
+func (s *TLSTestSuite) writeCert(name string, notBefore time.Time, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	s.Require().NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	s.Require().NoError(err)
+
+	certPath := filepath.Join(s.dir, name+".crt")
+	keyPath := filepath.Join(s.dir, name+".key")
+	s.Require().NoError(os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	s.Require().NoError(os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certPath, keyPath
+}
+
+func (s *TLSTestSuite) TestNewTLSConfig() {
+	validFrom := s.now.Add(-24 * time.Hour)
+	validTo := s.now.Add(24 * time.Hour)
+	caPath, _ := s.writeCert("ca", validFrom, validTo)
+	certPath, keyPath := s.writeCert("client", validFrom, validTo)
+	expiredPath, expiredKeyPath := s.writeCert("expired", s.now.Add(-48*time.Hour), s.now.Add(-24*time.Hour))
+	futurePath, _ := s.writeCert("future", s.now.Add(24*time.Hour), s.now.Add(48*time.Hour))
+	garbagePath := filepath.Join(s.dir, "garbage.pem")
+	s.Require().NoError(os.WriteFile(garbagePath, []byte("not a certificate"), 0o600))
+
+	testCases := []struct {
+		name     string
+		cfg      *config.TLS
+		errorMsg string
+		validate func(*tls.Config)
+	}{
+		{
+			name: "system roots",
+			cfg:  &config.TLS{MinVersion: "1.2", ServerName: "broker.internal"},
+			validate: func(tc *tls.Config) {
+				s.Nil(tc.RootCAs)
+				s.Empty(tc.Certificates)
+				s.False(tc.InsecureSkipVerify)
+				s.Equal("broker.internal", tc.ServerName)
+				s.Equal(uint16(tls.VersionTLS12), tc.MinVersion)
+			},
+		},
+		{
+			name: "mutual tls",
+			cfg:  &config.TLS{MinVersion: "1.3", CAFile: caPath, CertFile: certPath, KeyFile: keyPath},
+			validate: func(tc *tls.Config) {
+				s.NotNil(tc.RootCAs)
+				s.Len(tc.Certificates, 1)
+				s.Equal("client", tc.Certificates[0].Leaf.Subject.CommonName)
+				s.Equal(uint16(tls.VersionTLS13), tc.MinVersion)
+			},
+		},
+		{
+			name:     "invalid min version",
+			cfg:      &config.TLS{MinVersion: "1.0"},
+			errorMsg: "invalid tls min_version",
+		},
+		{
+			name:     "missing ca file",
+			cfg:      &config.TLS{MinVersion: "1.2", CAFile: filepath.Join(s.dir, "missing.pem")},
+			errorMsg: "failed to read tls ca_file",
+		},
+		{
+			name:     "ca file without certificates",
+			cfg:      &config.TLS{MinVersion: "1.2", CAFile: garbagePath},
+			errorMsg: "no certificates found",
+		},
+		{
+			name:     "expired ca",
+			cfg:      &config.TLS{MinVersion: "1.2", CAFile: expiredPath},
+			errorMsg: "expired at",
+		},
+		{
+			name:     "expired client certificate",
+			cfg:      &config.TLS{MinVersion: "1.2", CertFile: expiredPath, KeyFile: expiredKeyPath},
+			errorMsg: "expired at",
+		},
+		{
+			name:     "ca not yet valid",
+			cfg:      &config.TLS{MinVersion: "1.2", CAFile: futurePath},
+			errorMsg: "not valid until",
+		},
+		{
+			name:     "mismatched key",
+			cfg:      &config.TLS{MinVersion: "1.2", CertFile: certPath, KeyFile: expiredKeyPath},
+			errorMsg: "failed to load tls client certificate",
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			cfg, err := newTLSConfig(tc.cfg, s.now)
+			if tc.errorMsg != "" {
+				s.Error(err)
+				s.Nil(cfg)
+				s.Contains(err.Error(), tc.errorMsg)
+			} else {
+				s.NoError(err)
+				s.NotNil(cfg)
+				tc.validate(cfg)
+			}
+		})
+	}
+}
+
+func TestTLSSuite(t *testing.T) {
+	suite.Run(t, new(TLSTestSuite))
+}
@@ -0,0 +1,158 @@
+package mqtt
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/pkg/errors"
+)
+
+type v3Conn struct {
+	client    mqtt.Client
+	manualAck bool
+	handler   func(Message)
+	// generation changes whenever the connection is lost or dropped, so that acknowledgements for
+	// messages delivered over an earlier connection are not sent
+	generation atomic.Uint64
+	log        *slog.Logger
+}
+
+func newV3Conn(cfg *config.MQTT, co connOptions, log *slog.Logger) (conn, error) {
+	c := &v3Conn{
+		manualAck: co.manualAck,
+		handler:   co.handler,
+		log:       log,
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(co.broker.String()).
+		SetClientID(co.clientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetProtocolVersion(4).
+		SetOnConnectHandler(func(_ mqtt.Client) {
+			log.Info("connected to mqtt broker", "client_id", co.clientID)
+			co.onConnect()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			c.generation.Add(1)
+			log.Error("lost connection to mqtt broker", "error", err)
+			co.onConnectionLost()
+		}).
+		SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+			log.Warn("attempting to reconnect to mqtt broker")
+		})
+
+	if co.tls != nil {
+		opts.SetTLSConfig(co.tls)
+	}
+
+	if co.session != nil {
+		opts.SetCleanSession(false).
+			SetStore(mqtt.NewFileStore(co.session.StoreDir))
+	}
+	opts.SetAutoAckDisabled(co.manualAck)
+
+	log.Info("mqtt client created with options",
+		"broker", opts.Servers[0].String(),
+		"client_id", opts.ClientID,
+		"clean_session", opts.CleanSession,
+		"keep_alive", opts.KeepAlive,
+		"username", opts.Username,
+		"tls_enabled", opts.TLSConfig != nil,
+		"tls_client_cert", opts.TLSConfig != nil && len(opts.TLSConfig.Certificates) > 0,
+		"auto_ack_disabled", opts.AutoAckDisabled,
+		"auto_reconnect", opts.AutoReconnect,
+		"protocol_version", opts.ProtocolVersion,
+		"connect_timeout", opts.ConnectTimeout.String(),
+		"write_timeout", opts.WriteTimeout.String(),
+	)
+
+	c.client = mqtt.NewClient(opts)
+	return c, nil
+}
+
+func (c *v3Conn) Connect(ctx context.Context) error {
+	return waitToken(ctx, c.client.Connect())
+}
+
+func (c *v3Conn) Subscribe(ctx context.Context, subs []subscription) error {
+	filters := make(map[string]byte, len(subs))
+	for _, sub := range subs {
+		filters[sub.topic] = sub.qos
+	}
+	token := c.client.SubscribeMultiple(filters, c.handleMessage)
+	if err := waitToken(ctx, token); err != nil {
+		return err
+	}
+	if st, ok := token.(*mqtt.SubscribeToken); ok {
+		return subackError(subs, st.Result())
+	}
+	return nil
+}
+
+// subackError reports the first subscription the broker refused, it grants each topic separately
+func subackError(subs []subscription, granted map[string]byte) error {
+	for _, sub := range subs {
+		if code, ok := granted[sub.topic]; ok && code >= 0x80 {
+			return errors.Errorf("subscription to %s rejected with return code %d", sub.topic, code)
+		}
+	}
+	return nil
+}
+
+func (c *v3Conn) Unsubscribe(ctx context.Context, topics []string) error {
+	return waitToken(ctx, c.client.Unsubscribe(topics...))
+}
+
+func (c *v3Conn) IsConnected() bool {
+	return c.client.IsConnected()
+}
+
+func (c *v3Conn) Disconnect(_ context.Context) error {
+	c.generation.Add(1)
+	c.client.Disconnect(250)
+	return nil
+}
+
+func (c *v3Conn) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	m := Message{
+		Topic:   msg.Topic(),
+		Payload: msg.Payload(),
+		QoS:     msg.Qos(),
+	}
+	if c.manualAck {
+		generation := c.generation.Load()
+		m.Ack = func() { c.ack(generation, msg) }
+	}
+	c.handler(m)
+}
+
+// ack acknowledges a message over the connection that delivered it. Paho sends acknowledgements on
+// a channel that it closes once that connection is lost, so they are dropped for messages from an
+// earlier connection, and one racing the loss is recovered from. The broker redelivers both
+func (c *v3Conn) ack(generation uint64, msg mqtt.Message) {
+	if c.generation.Load() != generation {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Warn("dropped acknowledgement for a lost connection", "topic", msg.Topic(), "message_id", msg.MessageID(), "error", r)
+		}
+	}()
+	msg.Ack()
+}
+
+func waitToken(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+	if err := token.Error(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
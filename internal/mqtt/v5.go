@@ -0,0 +1,187 @@
+package mqtt
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/pkg/errors"
+)
+
+type v5Conn struct {
+	cfg       autopaho.ClientConfig
+	cm        *autopaho.ConnectionManager
+	cancel    context.CancelFunc
+	connected atomic.Bool
+	manualAck bool
+	handler   func(Message)
+	log       *slog.Logger
+}
+
+func newV5Conn(cfg *config.MQTT, co connOptions, log *slog.Logger) (conn, error) {
+	c := &v5Conn{
+		manualAck: co.manualAck,
+		handler:   co.handler,
+		log:       log,
+	}
+
+	c.cfg = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{co.broker},
+		TlsCfg:                        co.tls,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: co.session == nil,
+		ConnectUsername:               cfg.Username,
+		ConnectPassword:               []byte(cfg.Password),
+		OnConnectionUp: func(_ *autopaho.ConnectionManager, _ *paho.Connack) {
+			c.connected.Store(true)
+			log.Info("connected to mqtt broker", "client_id", co.clientID)
+			co.onConnect()
+		},
+		OnConnectError: func(err error) {
+			log.Warn("failed to connect to mqtt broker", "error", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:                   co.clientID,
+			EnableManualAcknowledgment: co.manualAck,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				c.handlePublish,
+			},
+			OnClientError: func(err error) {
+				c.connected.Store(false)
+				log.Error("lost connection to mqtt broker", "error", err)
+				co.onConnectionLost()
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				c.connected.Store(false)
+				log.Error("mqtt broker requested disconnect", "reason_code", d.ReasonCode)
+				co.onConnectionLost()
+			},
+		},
+	}
+
+	if co.session != nil {
+		sess, err := newFileSession(co.session.StoreDir)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		c.cfg.Session = sess
+		c.cfg.SessionExpiryInterval = uint32(co.session.Expiry.Seconds())
+	}
+
+	log.Info("mqtt client created with options",
+		"broker", co.broker.String(),
+		"client_id", co.clientID,
+		"clean_start", c.cfg.CleanStartOnInitialConnection,
+		"session_expiry", c.cfg.SessionExpiryInterval,
+		"manual_ack", co.manualAck,
+		"keep_alive", c.cfg.KeepAlive,
+		"username", cfg.Username,
+		"tls_enabled", co.tls != nil,
+		"tls_client_cert", co.tls != nil && len(co.tls.Certificates) > 0,
+		"protocol_version", 5,
+	)
+	return c, nil
+}
+
+func (c *v5Conn) Connect(ctx context.Context) error {
+	// The connection manager outlives the connect call, so it gets its own context
+	cmCtx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(cmCtx, c.cfg)
+	if err != nil {
+		cancel()
+		return errors.WithStack(err)
+	}
+	c.cm = cm
+	c.cancel = cancel
+
+	if err := cm.AwaitConnection(ctx); err != nil {
+		cancel()
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (c *v5Conn) Subscribe(ctx context.Context, subs []subscription) error {
+	opts := make([]paho.SubscribeOptions, len(subs))
+	for i, sub := range subs {
+		opts[i] = paho.SubscribeOptions{Topic: sub.topic, QoS: sub.qos}
+	}
+
+	suback, err := c.cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: opts})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for i, code := range suback.Reasons {
+		if code >= 0x80 && i < len(subs) {
+			return errors.Errorf("subscription to %s rejected with reason code %d", subs[i].topic, code)
+		}
+	}
+	return nil
+}
+
+func (c *v5Conn) Unsubscribe(ctx context.Context, topics []string) error {
+	if _, err := c.cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics}); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (c *v5Conn) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *v5Conn) Disconnect(ctx context.Context) error {
+	defer c.cancel()
+	c.connected.Store(false)
+	if err := c.cm.Disconnect(ctx); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (c *v5Conn) handlePublish(pr paho.PublishReceived) (bool, error) {
+	p := pr.Packet
+	msg := Message{
+		Topic:   p.Topic,
+		Payload: p.Payload,
+		QoS:     p.QoS,
+	}
+	if p.Properties != nil {
+		msg.ContentType = p.Properties.ContentType
+		msg.MessageExpiry = p.Properties.MessageExpiry
+		if len(p.Properties.User) > 0 {
+			msg.UserProperties = make(map[string]string, len(p.Properties.User))
+			for _, up := range p.Properties.User {
+				msg.UserProperties[up.Key] = up.Value
+			}
+		}
+	}
+	if c.manualAck {
+		msg.Ack = func() {
+			if err := pr.Client.Ack(p); err != nil {
+				c.log.Warn("failed to acknowledge message", "topic", p.Topic, "packet_id", p.PacketID, "error", err)
+			}
+		}
+	}
+	c.handler(msg)
+	return true, nil
+}
+
+// newFileSession keeps in-flight packet state on disk so that unacknowledged messages survive restarts
+func newFileSession(dir string) (*state.State, error) {
+	clientStore, err := file.New(dir, "client_", ".pkt")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open mqtt client session store")
+	}
+	serverStore, err := file.New(dir, "server_", ".pkt")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open mqtt server session store")
+	}
+	return state.New(clientStore, serverStore), nil
+}
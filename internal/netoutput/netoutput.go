@@ -0,0 +1,96 @@
+package netoutput
+
+import (
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/types"
+)
+
+// Strategy returns how much of the site meter reading one DER accounts for. Net output is the
+// meter reading less the contribution of every DER behind it. A negative contribution is power the
+// DER draws, which is added back to leave it out of the net output
+type Strategy func(der types.DER) float64
+
+// strategies are the registered strategies, by the name used in config
+var strategies = map[string]Strategy{
+	"output":     Output,
+	"generation": Generation,
+	"storage":    Storage,
+	"load":       Load,
+}
+
+// Output subtracts the current output of every DER, whether it is online or standalone. It is how
+// net output was always computed, and the default
+func Output(der types.DER) float64 {
+	return der.CurrentOutput
+}
+
+// Generation is for solar and other units that only produce power. An offline unit produces nothing
+// and a standalone unit is not behind the site meter, so neither contributes. Negative readings are
+// inverter standby draw rather than generation, and count as zero
+func Generation(der types.DER) float64 {
+	if !der.IsOnline || der.IsStandalone {
+		return 0
+	}
+	return max(der.CurrentOutput, 0)
+}
+
+// Storage is for batteries, whose output is positive while discharging and negative while charging.
+// Discharging is subtracted like generation. Charging only shifts energy to a later discharge, so the
+// draw is added back to the meter reading rather than counted as site load. Offline and standalone
+// units contribute nothing, as for generation
+func Storage(der types.DER) float64 {
+	if !der.IsOnline || der.IsStandalone {
+		return 0
+	}
+	return der.CurrentOutput
+}
+
+// Load is for EV chargers and other loads behind the meter. What they draw is already part of the
+// meter reading, so they contribute nothing whether they are online, offline or standalone
+func Load(types.DER) float64 {
+	return 0
+}
+
+// Calculator computes net output with the strategies configured per DER type and per project
+type Calculator struct {
+	cfg *config.NetOutput
+}
+
+func New(cfg *config.NetOutput) *Calculator {
+	return &Calculator{cfg: cfg}
+}
+
+// NetOutput is the meter reading of the first DER less the contribution of every DER
+func (c *Calculator) NetOutput(ders []types.DER) float64 {
+	if len(ders) == 0 {
+		return 0
+	}
+	net := ders[0].PowerMeterMeasurement
+	for _, der := range ders {
+		net -= c.Strategy(der.ProjectID, der.Type)(der)
+	}
+	return net
+}
+
+// Strategy returns the strategy for a DER type in a project. The project's type and default
+// strategies are tried before the top level ones
+func (c *Calculator) Strategy(projectID string, derType string) Strategy {
+	if c.cfg == nil {
+		return Output
+	}
+	if p, ok := c.cfg.Projects[projectID]; ok {
+		if name, ok := p.Types[derType]; ok {
+			return strategies[name]
+		}
+		if p.Default != "" {
+			return strategies[p.Default]
+		}
+	}
+	if name, ok := c.cfg.Types[derType]; ok {
+		return strategies[name]
+	}
+	if s, ok := strategies[c.cfg.Default]; ok {
+		return s
+	}
+	return Output
+}
@@ -0,0 +1,158 @@
+package netoutput
+
+import (
+	"testing"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/types"
+	"github.com/stretchr/testify/suite"
+)
+
+type NetOutputTestSuite struct {
+	suite.Suite
+}
+
+type strategyCase struct {
+	name       string
+	output     float64
+	online     bool
+	standalone bool
+	expected   float64
+}
+
+func (s *NetOutputTestSuite) run(strategy Strategy, testCases []strategyCase) {
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			der := types.DER{CurrentOutput: tc.output, IsOnline: tc.online, IsStandalone: tc.standalone}
+			s.Equal(tc.expected, strategy(der))
+		})
+	}
+}
+
+func (s *NetOutputTestSuite) TestOutput() {
+	s.run(Output, []strategyCase{
+		{name: "online", output: 10, online: true, expected: 10},
+		{name: "offline still counts", output: 10, online: false, expected: 10},
+		{name: "standalone still counts", output: 10, online: true, standalone: true, expected: 10},
+		{name: "negative", output: -5, online: true, expected: -5},
+	})
+}
+
+func (s *NetOutputTestSuite) TestGeneration() {
+	s.run(Generation, []strategyCase{
+		{name: "online", output: 10, online: true, expected: 10},
+		{name: "offline", output: 10, online: false, expected: 0},
+		{name: "standalone", output: 10, online: true, standalone: true, expected: 0},
+		{name: "standby draw", output: -0.5, online: true, expected: 0},
+	})
+}
+
+func (s *NetOutputTestSuite) TestStorage() {
+	s.run(Storage, []strategyCase{
+		{name: "discharging", output: 10, online: true, expected: 10},
+		{name: "charging", output: -10, online: true, expected: -10},
+		{name: "offline", output: 10, online: false, expected: 0},
+		{name: "standalone", output: -10, online: true, standalone: true, expected: 0},
+	})
+}
+
+func (s *NetOutputTestSuite) TestStorageAndGeneration() {
+	// The two only differ for a unit drawing power
+	testCases := []struct {
+		name       string
+		output     float64
+		generation float64
+		storage    float64
+	}{
+		{name: "producing", output: 10, generation: 10, storage: 10},
+		{name: "idle", output: 0, generation: 0, storage: 0},
+		{name: "drawing", output: -10, generation: 0, storage: -10},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			der := types.DER{CurrentOutput: tc.output, IsOnline: true, PowerMeterMeasurement: 100}
+			s.Equal(tc.generation, Generation(der))
+			s.Equal(tc.storage, Storage(der))
+			calc := New(&config.NetOutput{Types: map[string]string{"solar": "generation", "battery": "storage"}})
+			der.Type = "solar"
+			s.Equal(100-tc.generation, calc.NetOutput([]types.DER{der}))
+			der.Type = "battery"
+			s.Equal(100-tc.storage, calc.NetOutput([]types.DER{der}))
+		})
+	}
+}
+
+func (s *NetOutputTestSuite) TestLoad() {
+	s.run(Load, []strategyCase{
+		{name: "online", output: 7, online: true, expected: 0},
+		{name: "offline", output: 7, online: false, expected: 0},
+		{name: "standalone", output: 7, online: true, standalone: true, expected: 0},
+	})
+}
+
+func (s *NetOutputTestSuite) TestNetOutput() {
+	ders := []types.DER{
+		{ProjectID: "project1", Type: "solar", CurrentOutput: 30, IsOnline: true, PowerMeterMeasurement: 100},
+		{ProjectID: "project1", Type: "battery", CurrentOutput: -20, IsOnline: true, PowerMeterMeasurement: 100},
+		{ProjectID: "project1", Type: "ev_charger", CurrentOutput: 15, IsOnline: true, PowerMeterMeasurement: 100},
+		{ProjectID: "project1", Type: "solar", CurrentOutput: 25, IsOnline: false, PowerMeterMeasurement: 100},
+	}
+
+	testCases := []struct {
+		name     string
+		cfg      *config.NetOutput
+		expected float64
+	}{
+		{
+			name:     "no config",
+			cfg:      nil,
+			expected: 50, // 100 - 30 + 20 - 15 - 25
+		},
+		{
+			name: "per type",
+			cfg: &config.NetOutput{
+				Default: "output",
+				Types:   map[string]string{"solar": "generation", "battery": "storage", "ev_charger": "load"},
+			},
+			expected: 90, // 100 - 30 + 20, the charger is in the meter reading
+		},
+		{
+			name: "project overrides type",
+			cfg: &config.NetOutput{
+				Default:  "output",
+				Types:    map[string]string{"solar": "generation", "battery": "storage", "ev_charger": "load"},
+				Projects: map[string]*config.NetOutput{"project1": {Types: map[string]string{"solar": "output"}}},
+			},
+			expected: 65, // 100 - 30 + 20 - 25
+		},
+		{
+			name: "project default before top level types",
+			cfg: &config.NetOutput{
+				Default:  "output",
+				Types:    map[string]string{"battery": "storage"},
+				Projects: map[string]*config.NetOutput{"project1": {Default: "load"}},
+			},
+			expected: 100,
+		},
+		{
+			name: "other project uses top level",
+			cfg: &config.NetOutput{
+				Default:  "load",
+				Types:    map[string]string{"battery": "storage"},
+				Projects: map[string]*config.NetOutput{"project2": {Default: "output"}},
+			},
+			expected: 120, // 100 + 20, the charging battery is added back
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			s.Equal(tc.expected, New(tc.cfg).NetOutput(ders))
+		})
+	}
+}
+
+func TestNetOutputSuite(t *testing.T) {
+	suite.Run(t, new(NetOutputTestSuite))
+}
@@ -11,14 +11,20 @@ type Outcome struct {
 	WorkerID          int                     `json:"worker_id"`
 	TaskID            string                  `json:"task_id"`
 	ProjectID         string                  `json:"project_id"`
+	Meter             string                  `json:"meter,omitempty"`
 	Baseline          float64                 `json:"baseline"`
 	ContractThreshold float64                 `json:"contract_threshold"`
 	NetOutput         float64                 `json:"net_output"`
+	Units             string                  `json:"units,omitempty"`
 	DurationMS        int64                   `json:"duration_ms"`
 	CreatedAt         time.Time               `json:"created_at"`
 	Data              []types.RealTimeDERData `json:"data"`
+	ack               func()
+	release           func()
 }
 
+// New builds the outcome of a group of DERs. Units is left for the caller to set, as the DERs of a
+// group only share units once they have been normalized
 func New(workerID int, taskID string, projectID string, data []types.RealTimeDERData, netOutput float64, duration time.Duration) *Outcome {
 	var contractThreshold float64
 	var baseline float64
@@ -41,6 +47,40 @@ func New(workerID int, taskID string, projectID string, data []types.RealTimeDER
 	}
 }
 
+// EventTime is when the readings were taken, the timestamp of the first DER. An outcome without
+// one falls back to when it was created
+func (o *Outcome) EventTime() time.Time {
+	if len(o.Data) > 0 && !o.Data[0].Timestamp.IsZero() {
+		return o.Data[0].Timestamp
+	}
+	return o.CreatedAt
+}
+
+// SetAck attaches the acknowledgement of the task that produced the outcome
+func (o *Outcome) SetAck(ack func()) {
+	o.ack = ack
+}
+
+// Ack acknowledges the task that produced the outcome, if it has an acknowledgement attached
+func (o *Outcome) Ack() {
+	if o.ack != nil {
+		o.ack()
+	}
+}
+
+// SetRelease attaches the release of the task that produced the outcome
+func (o *Outcome) SetRelease(release func()) {
+	o.release = release
+}
+
+// Release tells the source of the task that produced the outcome that it will not be acknowledged,
+// so that it can be delivered again
+func (o *Outcome) Release() {
+	if o.release != nil {
+		o.release()
+	}
+}
+
 func (o *Outcome) LogFields() []any {
 	fields := []any{
 		"component", "outcome",
@@ -55,5 +95,8 @@ func (o *Outcome) LogFields() []any {
 		"created_at", o.CreatedAt.Format(time.RFC3339),
 		"data", o.Data,
 	}
+	if o.Meter != "" {
+		fields = append(fields, "meter", o.Meter)
+	}
 	return fields
 }
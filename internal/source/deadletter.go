@@ -0,0 +1,116 @@
+package source
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/deadletter"
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/pkg/errors"
+)
+
+// DeadLetterSource submits dead letter entries back through the task pool. An entry is removed from
+// the store once its task is acknowledged, unless it failed again and was dead lettered once more
+type DeadLetterSource struct {
+	cfg     *config.DeadLetterSource
+	store   *deadletter.Store
+	pool    Submitter
+	entries []*deadletter.Entry
+	cancel  context.CancelFunc
+	done    chan struct{}
+	log     *slog.Logger
+}
+
+func NewDeadLetterSource(cfg *config.DeadLetterSource, store *deadletter.Store, pool Submitter, log *slog.Logger) *DeadLetterSource {
+	return &DeadLetterSource{
+		cfg:   cfg,
+		store: store,
+		pool:  pool,
+		done:  make(chan struct{}),
+		log:   log.With("component", "dead_letter_source"),
+	}
+}
+
+func (s *DeadLetterSource) Name() string {
+	return "dead_letter"
+}
+
+func (s *DeadLetterSource) Start(ctx context.Context) error {
+	entries, err := s.selectEntries()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.entries = entries
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	go s.run(ctx)
+
+	s.log.Info("dead letter replay started", "entries", len(entries))
+	return nil
+}
+
+func (s *DeadLetterSource) Stop(ctx context.Context) error {
+	s.cancel()
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+
+	select {
+	case <-s.done:
+		s.log.Info("dead letter source stopped")
+		return nil
+	case <-ctx.Done():
+		return errors.New("timed out waiting for dead letter replay to stop")
+	}
+}
+
+// Done is closed once every selected entry has been submitted or the source has been stopped
+func (s *DeadLetterSource) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *DeadLetterSource) selectEntries() ([]*deadletter.Entry, error) {
+	if len(s.cfg.IDs) == 0 {
+		return s.store.List()
+	}
+	entries := make([]*deadletter.Entry, 0, len(s.cfg.IDs))
+	for _, id := range s.cfg.IDs {
+		e, err := s.store.Get(id)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *DeadLetterSource) run(ctx context.Context) {
+	defer close(s.done)
+
+	for i, e := range s.entries {
+		for s.pool.Saturated() {
+			if err := sleep(ctx, saturatedPollInterval); err != nil {
+				s.log.Info("dead letter replay cancelled", "submitted", i)
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			s.log.Info("dead letter replay cancelled", "submitted", i)
+			return
+		}
+
+		rec := e.Record
+		// Expiry was relative to the original delivery, replayed payloads are always processed
+		rec.Metadata.ExpiresAt = time.Time{}
+		id, attempts := e.ID(), e.Attempts
+		// The DERs were seen when the task first failed, so deduplication would drop them
+		t := task.NewTaskFromRecord(rec).WithoutDedup().WithAck(func() {
+			if err := s.store.Resolve(id, attempts); err != nil {
+				s.log.Error("failed to resolve dead letter entry", "id", id, "error", err)
+			}
+		})
+		s.pool.Submit(t)
+	}
+	s.log.Info("dead letter replay complete", "submitted", len(s.entries))
+}
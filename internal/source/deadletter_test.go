@@ -0,0 +1,79 @@
+package source
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/deadletter"
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+)
+
+type DeadLetterSourceTestSuite struct {
+	suite.Suite
+	store   *deadletter.Store
+	records []task.Record
+}
+
+func (s *DeadLetterSourceTestSuite) SetupTest() {
+	store, err := deadletter.Open(s.T().TempDir(), slog.Default())
+	s.Require().NoError(err)
+	s.store = store
+
+	s.records = nil
+	for _, payload := range []string{`[{"der_id":"der1"}]`, `[{"der_id":"der2"}]`} {
+		t := task.NewTaskWithMetadata([]byte(payload), task.Metadata{Topic: "grid/project1/ders"})
+		rec := t.Record()
+		s.Require().NoError(store.Put(rec, task.FailureUndeliverable, errors.New("stream closed")))
+		s.records = append(s.records, rec)
+	}
+}
+
+func (s *DeadLetterSourceTestSuite) replay(ids []string) *fakeSubmitter {
+	pool := &fakeSubmitter{}
+	src := NewDeadLetterSource(&config.DeadLetterSource{IDs: ids}, s.store, pool, slog.Default())
+	ctx := context.Background()
+	s.Require().NoError(src.Start(ctx))
+
+	select {
+	case <-src.Done():
+	case <-time.After(5 * time.Second):
+		s.FailNow("dead letter replay did not finish")
+	}
+	s.NoError(src.Stop(ctx))
+	return pool
+}
+
+func (s *DeadLetterSourceTestSuite) TestReplayAll() {
+	pool := s.replay(nil)
+	s.Require().Len(pool.tasks, 2)
+
+	// Acknowledging the first task resolves it, the second failed again and is kept
+	s.Require().NoError(s.store.Put(s.records[1], task.FailureUndeliverable, errors.New("stream closed")))
+	for i := range pool.tasks {
+		pool.tasks[i].Ack()
+	}
+
+	entries, err := s.store.List()
+	s.NoError(err)
+	s.Require().Len(entries, 1)
+	s.Equal(s.records[1].ID, entries[0].ID())
+	s.Equal(2, entries[0].Attempts)
+}
+
+func (s *DeadLetterSourceTestSuite) TestReplayIDs() {
+	pool := s.replay([]string{s.records[1].ID})
+	s.Require().Len(pool.tasks, 1)
+	s.Equal(s.records[1].ID, pool.tasks[0].ID())
+
+	src := NewDeadLetterSource(&config.DeadLetterSource{IDs: []string{"missing"}}, s.store, &fakeSubmitter{}, slog.Default())
+	s.ErrorIs(src.Start(context.Background()), deadletter.ErrNotFound)
+}
+
+func TestDeadLetterSourceSuite(t *testing.T) {
+	suite.Run(t, new(DeadLetterSourceTestSuite))
+}
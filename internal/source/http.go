@@ -0,0 +1,209 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/pkg/errors"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// HTTPSource accepts payloads pushed by partners. Tasks are submitted straight to the task pool
+// rather than published on the event bus, which drops what does not fit, so that a payload
+// answered with 202 has been taken by the pool. When the pool drops any of a request's payloads
+// the request is answered with 429, listing the dropped ones so that only they need resending
+type HTTPSource struct {
+	cfg    *config.HTTPSource
+	srv    *http.Server
+	pool   Submitter
+	tokens [][]byte
+	log    *slog.Logger
+}
+
+type ingestResponse struct {
+	TaskIDs        []string `json:"task_ids,omitempty"`
+	DroppedTaskIDs []string `json:"dropped_task_ids,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+func NewHTTPSource(cfg *config.HTTPSource, pool Submitter, log *slog.Logger) *HTTPSource {
+	s := &HTTPSource{
+		cfg:    cfg,
+		pool:   pool,
+		tokens: make([][]byte, len(cfg.Tokens)),
+		log:    log.With("component", "http_source"),
+	}
+	for i, token := range cfg.Tokens {
+		s.tokens[i] = []byte(token)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+cfg.Path, s.handleIngest)
+	s.srv = &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+func (s *HTTPSource) Name() string {
+	return "http"
+}
+
+func (s *HTTPSource) Start(_ context.Context) error {
+	// Listen up front so a bad address fails startup rather than the background goroutine
+	ln, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tlsEnabled := s.cfg.CertFile != ""
+	go func() {
+		var err error
+		if tlsEnabled {
+			err = s.srv.ServeTLS(ln, s.cfg.CertFile, s.cfg.KeyFile)
+		} else {
+			err = s.srv.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Error("http source stopped unexpectedly", "error", err)
+		}
+	}()
+
+	s.log.Info("http source listening", "addr", ln.Addr().String(), "path", s.cfg.Path, "tls_enabled", tlsEnabled)
+	return nil
+}
+
+func (s *HTTPSource) Stop(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+
+	if err := s.srv.Shutdown(ctx); err != nil {
+		return errors.WithStack(err)
+	}
+	s.log.Info("http source stopped")
+	return nil
+}
+
+func (s *HTTPSource) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, ingestResponse{Error: "invalid or missing bearer token"})
+		return
+	}
+
+	if s.pool.Saturated() {
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusTooManyRequests, ingestResponse{Error: "task pool saturated"})
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, ingestResponse{Error: "payload too large"})
+			return
+		}
+		writeJSON(w, http.StatusBadRequest, ingestResponse{Error: "failed to read payload"})
+		return
+	}
+
+	payloads, err := splitPayloads(body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ingestResponse{Error: err.Error()})
+		return
+	}
+
+	meta := task.Metadata{
+		Topic:       s.cfg.Topic,
+		ContentType: r.Header.Get("Content-Type"),
+	}
+	res := ingestResponse{TaskIDs: make([]string, 0, len(payloads))}
+	for _, pl := range payloads {
+		t := task.NewTaskWithMetadata(pl, meta)
+		if !s.pool.Submit(t) {
+			res.DroppedTaskIDs = append(res.DroppedTaskIDs, t.ID())
+			continue
+		}
+		res.TaskIDs = append(res.TaskIDs, t.ID())
+	}
+
+	if len(res.DroppedTaskIDs) > 0 {
+		s.log.Warn("task pool dropped payloads", "accepted", len(res.TaskIDs), "dropped", len(res.DroppedTaskIDs))
+		res.Error = fmt.Sprintf("task pool full, dropped %d of %d payloads", len(res.DroppedTaskIDs), len(payloads))
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusTooManyRequests, res)
+		return
+	}
+	s.log.Debug("payloads accepted", "tasks", len(res.TaskIDs), "payload_size", len(body))
+	writeJSON(w, http.StatusAccepted, res)
+}
+
+func (s *HTTPSource) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), t) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPayloads accepts a single DER object, a single payload (an array of DERs) or a batch of
+// payloads (an array of arrays of DERs), and returns one payload per task
+func splitPayloads(body []byte) ([][]byte, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, errors.New("empty payload")
+	}
+
+	switch body[0] {
+	case '{':
+		if !json.Valid(body) {
+			return nil, errors.New("invalid json payload")
+		}
+		return [][]byte{append(append([]byte{'['}, body...), ']')}, nil
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, errors.New("invalid json payload")
+		}
+		if len(items) == 0 || bytes.TrimSpace(items[0])[0] != '[' {
+			return [][]byte{body}, nil
+		}
+		payloads := make([][]byte, 0, len(items))
+		for _, item := range items {
+			item = bytes.TrimSpace(item)
+			if item[0] != '[' {
+				return nil, errors.New("batched payloads must all be arrays of ders")
+			}
+			payloads = append(payloads, item)
+		}
+		return payloads, nil
+	default:
+		return nil, errors.New("payload must be a der object, an array of ders or an array of der arrays")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, res ingestResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,139 @@
+package source
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/stretchr/testify/suite"
+)
+
+type fakePool struct {
+	saturated bool
+}
+
+func (p *fakePool) Saturated() bool {
+	return p.saturated
+}
+
+type HTTPSourceTestSuite struct {
+	suite.Suite
+	pool *fakeSubmitter
+	src  *HTTPSource
+}
+
+func (s *HTTPSourceTestSuite) SetupTest() {
+	s.pool = &fakeSubmitter{}
+	s.src = NewHTTPSource(&config.HTTPSource{
+		Addr:         "127.0.0.1:0",
+		Path:         "/ingest",
+		Topic:        "http/partner",
+		Tokens:       []string{"secret"},
+		MaxBodyBytes: 1024,
+	}, s.pool, slog.Default())
+}
+
+func (s *HTTPSourceTestSuite) post(token string, body string) (*httptest.ResponseRecorder, ingestResponse) {
+	req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.src.srv.Handler.ServeHTTP(rec, req)
+
+	var res ingestResponse
+	s.NoError(json.Unmarshal(rec.Body.Bytes(), &res))
+	return rec, res
+}
+
+func (s *HTTPSourceTestSuite) TestIngest() {
+	testCases := []struct {
+		name     string
+		body     string
+		payloads []string
+	}{
+		{
+			name:     "single der",
+			body:     `{"der_id":"der1","project_id":"project1"}`,
+			payloads: []string{`[{"der_id":"der1","project_id":"project1"}]`},
+		},
+		{
+			name:     "single payload",
+			body:     `[{"der_id":"der1"},{"der_id":"der2"}]`,
+			payloads: []string{`[{"der_id":"der1"},{"der_id":"der2"}]`},
+		},
+		{
+			name:     "batched payloads",
+			body:     ` [[{"der_id":"der1"}], [{"der_id":"der2"}]] `,
+			payloads: []string{`[{"der_id":"der1"}]`, `[{"der_id":"der2"}]`},
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			s.pool.tasks = nil
+			rec, res := s.post("secret", tc.body)
+			s.Equal(http.StatusAccepted, rec.Code)
+			s.Len(res.TaskIDs, len(tc.payloads))
+
+			// Every accepted payload was handed to the pool before the response was written
+			s.Require().Len(s.pool.tasks, len(tc.payloads))
+			for i, pl := range tc.payloads {
+				t := s.pool.tasks[i]
+				s.Equal(res.TaskIDs[i], t.ID())
+				s.Equal("http/partner", t.Metadata().Topic)
+				expected := task.NewTask([]byte(pl))
+				s.Equal(expected.ID(), t.ID())
+			}
+		})
+	}
+}
+
+func (s *HTTPSourceTestSuite) TestRejections() {
+	testCases := []struct {
+		name      string
+		token     string
+		body      string
+		saturated bool
+		status    int
+	}{
+		{name: "missing token", token: "", body: `[]`, status: http.StatusUnauthorized},
+		{name: "wrong token", token: "guess", body: `[]`, status: http.StatusUnauthorized},
+		{name: "saturated pool", token: "secret", body: `[]`, saturated: true, status: http.StatusTooManyRequests},
+		{name: "invalid json", token: "secret", body: `[{"der_id":`, status: http.StatusBadRequest},
+		{name: "not a der", token: "secret", body: `"der1"`, status: http.StatusBadRequest},
+		{name: "mixed batch", token: "secret", body: `[[{"der_id":"der1"}], {"der_id":"der2"}]`, status: http.StatusBadRequest},
+		{name: "too large", token: "secret", body: "[" + strings.Repeat(" ", 2048) + "]", status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			s.pool.saturated = tc.saturated
+			rec, res := s.post(tc.token, tc.body)
+			s.Equal(tc.status, rec.Code)
+			s.NotEmpty(res.Error)
+			s.Empty(res.TaskIDs)
+			s.Empty(s.pool.tasks)
+		})
+	}
+}
+
+func (s *HTTPSourceTestSuite) TestDropped() {
+	s.pool.capacity = 1
+	first, second := task.NewTask([]byte(`[{"der_id":"der1"}]`)), task.NewTask([]byte(`[{"der_id":"der2"}]`))
+	rec, res := s.post("secret", `[[{"der_id":"der1"}], [{"der_id":"der2"}]]`)
+	s.Equal(http.StatusTooManyRequests, rec.Code)
+	s.Equal("1", rec.Header().Get("Retry-After"))
+	s.Equal("task pool full, dropped 1 of 2 payloads", res.Error)
+	s.Equal([]string{first.ID()}, res.TaskIDs)
+	s.Equal([]string{second.ID()}, res.DroppedTaskIDs)
+}
+
+func TestHTTPSourceSuite(t *testing.T) {
+	suite.Run(t, new(HTTPSourceTestSuite))
+}
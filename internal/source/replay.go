@@ -0,0 +1,155 @@
+package source
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/capture"
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/pkg/errors"
+)
+
+const saturatedPollInterval = 10 * time.Millisecond
+
+// ReplaySource feeds captured archives back through the task pool, paced relative to when each
+// payload was originally received
+type ReplaySource struct {
+	cfg      *config.ReplaySource
+	pool     Submitter
+	archives []string
+	cancel   context.CancelFunc
+	done     chan struct{}
+	first    time.Time
+	start    time.Time
+	log      *slog.Logger
+}
+
+func NewReplaySource(cfg *config.ReplaySource, pool Submitter, log *slog.Logger) *ReplaySource {
+	return &ReplaySource{
+		cfg:  cfg,
+		pool: pool,
+		done: make(chan struct{}),
+		log:  log.With("component", "replay_source", "path", cfg.Path, "pace", cfg.Pace),
+	}
+}
+
+func (s *ReplaySource) Name() string {
+	return "replay"
+}
+
+func (s *ReplaySource) Start(ctx context.Context) error {
+	archives, err := capture.Archives(s.cfg.Path)
+	if err != nil {
+		return errors.Wrap(err, "failed to find replay archives")
+	}
+	s.archives = archives
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	go s.run(ctx)
+
+	s.log.Info("replay started", "archives", len(archives), "factor", s.cfg.Factor)
+	return nil
+}
+
+func (s *ReplaySource) Stop(ctx context.Context) error {
+	s.cancel()
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+
+	select {
+	case <-s.done:
+		s.log.Info("replay source stopped")
+		return nil
+	case <-ctx.Done():
+		return errors.New("timed out waiting for replay to stop")
+	}
+}
+
+// Done is closed once the replay has submitted every archived task or has been stopped
+func (s *ReplaySource) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *ReplaySource) run(ctx context.Context) {
+	defer close(s.done)
+
+	total := 0
+	for _, path := range s.archives {
+		n, err := s.replay(ctx, path)
+		total += n
+		if ctx.Err() != nil {
+			s.log.Info("replay cancelled", "tasks", total)
+			return
+		}
+		if err != nil {
+			// A damaged archive should not prevent the rest from being replayed
+			s.log.Error("failed to replay archive", "archive", path, "tasks", n, "error", err)
+		}
+	}
+	s.log.Info("replay complete", "archives", len(s.archives), "tasks", total)
+}
+
+func (s *ReplaySource) replay(ctx context.Context, path string) (int, error) {
+	r, err := capture.Open(path)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer r.Close()
+
+	n := 0
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, errors.WithStack(err)
+		}
+		if err := s.wait(ctx, rec.ReceivedAt); err != nil {
+			return n, errors.WithStack(err)
+		}
+
+		// Expiry was relative to the original delivery, replayed payloads are always processed
+		rec.Metadata.ExpiresAt = time.Time{}
+		s.pool.Submit(task.NewTaskFromRecord(rec))
+		n++
+	}
+}
+
+// wait blocks until the record is due, keeping the original gaps between records divided by the
+// replay factor, and until the pool has room for it
+func (s *ReplaySource) wait(ctx context.Context, receivedAt time.Time) error {
+	if s.cfg.Factor > 0 {
+		if s.start.IsZero() {
+			s.first, s.start = receivedAt, time.Now()
+		}
+		offset := time.Duration(float64(receivedAt.Sub(s.first)) / s.cfg.Factor)
+		if err := sleep(ctx, time.Until(s.start.Add(offset))); err != nil {
+			return err
+		}
+	}
+
+	for s.pool.Saturated() {
+		if err := sleep(ctx, saturatedPollInterval); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,126 @@
+package source
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/capture"
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/task"
+	"github.com/stretchr/testify/suite"
+)
+
+type fakeSubmitter struct {
+	fakePool
+	mu    sync.Mutex
+	tasks []task.Task
+	times []time.Time
+	// capacity drops tasks once that many have been taken, when it is set
+	capacity int
+}
+
+func (p *fakeSubmitter) Submit(t any) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.capacity > 0 && len(p.tasks) >= p.capacity {
+		return false
+	}
+	p.tasks = append(p.tasks, t.(task.Task))
+	p.times = append(p.times, time.Now())
+	return true
+}
+
+type ReplaySourceTestSuite struct {
+	suite.Suite
+	dir     string
+	records []task.Record
+}
+
+func (s *ReplaySourceTestSuite) SetupTest() {
+	s.dir = s.T().TempDir()
+	w, err := capture.NewWriter(&config.Capture{Dir: s.dir, RotateInterval: time.Hour, MaxFileBytes: 1 << 20}, slog.Default())
+	s.Require().NoError(err)
+
+	received := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.records = nil
+	for i, payload := range []string{`[{"der_id":"der1"}]`, `[{"der_id":"der2"}]`, `[{"der_id":"der3"}]`} {
+		t := task.NewTaskWithMetadata([]byte(payload), task.Metadata{
+			Topic:     "grid/project1/ders",
+			ExpiresAt: received.Add(time.Minute),
+		})
+		rec := t.Record()
+		rec.ReceivedAt = received.Add(time.Duration(i) * time.Second)
+		s.Require().NoError(w.Write(rec))
+		s.records = append(s.records, rec)
+	}
+	s.Require().NoError(w.Close())
+}
+
+func (s *ReplaySourceTestSuite) replay(cfg *config.ReplaySource, pool *fakeSubmitter) {
+	src := NewReplaySource(cfg, pool, slog.Default())
+	ctx := context.Background()
+	s.Require().NoError(src.Start(ctx))
+
+	select {
+	case <-src.Done():
+	case <-time.After(5 * time.Second):
+		s.FailNow("replay did not finish")
+	}
+	s.NoError(src.Stop(ctx))
+}
+
+func (s *ReplaySourceTestSuite) TestReplay() {
+	testCases := []struct {
+		name   string
+		pace   string
+		factor float64
+		minGap time.Duration
+	}{
+		{name: "unthrottled", pace: "unthrottled", factor: 0},
+		{name: "accelerated", pace: "accelerated", factor: 50, minGap: 15 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			pool := &fakeSubmitter{}
+			s.replay(&config.ReplaySource{Path: s.dir, Pace: tc.pace, Factor: tc.factor}, pool)
+
+			s.Require().Len(pool.tasks, len(s.records))
+			for i, t := range pool.tasks {
+				s.Equal(s.records[i].ID, t.ID())
+				s.Equal(s.records[i].Metadata.Topic, t.Metadata().Topic)
+				s.True(t.Metadata().ExpiresAt.IsZero())
+			}
+			for i := 1; i < len(pool.times); i++ {
+				s.GreaterOrEqual(pool.times[i].Sub(pool.times[i-1]), tc.minGap)
+			}
+		})
+	}
+}
+
+func (s *ReplaySourceTestSuite) TestStop() {
+	pool := &fakeSubmitter{}
+	pool.saturated = true
+
+	src := NewReplaySource(&config.ReplaySource{Path: s.dir, Pace: "unthrottled"}, pool, slog.Default())
+	ctx := context.Background()
+	s.Require().NoError(src.Start(ctx))
+	s.NoError(src.Stop(ctx))
+
+	// A saturated pool holds the replay back until it is stopped
+	s.Empty(pool.tasks)
+	_, open := <-src.Done()
+	s.False(open)
+}
+
+func (s *ReplaySourceTestSuite) TestMissingArchives() {
+	src := NewReplaySource(&config.ReplaySource{Path: s.T().TempDir(), Pace: "unthrottled"}, &fakeSubmitter{}, slog.Default())
+	s.Error(src.Start(context.Background()))
+}
+
+func TestReplaySourceSuite(t *testing.T) {
+	suite.Run(t, new(ReplaySourceTestSuite))
+}
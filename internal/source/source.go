@@ -0,0 +1,37 @@
+package source
+
+import "context"
+
+// Source feeds tasks into the pipeline. Batcher starts every configured source once the task pool
+// is running, and stops them before the pool drains
+type Source interface {
+	Name() string
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// Pool reports whether the task pool can accept more work, so that sources able to push back on
+// their clients can do so instead of accepting tasks that would be dropped
+type Pool interface {
+	Saturated() bool
+}
+
+// Submitter hands tasks straight to the task pool, blocking while it is full unless its overflow
+// policy drops tasks. Submit reports whether the pool took the task. Sources that are not driven by
+// a client, like a replay, use it so that tasks are never dropped by the event bus
+type Submitter interface {
+	Pool
+	Submit(t any) bool
+}
+
+// Pauser is implemented by sources whose connection is still needed after they stop taking input,
+// to acknowledge what they delivered. Batcher pauses them before the pool drains, and only stops
+// them once every destination has flushed
+type Pauser interface {
+	Pause(ctx context.Context) error
+}
+
+// Finite is implemented by sources that run out of input. Done is closed once every task has been submitted
+type Finite interface {
+	Done() <-chan struct{}
+}
@@ -0,0 +1,115 @@
+package task
+
+import (
+	"context"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/metrics"
+)
+
+// autoscaler decides how many workers the pool should have. It only keeps the state the decision
+// needs, starting and retiring workers is left to the pool
+type autoscaler struct {
+	cfg        *config.Autoscale
+	size       int
+	lastScaled time.Time
+}
+
+// decide returns the number of workers the pool should have, and the direction of the change
+// when there is one. A change is only made once the cooldown since the last one has passed
+func (a *autoscaler) decide(now time.Time, depth int, latency time.Duration) (int, string) {
+	// Enough workers for each to have target depth tasks queued in front of it
+	desired := (depth + a.cfg.TargetDepth - 1) / a.cfg.TargetDepth
+	desired = min(max(desired, a.cfg.MinWorkers), a.cfg.MaxWorkers)
+
+	switch {
+	case desired > a.size:
+		if now.Sub(a.lastScaled) < a.cfg.ScaleUpCooldown {
+			return a.size, ""
+		}
+		if a.cfg.MaxLatency > 0 && latency > a.cfg.MaxLatency {
+			return a.size, metrics.ScaleHeld
+		}
+		a.size, a.lastScaled = desired, now
+		return desired, metrics.ScaleUp
+	case desired < a.size:
+		if now.Sub(a.lastScaled) < a.cfg.ScaleDownCooldown {
+			return a.size, ""
+		}
+		a.size, a.lastScaled = desired, now
+		return desired, metrics.ScaleDown
+	default:
+		return a.size, ""
+	}
+}
+
+func (tp *TaskPool) autoscale(ctx context.Context) {
+	defer tp.background.Done()
+	cfg := tp.cfg.Autoscale
+	a := &autoscaler{cfg: cfg, size: tp.cfg.NumWorkers, lastScaled: time.Now()}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-tp.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		depth := len(tp.tasks)
+		if tp.spill != nil {
+			depth += tp.spill.Len()
+		}
+		latency := tp.writeLatency()
+		metrics.Local.Gauge(metrics.WriteLatency).WithLabelValues().Set(latency.Seconds())
+
+		from := a.size
+		to, direction := a.decide(time.Now(), depth, latency)
+		if direction == "" {
+			continue
+		}
+		metrics.Local.Counter(metrics.ScalingDecisions).WithLabelValues(direction).Inc()
+		log := tp.log.With("direction", direction, "queue_depth", depth, "write_latency", latency.String())
+		if direction == metrics.ScaleHeld {
+			log.Warn("not scaling up, destination writes are slow", "workers", from, "max_latency", cfg.MaxLatency.String())
+			continue
+		}
+		tp.resize(ctx, from, to)
+		log.Info("task pool scaled", "from", from, "to", to)
+	}
+}
+
+// resize starts or retires workers to go from one size to another. Workers are retired once they
+// finish the task in hand, and a retirement that has not been picked up yet is cancelled in
+// preference to starting a new worker
+func (tp *TaskPool) resize(ctx context.Context, from, to int) {
+	for n := from; n < to; n++ {
+		select {
+		case <-tp.retire:
+		default:
+			tp.startWorker(ctx, tp.tasks)
+		}
+	}
+	for n := from; n > to; n-- {
+		tp.retire <- struct{}{}
+	}
+	metrics.Local.Gauge(metrics.PoolWorkers).WithLabelValues().Set(float64(to))
+}
+
+func (tp *TaskPool) observeLatency(d time.Duration) {
+	tp.latencyTotal.Add(int64(d))
+	tp.latencyCount.Add(1)
+}
+
+// writeLatency returns the average destination write latency since it was last called
+func (tp *TaskPool) writeLatency() time.Duration {
+	total, count := tp.latencyTotal.Swap(0), tp.latencyCount.Swap(0)
+	if count == 0 {
+		return 0
+	}
+	return time.Duration(total / count)
+}
@@ -0,0 +1,118 @@
+package task
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/destination"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+type AutoscaleTestSuite struct {
+	suite.Suite
+}
+
+func (s *AutoscaleTestSuite) SetupSuite() {
+	metrics.InitMetricsProvider()
+}
+
+func (s *AutoscaleTestSuite) TestDecide() {
+	cfg := &config.Autoscale{
+		MinWorkers:        2,
+		MaxWorkers:        8,
+		TargetDepth:       10,
+		MaxLatency:        time.Second,
+		ScaleUpCooldown:   10 * time.Second,
+		ScaleDownCooldown: time.Minute,
+	}
+	now := time.Now()
+
+	testCases := []struct {
+		name       string
+		size       int
+		sinceScale time.Duration
+		depth      int
+		latency    time.Duration
+		expected   int
+		direction  string
+	}{
+		{name: "steady", size: 2, sinceScale: time.Hour, depth: 15, expected: 2},
+		{name: "scale up to depth", size: 2, sinceScale: time.Hour, depth: 45, expected: 5, direction: metrics.ScaleUp},
+		{name: "scale up capped at max", size: 2, sinceScale: time.Hour, depth: 1000, expected: 8, direction: metrics.ScaleUp},
+		{name: "scale up in cooldown", size: 2, sinceScale: 5 * time.Second, depth: 45, expected: 2},
+		{name: "scale up held by latency", size: 2, sinceScale: time.Hour, depth: 45, latency: 2 * time.Second, expected: 2, direction: metrics.ScaleHeld},
+		{name: "scale down to min", size: 8, sinceScale: time.Hour, depth: 0, expected: 2, direction: metrics.ScaleDown},
+		{name: "scale down ignores latency", size: 8, sinceScale: time.Hour, depth: 30, latency: 2 * time.Second, expected: 3, direction: metrics.ScaleDown},
+		{name: "scale down in cooldown", size: 8, sinceScale: 30 * time.Second, depth: 0, expected: 8},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			a := &autoscaler{cfg: cfg, size: tc.size, lastScaled: now.Add(-tc.sinceScale)}
+			size, direction := a.decide(now, tc.depth, tc.latency)
+			s.Equal(tc.expected, size)
+			s.Equal(tc.direction, direction)
+			s.Equal(tc.expected, a.size)
+		})
+	}
+}
+
+func (s *AutoscaleTestSuite) TestResize() {
+	router, err := destination.NewRouter(context.Background(),
+		map[string]*config.Destination{"grid": {Type: "stdout"}},
+		[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+		slog.Default(),
+	)
+	s.Require().NoError(err)
+	cfg := &config.Pool{
+		NumWorkers: 1,
+		Capacity:   4,
+		Overflow:   "block",
+		Autoscale:  &config.Autoscale{MinWorkers: 1, MaxWorkers: 4, Interval: time.Hour, TargetDepth: 1},
+	}
+	tp, err := NewTaskPool(context.Background(), cfg, router, nil, slog.Default())
+	s.Require().NoError(err)
+	tp.Start(context.Background())
+
+	workers := func() float64 {
+		return testutil.ToFloat64(metrics.Local.Gauge(metrics.PoolWorkers).WithLabelValues())
+	}
+
+	tp.resize(context.Background(), 1, 4)
+	s.Equal(4, tp.nextWorkerId)
+	s.Equal(float64(4), workers())
+
+	// Idle workers pick up their retirement straight away
+	tp.resize(context.Background(), 4, 1)
+	s.Eventually(func() bool { return len(tp.retire) == 0 }, time.Second, 10*time.Millisecond)
+	s.Equal(float64(1), workers())
+
+	// The remaining worker still processes tasks
+	acked := make(chan struct{})
+	t := NewTaskWithMetadata([]byte(`[{"der_id":"der1","project_id":"project1"}]`), Metadata{Topic: "grid/ders"})
+	tp.Submit(t.WithAck(func() { close(acked) }))
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		s.FailNow("task was not processed after scaling down")
+	}
+	tp.Wait()
+}
+
+func (s *AutoscaleTestSuite) TestWriteLatency() {
+	tp := &TaskPool{}
+	s.Equal(time.Duration(0), tp.writeLatency())
+	tp.observeLatency(100 * time.Millisecond)
+	tp.observeLatency(300 * time.Millisecond)
+	s.Equal(200*time.Millisecond, tp.writeLatency())
+	s.Equal(time.Duration(0), tp.writeLatency())
+}
+
+func TestAutoscaleSuite(t *testing.T) {
+	suite.Run(t, new(AutoscaleTestSuite))
+}
@@ -0,0 +1,97 @@
+package task
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/grid-stream-org/batcher/metrics"
+)
+
+// dedupe removes the DERs in the task that were already seen within the dedup window, and reports
+// whether any are left. DERs are keyed on their ID and timestamp, so a payload serialised again
+// with different whitespace or field order is still recognised. Payloads that do not parse are
+// left for Execute to reject. The keys are forgotten again if the task is released, so that its
+// redelivery is not taken for a duplicate. The payload as received is kept for the task's record
+func (tp *TaskPool) dedupe(t *Task, log *slog.Logger) bool {
+	if tp.dedup == nil || t.skipDedup {
+		return true
+	}
+	var ders []json.RawMessage
+	if err := json.Unmarshal(t.payload, &ders); err != nil {
+		return true
+	}
+
+	now := time.Now()
+	kept := make([][]byte, 0, len(ders))
+	var recorded []string
+	for _, der := range ders {
+		key, ok := derKey(der)
+		if ok && tp.dedup.Seen(key, now) {
+			continue
+		}
+		if ok {
+			recorded = append(recorded, key)
+		}
+		kept = append(kept, der)
+	}
+	if len(recorded) > 0 {
+		release := t.release
+		t.release = sync.OnceFunc(func() {
+			for _, key := range recorded {
+				tp.dedup.Forget(key)
+			}
+			if release != nil {
+				release()
+			}
+		})
+	}
+	metrics.Local.Gauge(metrics.DedupEntries).WithLabelValues().Set(float64(tp.dedup.Len()))
+
+	duplicates := len(ders) - len(kept)
+	if duplicates == 0 {
+		return true
+	}
+	metrics.Local.Counter(metrics.DuplicateDERs).WithLabelValues(t.meta.Topic).Add(float64(duplicates))
+	if len(kept) == 0 {
+		return false
+	}
+	log.Debug("removed duplicate DERs from task", "duplicates", duplicates, "kept", len(kept))
+	t.payload = append(append([]byte{'['}, bytes.Join(kept, []byte{','})...), ']')
+	return true
+}
+
+// saveDedup saves the dedup cache every save interval, so that a crash forgets at most the keys seen
+// since. Drain saves it a last time once every task is done with
+func (tp *TaskPool) saveDedup(ctx context.Context) {
+	defer tp.background.Done()
+	ticker := time.NewTicker(tp.cfg.Dedup.SaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-tp.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if err := tp.dedup.Save(); err != nil {
+			tp.log.Error("failed to save dedup cache", "error", err)
+		}
+	}
+}
+
+// derKey identifies a DER reading, DERs without an ID are never treated as duplicates
+func derKey(der json.RawMessage) (string, bool) {
+	var key struct {
+		DerID     string    `json:"der_id"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+	if err := json.Unmarshal(der, &key); err != nil || key.DerID == "" {
+		return "", false
+	}
+	return key.DerID + "@" + key.Timestamp.UTC().Format(time.RFC3339Nano), true
+}
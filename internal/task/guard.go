@@ -0,0 +1,102 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/grid-stream-org/batcher/internal/destination"
+	"github.com/grid-stream-org/batcher/internal/outcome"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/pkg/errors"
+)
+
+// PanicError is a recovered panic, with the stack of the goroutine that panicked
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n\n%s", e.Value, e.Stack)
+}
+
+func recovered(r any) *PanicError {
+	return &PanicError{Value: r, Stack: debug.Stack()}
+}
+
+// guard runs fn, turning a panic into a *PanicError
+func guard(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recovered(r)
+		}
+	}()
+	return fn()
+}
+
+// ErrTooManyAbandoned is returned, without writing, while too many abandoned writes are outstanding
+var ErrTooManyAbandoned = errors.New("too many abandoned destination writes outstanding")
+
+// AbandonedError is returned when the task deadline passes before the destination write returns.
+// The write carries on in the background and may still commit, Done receives its result
+type AbandonedError struct {
+	Cause error
+	Done  <-chan error
+}
+
+func (e *AbandonedError) Error() string {
+	return fmt.Sprintf("destination write abandoned: %v", e.Cause)
+}
+
+func (e *AbandonedError) Unwrap() error {
+	return e.Cause
+}
+
+// States of a destination write run on its own goroutine
+const (
+	writeRunning int32 = iota
+	writeFinished
+	writeAbandoned
+)
+
+// add writes an outcome to the destination on its own goroutine. A destination that ignores the
+// context deadline then only holds up that goroutine, and the worker moves on to the next task,
+// unless the pool is ordered, in which case the worker waits for the write to return first.
+// Abandoned goroutines are bounded, once max_abandoned_writes are outstanding writes are refused
+func (tp *TaskPool) add(ctx context.Context, dest destination.Destination, o *outcome.Outcome) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return guard(func() error { return dest.Add(ctx, o) })
+	}
+	if tp.cfg.MaxAbandonedWrites > 0 && tp.abandoned.Load() >= int64(tp.cfg.MaxAbandonedWrites) {
+		return errors.WithStack(ErrTooManyAbandoned)
+	}
+
+	done := make(chan error, 1)
+	var state atomic.Int32
+	go func() {
+		err := guard(func() error { return dest.Add(ctx, o) })
+		if !state.CompareAndSwap(writeRunning, writeFinished) {
+			tp.reportAbandoned(-1)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		tp.reportAbandoned(1)
+		if !state.CompareAndSwap(writeRunning, writeAbandoned) {
+			// The write returned just as the deadline passed
+			tp.reportAbandoned(-1)
+			return <-done
+		}
+		return &AbandonedError{Cause: errors.WithStack(ctx.Err()), Done: done}
+	}
+}
+
+func (tp *TaskPool) reportAbandoned(delta int64) {
+	n := tp.abandoned.Add(delta)
+	metrics.Local.Gauge(metrics.AbandonedWrites).WithLabelValues().Set(float64(n))
+}
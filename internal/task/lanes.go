@@ -0,0 +1,86 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+)
+
+// queueSizes splits the pool capacity between the shared queue and the lanes of an ordered pool, so
+// that together they hold no more than the configured capacity. Half goes to the lanes, and every
+// lane and a buffered shared queue hold at least one task
+func queueSizes(cfg *config.Pool) (queue int, lane int) {
+	if cfg.Ordering == nil {
+		return cfg.Capacity, 0
+	}
+	lane = max(1, cfg.Capacity/(2*cfg.NumWorkers))
+	if cfg.Capacity == 0 {
+		return 0, lane
+	}
+	return max(1, cfg.Capacity-lane*cfg.NumWorkers), lane
+}
+
+// dispatch moves tasks from the shared queue onto the lane their ordering key hashes to. A full lane
+// holds back the tasks behind it rather than letting them overtake, which is what keeps the order
+func (tp *TaskPool) dispatch(ctx context.Context, lanes []chan Task) {
+	defer tp.wg.Done()
+	defer func() {
+		for _, lane := range lanes {
+			close(lane)
+		}
+	}()
+
+	for {
+		select {
+		case t, ok := <-tp.tasks:
+			if !ok {
+				return
+			}
+			lane := lanes[laneIndex(tp.orderingKey(t), len(lanes))]
+			select {
+			case lane <- t:
+			case <-ctx.Done():
+				tp.persist(t, tp.log.With(t.LogFields()...))
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// orderingKey returns the key tasks are kept in order by. Tasks without one, such as unparseable
+// payloads, share the empty key
+func (tp *TaskPool) orderingKey(t Task) string {
+	if tp.cfg.Ordering.Key == "segment" {
+		if v, ok := t.meta.Segments[tp.cfg.Ordering.Segment]; ok {
+			return v
+		}
+		// Topics that do not match the template are at least kept in order with themselves
+		return t.meta.Topic
+	}
+	return payloadProjectID(t.payload)
+}
+
+// payloadProjectID reads the project of the first DER without decoding the rest of the payload
+func payloadProjectID(payload []byte) string {
+	var ders []json.RawMessage
+	if err := json.Unmarshal(payload, &ders); err != nil || len(ders) == 0 {
+		return ""
+	}
+	var der struct {
+		ProjectID string `json:"project_id"`
+	}
+	if err := json.Unmarshal(ders[0], &der); err != nil {
+		return ""
+	}
+	return der.ProjectID
+}
+
+func laneIndex(key string, lanes int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(lanes))
+}
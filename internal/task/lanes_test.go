@@ -0,0 +1,172 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/destination"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/stretchr/testify/suite"
+)
+
+type LanesTestSuite struct {
+	suite.Suite
+}
+
+func (s *LanesTestSuite) SetupSuite() {
+	metrics.InitMetricsProvider()
+}
+
+func (s *LanesTestSuite) TestOrderingKey() {
+	testCases := []struct {
+		name     string
+		ordering *config.Ordering
+		payload  string
+		meta     Metadata
+		expected string
+	}{
+		{
+			name:     "project from payload",
+			ordering: &config.Ordering{Key: "project"},
+			payload:  `[{"der_id":"der1","project_id":"project1"},{"der_id":"der2","project_id":"project2"}]`,
+			expected: "project1",
+		},
+		{
+			name:     "unparseable payload",
+			ordering: &config.Ordering{Key: "project"},
+			payload:  `[{"der_id":`,
+			expected: "",
+		},
+		{
+			name:     "topic segment",
+			ordering: &config.Ordering{Key: "segment", Segment: "site"},
+			payload:  `[]`,
+			meta:     Metadata{Topic: "grid/site1/ders", Segments: map[string]string{"site": "site1"}},
+			expected: "site1",
+		},
+		{
+			name:     "missing segment falls back to the topic",
+			ordering: &config.Ordering{Key: "segment", Segment: "site"},
+			payload:  `[]`,
+			meta:     Metadata{Topic: "grid/ders"},
+			expected: "grid/ders",
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			tp := &TaskPool{cfg: &config.Pool{Ordering: tc.ordering}}
+			s.Equal(tc.expected, tp.orderingKey(NewTaskWithMetadata([]byte(tc.payload), tc.meta)))
+		})
+	}
+}
+
+func (s *LanesTestSuite) TestLaneIndexStable() {
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("project%d", i)
+		lane := laneIndex(key, 4)
+		s.GreaterOrEqual(lane, 0)
+		s.Less(lane, 4)
+		s.Equal(lane, laneIndex(key, 4))
+	}
+}
+
+func (s *LanesTestSuite) TestQueueSizes() {
+	testCases := []struct {
+		name  string
+		cfg   *config.Pool
+		queue int
+		lane  int
+	}{
+		{name: "unordered", cfg: &config.Pool{NumWorkers: 4, Capacity: 16}, queue: 16, lane: 0},
+		{name: "ordered", cfg: &config.Pool{NumWorkers: 4, Capacity: 16, Ordering: &config.Ordering{}}, queue: 8, lane: 2},
+		{name: "fewer slots than lanes", cfg: &config.Pool{NumWorkers: 4, Capacity: 3, Ordering: &config.Ordering{}}, queue: 1, lane: 1},
+		{name: "unbuffered", cfg: &config.Pool{NumWorkers: 4, Ordering: &config.Ordering{}}, queue: 0, lane: 1},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			queue, lane := queueSizes(tc.cfg)
+			s.Equal(tc.queue, queue)
+			s.Equal(tc.lane, lane)
+		})
+	}
+}
+
+func (s *LanesTestSuite) TestSaturatedCountsLanes() {
+	cfg := &config.Pool{NumWorkers: 2, Capacity: 4, Overflow: "block", Ordering: &config.Ordering{Key: "project"}}
+	tp, err := NewTaskPool(context.Background(), cfg, nil, nil, slog.Default())
+	s.Require().NoError(err)
+	tp.lanes = []chan Task{make(chan Task, 1), make(chan Task, 1)}
+
+	tp.tasks <- NewTask([]byte(`[]`))
+	s.False(tp.Saturated())
+	tp.lanes[0] <- NewTask([]byte(`[]`))
+	tp.lanes[1] <- NewTask([]byte(`[]`))
+	s.False(tp.Saturated())
+	tp.tasks <- NewTask([]byte(`[]`))
+	s.True(tp.Saturated())
+	s.Equal(4, tp.queued())
+}
+
+func (s *LanesTestSuite) TestOrderPreservedPerProject() {
+	router, err := destination.NewRouter(context.Background(),
+		map[string]*config.Destination{"grid": {Type: "stdout"}},
+		[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+		slog.Default(),
+	)
+	s.Require().NoError(err)
+	cfg := &config.Pool{NumWorkers: 4, Capacity: 16, Overflow: "block", Ordering: &config.Ordering{Key: "project"}}
+	tp, err := NewTaskPool(context.Background(), cfg, router, nil, slog.Default())
+	s.Require().NoError(err)
+
+	const projects, perProject = 3, 20
+	var mu sync.Mutex
+	acked := map[string][]int{}
+	var wg sync.WaitGroup
+	wg.Add(projects * perProject)
+
+	tp.Start(context.Background())
+	for i := 0; i < perProject; i++ {
+		for p := 0; p < projects; p++ {
+			project, seq := fmt.Sprintf("project%d", p), i
+			payload := fmt.Sprintf(`[{"der_id":"der%d","project_id":"%s"}]`, i, project)
+			t := NewTaskWithMetadata([]byte(payload), Metadata{Topic: "grid/ders"})
+			tp.Submit(t.WithAck(func() {
+				mu.Lock()
+				acked[project] = append(acked[project], seq)
+				mu.Unlock()
+				wg.Done()
+			}))
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		s.FailNow("tasks were not acknowledged")
+	}
+	tp.Wait()
+
+	for p := 0; p < projects; p++ {
+		seqs := acked[fmt.Sprintf("project%d", p)]
+		s.Require().Len(seqs, perProject)
+		for i, seq := range seqs {
+			s.Equal(i, seq)
+		}
+	}
+}
+
+func TestLanesSuite(t *testing.T) {
+	suite.Run(t, new(LanesTestSuite))
+}
@@ -0,0 +1,288 @@
+package task
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+const (
+	spillExt = ".spill"
+	// corruptExt holds the records of a segment that could not be decoded, and unreadableExt is
+	// given to a segment that could not be read to the end. Neither is picked up as a segment
+	corruptExt    = ".corrupt"
+	unreadableExt = ".unreadable"
+
+	// maxSpillRecordBytes bounds a single spilled record, payloads are base64 encoded
+	maxSpillRecordBytes = 16 << 20
+)
+
+// spillQueue is a FIFO of task records kept on disk in JSONL segments. Records are appended to a
+// write segment, which is sealed and handed to the reader once everything before it has been read.
+// Segments left behind by a previous run are picked up again on open. Records that cannot be read
+// back are moved aside rather than dropped, and the rest of the queue is read on
+type spillQueue struct {
+	dir      string
+	mu       sync.Mutex
+	sealed   []spillSegment
+	w        *os.File
+	wPath    string
+	wCount   int
+	r        *os.File
+	rScanner *bufio.Scanner
+	rPath    string
+	rLeft    int
+	len      int
+	seq      int
+	ready    chan struct{}
+}
+
+// spillSegment is a sealed segment and the number of records in it
+type spillSegment struct {
+	path  string
+	count int
+}
+
+func openSpillQueue(dir string) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "failed to create spill directory")
+	}
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+spillExt))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Segment names start with the time they were created, so lexical order is FIFO order
+	slices.Sort(segments)
+
+	q := &spillQueue{
+		dir:   dir,
+		ready: make(chan struct{}, 1),
+	}
+	for _, path := range segments {
+		n, err := countLines(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		q.sealed = append(q.sealed, spillSegment{path: path, count: n})
+		q.len += n
+	}
+	if q.len > 0 {
+		q.signal()
+	}
+	return q, nil
+}
+
+// Push appends a record to the end of the queue
+func (q *spillQueue) Push(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode spilled task")
+	}
+	data = append(data, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.w == nil {
+		q.seq++
+		q.wPath = filepath.Join(q.dir, fmt.Sprintf("%s-%06d%s", time.Now().UTC().Format("20060102T150405.000000000Z"), q.seq, spillExt))
+		if q.w, err = os.OpenFile(q.wPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644); err != nil {
+			q.w = nil
+			return errors.Wrap(err, "failed to create spill segment")
+		}
+		q.wCount = 0
+		if err := syncDir(q.dir); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if _, err := q.w.Write(data); err != nil {
+		return errors.Wrap(err, "failed to write spilled task")
+	}
+	// The source is acknowledged as soon as Push returns, so the record must already be on disk
+	if err := q.w.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync spilled task")
+	}
+	q.wCount++
+	q.len++
+	q.signal()
+	return nil
+}
+
+// Pop removes the record at the front of the queue, ok is false when the queue is empty
+func (q *spillQueue) Pop() (r Record, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.r == nil {
+			if len(q.sealed) == 0 {
+				if q.wCount == 0 {
+					return r, false, nil
+				}
+				if err := q.seal(); err != nil {
+					return r, false, errors.WithStack(err)
+				}
+			}
+			if err := q.openReader(); err != nil {
+				return r, false, errors.WithStack(err)
+			}
+		}
+
+		if q.rScanner.Scan() {
+			line := q.rScanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			q.len--
+			q.rLeft--
+			if err := json.Unmarshal(line, &r); err != nil {
+				if qErr := q.quarantine(line); qErr != nil {
+					return r, false, errors.Wrapf(multierr.Combine(err, qErr), "invalid spilled task in %s", q.rPath)
+				}
+				return r, false, errors.Wrapf(err, "invalid spilled task in %s, moved to %s", q.rPath, q.rPath+corruptExt)
+			}
+			return r, true, nil
+		}
+		if scanErr := q.rScanner.Err(); scanErr != nil {
+			// The records after the one that could not be read are kept in the segment, moved aside
+			q.len -= max(q.rLeft, 0)
+			path := q.rPath
+			if err := q.closeReader(path + unreadableExt); err != nil {
+				return r, false, errors.Wrapf(multierr.Combine(scanErr, err), "failed to read spill segment %s", path)
+			}
+			return r, false, errors.Wrapf(scanErr, "failed to read spill segment %s, moved to %s", path, path+unreadableExt)
+		}
+		if err := q.closeReader(""); err != nil {
+			return r, false, errors.WithStack(err)
+		}
+	}
+}
+
+func (q *spillQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.len
+}
+
+// Ready receives a value whenever records may be waiting to be popped
+func (q *spillQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Close releases open segments, any unread records stay on disk for the next run
+func (q *spillQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var err error
+	if q.w != nil {
+		err = q.w.Close()
+		q.w = nil
+	}
+	if q.r != nil {
+		// The partly read segment is kept, so its records are read again after a restart
+		q.r.Close()
+		q.r = nil
+	}
+	return errors.WithStack(err)
+}
+
+func (q *spillQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *spillQueue) seal() error {
+	if err := q.w.Close(); err != nil {
+		return errors.Wrap(err, "failed to close spill segment")
+	}
+	q.sealed = append(q.sealed, spillSegment{path: q.wPath, count: q.wCount})
+	q.w, q.wCount = nil, 0
+	return nil
+}
+
+func (q *spillQueue) openReader() error {
+	seg := q.sealed[0]
+	q.sealed = q.sealed[1:]
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open spill segment")
+	}
+	q.r, q.rPath, q.rLeft = f, seg.path, seg.count
+	q.rScanner = bufio.NewScanner(f)
+	q.rScanner.Buffer(make([]byte, 0, 64*1024), maxSpillRecordBytes)
+	return nil
+}
+
+// closeReader removes a segment once every record in it has been read, or renames it to aside when
+// it could not be read to the end
+func (q *spillQueue) closeReader(aside string) error {
+	q.r.Close()
+	q.r, q.rScanner = nil, nil
+	if aside != "" {
+		if err := os.Rename(q.rPath, aside); err != nil {
+			return errors.Wrap(err, "failed to move unreadable spill segment aside")
+		}
+		return nil
+	}
+	if err := os.Remove(q.rPath); err != nil {
+		return errors.Wrap(err, "failed to remove spill segment")
+	}
+	return nil
+}
+
+// quarantine appends a record that could not be decoded to the corrupt file of its segment
+func (q *spillQueue) quarantine(line []byte) error {
+	f, err := os.OpenFile(q.rPath+corruptExt, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open corrupt spill records")
+	}
+	defer f.Close()
+	if _, err := f.Write(append(slices.Clone(line), '\n')); err != nil {
+		return errors.Wrap(err, "failed to keep corrupt spill record")
+	}
+	return errors.WithStack(f.Sync())
+}
+
+// syncDir makes a newly created segment survive a crash, not only the records written to it
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to open spill directory")
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync spill directory")
+	}
+	return nil
+}
+
+func countLines(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open spill segment")
+	}
+	defer f.Close()
+
+	// Only the records before one that cannot be read are counted, reading the segment stops there
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSpillRecordBytes)
+	n := 0
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			n++
+		}
+	}
+	return n, nil
+}
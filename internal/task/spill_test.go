@@ -0,0 +1,142 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SpillQueueTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *SpillQueueTestSuite) SetupTest() {
+	s.dir = s.T().TempDir()
+}
+
+func (s *SpillQueueTestSuite) record(i int) Record {
+	t := NewTaskWithMetadata([]byte(fmt.Sprintf(`[{"der_id":"der%d"}]`, i)), Metadata{Topic: "grid/project1/ders"})
+	return t.Record()
+}
+
+func (s *SpillQueueTestSuite) pop(q *spillQueue) (Record, bool) {
+	r, ok, err := q.Pop()
+	s.Require().NoError(err)
+	return r, ok
+}
+
+func (s *SpillQueueTestSuite) TestFIFO() {
+	q, err := openSpillQueue(s.dir)
+	s.Require().NoError(err)
+
+	_, ok := s.pop(q)
+	s.False(ok)
+
+	// Interleave pushes and pops so that reads cross from sealed segments into new ones
+	s.NoError(q.Push(s.record(0)))
+	s.NoError(q.Push(s.record(1)))
+	r, ok := s.pop(q)
+	s.True(ok)
+	s.Equal(s.record(0).ID, r.ID)
+
+	s.NoError(q.Push(s.record(2)))
+	s.Equal(2, q.Len())
+	for _, i := range []int{1, 2} {
+		r, ok := s.pop(q)
+		s.True(ok)
+		s.Equal(s.record(i).ID, r.ID)
+	}
+
+	_, ok = s.pop(q)
+	s.False(ok)
+	s.Zero(q.Len())
+	s.NoError(q.Close())
+}
+
+func (s *SpillQueueTestSuite) TestRecovery() {
+	q, err := openSpillQueue(s.dir)
+	s.Require().NoError(err)
+	for i := 0; i < 3; i++ {
+		s.NoError(q.Push(s.record(i)))
+	}
+	r, ok := s.pop(q)
+	s.True(ok)
+	s.Equal(s.record(0).ID, r.ID)
+	s.NoError(q.Push(s.record(3)))
+	s.NoError(q.Close())
+
+	// The partly read segment is read again in full, followed by the unsealed one
+	q, err = openSpillQueue(s.dir)
+	s.Require().NoError(err)
+	s.Equal(4, q.Len())
+	select {
+	case <-q.Ready():
+	default:
+		s.Fail("recovered queue should be ready")
+	}
+	for i := 0; i < 4; i++ {
+		r, ok := s.pop(q)
+		s.True(ok)
+		s.Equal(s.record(i).ID, r.ID)
+	}
+	s.NoError(q.Close())
+}
+
+func (s *SpillQueueTestSuite) TestCorruptRecords() {
+	line := func(i int) string {
+		data, err := json.Marshal(s.record(i))
+		s.Require().NoError(err)
+		return string(data) + "\n"
+	}
+	testCases := []struct {
+		name    string
+		bad     string
+		aside   string
+		records []int
+	}{
+		// A record that cannot be decoded is skipped, and the ones after it are still read
+		{name: "invalid record", bad: "{\"id\":\n", aside: corruptExt, records: []int{0, 2}},
+		// Nothing can be read past a record longer than the limit, so the segment is kept aside
+		{name: "record too long", bad: strings.Repeat("x", maxSpillRecordBytes+1) + "\n", aside: unreadableExt, records: []int{0}},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			dir := s.T().TempDir()
+			path := filepath.Join(dir, "20240101T000000.000000000Z-000001"+spillExt)
+			s.Require().NoError(os.WriteFile(path, []byte(line(0)+tc.bad+line(2)), 0o644))
+
+			q, err := openSpillQueue(dir)
+			s.Require().NoError(err)
+			var popped []int
+			for range 4 {
+				r, ok, err := q.Pop()
+				if err != nil {
+					continue
+				}
+				if !ok {
+					break
+				}
+				for i := range 3 {
+					if r.ID == s.record(i).ID {
+						popped = append(popped, i)
+					}
+				}
+			}
+			s.Equal(tc.records, popped)
+			s.Zero(q.Len())
+			s.FileExists(path + tc.aside)
+			s.NoError(q.Close())
+		})
+	}
+}
+
+func TestSpillQueueSuite(t *testing.T) {
+	suite.Run(t, new(SpillQueueTestSuite))
+}
@@ -1,36 +1,201 @@
 package task
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/grid-stream-org/batcher/internal/netoutput"
 	"github.com/grid-stream-org/batcher/internal/outcome"
 	"github.com/grid-stream-org/batcher/internal/types"
 	"github.com/pkg/errors"
 )
 
 var (
-	ErrNoDERs = errors.New("received empty DER array")
+	ErrNoDERs   = errors.New("received empty DER array")
+	ErrShutdown = errors.New("task pool shut down before the task was processed")
 )
 
+// Reasons a well formed payload can be rejected
+const (
+	ReasonProjectMismatch = "project_mismatch"
+	ReasonUnknownUnits    = "unknown_units"
+)
+
+// Classes of failure recorded when a task is dead lettered
+const (
+	FailureParse         = "parse"
+	FailureEmpty         = "empty"
+	FailureRejected      = "rejected"
+	FailureUnroutable    = "unroutable"
+	FailureUndeliverable = "undeliverable"
+	FailureTimeout       = "timeout"
+	FailurePanic         = "panic"
+	FailureShutdown      = "shutdown"
+)
+
+// SegmentProjectID is the topic template segment that, when present, fixes the project a payload may write to
+const SegmentProjectID = "project_id"
+
+// RejectionError is returned when a payload parses but is refused, Reason is machine readable
+type RejectionError struct {
+	Reason string
+	Detail string
+}
+
+func (e *RejectionError) Error() string {
+	return fmt.Sprintf("payload rejected (%s): %s", e.Reason, e.Detail)
+}
+
 type Task struct {
-	id        string
-	payload   []byte
+	id      string
+	payload []byte
+	// raw is the payload as it was received, before deduplication removed any DERs from it
+	raw       []byte
 	createdAt time.Time
+	meta      Metadata
+	ack       func()
+	release   func()
+	skipDedup bool
+}
+
+// Metadata describes where a payload came from, as reported by the source that received it
+type Metadata struct {
+	Topic          string            `json:"topic,omitempty"`
+	Segments       map[string]string `json:"segments,omitempty"`
+	ContentType    string            `json:"content_type,omitempty"`
+	ExpiresAt      time.Time         `json:"expires_at,omitempty"`
+	UserProperties map[string]string `json:"user_properties,omitempty"`
+}
+
+// Record is a task as it was received, in a form that can be archived and replayed. Deduplicated
+// is what was left of the payload once duplicate DERs were removed, when any were, and is what a
+// replay processes
+type Record struct {
+	ID           string    `json:"id"`
+	ReceivedAt   time.Time `json:"received_at"`
+	Payload      []byte    `json:"payload"`
+	Deduplicated []byte    `json:"deduplicated,omitempty"`
+	Metadata     Metadata  `json:"metadata"`
 }
 
 func NewTask(payload []byte) Task {
+	return NewTaskWithMetadata(payload, Metadata{})
+}
+
+func NewTaskWithMetadata(payload []byte, meta Metadata) Task {
 	return Task{
 		id:        makeID(payload),
 		payload:   payload,
+		raw:       payload,
 		createdAt: time.Now(),
+		meta:      meta,
+	}
+}
+
+// WithAck returns a copy of the task that calls ack, at most once, when Ack is called
+func (t Task) WithAck(ack func()) Task {
+	t.ack = sync.OnceFunc(ack)
+	return t
+}
+
+// WithRelease returns a copy of the task that calls release, at most once, when Release is called
+func (t Task) WithRelease(release func()) Task {
+	t.release = sync.OnceFunc(release)
+	return t
+}
+
+// WithoutDedup returns a copy of the task that deduplication lets through, for sources that
+// resubmit tasks that were seen before on purpose
+func (t Task) WithoutDedup() Task {
+	t.skipDedup = true
+	return t
+}
+
+// Ack tells the source the task has been fully handled and does not need to be redelivered
+func (t *Task) Ack() {
+	if t.ack != nil {
+		t.ack()
 	}
 }
 
-func (t *Task) Execute(workerId int) (*outcome.Outcome, error) {
+// Release tells the source the task will never be acknowledged, so that it can arrange for the
+// task to be redelivered instead of waiting on it
+func (t *Task) Release() {
+	if t.release != nil {
+		t.release()
+	}
+}
+
+func (t *Task) ID() string {
+	return t.id
+}
+
+func (t *Task) Metadata() Metadata {
+	return t.meta
+}
+
+// Expired reports whether the source attached an expiry to the task and it has passed
+func (t *Task) Expired(now time.Time) bool {
+	return !t.meta.ExpiresAt.IsZero() && now.After(t.meta.ExpiresAt)
+}
+
+func (t *Task) Record() Record {
+	r := Record{
+		ID:         t.id,
+		ReceivedAt: t.createdAt,
+		Payload:    t.raw,
+		Metadata:   t.meta,
+	}
+	if !bytes.Equal(t.payload, t.raw) {
+		r.Deduplicated = t.payload
+	}
+	return r
+}
+
+// NewTaskFromRecord rebuilds a task from an archived record, the ID is derived from the payload
+// again. Only the DERs that were left after deduplication are processed
+func NewTaskFromRecord(r Record) Task {
+	t := NewTaskWithMetadata(r.Payload, r.Metadata)
+	if r.Deduplicated != nil {
+		t.payload = r.Deduplicated
+	}
+	return t
+}
+
+// Stage checks or amends the DERs of a payload before its outcomes are built. Returning a
+// *RejectionError refuses the payload
+type Stage func(ders []types.DER) error
+
+// Grouping splits the DERs of a payload into the groups that each get an outcome, by returning
+// the key of the group a DER belongs to
+type Grouping func(der types.DER) string
+
+// ByProject gives each project in a payload its own outcome
+func ByProject(der types.DER) string {
+	return der.ProjectID
+}
+
+// ByMeter gives each site meter in a payload its own outcome, as named by the meter_id of its DERs.
+// DERs that do not name a meter are grouped by project
+func ByMeter(der types.DER) string {
+	if der.MeterID == "" {
+		return der.ProjectID
+	}
+	return der.ProjectID + "/" + der.MeterID
+}
+
+// NetOutput computes the net output of a group of DERs that share a meter
+type NetOutput func(ders []types.DER) float64
+
+// Execute builds one outcome per group of DERs in the payload, in the order each group first
+// appears. Each outcome has its own net output, and takes its baseline and threshold from its own
+// DERs. A nil grouping groups by project and a nil net output subtracts the output of every DER
+func (t *Task) Execute(workerId int, group Grouping, net NetOutput, stages ...Stage) ([]*outcome.Outcome, error) {
 	start := time.Now()
 	var ders []types.DER
 
@@ -42,19 +207,98 @@ func (t *Task) Execute(workerId int) (*outcome.Outcome, error) {
 		return nil, ErrNoDERs
 	}
 
-	data := []types.RealTimeDERData{}
-	var netOutput float64 = ders[0].PowerMeterMeasurement
-	for _, der := range ders {
-		netOutput -= der.CurrentOutput
-		derData := types.RealTimeDERData{
-			ID:  uuid.New().String(),
-			DER: der,
+	if err := t.checkProject(ders); err != nil {
+		return nil, err
+	}
+
+	// IDs come from the readings as received, a stage that clamps the timestamp must not change them
+	ids := make([]string, len(ders))
+	for i, der := range ders {
+		ids[i] = der.RowID()
+	}
+	for _, stage := range stages {
+		if err := stage(ders); err != nil {
+			return nil, err
+		}
+	}
+
+	if group == nil {
+		group = ByProject
+	}
+	if net == nil {
+		net = netoutput.New(nil).NetOutput
+	}
+	var keys []string
+	groups := make(map[string][]int)
+	for i, der := range ders {
+		key := group(der)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
 		}
-		data = append(data, derData)
+		groups[key] = append(groups[key], i)
 	}
 
-	o := outcome.New(workerId, t.id, ders[0].ProjectID, data, netOutput, time.Since(start))
-	return o, nil
+	outcomes := make([]*outcome.Outcome, 0, len(keys))
+	for _, key := range keys {
+		members := make([]types.DER, 0, len(groups[key]))
+		data := make([]types.RealTimeDERData, 0, len(groups[key]))
+		for _, i := range groups[key] {
+			members = append(members, ders[i])
+			data = append(data, types.RealTimeDERData{ID: ids[i], DER: ders[i]})
+		}
+		o := outcome.New(workerId, t.id, data[0].ProjectID, data, net(members), time.Since(start))
+		if key != data[0].ProjectID {
+			o.Meter = key
+		}
+		outcomes = append(outcomes, o)
+	}
+	return outcomes, nil
+}
+
+// remainder returns a task holding only the DERs of outcomes, as they were received, for dead
+// lettering what was not written when the outcomes before them were
+func (t *Task) remainder(outcomes []*outcome.Outcome) (Task, error) {
+	ids := make(map[string]bool)
+	for _, o := range outcomes {
+		for _, d := range o.Data {
+			ids[d.ID] = true
+		}
+	}
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(t.payload, &raw); err != nil {
+		return Task{}, errors.Wrap(err, "failed to parse message payload")
+	}
+	kept := make([][]byte, 0, len(ids))
+	for _, r := range raw {
+		var der types.DER
+		if err := json.Unmarshal(r, &der); err != nil {
+			return Task{}, errors.Wrap(err, "failed to parse der")
+		}
+		if ids[der.RowID()] {
+			kept = append(kept, r)
+		}
+	}
+	payload := append(append([]byte{'['}, bytes.Join(kept, []byte{','})...), ']')
+	return NewTaskWithMetadata(payload, t.meta), nil
+}
+
+// checkProject stops a gateway writing into another project's averages by requiring every DER to
+// belong to the project named in the topic the payload arrived on
+func (t *Task) checkProject(ders []types.DER) error {
+	projectID, ok := t.meta.Segments[SegmentProjectID]
+	if !ok {
+		return nil
+	}
+	for _, der := range ders {
+		if der.ProjectID != projectID {
+			return &RejectionError{
+				Reason: ReasonProjectMismatch,
+				Detail: fmt.Sprintf("der %s has project %q but topic %s is for project %q", der.DerID, der.ProjectID, t.meta.Topic, projectID),
+			}
+		}
+	}
+	return nil
 }
 
 func makeID(payload []byte) string {
@@ -5,103 +5,418 @@ import (
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/dedup"
 	"github.com/grid-stream-org/batcher/internal/destination"
-	"github.com/patrickmn/go-cache"
+	"github.com/grid-stream-org/batcher/internal/netoutput"
+	"github.com/grid-stream-org/batcher/internal/outcome"
+	"github.com/grid-stream-org/batcher/internal/types"
+	"github.com/grid-stream-org/batcher/internal/units"
+	"github.com/grid-stream-org/batcher/internal/validate"
+	"github.com/grid-stream-org/batcher/metrics"
 	"github.com/pkg/errors"
 )
 
+const (
+	minSpillBackoff = 100 * time.Millisecond
+	maxSpillBackoff = 30 * time.Second
+)
+
+// DeadLetterer keeps tasks that could not be processed so that they can be replayed later
+type DeadLetterer interface {
+	Put(r Record, class string, cause error) error
+}
+
 type TaskPool struct {
-	cfg         *config.Pool
-	tasks       chan Task
-	destination destination.Destination
-	dedup       *cache.Cache
-	wg          sync.WaitGroup
-	log         *slog.Logger
+	cfg    *config.Pool
+	tasks  chan Task
+	router *destination.Router
+	dedup  *dedup.Cache
+	spill  *spillQueue
+	dlq    DeadLetterer
+	stages []Stage
+	group  Grouping
+	net    NetOutput
+	done   chan struct{}
+	retire chan struct{}
+	// abort is closed when the drain deadline passes, releasing submitters blocked on a full queue
+	abort  chan struct{}
+	cancel context.CancelFunc
+	lanes  []chan Task
+	// mu is held for reading while submitting, so that the queue is not closed under a submitter
+	mu     sync.RWMutex
+	closed bool
+	// background goroutines feed and resize the pool, so they stop before the task queue closes
+	background   sync.WaitGroup
+	wg           sync.WaitGroup
+	nextWorkerId int
+	latencyTotal atomic.Int64
+	latencyCount atomic.Int64
+	// abandoned counts destination writes still running after their task timed out, and settling
+	// tracks the tasks waiting on one of them to find out whether it committed
+	abandoned atomic.Int64
+	settling  sync.WaitGroup
+	log       *slog.Logger
 }
 
 func NewTaskPool(
 	ctx context.Context,
 	cfg *config.Pool,
-	dest destination.Destination,
+	router *destination.Router,
+	dlq DeadLetterer,
 	log *slog.Logger,
-) *TaskPool {
+) (*TaskPool, error) {
+	queue, _ := queueSizes(cfg)
 	tp := &TaskPool{
-		cfg:         cfg,
-		tasks:       make(chan Task, cfg.Capacity),
-		destination: dest,
-		dedup:       cache.New(1*time.Minute, 5*time.Minute),
+		cfg:    cfg,
+		tasks:  make(chan Task, queue),
+		router: router,
+		dlq:    dlq,
+		done:   make(chan struct{}),
+		abort:  make(chan struct{}),
+		cancel: func() {},
 		log: log.With(
 			"component", "task_pool",
 			"num_workers", cfg.NumWorkers,
 			"capacity", cfg.Capacity,
+			"overflow", cfg.Overflow,
 		),
 	}
 
+	if cfg.Dedup != nil {
+		cache, err := dedup.New(cfg.Dedup, log)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		tp.dedup = cache
+	}
+
+	// DERs are converted first, so that validation rules are written in the canonical unit
+	if cfg.Units != "" {
+		tp.stages = append(tp.stages, normalizeStage(cfg.Units))
+	}
+
+	if cfg.Validation != nil {
+		v, err := validate.New(cfg.Validation, log)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		tp.stages = append(tp.stages, validationStage(v))
+	}
+
+	tp.net = netoutput.New(cfg.NetOutput).NetOutput
+
+	if cfg.GroupBy == "meter" {
+		tp.group = ByMeter
+	}
+
+	if cfg.Autoscale != nil {
+		tp.retire = make(chan struct{}, cfg.Autoscale.MaxWorkers)
+		tp.log = tp.log.With("min_workers", cfg.Autoscale.MinWorkers, "max_workers", cfg.Autoscale.MaxWorkers)
+	}
+
+	if cfg.Overflow == "spill" {
+		spill, err := openSpillQueue(cfg.SpillDir)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		tp.spill = spill
+		tp.log.Info("spill queue opened", "dir", cfg.SpillDir, "spilled_tasks", spill.Len())
+	}
+
 	tp.log.Info("task pool created")
-	return tp
+	return tp, nil
 }
 
-func (tp *TaskPool) Submit(t any) {
+// Submit reports whether the pool took the task. It has not when the task was dropped because the
+// queue was full, or the pool had already shut down
+func (tp *TaskPool) Submit(t any) bool {
 	task, ok := t.(Task)
 	if !ok {
 		tp.log.Warn("received non-task event", "type", fmt.Sprintf("%T", t))
-		return
+		return false
 	}
-	tp.submitTask(task)
+	return tp.submitTask(task)
 }
 
-func (tp *TaskPool) submitTask(t Task) {
+func (tp *TaskPool) submitTask(t Task) bool {
 	log := tp.log.With(t.LogFields()...)
 	log.Debug("received task from event bus")
-	if tp.dedup.Add(t.id, struct{}{}, 5*time.Minute) != nil {
-		log.Warn("skipping duplicate task")
-		return
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	if tp.closed {
+		log.Warn("task submitted after the task pool shut down")
+		tp.persist(t, log)
+		return false
+	}
+	if !tp.dedupe(&t, log) {
+		log.Warn("skipping task, every DER in it is a duplicate")
+		tp.drop(t, metrics.ReasonDuplicate)
+		return true
 	}
 	log.Debug("submitting task")
-	tp.tasks <- t
+	queued := tp.enqueue(t, log)
+	tp.reportDepth()
+	return queued
+}
+
+// enqueue applies the overflow policy when the task queue is full, and reports whether the task
+// was queued or spilled
+func (tp *TaskPool) enqueue(t Task, log *slog.Logger) bool {
+	switch tp.cfg.Overflow {
+	case "drop_newest":
+		select {
+		case tp.tasks <- t:
+			return true
+		default:
+			log.Warn("task queue full, dropping task")
+			tp.drop(t, metrics.ReasonQueueFull)
+			return false
+		}
+	case "drop_oldest":
+		for {
+			select {
+			case tp.tasks <- t:
+				return true
+			default:
+			}
+			select {
+			case old := <-tp.tasks:
+				log.Warn("task queue full, evicting oldest task", "evicted_id", old.id)
+				tp.drop(old, metrics.ReasonEvicted)
+			default:
+			}
+		}
+	case "spill":
+		// Once anything has spilled, new tasks queue behind it so that arrival order is kept
+		if tp.spill.Len() == 0 {
+			select {
+			case tp.tasks <- t:
+				return true
+			default:
+			}
+		}
+		if err := tp.spill.Push(t.Record()); err != nil {
+			log.Error("failed to spill task, dropping task", "error", err)
+			tp.drop(t, metrics.ReasonSpillFailed)
+			return false
+		}
+		log.Debug("task queue full, spilled task to disk")
+		// The spill now holds the task, so the source does not need to redeliver it
+		t.Ack()
+		return true
+	default:
+		select {
+		case tp.tasks <- t:
+			return true
+		case <-tp.abort:
+			log.Warn("drain deadline passed while waiting for room in the task queue")
+			tp.persist(t, log)
+			return false
+		}
+	}
+}
+
+// validationStage reports rule rejections as rejected payloads, with the rule as the reason
+func validationStage(v *validate.Validator) Stage {
+	return func(ders []types.DER) error {
+		err := v.Check(ders)
+		var rejection *validate.Rejection
+		if errors.As(err, &rejection) {
+			return &RejectionError{Reason: rejection.Rule, Detail: rejection.Error()}
+		}
+		return errors.WithStack(err)
+	}
+}
+
+// normalizeStage converts the power fields of every DER to units, rejecting payloads with units
+// that are not known
+func normalizeStage(canonical string) Stage {
+	return func(ders []types.DER) error {
+		err := units.Normalize(ders, canonical)
+		var unknown *units.UnknownError
+		if errors.As(err, &unknown) {
+			return &RejectionError{Reason: ReasonUnknownUnits, Detail: unknown.Error()}
+		}
+		return errors.WithStack(err)
+	}
+}
+
+// drop discards a task for good, it is acknowledged so that the source does not redeliver it
+func (tp *TaskPool) drop(t Task, reason string) {
+	metrics.Local.Counter(metrics.MessagesDropped).WithLabelValues(t.meta.Topic, reason).Inc()
+	t.Ack()
+}
+
+// deadLetter stores a task that could not be processed and acknowledges it. Without a dead letter
+// store, or when storing fails, the task is released so that a persistent session can redeliver it
+func (tp *TaskPool) deadLetter(t Task, class string, cause error, log *slog.Logger) {
+	if tp.dlq == nil {
+		t.Release()
+		return
+	}
+	if err := tp.dlq.Put(t.Record(), class, cause); err != nil {
+		log.Error("failed to dead letter task", "class", class, "error", err)
+		t.Release()
+		return
+	}
+	metrics.Local.Counter(metrics.DeadLetters).WithLabelValues(class).Inc()
+	log.Info("task dead lettered", "class", class)
+	t.Ack()
+}
+
+// discard is for tasks that would fail the same way if they were redelivered. They are dead
+// lettered when there is a store to keep them, and otherwise acknowledged and dropped
+func (tp *TaskPool) discard(t Task, class string, cause error, log *slog.Logger) {
+	if tp.dlq == nil {
+		log.Warn("no dead letter store, dropping task", "class", class)
+		t.Ack()
+		return
+	}
+	tp.deadLetter(t, class, cause, log)
+}
+
+// queued counts the tasks waiting in the shared queue and in the lanes
+func (tp *TaskPool) queued() int {
+	n := len(tp.tasks)
+	for _, lane := range tp.lanes {
+		n += len(lane)
+	}
+	return n
+}
+
+func (tp *TaskPool) reportDepth() {
+	metrics.Local.Gauge(metrics.QueueDepth).WithLabelValues().Set(float64(tp.queued()))
+	if tp.spill != nil {
+		metrics.Local.Gauge(metrics.SpilledTasks).WithLabelValues().Set(float64(tp.spill.Len()))
+	}
 }
 
+// Saturated reports whether the task queue is full, meaning the next submission would block, or
+// whether the queue and lanes together hold the pool's capacity. An unbuffered queue hands tasks
+// straight to workers and is never reported as saturated
+func (tp *TaskPool) Saturated() bool {
+	return cap(tp.tasks) > 0 && (len(tp.tasks) >= cap(tp.tasks) || tp.queued() >= tp.cfg.Capacity)
+}
+
+// Start runs the workers until the pool is drained. Cancelling ctx stops them straight away and
+// leaves queued tasks unprocessed, so callers that want them processed pass a context that outlives
+// the shutdown signal and call Drain
 func (tp *TaskPool) Start(ctx context.Context) {
 	tp.log.Info("starting task pool")
-	for i := 0; i < tp.cfg.NumWorkers; i++ {
+	ctx, tp.cancel = context.WithCancel(ctx)
+	if tp.cfg.Ordering != nil {
+		// Each worker owns a lane, and every task with the same key goes to the same lane
+		_, lane := queueSizes(tp.cfg)
+		tp.lanes = make([]chan Task, tp.cfg.NumWorkers)
+		for i := range tp.lanes {
+			tp.lanes[i] = make(chan Task, lane)
+			tp.startWorker(ctx, tp.lanes[i])
+		}
 		tp.wg.Add(1)
-		go tp.worker(ctx, i)
+		go tp.dispatch(ctx, tp.lanes)
+	} else {
+		for i := 0; i < tp.cfg.NumWorkers; i++ {
+			tp.startWorker(ctx, tp.tasks)
+		}
+	}
+	metrics.Local.Gauge(metrics.PoolWorkers).WithLabelValues().Set(float64(tp.cfg.NumWorkers))
+	if tp.cfg.Autoscale != nil {
+		tp.background.Add(1)
+		go tp.autoscale(ctx)
+	}
+	if tp.spill != nil {
+		tp.background.Add(1)
+		go tp.feedSpill(ctx)
+	}
+	if tp.dedup != nil && tp.cfg.Dedup.Path != "" {
+		tp.background.Add(1)
+		go tp.saveDedup(ctx)
 	}
 	tp.log.Info("task pool started successfully")
 }
 
-func (tp *TaskPool) worker(ctx context.Context, workerId int) {
+// feedSpill moves spilled tasks back into the task queue as room frees up
+func (tp *TaskPool) feedSpill(ctx context.Context) {
+	defer tp.background.Done()
+	backoff := minSpillBackoff
+	for {
+		rec, ok, err := tp.spill.Pop()
+		if err != nil {
+			// What could not be read has been moved aside, backing off keeps a failing disk from
+			// being retried in a tight loop
+			tp.log.Error("failed to read spilled task, retrying", "error", err, "backoff", backoff)
+			select {
+			case <-time.After(backoff):
+				backoff = min(backoff*2, maxSpillBackoff)
+				continue
+			case <-tp.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+		backoff = minSpillBackoff
+		if !ok {
+			select {
+			case <-tp.spill.Ready():
+				continue
+			case <-tp.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case tp.tasks <- NewTaskFromRecord(rec):
+			tp.reportDepth()
+		case <-tp.done:
+			tp.respill(rec)
+			return
+		case <-ctx.Done():
+			tp.respill(rec)
+			return
+		}
+	}
+}
+
+// respill puts back a task that was read from the spill but could not be queued before shutdown,
+// so that it is picked up again on the next run
+func (tp *TaskPool) respill(rec Record) {
+	if err := tp.spill.Push(rec); err != nil {
+		tp.log.Error("failed to return task to spill, task lost", "id", rec.ID, "error", err)
+	}
+}
+
+func (tp *TaskPool) startWorker(ctx context.Context, tasks <-chan Task) {
+	tp.wg.Add(1)
+	go tp.worker(ctx, tp.nextWorkerId, tasks)
+	tp.nextWorkerId++
+}
+
+func (tp *TaskPool) worker(ctx context.Context, workerId int, tasks <-chan Task) {
 	defer tp.wg.Done()
 	log := tp.log.With("worker_id", workerId)
 	for {
 		select {
-		case t, ok := <-tp.tasks:
+		case <-tp.retire:
+			log.Debug("worker retired")
+			return
+		case t, ok := <-tasks:
 			if !ok {
 				log.Debug("task channel closed, stopping worker")
 				return
 			}
-			log := log.With(t.LogFields()...)
-			log.Debug("processing task")
-			outcome, err := t.Execute(workerId)
-			if err != nil {
-				if errors.Is(err, ErrNoDERs) {
-					log.Warn("received empty DER array")
-				} else {
-					// For now we will just log an error if the task execution fails
-					// I can't see this happening for any other reason than a bad json payload
-					// Until something else arises, we can stick with this
-					log.Error("task execution failed", "error", err)
-				}
+			tp.reportDepth()
+			if ctx.Err() != nil {
+				tp.persist(t, log.With(t.LogFields()...))
 				continue
 			}
-			if err := tp.destination.Add(ctx, outcome); err != nil {
-				log.Error("failed to add outcome to destination", "error", err)
-				continue
-			}
-			log.With("outcome", outcome.LogFields()).Debug("task completed successfully")
+			tp.process(ctx, workerId, t, log.With(t.LogFields()...))
 		case <-ctx.Done():
 			log.Debug("context cancelled, stopping worker", "reason", ctx.Err())
 			return
@@ -109,18 +424,270 @@ func (tp *TaskPool) worker(ctx context.Context, workerId int) {
 	}
 }
 
+// process runs one task. A panic is recovered and the task dead lettered, so that one bad payload
+// or destination cannot take the whole process down
+func (tp *TaskPool) process(ctx context.Context, workerId int, t Task, log *slog.Logger) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := recovered(r)
+			log.Error("task panicked", "panic", fmt.Sprint(r), "stack", string(err.Stack))
+			// It would most likely panic again if it were redelivered
+			tp.discard(t, FailurePanic, err, log)
+		}
+	}()
+	if tp.cfg.TaskTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tp.cfg.TaskTimeout)
+		defer cancel()
+	}
+
+	if t.Expired(time.Now()) {
+		log.Warn("skipping expired task", "expires_at", t.meta.ExpiresAt.Format(time.RFC3339))
+		tp.drop(t, metrics.ReasonExpired)
+		return
+	}
+	name, dest, err := tp.router.Route(t.meta.Topic)
+	if err != nil {
+		log.Error("failed to route task", "error", err)
+		tp.deadLetter(t, FailureUnroutable, err, log)
+		return
+	}
+	log = log.With("destination", name)
+	log.Debug("processing task")
+	outcomes, err := t.Execute(workerId, tp.group, tp.net, tp.stages...)
+	if err != nil {
+		var rejection *RejectionError
+		// Redelivering a payload that cannot be executed will not help
+		if errors.Is(err, ErrNoDERs) {
+			log.Warn("received empty DER array")
+			tp.discard(t, FailureEmpty, err, log)
+		} else if errors.As(err, &rejection) {
+			log.Warn("task rejected", "reason", rejection.Reason, "detail", rejection.Detail)
+			tp.discard(t, FailureRejected, err, log)
+		} else {
+			// I can't see this happening for any other reason than a bad json payload
+			log.Error("task execution failed", "error", err)
+			tp.discard(t, FailureParse, err, log)
+		}
+		return
+	}
+	ack := splitAck(t.Ack, len(outcomes))
+	for _, o := range outcomes {
+		o.SetAck(ack())
+		o.SetRelease(t.Release)
+		o.Units = tp.cfg.Units
+	}
+	written := 0
+	for i, o := range outcomes {
+		start := time.Now()
+		err = tp.add(ctx, dest, o)
+		tp.observeLatency(time.Since(start))
+		var abandoned *AbandonedError
+		if errors.As(err, &abandoned) {
+			// Dead lettering a write that may still commit would have it counted twice on replay
+			log.Error("destination write timed out, settling the task once the write returns", "timeout", tp.cfg.TaskTimeout.String())
+			tp.settling.Add(1)
+			if tp.cfg.Ordering != nil {
+				// The next task on the lane must not be written before this one commits or fails
+				tp.settle(t, dest, abandoned, outcomes, i, log)
+				return
+			}
+			go tp.settle(t, dest, abandoned, outcomes, i, log)
+			return
+		}
+		if err != nil {
+			break
+		}
+		written++
+	}
+	if err != nil {
+		rest := tp.unwritten(t, dest, outcomes, written, log)
+		var panicErr *PanicError
+		switch {
+		case errors.As(err, &panicErr):
+			log.Error("destination panicked", "panic", fmt.Sprint(panicErr.Value), "stack", string(panicErr.Stack))
+			tp.discard(rest, FailurePanic, err, log)
+		case errors.Is(err, context.DeadlineExceeded):
+			log.Error("destination write timed out", "timeout", tp.cfg.TaskTimeout.String(), "error", err)
+			tp.deadLetter(rest, FailureTimeout, err, log)
+		default:
+			log.Error("failed to add outcome to destination", "error", err)
+			tp.deadLetter(rest, FailureUndeliverable, err, log)
+		}
+		return
+	}
+	if !destination.DefersAck(dest) {
+		t.Ack()
+	}
+	for _, o := range outcomes {
+		log.With("outcome", o.LogFields()).Debug("task completed successfully")
+	}
+}
+
+// settle finishes a task once its abandoned write, of outcome i, returns. The outcomes after it were
+// never written, so the task is only complete if the write committed and it was the last
+func (tp *TaskPool) settle(t Task, dest destination.Destination, abandoned *AbandonedError, outcomes []*outcome.Outcome, i int, log *slog.Logger) {
+	defer tp.settling.Done()
+	if err := <-abandoned.Done; err != nil {
+		log.Error("abandoned destination write failed", "error", err)
+	} else {
+		log.Info("abandoned destination write committed")
+		i++
+	}
+	if i == len(outcomes) {
+		if !destination.DefersAck(dest) {
+			t.Ack()
+		}
+		return
+	}
+	tp.deadLetter(tp.unwritten(t, dest, outcomes, i, log), FailureTimeout, abandoned, log)
+}
+
+// unwritten returns the part of a task whose outcomes were not written, from the first that failed.
+// Outcomes already written stay written, replaying them from the dead letter store would count them
+// twice. Acknowledging the part acknowledges its outcomes, or the task when dest acknowledges no outcome
+func (tp *TaskPool) unwritten(t Task, dest destination.Destination, outcomes []*outcome.Outcome, written int, log *slog.Logger) Task {
+	if written == 0 {
+		return t
+	}
+	rest, err := t.remainder(outcomes[written:])
+	if err != nil {
+		log.Error("failed to split the unwritten outcomes from the task, keeping all of it", "error", err)
+		return t
+	}
+	log.Warn("outcomes partly written", "written", written, "unwritten", len(outcomes)-written, "unwritten_id", rest.id)
+	rest.release = t.release
+	return rest.WithAck(func() {
+		if !destination.DefersAck(dest) {
+			t.Ack()
+			return
+		}
+		for _, o := range outcomes[written:] {
+			o.Ack()
+		}
+	})
+}
+
+// splitAck shares ack between n outcomes. Each call returns the ack of one outcome, and ack runs
+// once all n have been acknowledged
+func splitAck(ack func(), n int) func() func() {
+	var remaining atomic.Int64
+	remaining.Store(int64(n))
+	return func() func() {
+		return sync.OnceFunc(func() {
+			if remaining.Add(-1) == 0 {
+				ack()
+			}
+		})
+	}
+}
+
+// Wait drains the pool with no deadline
 func (tp *TaskPool) Wait() {
-	tp.log.Info("shutting down task pool")
+	tp.Drain(context.Background())
+}
+
+// Drain stops the pool once every queued task has been processed. Submitting must have stopped,
+// anything submitted from now on is persisted. If ctx is done first the workers are stopped and
+// the tasks still queued are persisted
+func (tp *TaskPool) Drain(ctx context.Context) {
+	tp.log.Info("draining task pool", "queued", len(tp.tasks))
+	close(tp.done)
+	tp.background.Wait()
+
+	stop := context.AfterFunc(ctx, func() { close(tp.abort) })
+	defer stop()
+	tp.mu.Lock()
+	tp.closed = true
 	close(tp.tasks)
-	tp.dedup.Flush()
-	tp.wg.Wait()
+	tp.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		tp.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		tp.log.Warn("drain deadline passed, stopping workers", "queued", len(tp.tasks))
+		tp.cancel()
+		<-finished
+	}
+	tp.cancel()
+
+	// Tasks waiting on an abandoned write that outlives the deadline are left unacknowledged
+	settled := make(chan struct{})
+	go func() {
+		tp.settling.Wait()
+		close(settled)
+	}()
+	select {
+	case <-settled:
+	case <-ctx.Done():
+		if n := tp.abandoned.Load(); n > 0 {
+			tp.log.Warn("drain deadline passed with abandoned destination writes outstanding", "abandoned", n)
+		}
+	}
+
+	persisted := 0
+	for t := range tp.tasks {
+		tp.persist(t, tp.log.With(t.LogFields()...))
+		persisted++
+	}
+	for _, lane := range tp.lanes {
+		for t := range lane {
+			tp.persist(t, tp.log.With(t.LogFields()...))
+			persisted++
+		}
+	}
+	tp.reportDepth()
+	if persisted > 0 {
+		tp.log.Warn("task pool drained with tasks left unprocessed", "unprocessed", persisted)
+	}
+
+	if tp.spill != nil {
+		if err := tp.spill.Close(); err != nil {
+			tp.log.Error("failed to close spill queue", "error", err)
+		}
+	}
+	// Saved last, once the keys of tasks that were released have been forgotten
+	if tp.dedup != nil {
+		if err := tp.dedup.Save(); err != nil {
+			tp.log.Error("failed to save dedup cache", "error", err)
+		}
+	}
 	tp.log.Info("task pool shutdown complete")
 }
 
+// persist keeps a task that shutdown stopped from being processed. The spill hands it to the next
+// run and the dead letter store keeps it for replay. Without either it is released, so that a
+// persistent session can redeliver it
+func (tp *TaskPool) persist(t Task, log *slog.Logger) {
+	if tp.spill != nil {
+		err := tp.spill.Push(t.Record())
+		if err == nil {
+			log.Debug("task spilled for the next run")
+			t.Ack()
+			return
+		}
+		log.Error("failed to spill task", "error", err)
+	}
+	if tp.dlq != nil {
+		tp.deadLetter(t, FailureShutdown, ErrShutdown, log)
+		return
+	}
+	log.Warn("task pool shut down before the task was processed, releasing it")
+	t.Release()
+}
+
 func (tp *TaskPool) LogFields() []any {
 	return []any{
 		"component", "task_pool",
 		"num_workers", tp.cfg.NumWorkers,
 		"capacity", tp.cfg.Capacity,
+		"overflow", tp.cfg.Overflow,
+		"ordered", tp.cfg.Ordering != nil,
+		"autoscale", tp.cfg.Autoscale != nil,
 	}
 }
@@ -0,0 +1,676 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/destination"
+	"github.com/grid-stream-org/batcher/internal/outcome"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+type fakeDeadLetterer struct {
+	mu      sync.Mutex
+	classes map[string]string
+	records []Record
+	err     error
+}
+
+func (d *fakeDeadLetterer) Put(r Record, class string, _ error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	d.classes[r.ID] = class
+	d.records = append(d.records, r)
+	return nil
+}
+
+func (d *fakeDeadLetterer) class(id string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.classes[id]
+}
+
+type funcDestination struct {
+	add func(ctx context.Context, data any) error
+}
+
+func (d *funcDestination) Add(ctx context.Context, data any) error {
+	return d.add(ctx, data)
+}
+
+func (d *funcDestination) Close() error {
+	return nil
+}
+
+type TaskPoolTestSuite struct {
+	suite.Suite
+}
+
+func (s *TaskPoolTestSuite) SetupSuite() {
+	metrics.InitMetricsProvider()
+}
+
+func (s *TaskPoolTestSuite) task(i int, acks *int) Task {
+	t := NewTaskWithMetadata([]byte(fmt.Sprintf(`[{"der_id":"der%d"}]`, i)), Metadata{Topic: "grid/overflow"})
+	return t.WithAck(func() { *acks++ })
+}
+
+func (s *TaskPoolTestSuite) dropped(reason string) float64 {
+	return testutil.ToFloat64(metrics.Local.Counter(metrics.MessagesDropped).WithLabelValues("grid/overflow", reason))
+}
+
+func (s *TaskPoolTestSuite) queued(tp *TaskPool) []string {
+	var ids []string
+	for len(tp.tasks) > 0 {
+		t := <-tp.tasks
+		ids = append(ids, t.id)
+	}
+	return ids
+}
+
+func (s *TaskPoolTestSuite) TestOverflow() {
+	testCases := []struct {
+		name    string
+		policy  string
+		queued  []int
+		reason  string
+		dropped float64
+		acks    int
+		spilled int
+		taken   int
+	}{
+		{name: "drop newest", policy: "drop_newest", queued: []int{0, 1}, reason: metrics.ReasonQueueFull, dropped: 2, acks: 2, taken: 2},
+		{name: "drop oldest", policy: "drop_oldest", queued: []int{2, 3}, reason: metrics.ReasonEvicted, dropped: 2, acks: 2, taken: 4},
+		{name: "spill", policy: "spill", queued: []int{0, 1}, reason: metrics.ReasonSpillFailed, dropped: 0, acks: 2, spilled: 2, taken: 4},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			cfg := &config.Pool{NumWorkers: 1, Capacity: 2, Overflow: tc.policy}
+			if tc.policy == "spill" {
+				cfg.SpillDir = s.T().TempDir()
+			}
+			tp, err := NewTaskPool(context.Background(), cfg, nil, nil, slog.Default())
+			s.Require().NoError(err)
+
+			before := s.dropped(tc.reason)
+			acks, taken := 0, 0
+			for i := 0; i < 4; i++ {
+				if tp.Submit(s.task(i, &acks)) {
+					taken++
+				}
+			}
+
+			s.Equal(tc.taken, taken)
+			s.Equal(tc.dropped, s.dropped(tc.reason)-before)
+			s.Equal(tc.acks, acks)
+			s.Equal(float64(len(tc.queued)), testutil.ToFloat64(metrics.Local.Gauge(metrics.QueueDepth).WithLabelValues()))
+
+			var expected []string
+			for _, i := range tc.queued {
+				expected = append(expected, s.task(i, &acks).id)
+			}
+			s.Equal(expected, s.queued(tp))
+			if tp.spill != nil {
+				s.Equal(tc.spilled, tp.spill.Len())
+			}
+		})
+	}
+}
+
+func (s *TaskPoolTestSuite) TestDedup() {
+	first := `[{"der_id":"der1","timestamp":"2024-01-01T00:00:00Z","current_output":1},{"der_id":"der2","timestamp":"2024-01-01T00:00:00Z"}]`
+	testCases := []struct {
+		name     string
+		second   string
+		dropped  bool
+		expected string
+	}{
+		{
+			name:    "identical payload",
+			second:  first,
+			dropped: true,
+		},
+		{
+			name:    "reserialised payload",
+			second:  `[ {"current_output":1, "der_id":"der1", "timestamp":"2024-01-01T01:00:00+01:00"}, {"der_id":"der2","timestamp":"2024-01-01T00:00:00Z"} ]`,
+			dropped: true,
+		},
+		{
+			name:     "partial duplicate",
+			second:   `[{"der_id":"der2","timestamp":"2024-01-01T00:00:00Z"},{"der_id":"der3","timestamp":"2024-01-01T00:00:00Z"}]`,
+			expected: `[{"der_id":"der3","timestamp":"2024-01-01T00:00:00Z"}]`,
+		},
+		{
+			name:     "new readings",
+			second:   `[{"der_id":"der1","timestamp":"2024-01-01T00:00:05Z"}]`,
+			expected: `[{"der_id":"der1","timestamp":"2024-01-01T00:00:05Z"}]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			cfg := &config.Pool{NumWorkers: 1, Capacity: 2, Overflow: "block", Dedup: &config.Dedup{Window: time.Minute, MaxEntries: 10}}
+			tp, err := NewTaskPool(context.Background(), cfg, nil, nil, slog.Default())
+			s.Require().NoError(err)
+
+			before := s.dropped(metrics.ReasonDuplicate)
+			acks := 0
+			tp.Submit(NewTaskWithMetadata([]byte(first), Metadata{Topic: "grid/overflow"}))
+			tp.Submit(NewTaskWithMetadata([]byte(tc.second), Metadata{Topic: "grid/overflow"}).WithAck(func() { acks++ }))
+
+			<-tp.tasks
+			if tc.dropped {
+				s.Equal(1.0, s.dropped(metrics.ReasonDuplicate)-before)
+				s.Equal(1, acks)
+				s.Empty(tp.tasks)
+				return
+			}
+			s.Equal(0.0, s.dropped(metrics.ReasonDuplicate)-before)
+			s.Require().Len(tp.tasks, 1)
+			t := <-tp.tasks
+			s.JSONEq(tc.expected, string(t.payload))
+
+			// Dead letters and spills keep the payload as it was received, and replay what was kept
+			rec := t.Record()
+			s.Equal(tc.second, string(rec.Payload))
+			replayed := NewTaskFromRecord(rec)
+			s.Equal(t.id, replayed.id)
+			s.JSONEq(tc.expected, string(replayed.payload))
+		})
+	}
+}
+
+func (s *TaskPoolTestSuite) TestDedupSavedWhileRunning() {
+	router := destination.NewStaticRouter(
+		map[string]destination.Destination{"grid": &funcDestination{add: func(context.Context, any) error { return nil }}},
+		[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+		slog.Default(),
+	)
+	path := filepath.Join(s.T().TempDir(), "dedup.json")
+	cfg := &config.Pool{NumWorkers: 1, Capacity: 2, Overflow: "block", Dedup: &config.Dedup{Window: time.Minute, MaxEntries: 10, Path: path, SaveInterval: 10 * time.Millisecond}}
+	tp, err := NewTaskPool(context.Background(), cfg, router, nil, slog.Default())
+	s.Require().NoError(err)
+	tp.Start(context.Background())
+	defer tp.Wait()
+
+	// The key is on disk before the pool is drained, so a crash would not forget it
+	tp.Submit(NewTaskWithMetadata([]byte(`[{"der_id":"der1","timestamp":"2024-01-01T00:00:00Z"}]`), Metadata{Topic: "grid/ders"}))
+	s.Eventually(func() bool {
+		data, err := os.ReadFile(path)
+		return err == nil && strings.Contains(string(data), "der1@2024-01-01T00:00:00Z")
+	}, time.Second, 5*time.Millisecond)
+}
+
+func (s *TaskPoolTestSuite) TestDedupForgetsReleased() {
+	payload := []byte(`[{"der_id":"der1","timestamp":"2024-01-01T00:00:00Z"}]`)
+	cfg := &config.Pool{NumWorkers: 1, Capacity: 2, Overflow: "block", Dedup: &config.Dedup{Window: time.Minute, MaxEntries: 10}}
+	tp, err := NewTaskPool(context.Background(), cfg, nil, nil, slog.Default())
+	s.Require().NoError(err)
+
+	released := 0
+	tp.Submit(NewTaskWithMetadata(payload, Metadata{Topic: "grid/overflow"}).WithRelease(func() { released++ }))
+	t := <-tp.tasks
+
+	// The task fails and is released, its redelivery must not be taken for a duplicate
+	t.Release()
+	s.Equal(1, released)
+	tp.Submit(NewTaskWithMetadata(payload, Metadata{Topic: "grid/overflow"}))
+	s.Len(tp.tasks, 1)
+}
+
+func (s *TaskPoolTestSuite) TestSpillFeedsQueue() {
+	cfg := &config.Pool{NumWorkers: 1, Capacity: 1, Overflow: "spill", SpillDir: s.T().TempDir()}
+	tp, err := NewTaskPool(context.Background(), cfg, nil, nil, slog.Default())
+	s.Require().NoError(err)
+
+	acks := 0
+	for i := 0; i < 3; i++ {
+		tp.Submit(s.task(i, &acks))
+	}
+	s.Equal(2, tp.spill.Len())
+
+	// Feed the spill back without workers and read the queue in their place
+	tp.background.Add(1)
+	go tp.feedSpill(context.Background())
+
+	for i := 0; i < 3; i++ {
+		select {
+		case t := <-tp.tasks:
+			s.Equal(s.task(i, &acks).id, t.id)
+		case <-time.After(time.Second):
+			s.FailNow("spilled task was not fed back")
+		}
+	}
+	s.Zero(tp.spill.Len())
+
+	close(tp.done)
+	tp.background.Wait()
+	s.NoError(tp.spill.Close())
+}
+
+func (s *TaskPoolTestSuite) TestDeadLetter() {
+	testCases := []struct {
+		name    string
+		topic   string
+		payload string
+		class   string
+	}{
+		{name: "unparseable", topic: "grid/ders", payload: `[{"der_id":`, class: FailureParse},
+		{name: "empty", topic: "grid/ders", payload: `[]`, class: FailureEmpty},
+		{name: "unroutable", topic: "other/ders", payload: `[{"der_id":"der1","project_id":"project1"}]`, class: FailureUnroutable},
+	}
+
+	// Only grid topics are routed and there is no default destination
+	router, err := destination.NewRouter(context.Background(),
+		map[string]*config.Destination{"grid": {Type: "stdout"}},
+		[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+		slog.Default(),
+	)
+	s.Require().NoError(err)
+	dlq := &fakeDeadLetterer{classes: map[string]string{}}
+	tp, err := NewTaskPool(context.Background(), &config.Pool{NumWorkers: 1, Capacity: 4, Overflow: "block"}, router, dlq, slog.Default())
+	s.Require().NoError(err)
+
+	acks := make(chan string, len(testCases))
+	tp.Start(context.Background())
+	for _, tc := range testCases {
+		t := NewTaskWithMetadata([]byte(tc.payload), Metadata{Topic: tc.topic})
+		id := t.id
+		tp.Submit(t.WithAck(func() { acks <- id }))
+	}
+
+	for range testCases {
+		select {
+		case <-acks:
+		case <-time.After(time.Second):
+			s.FailNow("dead lettered task was not acknowledged")
+		}
+	}
+	tp.Wait()
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			t := NewTask([]byte(tc.payload))
+			s.Equal(tc.class, dlq.class(t.id))
+		})
+	}
+}
+
+func (s *TaskPoolTestSuite) TestDiscard() {
+	testCases := []struct {
+		name     string
+		dlq      *fakeDeadLetterer
+		expected string
+	}{
+		{name: "no dead letter store", expected: "ack"},
+		{name: "dead lettered", dlq: &fakeDeadLetterer{classes: map[string]string{}}, expected: "ack"},
+		{name: "dead lettering fails", dlq: &fakeDeadLetterer{classes: map[string]string{}, err: errors.New("disk full")}, expected: "release"},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			var dlq DeadLetterer
+			if tc.dlq != nil {
+				dlq = tc.dlq
+			}
+			tp, err := NewTaskPool(context.Background(), &config.Pool{NumWorkers: 1, Capacity: 1, Overflow: "block"}, nil, dlq, slog.Default())
+			s.Require().NoError(err)
+
+			var settled []string
+			t := NewTask([]byte(`[{"der_id":`))
+			t = t.WithAck(func() { settled = append(settled, "ack") }).WithRelease(func() { settled = append(settled, "release") })
+			tp.discard(t, FailureParse, errors.New("bad json"), slog.Default())
+			s.Equal([]string{tc.expected}, settled)
+		})
+	}
+}
+
+func (s *TaskPoolTestSuite) TestSplitAck() {
+	acks := 0
+	next := splitAck(func() { acks++ }, 2)
+	first, second := next(), next()
+
+	first()
+	first() // acknowledging one outcome twice must not count for the other
+	s.Equal(0, acks)
+	second()
+	s.Equal(1, acks)
+}
+
+func (s *TaskPoolTestSuite) TestIsolation() {
+	testCases := []struct {
+		name  string
+		add   func(ctx context.Context, data any) error
+		class string
+	}{
+		{
+			name:  "destination panics",
+			add:   func(context.Context, any) error { panic("boom") },
+			class: FailurePanic,
+		},
+		{
+			name: "destination honours the deadline",
+			add: func(ctx context.Context, _ any) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			class: FailureTimeout,
+		},
+		{
+			name:  "destination fails",
+			add:   func(context.Context, any) error { return errors.New("unavailable") },
+			class: FailureUndeliverable,
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			router := destination.NewStaticRouter(
+				map[string]destination.Destination{"grid": &funcDestination{add: tc.add}},
+				[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+				slog.Default(),
+			)
+			dlq := &fakeDeadLetterer{classes: map[string]string{}}
+			cfg := &config.Pool{NumWorkers: 1, Capacity: 1, Overflow: "block", TaskTimeout: 50 * time.Millisecond}
+			tp, err := NewTaskPool(context.Background(), cfg, router, dlq, slog.Default())
+			s.Require().NoError(err)
+			tp.Start(context.Background())
+
+			t := NewTaskWithMetadata([]byte(`[{"der_id":"der1","project_id":"project1"}]`), Metadata{Topic: "grid/ders"})
+			tp.Submit(t)
+			s.Eventually(func() bool { return dlq.class(t.id) != "" }, time.Second, 10*time.Millisecond)
+			s.Equal(tc.class, dlq.class(t.id))
+			tp.Wait()
+		})
+	}
+}
+
+func (s *TaskPoolTestSuite) TestReleaseWithoutDeadLetter() {
+	var mu sync.Mutex
+	writes := 0
+	router := destination.NewStaticRouter(
+		map[string]destination.Destination{"grid": &funcDestination{add: func(context.Context, any) error {
+			mu.Lock()
+			defer mu.Unlock()
+			writes++
+			if writes == 1 {
+				return errors.New("unavailable")
+			}
+			return nil
+		}}},
+		[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+		slog.Default(),
+	)
+	tp, err := NewTaskPool(context.Background(), &config.Pool{NumWorkers: 1, Capacity: 4, Overflow: "block"}, router, nil, slog.Default())
+	s.Require().NoError(err)
+	tp.Start(context.Background())
+
+	// The first write fails and the ones after it succeed
+	settled := make(chan string, 4)
+	var ids []string
+	for i := 0; i < 4; i++ {
+		t := NewTaskWithMetadata(s.ders(i), Metadata{Topic: "grid/ders"})
+		id := t.id
+		ids = append(ids, id)
+		tp.Submit(t.WithAck(func() { settled <- "ack " + id }).WithRelease(func() { settled <- "release " + id }))
+	}
+	tp.Wait()
+	close(settled)
+
+	var got []string
+	for r := range settled {
+		got = append(got, r)
+	}
+	s.Equal([]string{"release " + ids[0], "ack " + ids[1], "ack " + ids[2], "ack " + ids[3]}, got)
+}
+
+func (s *TaskPoolTestSuite) TestAbandonedWrite() {
+	testCases := []struct {
+		name   string
+		result error
+		class  string
+	}{
+		{name: "write commits after the deadline", result: nil},
+		{name: "write fails after the deadline", result: errors.New("unavailable"), class: FailureTimeout},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			release := make(chan struct{})
+			router := destination.NewStaticRouter(
+				map[string]destination.Destination{"grid": &funcDestination{add: func(context.Context, any) error {
+					<-release
+					return tc.result
+				}}},
+				[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+				slog.Default(),
+			)
+			dlq := &fakeDeadLetterer{classes: map[string]string{}}
+			cfg := &config.Pool{NumWorkers: 1, Capacity: 1, Overflow: "block", TaskTimeout: 20 * time.Millisecond, MaxAbandonedWrites: 1}
+			tp, err := NewTaskPool(context.Background(), cfg, router, dlq, slog.Default())
+			s.Require().NoError(err)
+			tp.Start(context.Background())
+
+			acked := make(chan struct{})
+			first := NewTaskWithMetadata(s.ders(0), Metadata{Topic: "grid/ders"})
+			tp.Submit(first.WithAck(func() { close(acked) }))
+			s.Eventually(func() bool { return tp.abandoned.Load() == 1 }, time.Second, 5*time.Millisecond)
+
+			// Nothing is dead lettered while the write may still commit, and no more writes are
+			// started while the limit of abandoned writes is reached
+			second := NewTaskWithMetadata(s.ders(1), Metadata{Topic: "grid/ders"})
+			tp.Submit(second)
+			s.Eventually(func() bool { return dlq.class(second.id) != "" }, time.Second, 5*time.Millisecond)
+			s.Equal(FailureUndeliverable, dlq.class(second.id))
+			s.Empty(dlq.class(first.id))
+
+			close(release)
+			tp.Wait()
+			s.Zero(tp.abandoned.Load())
+			// Either way the task is done with, committed or kept in the dead letter store
+			s.Equal(tc.class, dlq.class(first.id))
+			select {
+			case <-acked:
+			default:
+				s.Fail("task was not acknowledged")
+			}
+		})
+	}
+}
+
+func (s *TaskPoolTestSuite) TestAbandonedWriteHoldsLane() {
+	var mu sync.Mutex
+	var writes []string
+	release := make(chan struct{})
+	router := destination.NewStaticRouter(
+		map[string]destination.Destination{"grid": &funcDestination{add: func(_ context.Context, data any) error {
+			id := data.(*outcome.Outcome).Data[0].DerID
+			if id == "der0" {
+				<-release
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			writes = append(writes, id)
+			return nil
+		}}},
+		[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+		slog.Default(),
+	)
+	cfg := &config.Pool{NumWorkers: 1, Capacity: 2, Overflow: "block", TaskTimeout: 20 * time.Millisecond, Ordering: &config.Ordering{Key: "project"}}
+	tp, err := NewTaskPool(context.Background(), cfg, router, nil, slog.Default())
+	s.Require().NoError(err)
+	tp.Start(context.Background())
+
+	tp.Submit(NewTaskWithMetadata(s.ders(0), Metadata{Topic: "grid/ders"}))
+	s.Eventually(func() bool { return tp.abandoned.Load() == 1 }, time.Second, 5*time.Millisecond)
+
+	// The second task of the project waits on the lane until the abandoned write returns
+	tp.Submit(NewTaskWithMetadata(s.ders(1), Metadata{Topic: "grid/ders"}))
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	s.Empty(writes)
+	mu.Unlock()
+
+	close(release)
+	tp.Wait()
+	s.Equal([]string{"der0", "der1"}, writes)
+}
+
+func (s *TaskPoolTestSuite) TestPartialWrite() {
+	router := destination.NewStaticRouter(
+		map[string]destination.Destination{"grid": &funcDestination{add: func(_ context.Context, data any) error {
+			if data.(*outcome.Outcome).ProjectID == "project2" {
+				return errors.New("unavailable")
+			}
+			return nil
+		}}},
+		[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+		slog.Default(),
+	)
+	dlq := &fakeDeadLetterer{classes: map[string]string{}}
+	tp, err := NewTaskPool(context.Background(), &config.Pool{NumWorkers: 1, Capacity: 1, Overflow: "block"}, router, dlq, slog.Default())
+	s.Require().NoError(err)
+	tp.Start(context.Background())
+
+	acked := make(chan struct{})
+	payload := `[{"der_id":"der1","project_id":"project1"},{"der_id":"der2","project_id":"project2"},{"der_id":"der3","project_id":"project1"}]`
+	t := NewTaskWithMetadata([]byte(payload), Metadata{Topic: "grid/ders"})
+	tp.Submit(t.WithAck(func() { close(acked) }))
+	tp.Wait()
+
+	// Only the project that was not written is kept for replay
+	s.Require().Len(dlq.records, 1)
+	s.JSONEq(`[{"der_id":"der2","project_id":"project2"}]`, string(dlq.records[0].Payload))
+	s.Equal(FailureUndeliverable, dlq.class(dlq.records[0].ID))
+	s.Empty(dlq.class(t.id))
+	select {
+	case <-acked:
+	default:
+		s.Fail("task was not acknowledged")
+	}
+}
+
+func (s *TaskPoolTestSuite) TestOutcomeUnits() {
+	testCases := []struct {
+		name     string
+		units    string
+		expected string
+	}{
+		{name: "normalized", units: "W", expected: "W"},
+		{name: "taken as received", units: "", expected: ""},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			written := make(chan *outcome.Outcome, 1)
+			router := destination.NewStaticRouter(
+				map[string]destination.Destination{"grid": &funcDestination{add: func(_ context.Context, data any) error {
+					written <- data.(*outcome.Outcome)
+					return nil
+				}}},
+				[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+				slog.Default(),
+			)
+			cfg := &config.Pool{NumWorkers: 1, Capacity: 1, Overflow: "block", Units: tc.units}
+			tp, err := NewTaskPool(context.Background(), cfg, router, nil, slog.Default())
+			s.Require().NoError(err)
+			tp.Start(context.Background())
+
+			tp.Submit(NewTaskWithMetadata([]byte(`[{"der_id":"der1","project_id":"project1","units":"kW"}]`), Metadata{Topic: "grid/ders"}))
+			tp.Wait()
+			s.Equal(tc.expected, (<-written).Units)
+		})
+	}
+}
+
+func (s *TaskPoolTestSuite) ders(i int) []byte {
+	return []byte(fmt.Sprintf(`[{"der_id":"der%d","project_id":"project1"}]`, i))
+}
+
+func (s *TaskPoolTestSuite) TestDrainProcessesQueue() {
+	var mu sync.Mutex
+	written := 0
+	router := destination.NewStaticRouter(
+		map[string]destination.Destination{"grid": &funcDestination{add: func(context.Context, any) error {
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			written++
+			mu.Unlock()
+			return nil
+		}}},
+		[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+		slog.Default(),
+	)
+	tp, err := NewTaskPool(context.Background(), &config.Pool{NumWorkers: 2, Capacity: 10, Overflow: "block"}, router, nil, slog.Default())
+	s.Require().NoError(err)
+
+	tp.Start(context.Background())
+	for i := 0; i < 10; i++ {
+		tp.Submit(NewTaskWithMetadata(s.ders(i), Metadata{Topic: "grid/ders"}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tp.Drain(ctx)
+
+	s.Equal(10, written)
+}
+
+func (s *TaskPoolTestSuite) TestDrainDeadlinePersists() {
+	started := make(chan struct{}, 1)
+	router := destination.NewStaticRouter(
+		map[string]destination.Destination{"grid": &funcDestination{add: func(ctx context.Context, _ any) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		}}},
+		[]*config.Route{{Topic: "grid/#", Destination: "grid"}},
+		slog.Default(),
+	)
+	dlq := &fakeDeadLetterer{classes: map[string]string{}}
+	tp, err := NewTaskPool(context.Background(), &config.Pool{NumWorkers: 1, Capacity: 4, Overflow: "block"}, router, dlq, slog.Default())
+	s.Require().NoError(err)
+
+	tp.Start(context.Background())
+	var ids []string
+	for i := 0; i < 5; i++ {
+		t := NewTaskWithMetadata(s.ders(i), Metadata{Topic: "grid/ders"})
+		ids = append(ids, t.id)
+		tp.Submit(t)
+		if i == 0 {
+			<-started
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tp.Drain(ctx)
+
+	// The task in flight fails when its write is cancelled, the queued tasks are never started
+	s.Equal(FailureUndeliverable, dlq.class(ids[0]))
+	for _, id := range ids[1:] {
+		s.Equal(FailureShutdown, dlq.class(id))
+	}
+
+	late := NewTaskWithMetadata(s.ders(5), Metadata{Topic: "grid/ders"})
+	tp.Submit(late)
+	s.Equal(FailureShutdown, dlq.class(late.id))
+}
+
+func TestTaskPoolSuite(t *testing.T) {
+	suite.Run(t, new(TaskPoolTestSuite))
+}
@@ -67,6 +67,84 @@ func (s *TaskTestSuite) TestNewTask() {
 	s.Equal(task.id, task2.id)
 }
 
+func (s *TaskTestSuite) TestNewTaskWithMetadata() {
+	payload, err := json.Marshal(s.validDERs)
+	s.NoError(err)
+
+	meta := Metadata{
+		Topic:          "grid/project1/ders",
+		ContentType:    "application/json",
+		UserProperties: map[string]string{"gateway": "gw1"},
+	}
+	task := NewTaskWithMetadata(payload, meta)
+
+	s.Equal(NewTask(payload).id, task.id)
+	s.Equal(meta, task.Metadata())
+}
+
+func (s *TaskTestSuite) TestRecord() {
+	payload, err := json.Marshal(s.validDERs)
+	s.NoError(err)
+
+	meta := Metadata{
+		Topic:    "grid/project1/ders",
+		Segments: map[string]string{"project_id": "project1"},
+	}
+	task := NewTaskWithMetadata(payload, meta)
+
+	data, err := json.Marshal(task.Record())
+	s.NoError(err)
+
+	var record Record
+	s.NoError(json.Unmarshal(data, &record))
+	s.Equal(task.id, record.ID)
+	s.True(task.createdAt.Equal(record.ReceivedAt))
+	s.Equal(payload, record.Payload)
+	s.Equal(meta, record.Metadata)
+
+	replayed := NewTaskFromRecord(record)
+	s.Equal(task.id, replayed.id)
+	s.Equal(payload, replayed.payload)
+	s.Equal(meta, replayed.Metadata())
+}
+
+func (s *TaskTestSuite) TestExpired() {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name      string
+		expiresAt time.Time
+		expected  bool
+	}{
+		{name: "no expiry", expiresAt: time.Time{}, expected: false},
+		{name: "expires later", expiresAt: now.Add(time.Second), expected: false},
+		{name: "already expired", expiresAt: now.Add(-time.Second), expected: true},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			task := NewTaskWithMetadata([]byte("[]"), Metadata{ExpiresAt: tc.expiresAt})
+			s.Equal(tc.expected, task.Expired(now))
+		})
+	}
+}
+
+func (s *TaskTestSuite) TestAck() {
+	// Acking a task without an acknowledgement attached is a no-op
+	task := NewTask([]byte("[]"))
+	task.Ack()
+
+	acks := 0
+	acked := task.WithAck(func() { acks++ })
+	acked.Ack()
+	acked.Ack()
+	s.Equal(1, acks)
+
+	// The original task is left untouched
+	task.Ack()
+	s.Equal(1, acks)
+}
+
 func (s *TaskTestSuite) TestTaskExecute() {
 	testCases := []struct {
 		name        string
@@ -110,20 +188,211 @@ func (s *TaskTestSuite) TestTaskExecute() {
 			s.NoError(err)
 
 			task := NewTask(payload)
-			outcome, err := task.Execute(1) // using worker ID 1 for testing
+			outcomes, err := task.Execute(1, nil, nil) // using worker ID 1 for testing
 
 			if tc.expectError != nil {
 				s.ErrorIs(err, tc.expectError)
-				s.Nil(outcome)
+				s.Nil(outcomes)
 			} else if tc.validate != nil {
 				s.NoError(err)
-				s.NotNil(outcome)
-				tc.validate(outcome)
+				s.Require().Len(outcomes, 1)
+				tc.validate(outcomes[0])
 			}
 		})
 	}
 }
 
+func (s *TaskTestSuite) TestExecuteRowIDs() {
+	payload, err := json.Marshal(s.validDERs)
+	s.Require().NoError(err)
+
+	task := NewTask(payload)
+	firsts, err := task.Execute(1, nil, nil)
+	s.Require().NoError(err)
+	first := firsts[0]
+	// A replay runs on another worker and with the payload serialised again
+	replayed, err := json.MarshalIndent(s.validDERs, "", "  ")
+	s.Require().NoError(err)
+	task = NewTask(replayed)
+	seconds, err := task.Execute(2, nil, nil)
+	s.Require().NoError(err)
+	second := seconds[0]
+
+	s.Require().Len(second.Data, len(first.Data))
+	for i := range first.Data {
+		s.Equal(first.Data[i].ID, second.Data[i].ID)
+	}
+	s.NotEqual(first.Data[0].ID, first.Data[1].ID)
+
+	// The same DER read at another time is another row
+	later := s.validDERs[0]
+	later.Timestamp = later.Timestamp.Add(time.Second)
+	s.NotEqual(s.validDERs[0].RowID(), later.RowID())
+}
+
+func (s *TaskTestSuite) TestExecuteStages() {
+	payload, err := json.Marshal(s.validDERs)
+	s.Require().NoError(err)
+
+	task := NewTask(payload)
+	expected, err := task.Execute(1, nil, nil)
+	s.Require().NoError(err)
+
+	// Stages can amend DERs without changing the IDs of the readings
+	clamp := func(ders []types.DER) error {
+		for i := range ders {
+			ders[i].Timestamp = ders[i].Timestamp.Add(-time.Hour)
+			ders[i].CurrentOutput = 0
+		}
+		return nil
+	}
+	o, err := task.Execute(1, nil, nil, clamp)
+	s.Require().NoError(err)
+	s.Equal(200.0, o[0].NetOutput)
+	for i := range o[0].Data {
+		s.Equal(expected[0].Data[i].ID, o[0].Data[i].ID)
+	}
+
+	reject := func([]types.DER) error {
+		return &RejectionError{Reason: "current_soc_range", Detail: "current_soc 140 is above 100"}
+	}
+	o, err = task.Execute(1, nil, nil, clamp, reject)
+	var rejection *RejectionError
+	s.Require().ErrorAs(err, &rejection)
+	s.Equal("current_soc_range", rejection.Reason)
+	s.Nil(o)
+}
+
+func (s *TaskTestSuite) TestExecuteProjectCheck() {
+	payload, err := json.Marshal(s.validDERs)
+	s.NoError(err)
+
+	testCases := []struct {
+		name     string
+		segments map[string]string
+		rejected bool
+	}{
+		{name: "no segments", segments: nil, rejected: false},
+		{name: "other segments only", segments: map[string]string{"gateway_id": "gw1"}, rejected: false},
+		{name: "matching project", segments: map[string]string{"project_id": "project1"}, rejected: false},
+		{name: "mismatched project", segments: map[string]string{"project_id": "project2"}, rejected: true},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			task := NewTaskWithMetadata(payload, Metadata{Topic: "grid/test", Segments: tc.segments})
+			outcomes, err := task.Execute(1, nil, nil)
+			if !tc.rejected {
+				s.NoError(err)
+				s.Equal("project1", outcomes[0].ProjectID)
+				return
+			}
+
+			var rejection *RejectionError
+			s.ErrorAs(err, &rejection)
+			s.Equal(ReasonProjectMismatch, rejection.Reason)
+			s.Contains(rejection.Error(), "project2")
+			s.Nil(outcomes)
+		})
+	}
+}
+
+func (s *TaskTestSuite) TestExecuteGrouping() {
+	ders := func() []types.DER {
+		ders := append([]types.DER{}, s.validDERs...)
+		ders[0].MeterID, ders[1].MeterID = "meter1", "meter1"
+		other := ders[0]
+		other.ProjectID = "project2"
+		other.DerID = "der3"
+		other.CurrentOutput = 30
+		other.Baseline = 90
+		other.ContractThreshold = 40
+		other.PowerMeterMeasurement = 100
+		second := s.validDERs[1]
+		second.DerID = "der4"
+		second.CurrentOutput = 20
+		second.PowerMeterMeasurement = 300
+		second.MeterID = "meter2"
+		// A DER that does not name its meter is grouped with its project
+		unnamed := s.validDERs[1]
+		unnamed.DerID = "der5"
+		unnamed.CurrentOutput = 10
+		return append(ders, other, second, unnamed)
+	}
+
+	type expected struct {
+		project   string
+		meter     string
+		netOutput float64
+		baseline  float64
+		threshold float64
+		ders      int
+	}
+	testCases := []struct {
+		name     string
+		group    Grouping
+		expected []expected
+	}{
+		{
+			name:  "by project",
+			group: nil,
+			expected: []expected{
+				{project: "project1", netOutput: 19.0, baseline: 120, threshold: 120, ders: 4}, // 200 - 100.5 - 50.5 - 20 - 10
+				{project: "project2", netOutput: 70.0, baseline: 90, threshold: 40, ders: 1},
+			},
+		},
+		{
+			name:  "by meter",
+			group: ByMeter,
+			expected: []expected{
+				{project: "project1", meter: "project1/meter1", netOutput: 49.0, baseline: 120, threshold: 120, ders: 2},
+				{project: "project2", meter: "project2/meter1", netOutput: 70.0, baseline: 90, threshold: 40, ders: 1},
+				{project: "project1", meter: "project1/meter2", netOutput: 280.0, baseline: 120, threshold: 80, ders: 1},
+				{project: "project1", netOutput: 190.0, baseline: 120, threshold: 80, ders: 1},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			payload, err := json.Marshal(ders())
+			s.Require().NoError(err)
+
+			task := NewTask(payload)
+			outcomes, err := task.Execute(1, tc.group, nil)
+			s.Require().NoError(err)
+			s.Require().Len(outcomes, len(tc.expected))
+			for i, e := range tc.expected {
+				s.Equal(e.project, outcomes[i].ProjectID)
+				s.Equal(e.meter, outcomes[i].Meter)
+				s.InDelta(e.netOutput, outcomes[i].NetOutput, 1e-9)
+				s.Equal(e.baseline, outcomes[i].Baseline)
+				s.Equal(e.threshold, outcomes[i].ContractThreshold)
+				s.Len(outcomes[i].Data, e.ders)
+				s.Equal(task.id, outcomes[i].TaskID)
+			}
+		})
+	}
+}
+
+func (s *TaskTestSuite) TestExecuteNetOutput() {
+	ders := append([]types.DER{}, s.validDERs...)
+	other := s.validDERs[0]
+	other.ProjectID = "project2"
+	ders = append(ders, other)
+	payload, err := json.Marshal(ders)
+	s.Require().NoError(err)
+
+	// Each group is netted on its own DERs
+	count := func(ders []types.DER) float64 { return float64(len(ders)) }
+	task := NewTask(payload)
+	outcomes, err := task.Execute(1, nil, count)
+	s.Require().NoError(err)
+	s.Require().Len(outcomes, 2)
+	s.Equal(2.0, outcomes[0].NetOutput)
+	s.Equal(1.0, outcomes[1].NetOutput)
+}
+
 func (s *TaskTestSuite) TestLogFields() {
 	payload, err := json.Marshal(s.validDERs)
 	s.NoError(err)
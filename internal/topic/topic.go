@@ -0,0 +1,122 @@
+package topic
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	separator      = "/"
+	singleWildcard = "+"
+	multiWildcard  = "#"
+)
+
+// Match reports whether topic matches the MQTT topic filter, which may contain + and # wildcards
+func Match(filter string, topic string) bool {
+	// Wildcards never match topics reserved by the broker, such as $SYS
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+
+	fs := strings.Split(filter, separator)
+	ts := strings.Split(topic, separator)
+	for i, f := range fs {
+		if f == multiWildcard {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != singleWildcard && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// ValidateFilter checks that filter is a well formed MQTT topic filter
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return errors.New("topic filter cannot be empty")
+	}
+
+	levels := strings.Split(filter, separator)
+	for i, level := range levels {
+		if strings.Contains(level, multiWildcard) && (level != multiWildcard || i != len(levels)-1) {
+			return errors.Errorf("invalid topic filter %s: # must occupy the whole last level", filter)
+		}
+		if strings.Contains(level, singleWildcard) && level != singleWildcard {
+			return errors.Errorf("invalid topic filter %s: + must occupy a whole level", filter)
+		}
+	}
+	return nil
+}
+
+// Template is a topic filter whose levels may name the value they hold, as in
+// grid/{project_id}/{gateway_id}/ders, so those values can be read back out of received topics
+type Template struct {
+	raw    string
+	filter string
+	names  map[int]string
+}
+
+func ParseTemplate(raw string) (*Template, error) {
+	t := &Template{
+		raw:   raw,
+		names: make(map[int]string),
+	}
+
+	levels := strings.Split(raw, separator)
+	seen := make(map[string]bool)
+	for i, level := range levels {
+		if !strings.ContainsAny(level, "{}") {
+			continue
+		}
+		if !strings.HasPrefix(level, "{") || !strings.HasSuffix(level, "}") || len(level) < 3 {
+			return nil, errors.Errorf("invalid topic template %s: placeholders must occupy a whole level", raw)
+		}
+		name := level[1 : len(level)-1]
+		if strings.ContainsAny(name, "{}+#") {
+			return nil, errors.Errorf("invalid topic template %s: bad placeholder %s", raw, level)
+		}
+		if seen[name] {
+			return nil, errors.Errorf("invalid topic template %s: duplicate placeholder %s", raw, level)
+		}
+		seen[name] = true
+		t.names[i] = name
+		levels[i] = singleWildcard
+	}
+
+	t.filter = strings.Join(levels, separator)
+	if err := ValidateFilter(t.filter); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return t, nil
+}
+
+// Filter is the template with every placeholder replaced by a single level wildcard
+func (t *Template) Filter() string {
+	return t.filter
+}
+
+func (t *Template) String() string {
+	return t.raw
+}
+
+// Extract returns the named segments of topic, and false if topic does not match the template
+func (t *Template) Extract(topic string) (map[string]string, bool) {
+	if !Match(t.filter, topic) {
+		return nil, false
+	}
+	if len(t.names) == 0 {
+		return nil, true
+	}
+
+	levels := strings.Split(topic, separator)
+	segments := make(map[string]string, len(t.names))
+	for i, name := range t.names {
+		segments[name] = levels[i]
+	}
+	return segments, true
+}
@@ -0,0 +1,88 @@
+package topic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TopicTestSuite struct {
+	suite.Suite
+}
+
+func (s *TopicTestSuite) TestMatch() {
+	testCases := []struct {
+		filter   string
+		topic    string
+		expected bool
+	}{
+		{"grid/ders", "grid/ders", true},
+		{"grid/ders", "grid/ders/extra", false},
+		{"grid/+/ders", "grid/project1/ders", true},
+		{"grid/+/ders", "grid/project1/gw1/ders", false},
+		{"grid/#", "grid", true},
+		{"grid/#", "grid/project1/gw1/ders", true},
+		{"#", "grid/ders", true},
+		{"+/ders", "grid/ders", true},
+		{"grid/+", "grid/", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"grid/test", "grid/ders", false},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.filter+" "+tc.topic, func() {
+			s.Equal(tc.expected, Match(tc.filter, tc.topic))
+		})
+	}
+}
+
+func (s *TopicTestSuite) TestValidateFilter() {
+	valid := []string{"grid/ders", "grid/+/ders", "grid/#", "#", "+"}
+	for _, f := range valid {
+		s.NoError(ValidateFilter(f), f)
+	}
+
+	invalid := []string{"", "grid/#/ders", "grid/ders#", "grid/pro+ject/ders"}
+	for _, f := range invalid {
+		s.Error(ValidateFilter(f), f)
+	}
+}
+
+func (s *TopicTestSuite) TestTemplate() {
+	tmpl, err := ParseTemplate("grid/{project_id}/{gateway_id}/ders")
+	s.Require().NoError(err)
+	s.Equal("grid/+/+/ders", tmpl.Filter())
+	s.Equal("grid/{project_id}/{gateway_id}/ders", tmpl.String())
+
+	segments, ok := tmpl.Extract("grid/project1/gw1/ders")
+	s.True(ok)
+	s.Equal(map[string]string{"project_id": "project1", "gateway_id": "gw1"}, segments)
+
+	_, ok = tmpl.Extract("grid/project1/ders")
+	s.False(ok)
+
+	// Templates without placeholders are plain filters
+	plain, err := ParseTemplate("grid/#")
+	s.Require().NoError(err)
+	s.Equal("grid/#", plain.Filter())
+	segments, ok = plain.Extract("grid/project1/ders")
+	s.True(ok)
+	s.Nil(segments)
+
+	invalid := []string{
+		"grid/{project_id/ders",
+		"grid/p{project_id}/ders",
+		"grid/{}/ders",
+		"grid/{project_id}/{project_id}",
+		"grid/{project_id}/#/ders",
+	}
+	for _, raw := range invalid {
+		_, err := ParseTemplate(raw)
+		s.Error(err, raw)
+	}
+}
+
+func TestTopicSuite(t *testing.T) {
+	suite.Run(t, new(TopicTestSuite))
+}
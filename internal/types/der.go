@@ -1,6 +1,13 @@
 package types
 
-import "time"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// derRowNamespace scopes the name based UUIDs given to DER readings
+var derRowNamespace = uuid.MustParse("6f1d7c52-3b9e-4a8e-9d0b-2c4f5e7a8b91")
 
 type DER struct {
 	DerID                 string    `bigquery:"der_id" json:"der_id"`
@@ -17,6 +24,8 @@ type DER struct {
 	CurrentSoc            float64   `bigquery:"current_soc" json:"current_soc"`
 	Type                  string    `bigquery:"type" json:"type"`
 	NameplateCapacity     float64   `bigquery:"nameplate_capacity" json:"nameplate_capacity"`
+	// MeterID names the site meter the DER sits behind, it is only used to group DERs by meter
+	MeterID string `bigquery:"-" json:"meter_id"`
 }
 
 type RealTimeDERData struct {
@@ -24,6 +33,13 @@ type RealTimeDERData struct {
 	DER
 }
 
+// RowID identifies a reading by its DER, project and timestamp, so the same reading gets the same
+// ID however many times it is processed
+func (d DER) RowID() string {
+	name := d.ProjectID + "/" + d.DerID + "/" + d.Timestamp.UTC().Format(time.RFC3339Nano)
+	return uuid.NewSHA1(derRowNamespace, []byte(name)).String()
+}
+
 type AverageOutput struct {
 	ProjectID         string    `bigquery:"project_id" json:"project_id"`
 	AverageOutput     float64   `bigquery:"average_output" json:"average_output"`
@@ -31,4 +47,16 @@ type AverageOutput struct {
 	ContractThreshold float64   `bigquery:"contract_threshold" json:"contract_threshold"`
 	StartTime         time.Time `bigquery:"start_time" json:"start_time"`
 	EndTime           time.Time `bigquery:"end_time" json:"end_time"`
+	Units             string    `bigquery:"units" json:"units"`
+	SampleCount       int64     `bigquery:"sample_count" json:"sample_count"`
+	MinOutput         float64   `bigquery:"min_output" json:"min_output"`
+	MaxOutput         float64   `bigquery:"max_output" json:"max_output"`
+	StdDevOutput      float64   `bigquery:"stddev_output" json:"stddev_output"`
+	P50Output         float64   `bigquery:"p50_output" json:"p50_output"`
+	P95Output         float64   `bigquery:"p95_output" json:"p95_output"`
+	FirstReadingAt    time.Time `bigquery:"first_reading_at" json:"first_reading_at"`
+	LastReadingAt     time.Time `bigquery:"last_reading_at" json:"last_reading_at"`
+	Averaging         string    `bigquery:"averaging" json:"averaging"`
+	EnergyKWh         float64   `bigquery:"energy_kwh" json:"energy_kwh"`
+	DroppedSamples    int64     `bigquery:"dropped_samples" json:"dropped_samples"`
 }
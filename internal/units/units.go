@@ -0,0 +1,70 @@
+package units
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grid-stream-org/batcher/internal/types"
+)
+
+// watts is the size of each power unit in watts, keyed by the unit in lower case
+var watts = map[string]float64{
+	"w":  1,
+	"kw": 1e3,
+	"mw": 1e6,
+}
+
+// UnknownError is returned for a DER whose units are not a known power unit
+type UnknownError struct {
+	DerID string
+	Units string
+}
+
+func (e *UnknownError) Error() string {
+	return fmt.Sprintf("der %q has unknown units %q", e.DerID, e.Units)
+}
+
+// Known reports whether units is a power unit, in any case
+func Known(units string) bool {
+	_, ok := watts[strings.ToLower(units)]
+	return ok
+}
+
+// Convert converts a power from one unit to another
+func Convert(v float64, from string, to string) (float64, error) {
+	f, ok := watts[strings.ToLower(from)]
+	if !ok {
+		return 0, &UnknownError{Units: from}
+	}
+	t, ok := watts[strings.ToLower(to)]
+	if !ok {
+		return 0, &UnknownError{Units: to}
+	}
+	return v * f / t, nil
+}
+
+// Normalize converts the power fields of every DER to the canonical unit and records it as their
+// units. Nothing is converted unless every DER has known units
+func Normalize(ders []types.DER, canonical string) error {
+	to, ok := watts[strings.ToLower(canonical)]
+	if !ok {
+		return &UnknownError{Units: canonical}
+	}
+	for _, der := range ders {
+		if !Known(der.Units) {
+			return &UnknownError{DerID: der.DerID, Units: der.Units}
+		}
+	}
+
+	for i := range ders {
+		d := &ders[i]
+		factor := watts[strings.ToLower(d.Units)] / to
+		d.CurrentOutput *= factor
+		d.PowerMeterMeasurement *= factor
+		d.Baseline *= factor
+		d.ContractThreshold *= factor
+		d.NameplateCapacity *= factor
+		d.Units = canonical
+	}
+	return nil
+}
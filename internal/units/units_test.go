@@ -0,0 +1,100 @@
+package units
+
+import (
+	"testing"
+
+	"github.com/grid-stream-org/batcher/internal/types"
+	"github.com/stretchr/testify/suite"
+)
+
+type UnitsTestSuite struct {
+	suite.Suite
+}
+
+func (s *UnitsTestSuite) TestNormalize() {
+	testCases := []struct {
+		name      string
+		units     string
+		canonical string
+		expected  float64
+		unknown   bool
+	}{
+		{name: "watts to kilowatts", units: "W", canonical: "kW", expected: 1.5},
+		{name: "megawatts to kilowatts", units: "MW", canonical: "kW", expected: 1_500_000},
+		{name: "kilowatts unchanged", units: "kW", canonical: "kW", expected: 1500},
+		{name: "kilowatts to watts", units: "kW", canonical: "W", expected: 1_500_000},
+		{name: "case insensitive", units: "kw", canonical: "MW", expected: 1.5},
+		{name: "unknown units", units: "hp", canonical: "kW", unknown: true},
+		{name: "missing units", units: "", canonical: "kW", unknown: true},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			ders := []types.DER{
+				{DerID: "der1", Units: "kW", CurrentOutput: 1500},
+				{
+					DerID:                 "der2",
+					Units:                 tc.units,
+					CurrentOutput:         1500,
+					PowerMeterMeasurement: 1500,
+					Baseline:              1500,
+					ContractThreshold:     1500,
+					NameplateCapacity:     1500,
+					CurrentSoc:            50,
+				},
+			}
+
+			err := Normalize(ders, tc.canonical)
+			if tc.unknown {
+				var unknown *UnknownError
+				s.Require().ErrorAs(err, &unknown)
+				s.Equal("der2", unknown.DerID)
+				// A rejected payload is left as it was
+				s.Equal(1500.0, ders[0].CurrentOutput)
+				s.Equal("kW", ders[0].Units)
+				return
+			}
+
+			s.Require().NoError(err)
+			d := ders[1]
+			for _, v := range []float64{d.CurrentOutput, d.PowerMeterMeasurement, d.Baseline, d.ContractThreshold, d.NameplateCapacity} {
+				s.InDelta(tc.expected, v, 1e-9)
+			}
+			s.Equal(50.0, d.CurrentSoc) // state of charge is a percentage, not power
+			s.Equal(tc.canonical, d.Units)
+			s.Equal(tc.canonical, ders[0].Units)
+		})
+	}
+}
+
+func (s *UnitsTestSuite) TestConvert() {
+	testCases := []struct {
+		name     string
+		from     string
+		to       string
+		expected float64
+		unknown  bool
+	}{
+		{name: "watts to kilowatts", from: "W", to: "kW", expected: 0.25},
+		{name: "megawatts to kilowatts", from: "MW", to: "kW", expected: 250_000},
+		{name: "same unit", from: "kW", to: "kw", expected: 250},
+		{name: "unknown unit", from: "hp", to: "kW", unknown: true},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			v, err := Convert(250, tc.from, tc.to)
+			if tc.unknown {
+				var unknown *UnknownError
+				s.ErrorAs(err, &unknown)
+				return
+			}
+			s.NoError(err)
+			s.InDelta(tc.expected, v, 1e-9)
+		})
+	}
+}
+
+func TestUnitsSuite(t *testing.T) {
+	suite.Run(t, new(UnitsTestSuite))
+}
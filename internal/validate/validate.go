@@ -0,0 +1,193 @@
+package validate
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/types"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/pkg/errors"
+)
+
+// Fields rules can check, by their name in the payload
+var (
+	numberFields = map[string]func(d *types.DER) *float64{
+		"current_output":          func(d *types.DER) *float64 { return &d.CurrentOutput },
+		"power_meter_measurement": func(d *types.DER) *float64 { return &d.PowerMeterMeasurement },
+		"baseline":                func(d *types.DER) *float64 { return &d.Baseline },
+		"contract_threshold":      func(d *types.DER) *float64 { return &d.ContractThreshold },
+		"current_soc":             func(d *types.DER) *float64 { return &d.CurrentSoc },
+		"nameplate_capacity":      func(d *types.DER) *float64 { return &d.NameplateCapacity },
+	}
+	stringFields = map[string]func(d *types.DER) *string{
+		"der_id":     func(d *types.DER) *string { return &d.DerID },
+		"project_id": func(d *types.DER) *string { return &d.ProjectID },
+		"units":      func(d *types.DER) *string { return &d.Units },
+		"type":       func(d *types.DER) *string { return &d.Type },
+	}
+	timeFields = map[string]func(d *types.DER) *time.Time{
+		"timestamp":           func(d *types.DER) *time.Time { return &d.Timestamp },
+		"connection_start_at": func(d *types.DER) *time.Time { return &d.ConnectionStartAt },
+	}
+)
+
+// Rejection is returned for a DER that failed a rule whose action is reject. Rule is the machine
+// readable reason
+type Rejection struct {
+	Rule   string
+	DerID  string
+	Detail string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("der %q failed rule %s: %s", r.DerID, r.Rule, r.Detail)
+}
+
+// rule is a configured rule with its check bound to the field it reads. check returns a
+// description of the violation, or an empty string when the DER passes. clamp, which is nil for
+// checks that cannot clamp, moves the value back into bounds
+type rule struct {
+	cfg   *config.Rule
+	check func(d *types.DER, now time.Time) string
+	clamp func(d *types.DER, now time.Time)
+}
+
+type Validator struct {
+	rules []*rule
+	now   func() time.Time
+	log   *slog.Logger
+}
+
+func New(cfg *config.Validation, log *slog.Logger) (*Validator, error) {
+	v := &Validator{
+		now: time.Now,
+		log: log.With("component", "validator"),
+	}
+	for _, rc := range cfg.Rules {
+		r, err := newRule(rc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "validation rule %s", rc.Name)
+		}
+		v.rules = append(v.rules, r)
+	}
+	v.log.Info("validator created", "rules", len(v.rules))
+	return v, nil
+}
+
+// Check applies every rule to every DER. Values are clamped in place, and the first rejection is
+// returned as a *Rejection
+func (v *Validator) Check(ders []types.DER) error {
+	now := v.now()
+	for i := range ders {
+		d := &ders[i]
+		for _, r := range v.rules {
+			detail := r.check(d, now)
+			if detail == "" {
+				continue
+			}
+			metrics.Local.Counter(metrics.RuleViolations).WithLabelValues(r.cfg.Name, r.cfg.Action).Inc()
+			switch r.cfg.Action {
+			case "reject":
+				return &Rejection{Rule: r.cfg.Name, DerID: d.DerID, Detail: detail}
+			case "flag":
+				v.log.Warn("der flagged", "rule", r.cfg.Name, "der_id", d.DerID, "project_id", d.ProjectID, "detail", detail)
+			case "clamp":
+				r.clamp(d, now)
+				v.log.Debug("der value clamped", "rule", r.cfg.Name, "der_id", d.DerID, "detail", detail)
+			}
+		}
+	}
+	return nil
+}
+
+func newRule(cfg *config.Rule) (*rule, error) {
+	r := &rule{cfg: cfg}
+	switch cfg.Check {
+	case "range":
+		field, ok := numberFields[cfg.Field]
+		if !ok {
+			return nil, errors.Errorf("range check needs a numeric field, got %q", cfg.Field)
+		}
+		r.check = func(d *types.DER, _ time.Time) string {
+			v := *field(d)
+			if cfg.Min != nil && v < *cfg.Min {
+				return fmt.Sprintf("%s %g is below %g", cfg.Field, v, *cfg.Min)
+			}
+			if cfg.Max != nil && v > *cfg.Max {
+				return fmt.Sprintf("%s %g is above %g", cfg.Field, v, *cfg.Max)
+			}
+			return ""
+		}
+		r.clamp = func(d *types.DER, _ time.Time) {
+			v := field(d)
+			if cfg.Min != nil {
+				*v = max(*v, *cfg.Min)
+			}
+			if cfg.Max != nil {
+				*v = min(*v, *cfg.Max)
+			}
+		}
+	case "required":
+		if field, ok := stringFields[cfg.Field]; ok {
+			r.check = func(d *types.DER, _ time.Time) string {
+				if *field(d) == "" {
+					return cfg.Field + " is empty"
+				}
+				return ""
+			}
+		} else if field, ok := timeFields[cfg.Field]; ok {
+			r.check = func(d *types.DER, _ time.Time) string {
+				if field(d).IsZero() {
+					return cfg.Field + " is not set"
+				}
+				return ""
+			}
+		} else {
+			return nil, errors.Errorf("required check needs a string or timestamp field, got %q", cfg.Field)
+		}
+	case "enum":
+		field, ok := stringFields[cfg.Field]
+		if !ok {
+			return nil, errors.Errorf("enum check needs a string field, got %q", cfg.Field)
+		}
+		r.check = func(d *types.DER, _ time.Time) string {
+			if v := *field(d); !slices.Contains(cfg.Values, v) {
+				return fmt.Sprintf("%s %q is not one of %v", cfg.Field, v, cfg.Values)
+			}
+			return ""
+		}
+	case "skew":
+		field, ok := timeFields[cfg.Field]
+		if !ok {
+			return nil, errors.Errorf("skew check needs a timestamp field, got %q", cfg.Field)
+		}
+		r.check = func(d *types.DER, now time.Time) string {
+			skew := field(d).Sub(now)
+			if cfg.MaxAhead > 0 && skew > cfg.MaxAhead {
+				return fmt.Sprintf("%s is %s ahead, more than %s", cfg.Field, skew, cfg.MaxAhead)
+			}
+			if cfg.MaxBehind > 0 && -skew > cfg.MaxBehind {
+				return fmt.Sprintf("%s is %s behind, more than %s", cfg.Field, -skew, cfg.MaxBehind)
+			}
+			return ""
+		}
+		r.clamp = func(d *types.DER, now time.Time) {
+			t := field(d)
+			if cfg.MaxAhead > 0 && t.After(now.Add(cfg.MaxAhead)) {
+				*t = now.Add(cfg.MaxAhead)
+			}
+			if cfg.MaxBehind > 0 && t.Before(now.Add(-cfg.MaxBehind)) {
+				*t = now.Add(-cfg.MaxBehind)
+			}
+		}
+	default:
+		return nil, errors.Errorf("invalid check: %s", cfg.Check)
+	}
+	if cfg.Action == "clamp" && r.clamp == nil {
+		return nil, errors.Errorf("%s check cannot clamp", cfg.Check)
+	}
+	return r, nil
+}
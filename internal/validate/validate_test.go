@@ -0,0 +1,158 @@
+package validate
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/grid-stream-org/batcher/internal/config"
+	"github.com/grid-stream-org/batcher/internal/types"
+	"github.com/grid-stream-org/batcher/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+type ValidateTestSuite struct {
+	suite.Suite
+	now time.Time
+}
+
+func (s *ValidateTestSuite) SetupSuite() {
+	metrics.InitMetricsProvider()
+	s.now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func (s *ValidateTestSuite) validator(rules ...*config.Rule) *Validator {
+	cfg := &config.Validation{Rules: rules}
+	v, err := New(cfg, slog.Default())
+	s.Require().NoError(err)
+	v.now = func() time.Time { return s.now }
+	return v
+}
+
+func (s *ValidateTestSuite) der() types.DER {
+	return types.DER{
+		DerID:             "der1",
+		ProjectID:         "project1",
+		Timestamp:         s.now,
+		CurrentSoc:        50,
+		NameplateCapacity: 10,
+		Units:             "kW",
+		Type:              "solar",
+	}
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
+
+func (s *ValidateTestSuite) TestCheck() {
+	testCases := []struct {
+		name     string
+		rule     *config.Rule
+		mutate   func(d *types.DER)
+		rejected bool
+		expected func(d *types.DER)
+	}{
+		{
+			name:   "in range",
+			rule:   &config.Rule{Name: "soc", Field: "current_soc", Check: "range", Min: ptr(0), Max: ptr(100), Action: "reject"},
+			mutate: func(d *types.DER) {},
+		},
+		{
+			name:     "above range rejected",
+			rule:     &config.Rule{Name: "soc", Field: "current_soc", Check: "range", Min: ptr(0), Max: ptr(100), Action: "reject"},
+			mutate:   func(d *types.DER) { d.CurrentSoc = 140 },
+			rejected: true,
+		},
+		{
+			name:     "above range clamped",
+			rule:     &config.Rule{Name: "soc", Field: "current_soc", Check: "range", Min: ptr(0), Max: ptr(100), Action: "clamp"},
+			mutate:   func(d *types.DER) { d.CurrentSoc = 140 },
+			expected: func(d *types.DER) { d.CurrentSoc = 100 },
+		},
+		{
+			name:     "below range flagged",
+			rule:     &config.Rule{Name: "capacity", Field: "nameplate_capacity", Check: "range", Min: ptr(0), Action: "flag"},
+			mutate:   func(d *types.DER) { d.NameplateCapacity = -5 },
+			expected: func(d *types.DER) { d.NameplateCapacity = -5 },
+		},
+		{
+			name:     "required field empty",
+			rule:     &config.Rule{Name: "der_id", Field: "der_id", Check: "required", Action: "reject"},
+			mutate:   func(d *types.DER) { d.DerID = "" },
+			rejected: true,
+		},
+		{
+			name:     "unit not allowed",
+			rule:     &config.Rule{Name: "units", Field: "units", Check: "enum", Values: []string{"kW", "MW"}, Action: "reject"},
+			mutate:   func(d *types.DER) { d.Units = "hp" },
+			rejected: true,
+		},
+		{
+			name:     "timestamp in the future rejected",
+			rule:     &config.Rule{Name: "skew", Field: "timestamp", Check: "skew", MaxAhead: time.Minute, Action: "reject"},
+			mutate:   func(d *types.DER) { d.Timestamp = s.now.Add(3 * time.Hour) },
+			rejected: true,
+		},
+		{
+			name:     "timestamp in the past clamped",
+			rule:     &config.Rule{Name: "skew", Field: "timestamp", Check: "skew", MaxBehind: time.Hour, Action: "clamp"},
+			mutate:   func(d *types.DER) { d.Timestamp = s.now.Add(-3 * time.Hour) },
+			expected: func(d *types.DER) { d.Timestamp = s.now.Add(-time.Hour) },
+		},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			v := s.validator(tc.rule)
+			before := testutil.ToFloat64(metrics.Local.Counter(metrics.RuleViolations).WithLabelValues(tc.rule.Name, tc.rule.Action))
+
+			ders := []types.DER{s.der()}
+			tc.mutate(&ders[0])
+			err := v.Check(ders)
+
+			violations := testutil.ToFloat64(metrics.Local.Counter(metrics.RuleViolations).WithLabelValues(tc.rule.Name, tc.rule.Action)) - before
+			if tc.rejected {
+				var rejection *Rejection
+				s.Require().ErrorAs(err, &rejection)
+				s.Equal(tc.rule.Name, rejection.Rule)
+				s.Equal(ders[0].DerID, rejection.DerID)
+				s.Equal(1.0, violations)
+				return
+			}
+			s.NoError(err)
+			if tc.expected == nil {
+				s.Equal(0.0, violations)
+				return
+			}
+			s.Equal(1.0, violations)
+			want := s.der()
+			tc.expected(&want)
+			s.Equal(want, ders[0])
+		})
+	}
+}
+
+func (s *ValidateTestSuite) TestInvalidField() {
+	testCases := []struct {
+		name string
+		rule *config.Rule
+	}{
+		{name: "unknown field", rule: &config.Rule{Field: "colour", Check: "required", Action: "reject"}},
+		{name: "range on a string", rule: &config.Rule{Field: "units", Check: "range", Max: ptr(1), Action: "reject"}},
+		{name: "enum on a number", rule: &config.Rule{Field: "current_soc", Check: "enum", Values: []string{"1"}, Action: "reject"}},
+		{name: "skew on a string", rule: &config.Rule{Field: "der_id", Check: "skew", MaxAhead: time.Minute, Action: "reject"}},
+	}
+
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			_, err := New(&config.Validation{Rules: []*config.Rule{tc.rule}}, slog.Default())
+			s.Error(err)
+		})
+	}
+}
+
+func TestValidateSuite(t *testing.T) {
+	suite.Run(t, new(ValidateTestSuite))
+}
@@ -11,8 +11,33 @@ const BasePath = "batcher_"
 
 // Labels
 const (
-	TopicLabel = "topic"
-	ErrorLabel = "error"
+	TopicLabel       = "topic"
+	ErrorLabel       = "error"
+	StateLabel       = "state"
+	ReasonLabel      = "reason"
+	ClassLabel       = "class"
+	DestinationLabel = "destination"
+	DirectionLabel   = "direction"
+	RuleLabel        = "rule"
+	ActionLabel      = "action"
+)
+
+// Label values
+const (
+	StateConnected  = "connected"
+	StateSubscribed = "subscribed"
+
+	ReasonQueueFull   = "queue_full"
+	ReasonEvicted     = "evicted"
+	ReasonSpillFailed = "spill_failed"
+	ReasonDuplicate   = "duplicate"
+	ReasonExpired     = "expired"
+	ReasonBusFull     = "bus_full"
+	ReasonPaused      = "paused"
+
+	ScaleUp   = "up"
+	ScaleDown = "down"
+	ScaleHeld = "held"
 )
 
 // Counters
@@ -20,6 +45,14 @@ const (
 	MessagesReceived = BasePath + "messages_received_total"
 	MessagesDropped  = BasePath + "messages_dropped_total"
 	FlushCount       = BasePath + "flushes_total"
+	DeadLetters      = BasePath + "dead_letters_total"
+	WriteRetries     = BasePath + "destination_retries_total"
+	FallbackWrites   = BasePath + "destination_fallback_writes_total"
+	ScalingDecisions = BasePath + "pool_scaling_decisions_total"
+	DuplicateDERs    = BasePath + "duplicate_ders_total"
+	RuleViolations   = BasePath + "validation_violations_total"
+	LateOutcomes     = BasePath + "late_outcomes_total"
+	Reconnects       = BasePath + "mqtt_release_reconnects_total"
 )
 
 // Gauges
@@ -27,6 +60,13 @@ const (
 	ConnectionStatus = BasePath + "connection_status"
 	BufferSize       = BasePath + "buffer_messages"
 	LastFlushTime    = BasePath + "last_flush_timestamp"
+	QueueDepth       = BasePath + "task_queue_depth"
+	SpilledTasks     = BasePath + "spilled_tasks"
+	BreakerState     = BasePath + "circuit_breaker_state"
+	PoolWorkers      = BasePath + "pool_workers"
+	WriteLatency     = BasePath + "destination_write_latency_seconds"
+	DedupEntries     = BasePath + "dedup_entries"
+	AbandonedWrites  = BasePath + "destination_abandoned_writes"
 )
 
 type Provider struct {
@@ -58,9 +98,9 @@ func InitMetricsProvider() {
 		Local.counters[MessagesDropped] = promauto.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: MessagesDropped,
-				Help: "Total number of messages dropped",
+				Help: "Total number of messages dropped, by the reason they were dropped",
 			},
-			[]string{TopicLabel, ErrorLabel},
+			[]string{TopicLabel, ReasonLabel},
 		)
 
 		Local.counters[FlushCount] = promauto.NewCounterVec(
@@ -71,13 +111,77 @@ func InitMetricsProvider() {
 			[]string{},
 		)
 
+		Local.counters[DeadLetters] = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: DeadLetters,
+				Help: "Total number of tasks dead lettered, by the class of failure",
+			},
+			[]string{ClassLabel},
+		)
+
+		Local.counters[WriteRetries] = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: WriteRetries,
+				Help: "Total number of destination writes retried after a transient error",
+			},
+			[]string{DestinationLabel},
+		)
+
+		Local.counters[FallbackWrites] = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: FallbackWrites,
+				Help: "Total number of outcomes sent to a destination's fallback instead of the destination",
+			},
+			[]string{DestinationLabel},
+		)
+
+		Local.counters[ScalingDecisions] = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: ScalingDecisions,
+				Help: "Total number of task pool scaling decisions, by direction (up, down, or held back by latency)",
+			},
+			[]string{DirectionLabel},
+		)
+
+		Local.counters[DuplicateDERs] = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: DuplicateDERs,
+				Help: "Total number of DERs removed as duplicates of one seen within the dedup window",
+			},
+			[]string{TopicLabel},
+		)
+
+		Local.counters[LateOutcomes] = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: LateOutcomes,
+				Help: "Total number of outcomes that arrived after their window closed",
+			},
+			[]string{},
+		)
+
+		Local.counters[Reconnects] = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: Reconnects,
+				Help: "Total number of MQTT reconnects forced to have unacknowledged messages redelivered",
+			},
+			[]string{},
+		)
+
+		Local.counters[RuleViolations] = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: RuleViolations,
+				Help: "Total number of DERs that failed a validation rule, by rule and the action taken",
+			},
+			[]string{RuleLabel, ActionLabel},
+		)
+
 		// Gauges
 		Local.gauges[ConnectionStatus] = promauto.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: ConnectionStatus,
-				Help: "MQTT connection status (1=connected, 0=disconnected)",
+				Help: "MQTT client status by state, connected or subscribed (1=true, 0=false)",
 			},
-			[]string{},
+			[]string{StateLabel},
 		)
 
 		Local.gauges[BufferSize] = promauto.NewGaugeVec(
@@ -95,6 +199,62 @@ func InitMetricsProvider() {
 			},
 			[]string{},
 		)
+
+		Local.gauges[QueueDepth] = promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: QueueDepth,
+				Help: "Current number of tasks waiting in the in-memory task queue",
+			},
+			[]string{},
+		)
+
+		Local.gauges[SpilledTasks] = promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: SpilledTasks,
+				Help: "Current number of tasks spilled to disk waiting for room in the task queue",
+			},
+			[]string{},
+		)
+
+		Local.gauges[BreakerState] = promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: BreakerState,
+				Help: "Circuit breaker state by destination (0=closed, 1=half open, 2=open)",
+			},
+			[]string{DestinationLabel},
+		)
+
+		Local.gauges[PoolWorkers] = promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: PoolWorkers,
+				Help: "Current number of task pool workers",
+			},
+			[]string{},
+		)
+
+		Local.gauges[WriteLatency] = promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: WriteLatency,
+				Help: "Average destination write latency over the last autoscale interval",
+			},
+			[]string{},
+		)
+
+		Local.gauges[DedupEntries] = promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: DedupEntries,
+				Help: "Current number of DER keys remembered for deduplication",
+			},
+			[]string{},
+		)
+
+		Local.gauges[AbandonedWrites] = promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: AbandonedWrites,
+				Help: "Current number of destination writes still running after their task timed out",
+			},
+			[]string{},
+		)
 	})
 }
 